@@ -5,22 +5,42 @@ import (
 	"image"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/klippa-app/go-libheif/library"
+	"github.com/klippa-app/go-libheif/library/isobmff"
 )
 
 func DecodeImage(r io.Reader) (image.Image, error) {
-	if !isInitialized {
+	if !isInitialized.Load() {
 		return nil, NotInitializedError
 	}
 
 	return library.DecodeImage(r)
 }
 
+// DecodeImageToProfile decodes the image and converts its colors to the RGB
+// ICC profile targetICCProfile, or to sRGB when targetICCProfile is nil.
+func DecodeImageToProfile(r io.Reader, targetICCProfile []byte) (image.Image, error) {
+	if !isInitialized.Load() {
+		return nil, NotInitializedError
+	}
+
+	return library.DecodeImageToProfile(r, targetICCProfile)
+}
+
+func DecodeImageWithOptions(r io.Reader, options library.DecodeOptions) (image.Image, error) {
+	if !isInitialized.Load() {
+		return nil, NotInitializedError
+	}
+
+	return library.DecodeImageWithOptions(r, options)
+}
+
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	var config image.Config
 
-	if !isInitialized {
+	if !isInitialized.Load() {
 		return config, NotInitializedError
 	}
 
@@ -28,49 +48,51 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 }
 
 var NotInitializedError = errors.New("goheif was not initialized, you must call the Init() method")
-var isInitialized = false
+var isInitialized atomic.Bool
 var initLock = sync.Mutex{}
 
 type Config struct {
 	LibraryConfig library.Config
 }
 
+// Init starts the worker, it does nothing when it's running already. After
+// Close or DeInit it can be called again, with another config.
 func Init(config Config) error {
 	initLock.Lock()
 	defer initLock.Unlock()
-	if isInitialized {
+	if isInitialized.Load() {
 		return nil
 	}
 	err := library.Init(config.LibraryConfig)
 	if err != nil {
 		return err
 	}
-	isInitialized = true
+	isInitialized.Store(true)
 
 	return nil
 }
 
-func DeInit() {
+// Close waits for the requests in flight and stops the worker. It does
+// nothing when the worker is not running.
+func Close() error {
 	initLock.Lock()
 	defer initLock.Unlock()
 
-	if !isInitialized {
-		return
+	if !isInitialized.Load() {
+		return nil
 	}
 
-	library.DeInit()
-	isInitialized = true
+	isInitialized.Store(false)
+	return library.Close()
+}
+
+// DeInit is Close without the error.
+func DeInit() {
+	Close()
 }
 
 func init() {
-	image.RegisterFormat("heif", "????ftypheic", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftypheim", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftypheis", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftypheix", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftyphevc", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftyphevm", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftyphevs", DecodeImage, DecodeConfig)
-	image.RegisterFormat("heif", "????ftypmif1", DecodeImage, DecodeConfig)
-	image.RegisterFormat("avif", "????ftypavif", DecodeImage, DecodeConfig)
-	image.RegisterFormat("avif", "????ftypavis", DecodeImage, DecodeConfig)
+	for _, imageBrand := range isobmff.ImageBrands() {
+		image.RegisterFormat(imageBrand.Format, "????ftyp"+imageBrand.Brand, decodeSniffedImage, decodeSniffedConfig)
+	}
 }
@@ -3,20 +3,129 @@
 package libheif
 
 import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"testing"
+
 	"github.com/klippa-app/go-libheif/library"
-	_ "image/jpeg"
-	_ "image/png"
+	"github.com/klippa-app/go-libheif/library/responses"
 )
 
-func initLib() error {
-	err := Init(Config{LibraryConfig: library.Config{
-		Command: library.Command{
-			BinPath: "go",
-			Args:    []string{"run", "-tags", "go_libheif_use_turbojpeg", "library/worker_example/main.go"},
-		},
-	}})
+func init() {
+	workerBuildTags = append(workerBuildTags, "go_libheif_use_turbojpeg")
+}
+
+func TestRenderJPEGOptions(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:    library.RenderFileOutputFormatJPG,
+		JPEGSubsampling: library.RenderFileJPEGSubsampling444,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := library.WorkerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codingOptions := false
+	for _, feature := range info.Features {
+		codingOptions = codingOptions || feature == responses.FeatureJPEGCoding
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:        library.RenderFileOutputFormatJPG,
+		JPEGSubsampling:     library.RenderFileJPEGSubsampling444,
+		JPEGOptimizeCoding:  true,
+		JPEGRestartInterval: 16,
+	})
+	if !codingOptions {
+		if err == nil {
+			t.Error("expected an error for the coding options without TurboJPEG 3")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*renderedFile.Output) >= len(*plainFile.Output) {
+		t.Errorf("rendered jpeg with optimized coding is not smaller: got %d, plain %d", len(*renderedFile.Output), len(*plainFile.Output))
+	}
+
+	// The restart interval marker.
+	if !bytes.Contains(*renderedFile.Output, []byte{0xff, 0xdd, 0x00, 0x04, 0x00, 0x10}) {
+		t.Error("rendered jpeg does not contain the restart interval")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(*renderedFile.Output))
 	if err != nil {
-		return err
+		t.Fatalf("unable to decode jpeg image: %s", err)
+	}
+
+	if ycbcr, ok := img.(*image.YCbCr); !ok || ycbcr.SubsampleRatio != image.YCbCrSubsampleRatio444 {
+		t.Errorf("unexpected decoded image: got %T, want a 4:4:4 *image.YCbCr", img)
+	}
+}
+
+func TestTransformJPEG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformedFile, err := library.TransformJPEG(renderedFile.Output, library.TransformJPEGOptions{
+		Operation: library.TransformJPEGOperationRotate90,
+		Trim:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The height of 1064 is not a multiple of the MCU size, the partial MCU
+	// row would end up on the left and is trimmed.
+	if w, h := transformedFile.Width, transformedFile.Height; w != 1056 || h != 1596 {
+		t.Errorf("unexpected transformed image size: got %dx%d, want 1056x1596", w, h)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(*transformedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode jpeg image: %s", err)
+	}
+
+	if got, want := img.Bounds().Size(), image.Pt(1056, 1596); got != want {
+		t.Errorf("unexpected decoded image size: got %v, want %v", got, want)
+	}
+
+	_, err = library.TransformJPEG(renderedFile.Output, library.TransformJPEGOptions{
+		Operation: library.TransformJPEGOperationRotate90,
+	})
+	if err == nil {
+		t.Fatal("expected an error for an imperfect transform without trim")
 	}
-	return nil
 }
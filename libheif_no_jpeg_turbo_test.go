@@ -3,20 +3,34 @@
 package libheif
 
 import (
+	"os"
+	"testing"
+
 	"github.com/klippa-app/go-libheif/library"
-	_ "image/jpeg"
-	_ "image/png"
 )
 
-func initLib() error {
-	err := Init(Config{LibraryConfig: library.Config{
-		Command: library.Command{
-			BinPath: "go",
-			Args:    []string{"run", "library/worker_example/main.go"},
-		},
-	}})
+func TestTransformJPEGUnsupported(t *testing.T) {
+	err := initLib()
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = library.TransformJPEG(renderedFile.Output, library.TransformJPEGOptions{
+		Operation: library.TransformJPEGOperationRotate90,
+	})
+	if err == nil {
+		t.Fatal("expected an error when transforming a jpeg without libturbojpeg")
 	}
-	return nil
 }
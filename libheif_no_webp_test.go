@@ -0,0 +1,29 @@
+//go:build !go_libheif_use_libwebp
+
+package libheif
+
+import (
+	"os"
+	"testing"
+
+	"github.com/klippa-app/go-libheif/library"
+)
+
+func TestRenderWebPUnsupported(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatWebP,
+	})
+	if err == nil {
+		t.Fatal("expected an error when rendering webp without libwebp")
+	}
+}
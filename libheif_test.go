@@ -2,16 +2,27 @@ package libheif
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/klippa-app/go-libheif/library"
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+	"github.com/klippa-app/go-libheif/library/responses"
+	"github.com/klippa-app/go-libheif/library/shared"
+
+	_ "golang.org/x/image/tiff"
 )
 
 func TestFormatRegistered(t *testing.T) {
@@ -61,51 +72,399 @@ func TestFormatRegistered(t *testing.T) {
 	}
 }
 
-func TestRenderJPEG(t *testing.T) {
+func TestSniffedFormatRegistered(t *testing.T) {
 	err := initLib()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	b, err := os.ReadFile("testdata/camel.heic")
+	b, err := os.ReadFile("testdata/receipt.avif")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
-		OutputFormat: library.RenderFileOutputFormatJPG,
-	})
+	type testCase struct {
+		Name       string
+		MajorBrand string
+		Format     string
+	}
+	testCases := []testCase{
+		{
+			Name:       "sequence major brand",
+			MajorBrand: "msf1",
+			Format:     "heif",
+		},
+	}
+	for _, testCase := range testCases {
+		data := make([]byte, len(b))
+		copy(data, b)
+		copy(data[8:12], testCase.MajorBrand)
+
+		img, dec, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("unable to decode image with %s: %s", testCase.Name, err)
+		}
+
+		if got, want := dec, testCase.Format; got != want {
+			t.Errorf("unexpected decoder for %s: got %s, want %s", testCase.Name, got, want)
+		}
+
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 826 || h != 826 {
+			t.Errorf("unexpected decoded image size for %s: got %dx%d, want 826x826", testCase.Name, w, h)
+		}
+	}
+
+	// Unknown major brands are left to the decoders of the application, but
+	// the HEIF compatible brands are still found when decoding directly.
+	data := make([]byte, len(b))
+	copy(data, b)
+	copy(data[8:12], "iso8")
+
+	_, _, err = image.Decode(bytes.NewReader(data))
+	if !errors.Is(err, image.ErrFormat) {
+		t.Errorf("unexpected error for unknown major brand: got %v, want %v", err, image.ErrFormat)
+	}
+
+	img, err := decodeSniffedImage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unable to decode image with unknown major brand: %s", err)
+	}
+
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 826 || h != 826 {
+		t.Errorf("unexpected decoded image size for unknown major brand: got %dx%d, want 826x826", w, h)
+	}
+
+	config, err := decodeSniffedConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unable to decode config with unknown major brand: %s", err)
+	}
+
+	if config.Width != 826 || config.Height != 826 {
+		t.Errorf("unexpected config size for unknown major brand: got %dx%d, want 826x826", config.Width, config.Height)
+	}
+
+	// A file with only non-HEIF brands, like an MP4 video, should not be sent to the worker.
+	copy(data[8:], "isom\x00\x00\x00\x00isomiso2mp41")
+
+	_, _, err = image.Decode(bytes.NewReader(data))
+	if !errors.Is(err, image.ErrFormat) {
+		t.Errorf("unexpected error for non-HEIF file: got %v, want %v", err, image.ErrFormat)
+	}
+
+	_, err = decodeSniffedImage(bytes.NewReader(data))
+	if err != UnsupportedFileTypeError {
+		t.Errorf("unexpected error for non-HEIF file: got %v, want %v", err, UnsupportedFileTypeError)
+	}
+
+	// The worker leaves non-HEIF files to the registered image decoders.
+	_, err = library.DecodeImage(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), image.ErrFormat.Error()) {
+		t.Errorf("unexpected error of the worker for non-HEIF file: got %v, want %v", err, image.ErrFormat)
+	}
+
+	_, err = library.DecodeConfig(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), image.ErrFormat.Error()) {
+		t.Errorf("unexpected config error of the worker for non-HEIF file: got %v, want %v", err, image.ErrFormat)
+	}
+
+	_, err = library.RenderFile(&data, library.RenderOptions{OutputFormat: library.RenderFileOutputFormatPNG})
+	if err == nil || !strings.Contains(err.Error(), image.ErrFormat.Error()) {
+		t.Errorf("unexpected render error of the worker for non-HEIF file: got %v, want %v", err, image.ErrFormat)
+	}
+}
+
+func TestAdditionalFormatRegistered(t *testing.T) {
+	err := initLib()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if got, want := renderedFile.OriginalFormat, "heif"; got != want {
-		t.Errorf("unexpected original format: got %s, want %s", got, want)
+	type expectedFile struct {
+		Name        string
+		Format      string
+		Compression responses.Compression
+		Width       int
+		Height      int
 	}
+	files := []expectedFile{
+		{
+			Name:        "receipt_msf1.heif",
+			Format:      "heif",
+			Compression: responses.CompressionAV1,
+			Width:       826,
+			Height:      826,
+		},
+		{
+			Name:        "receipt_avio.avif",
+			Format:      "avif",
+			Compression: responses.CompressionAV1,
+			Width:       826,
+			Height:      826,
+		},
+		{
+			Name:        "receipt_jpeg.heif",
+			Format:      "heif",
+			Compression: responses.CompressionJPEG,
+			Width:       826,
+			Height:      826,
+		},
+		{
+			Name:        "gradient_uncompressed.heif",
+			Format:      "heif",
+			Compression: responses.CompressionUncompressed,
+			Width:       64,
+			Height:      48,
+		},
+	}
+	for _, file := range files {
+		t.Run(file.Name, func(t *testing.T) {
+			b, err := os.ReadFile(fmt.Sprintf("testdata/%s", file.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	if got, want := renderedFile.NewFormat, "jpeg"; got != want {
-		t.Errorf("unexpected new format: got %s, want %s", got, want)
+			config, dec, err := image.DecodeConfig(bytes.NewReader(b))
+			if err != nil {
+				skipUnsupportedCodec(t, err)
+				t.Fatalf("unable to decode config of %s: %s", file.Name, err)
+			}
+
+			if got, want := dec, file.Format; got != want {
+				t.Errorf("unexpected decoder for %s: got %s, want %s", file.Name, got, want)
+			}
+
+			if w, h := config.Width, config.Height; w != file.Width || h != file.Height {
+				t.Errorf("unexpected config size for %s: got %dx%d, want %dx%d", file.Name, w, h, file.Width, file.Height)
+			}
+
+			if config.ColorModel == nil {
+				t.Errorf("missing color model for %s", file.Name)
+			}
+
+			probe, err := library.Probe(&b)
+			if err != nil {
+				t.Fatalf("unable to probe %s: %s", file.Name, err)
+			}
+
+			if got, want := len(probe.Images), 1; got != want {
+				t.Fatalf("unexpected image count for %s: got %d, want %d", file.Name, got, want)
+			}
+
+			if got, want := probe.Images[0].Compression, file.Compression; got != want {
+				t.Errorf("unexpected compression for %s: got %s, want %s", file.Name, got, want)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(b))
+			if err != nil {
+				skipUnsupportedCodec(t, err)
+				t.Fatalf("unable to decode image %s: %s", file.Name, err)
+			}
+
+			if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != file.Width || h != file.Height {
+				t.Errorf("unexpected decoded image size for %s: got %dx%d, want %dx%d", file.Name, w, h, file.Width, file.Height)
+			}
+
+			if config.ColorModel != img.ColorModel() {
+				t.Errorf("color model of the config of %s differs from the decoded %T", file.Name, img)
+			}
+		})
 	}
+}
 
-	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
-		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+func TestDecodeConfigColorModel(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	for _, name := range []string{"camel.heic", "gradient_10bit.heic", "alpha.avif", "receipt.avif", "multi_image.heic"} {
+		b, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("unable to decode config of %s: %s", name, err)
+		}
+
+		img, err := DecodeImage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("unable to decode image %s: %s", name, err)
+		}
+
+		if config.ColorModel != img.ColorModel() {
+			t.Errorf("color model of the config of %s differs from the decoded %T", name, img)
+		}
+	}
+}
+
+// skipUnsupportedCodec skips the test when the installed libheif has not been
+// built with support for the codec of the file, or is too old to know it.
+func skipUnsupportedCodec(t *testing.T, err error) {
+	if strings.Contains(err.Error(), "Unsupported codec") || strings.Contains(err.Error(), "references a non-existing image") {
+		t.Skipf("codec not supported by libheif: %s", err)
+	}
+}
+
+func TestDecodeImageWithOptions(t *testing.T) {
+	err := initLib()
 	if err != nil {
-		t.Fatalf("unable to decode jpeg image: %s", err)
+		t.Fatal(err)
 	}
 
-	if got, want := dec, "jpeg"; got != want {
-		t.Errorf("unexpected decoder: got %s, want %s", got, want)
+	decode := func(name string, options library.DecodeOptions) (image.Image, error) {
+		b, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DecodeImageWithOptions(bytes.NewReader(b), options)
 	}
 
-	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
-		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	tests := []struct {
+		Name    string
+		Options library.DecodeOptions
+		Type    string
+		Width   int
+		Height  int
+	}{
+		{Name: "camel.heic", Type: "*image.RGBA", Width: 1596, Height: 1064},
+		{Name: "camel.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceRGB}, Type: "*image.RGBA", Width: 1596, Height: 1064},
+		{Name: "camel.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceMonochrome}, Type: "*image.Gray", Width: 1596, Height: 1064},
+		{Name: "camel.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceYCbCr}, Type: "*image.YCbCr", Width: 1596, Height: 1064},
+		{Name: "camel.heic", Options: library.DecodeOptions{DecoderID: "libde265"}, Type: "*image.RGBA", Width: 1596, Height: 1064},
+		{Name: "gradient_10bit.heic", Type: "*image.RGBA64", Width: 64, Height: 48},
+		{Name: "gradient_10bit.heic", Options: library.DecodeOptions{ConvertHDRTo8Bit: true}, Type: "*image.RGBA", Width: 64, Height: 48},
+		{Name: "gradient_10bit.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceMonochrome}, Type: "*image.Gray16", Width: 64, Height: 48},
+		{Name: "gradient_10bit.heic", Options: library.DecodeOptions{ConvertHDRTo8Bit: true, Colorspace: library.DecodeImageColorspaceYCbCr}, Type: "*image.YCbCr", Width: 64, Height: 48},
+		{Name: "alpha.avif", Type: "*image.NRGBA", Width: 64, Height: 64},
+		{Name: "alpha.avif", Options: library.DecodeOptions{Alpha: library.DecodeImageAlphaPremultiplied}, Type: "*image.RGBA", Width: 64, Height: 64},
+		{Name: "multi_image.heic", Type: "*image.RGBA", Width: 64, Height: 48},
+		{Name: "multi_image.heic", Options: library.DecodeOptions{ImageID: 4}, Type: "*image.RGBA", Width: 48, Height: 64},
+	}
+
+	for _, test := range tests {
+		img, err := decode(test.Name, test.Options)
+		if err != nil {
+			t.Errorf("unable to decode %s with %+v: %s", test.Name, test.Options, err)
+			continue
+		}
+
+		if got := fmt.Sprintf("%T", img); got != test.Type {
+			t.Errorf("unexpected image type for %s with %+v: got %s, want %s", test.Name, test.Options, got, test.Type)
+		}
+
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != test.Width || h != test.Height {
+			t.Errorf("unexpected size for %s with %+v: got %dx%d, want %dx%d", test.Name, test.Options, w, h, test.Width, test.Height)
+		}
+	}
+
+	for chroma, want := range map[library.DecodeImageChroma]image.YCbCrSubsampleRatio{
+		library.DecodeImageChromaDefault: image.YCbCrSubsampleRatio420,
+		library.DecodeImageChroma444:     image.YCbCrSubsampleRatio444,
+	} {
+		img, err := decode("camel.heic", library.DecodeOptions{Colorspace: library.DecodeImageColorspaceYCbCr, Chroma: chroma})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := img.(*image.YCbCr).SubsampleRatio; got != want {
+			t.Errorf("unexpected subsample ratio for chroma %q: got %s, want %s", chroma, got, want)
+		}
+	}
+
+	// Premultiplying keeps the colors of the straight alpha image.
+	straight, err := decode("alpha.avif", library.DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	premultiplied, err := decode("alpha.avif", library.DecodeOptions{Alpha: library.DecodeImageAlphaPremultiplied})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, point := range []image.Point{{0, 0}, {32, 32}, {63, 63}} {
+		if got, want := color.RGBAModel.Convert(premultiplied.At(point.X, point.Y)), color.RGBAModel.Convert(straight.At(point.X, point.Y)); got != want {
+			t.Errorf("unexpected premultiplied pixel at %v: got %v, want %v", point, got, want)
+		}
+	}
+
+	errorTests := []struct {
+		Name    string
+		Options library.DecodeOptions
+	}{
+		{Name: "camel.heic", Options: library.DecodeOptions{Chroma: library.DecodeImageChroma444}},
+		{Name: "camel.heic", Options: library.DecodeOptions{Colorspace: "cmyk"}},
+		{Name: "camel.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceYCbCr, ConvertColors: true}},
+		{Name: "camel.heic", Options: library.DecodeOptions{Alpha: "unknown"}},
+		{Name: "gradient_10bit.heic", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceYCbCr}},
+		{Name: "alpha.avif", Options: library.DecodeOptions{Colorspace: library.DecodeImageColorspaceMonochrome}},
+		{Name: "multi_image.heic", Options: library.DecodeOptions{ImageID: 99}},
+	}
+
+	for _, test := range errorTests {
+		_, err := decode(test.Name, test.Options)
+		if err == nil {
+			t.Errorf("expected an error for %s with %+v", test.Name, test.Options)
+		}
 	}
 }
 
-func TestRenderPNG(t *testing.T) {
+func TestWorkerInfo(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := library.WorkerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ProtocolVersion != shared.ProtocolVersion {
+		t.Errorf("unexpected protocol version: got %d, want %d", info.ProtocolVersion, shared.ProtocolVersion)
+	}
+
+	if info.Version != shared.Version() {
+		t.Errorf("unexpected go-libheif version: got %q, want %q", info.Version, shared.Version())
+	}
+
+	if !strings.HasPrefix(info.LibheifVersion, "1.") {
+		t.Errorf("unexpected libheif version: %q", info.LibheifVersion)
+	}
+
+	features := map[responses.Feature]bool{}
+	for _, feature := range info.Features {
+		features[feature] = true
+	}
+
+	if !features[responses.FeatureDecodeHEVC] {
+		t.Errorf("expected feature %s: got %v", responses.FeatureDecodeHEVC, info.Features)
+	}
+
+	tags := strings.Join(workerBuildTags, ",")
+	if want := strings.Contains(tags, "go_libheif_use_turbojpeg"); features[responses.FeatureTurboJPEG] != want {
+		t.Errorf("expected feature %s to be %t: got %v", responses.FeatureTurboJPEG, want, info.Features)
+	}
+	if want := strings.Contains(tags, "go_libheif_use_libwebp"); features[responses.FeatureWebP] != want {
+		t.Errorf("expected feature %s to be %t: got %v", responses.FeatureWebP, want, info.Features)
+	}
+
+	// A worker without a required feature is rejected.
+	library.DeInit()
+	config := workerConfig()
+	config.RequiredFeatures = []responses.Feature{responses.FeatureDecodeHEVC, "does_not_exist"}
+	err = library.Init(config)
+	if !errors.Is(err, library.IncompatibleWorkerError) {
+		t.Errorf("expected IncompatibleWorkerError for a missing feature, got %v", err)
+	}
+
+	err = library.Init(workerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecycle(t *testing.T) {
 	err := initLib()
 	if err != nil {
 		t.Fatal(err)
@@ -116,36 +475,1423 @@ func TestRenderPNG(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
-		OutputFormat: library.RenderFileOutputFormatPNG,
-	})
+	workerPID := func() int {
+		info, err := library.WorkerInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.PID
+	}
+
+	library.DeInit()
+	config := workerConfig()
+	config.Recycle.MaxRequests = 2
+	err = library.Init(config)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if got, want := renderedFile.OriginalFormat, "heif"; got != want {
-		t.Errorf("unexpected original format: got %s, want %s", got, want)
+	pid := workerPID()
+	for i := 0; i < 2; i++ {
+		if _, err := library.DecodeConfig(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if workerPID() != pid {
+		t.Errorf("expected the worker to handle 2 requests before it's recycled")
 	}
 
-	if got, want := renderedFile.NewFormat, "png"; got != want {
-		t.Errorf("unexpected new format: got %s, want %s", got, want)
+	if _, err := library.DecodeConfig(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if workerPID() == pid {
+		t.Errorf("expected the worker to be recycled after 2 requests")
 	}
 
-	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
-		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+	// The requests in flight finish before the worker is recycled.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := library.DecodeConfig(bytes.NewReader(b))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error during recycling: %s", err)
+		}
 	}
 
-	img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if runtime.GOOS == "linux" {
+		library.DeInit()
+		config = workerConfig()
+		config.Recycle.MaxRSS = 1
+		err = library.Init(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pid = workerPID()
+		for i := 0; i < 2; i++ {
+			if _, err := library.DecodeConfig(bytes.NewReader(b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if workerPID() == pid {
+			t.Errorf("expected the worker to be recycled above the max RSS")
+		}
+	}
+
+	library.DeInit()
+	err = library.Init(workerConfig())
 	if err != nil {
-		t.Fatalf("unable to decode jpeg image: %s", err)
+		t.Fatal(err)
 	}
+}
 
-	if got, want := dec, "png"; got != want {
-		t.Errorf("unexpected decoder: got %s, want %s", got, want)
+func TestInstances(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
-		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sandboxConfig := workerConfig()
+	sandboxConfig.Recycle.MaxRequests = 1
+	sandbox, err := library.New(sandboxConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+
+	trusted, err := library.New(workerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trusted.Close()
+
+	pids := map[int]bool{}
+	for _, worker := range []func() (*responses.Handshake, error){library.WorkerInfo, sandbox.WorkerInfo, trusted.WorkerInfo} {
+		info, err := worker()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids[info.PID] = true
+	}
+	if len(pids) != 3 {
+		t.Errorf("expected every instance to have its own worker, got %d workers", len(pids))
+	}
+
+	var wg sync.WaitGroup
+	for _, instance := range []*library.Instance{sandbox, trusted} {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(instance *library.Instance) {
+				defer wg.Done()
+
+				config, err := instance.DecodeConfig(bytes.NewReader(b))
+				if err != nil {
+					t.Errorf("unable to decode config: %s", err)
+					return
+				}
+				if config.Width != 1596 || config.Height != 1064 {
+					t.Errorf("unexpected config size: got %dx%d, want 1596x1064", config.Width, config.Height)
+				}
+			}(instance)
+		}
+	}
+	wg.Wait()
+
+	err = sandbox.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sandbox.DecodeConfig(bytes.NewReader(b)); !errors.Is(err, library.NotInitializedError) {
+		t.Errorf("expected NotInitializedError after Close, got %v", err)
+	}
+
+	if _, err := trusted.DecodeConfig(bytes.NewReader(b)); err != nil {
+		t.Errorf("expected the other instance to keep working, got %s", err)
+	}
+
+	if _, err := DecodeConfig(bytes.NewReader(b)); err != nil {
+		t.Errorf("expected the default instance to keep working, got %s", err)
+	}
+}
+
+func TestInitDeInit(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cycle := 0; cycle < 2; cycle++ {
+		// Requests in flight during Close finish, later requests fail.
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, err := DecodeConfig(bytes.NewReader(b))
+				if err != nil && !errors.Is(err, NotInitializedError) && !errors.Is(err, library.NotInitializedError) {
+					t.Errorf("unexpected error during Close: %s", err)
+				}
+			}()
+		}
+
+		err = Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		DeInit()
+		err = Close()
+		if err != nil {
+			t.Errorf("expected Close to do nothing when closed, got %s", err)
+		}
+
+		if _, err := DecodeConfig(bytes.NewReader(b)); !errors.Is(err, NotInitializedError) {
+			t.Errorf("expected NotInitializedError after DeInit, got %v", err)
+		}
+
+		// The library can be started again with another config.
+		config := workerConfig()
+		config.Recycle.MaxRequests = int64(cycle + 1)
+		err = Init(Config{LibraryConfig: config})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := DecodeConfig(bytes.NewReader(b)); err != nil {
+			t.Errorf("unable to decode config after Init in cycle %d: %s", cycle, err)
+		}
+	}
+
+	DeInit()
+	err = initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities, err := library.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(capabilities.LibheifVersion, "1.") {
+		t.Errorf("unexpected libheif version: %q", capabilities.LibheifVersion)
+	}
+
+	formats := map[responses.Compression]responses.CapabilitiesFormat{}
+	for _, format := range capabilities.Formats {
+		formats[format.Compression] = format
+	}
+
+	// The test files need HEVC and AV1 decoders.
+	for _, compression := range []responses.Compression{responses.CompressionHEVC, responses.CompressionAV1} {
+		if len(formats[compression].Decoders) == 0 {
+			t.Errorf("expected a decoder for %s: got %+v", compression, capabilities.Formats)
+		}
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every decoder can be picked.
+	for _, decoder := range formats[responses.CompressionHEVC].Decoders {
+		if decoder.ID == "" {
+			continue
+		}
+
+		img, err := DecodeImageWithOptions(bytes.NewReader(b), library.DecodeOptions{DecoderID: decoder.ID})
+		if err != nil {
+			t.Errorf("unable to decode with %s: %s", decoder.ID, err)
+			continue
+		}
+
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+			t.Errorf("unexpected decoded image size with %s: got %dx%d, want 1596x1064", decoder.ID, w, h)
+		}
+	}
+}
+
+func TestRenderJPEG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := renderedFile.OriginalFormat, "heif"; got != want {
+		t.Errorf("unexpected original format: got %s, want %s", got, want)
+	}
+
+	if got, want := renderedFile.NewFormat, "jpeg"; got != want {
+		t.Errorf("unexpected new format: got %s, want %s", got, want)
+	}
+
+	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
+		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+	}
+
+	img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode jpeg image: %s", err)
+	}
+
+	if got, want := dec, "jpeg"; got != want {
+		t.Errorf("unexpected decoder: got %s, want %s", got, want)
+	}
+
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	}
+}
+
+func TestRenderJPEGGray(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:    library.RenderFileOutputFormatJPG,
+		JPEGSubsampling: library.RenderFileJPEGSubsamplingGray,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode jpeg image: %s", err)
+	}
+
+	if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("unexpected decoded image type: got %T, want *image.Gray", img)
+	}
+}
+
+func TestRenderFromJPEG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err = library.RenderFile(renderedFile.Output, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPNG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := renderedFile.OriginalFormat, "jpeg"; got != want {
+		t.Errorf("unexpected original format: got %s, want %s", got, want)
+	}
+
+	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
+		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+	}
+}
+
+func TestRenderPNG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPNG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := renderedFile.OriginalFormat, "heif"; got != want {
+		t.Errorf("unexpected original format: got %s, want %s", got, want)
+	}
+
+	if got, want := renderedFile.NewFormat, "png"; got != want {
+		t.Errorf("unexpected new format: got %s, want %s", got, want)
+	}
+
+	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
+		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+	}
+
+	img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode jpeg image: %s", err)
+	}
+
+	if got, want := dec, "png"; got != want {
+		t.Errorf("unexpected decoder: got %s, want %s", got, want)
+	}
+
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+		t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+	}
+}
+
+func TestRenderJPEGBackground(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/alpha.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The left quarter of the image is transparent, the second quarter half
+	// transparent and the rest opaque.
+	type testCase struct {
+		Name       string
+		Background *color.RGBA
+		Want       map[int]color.RGBA
+	}
+	testCases := []testCase{
+		{Name: "default", Want: map[int]color.RGBA{0: {R: 0xff, G: 0xff, B: 0xff}, 24: {R: 0xb0, G: 0xc0, B: 0xbe}, 48: {R: 0xc1, G: 0x80, B: 0x7e}}},
+		{Name: "red", Background: &color.RGBA{R: 0xff, A: 0xff}, Want: map[int]color.RGBA{0: {R: 0xff}, 24: {R: 0xb0, G: 0x40, B: 0x3f}, 48: {R: 0xc1, G: 0x80, B: 0x7e}}},
+	}
+	for _, testCase := range testCases {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatJPG,
+			Background:   testCase.Background,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !renderedFile.HasAlpha {
+			t.Errorf("expected the rendered file to report alpha")
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode jpeg image: %s", err)
+		}
+
+		for x, want := range testCase.Want {
+			got := color.RGBAModel.Convert(img.At(x, 32)).(color.RGBA)
+			for c, pair := range [][2]uint8{{got.R, want.R}, {got.G, want.G}, {got.B, want.B}} {
+				if diff := int(pair[0]) - int(pair[1]); diff < -12 || diff > 12 {
+					t.Errorf("unexpected channel %d at x %d with %s background: got %#x, want %#x", c, x, testCase.Name, pair[0], pair[1])
+				}
+			}
+		}
+	}
+
+	// Images with alpha can be decoded through the worker.
+	img, err := library.DecodeImage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Errorf("unexpected decoded image type: got %T, want *image.NRGBA", img)
+	}
+
+	b, err = os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renderedFile.HasAlpha {
+		t.Errorf("expected the rendered file to not report alpha")
+	}
+}
+
+func TestRenderToneMapping(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files have four columns of gray of 10, 100, 203 and 1000 cd/m², and
+	// a bottom half of BT.2020 red.
+	render := func(b []byte, options library.RenderOptions) (image.Image, []uint8) {
+		options.OutputFormat = library.RenderFileOutputFormatJPG
+		renderedFile, err := library.RenderFile(&b, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode jpeg image: %s", err)
+		}
+
+		var columns []uint8
+		for _, x := range []int{8, 24, 40, 56} {
+			columns = append(columns, color.GrayModel.Convert(img.At(x, 8)).(color.Gray).Y)
+		}
+		return img, columns
+	}
+
+	for _, name := range []string{"hdr_pq.heic", "hdr_hlg.heic"} {
+		b, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		toneMappings := []library.RenderFileToneMapping{
+			library.RenderFileToneMappingReinhard,
+			library.RenderFileToneMappingHable,
+			library.RenderFileToneMappingBT2390,
+		}
+		for _, toneMapping := range toneMappings {
+			img, columns := render(b, library.RenderOptions{ToneMapping: toneMapping})
+			for i := 1; i < len(columns); i++ {
+				if columns[i] <= columns[i-1] {
+					t.Errorf("expected the columns of %s with %s to get brighter: got %v", name, toneMapping, columns)
+				}
+			}
+
+			if columns[0] > 90 || columns[3] < 250 {
+				t.Errorf("expected the columns of %s with %s to range from dark to white: got %v", name, toneMapping, columns)
+			}
+
+			if c := color.RGBAModel.Convert(img.At(8, 24)).(color.RGBA); c.R < 200 || c.G > 30 || c.B > 30 {
+				t.Errorf("expected the bottom of %s with %s to be red: got %v", name, toneMapping, c)
+			}
+		}
+
+		// A higher target peak gives a darker image.
+		_, bright := render(b, library.RenderOptions{ToneMapping: library.RenderFileToneMappingBT2390})
+		_, dark := render(b, library.RenderOptions{ToneMapping: library.RenderFileToneMappingBT2390, TargetPeakLuminance: 1000})
+		if dark[2] >= bright[2] {
+			t.Errorf("expected a higher target peak to give a darker image for %s: got %d, want less than %d", name, dark[2], bright[2])
+		}
+	}
+
+	// Without tone mapping the PQ values are shown as is, so the highlights
+	// are dim.
+	b, err := os.ReadFile("testdata/hdr_pq.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, columns := render(b, library.RenderOptions{})
+	if columns[3] > 220 {
+		t.Errorf("expected 1000 cd/m² to be dim without tone mapping: got %d", columns[3])
+	}
+
+	_, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+		ToneMapping:  "unknown",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown tone mapping")
+	}
+}
+
+func TestRenderColorConversion(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file has a Display P3 ICC profile, the left half is the P3 value of
+	// sRGB 200, 100, 50 and the right half is gray.
+	b, err := os.ReadFile("testdata/display_p3.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p3Profile, err := os.ReadFile("testdata/display_p3.icc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	near := func(img image.Image, x, y int, want color.RGBA, tolerance int) bool {
+		c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+		for _, d := range []int{int(c.R) - int(want.R), int(c.G) - int(want.G), int(c.B) - int(want.B)} {
+			if d < -tolerance || d > tolerance {
+				return false
+			}
+		}
+		return true
+	}
+
+	p3 := color.RGBA{R: 187, G: 105, B: 62, A: 255}
+	srgb := color.RGBA{R: 200, G: 100, B: 50, A: 255}
+	gray := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+
+	img, err := DecodeImage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(img, 16, 16, p3, 4) {
+		t.Errorf("expected the P3 values without conversion: got %v, want %v", img.At(16, 16), p3)
+	}
+
+	img, err = DecodeImageToProfile(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(img, 16, 16, srgb, 4) || !near(img, 96, 16, gray, 3) {
+		t.Errorf("expected the sRGB values: got %v and %v, want %v and %v", img.At(16, 16), img.At(96, 16), srgb, gray)
+	}
+
+	// Converting to the profile of the image keeps the values.
+	img, err = DecodeImageToProfile(bytes.NewReader(b), p3Profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(img, 16, 16, p3, 4) {
+		t.Errorf("expected the P3 values with the P3 target: got %v, want %v", img.At(16, 16), p3)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:  library.RenderFileOutputFormatPNG,
+		ConvertColors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = png.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(img, 16, 16, srgb, 4) {
+		t.Errorf("expected the rendered sRGB values: got %v, want %v", img.At(16, 16), srgb)
+	}
+
+	// The TIFF file has the target profile instead of the profile of the image.
+	renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:  library.RenderFileOutputFormatTIFF,
+		ConvertColors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(*renderedFile.Output, p3Profile[:128]) {
+		t.Error("expected no ICC profile in the sRGB tiff file")
+	}
+
+	_, err = DecodeImageToProfile(bytes.NewReader(b), []byte("not a profile"))
+	if err == nil {
+		t.Error("expected an error for an invalid target profile")
+	}
+
+	// PQ images have to be tone mapped.
+	pq, err := os.ReadFile("testdata/hdr_pq.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DecodeImageToProfile(bytes.NewReader(pq), nil)
+	if err == nil {
+		t.Error("expected an error for converting a PQ image")
+	}
+
+	// Tone mapped images are sRGB, so they can be converted to the target.
+	_, err = library.RenderFile(&pq, library.RenderOptions{
+		OutputFormat:     library.RenderFileOutputFormatPNG,
+		ToneMapping:      library.RenderFileToneMappingBT2390,
+		ConvertColors:    true,
+		TargetICCProfile: p3Profile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderGainMap(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files have a left half of mid gray and a right half of white, the
+	// gain map boosts the right half to the headroom.
+	type testCase struct {
+		Name     string
+		Type     responses.GainMapType
+		ID       int
+		Headroom float64
+	}
+	testCases := []testCase{
+		{Name: "gainmap_apple.heic", Type: responses.GainMapTypeApple, ID: 4, Headroom: math.Exp2(2.1515)},
+		{Name: "gainmap_iso.heic", Type: responses.GainMapTypeISO21496, ID: 3, Headroom: 4},
+	}
+	for _, testCase := range testCases {
+		b, err := os.ReadFile("testdata/" + testCase.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		probe, err := library.Probe(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(probe.Images) != 1 {
+			t.Fatalf("expected the gain map of %s to not be a top level image: got %d images", testCase.Name, len(probe.Images))
+		}
+
+		gainMap := probe.Images[0].GainMap
+		if gainMap == nil {
+			t.Fatalf("expected %s to have a gain map", testCase.Name)
+		}
+
+		if gainMap.Type != testCase.Type || gainMap.ID != testCase.ID || gainMap.Width != 64 || gainMap.Height != 32 || math.Abs(gainMap.Headroom-testCase.Headroom) > 0.01 {
+			t.Errorf("unexpected gain map of %s: got %+v", testCase.Name, gainMap)
+		}
+
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatPNG,
+			GainMap:      library.RenderFileGainMapApply,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if renderedFile.GainMap != testCase.Type {
+			t.Errorf("unexpected gain map type of %s: got %q, want %q", testCase.Name, renderedFile.GainMap, testCase.Type)
+		}
+
+		if !bytes.Contains(*renderedFile.Output, []byte("cICP")) {
+			t.Errorf("expected the hdr png of %s to have a cICP chunk", testCase.Name)
+		}
+
+		img, err := png.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Mid gray is not boosted, white is boosted to the headroom.
+		for x, luminance := range map[int]float64{16: 0.2158 * 203, 112: testCase.Headroom * 203} {
+			want := tonemap.EncodePQ(luminance)
+			got := float64(color.Gray16Model.Convert(img.At(x, 32)).(color.Gray16).Y) / 0xffff
+			if math.Abs(got-want) > 0.01 {
+				t.Errorf("unexpected pq value at x %d of %s: got %f, want %f", x, testCase.Name, got, want)
+			}
+		}
+
+		renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatJPG,
+			GainMap:      library.RenderFileGainMapUltraHDR,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{"MPF\x00", "hdrgm:Version", `Item:Semantic="GainMap"`} {
+			if !bytes.Contains(*renderedFile.Output, []byte(want)) {
+				t.Errorf("expected the ultrahdr jpeg of %s to contain %q", testCase.Name, want)
+			}
+		}
+
+		img, _, err = image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode jpeg image: %s", err)
+		}
+
+		if img.Bounds().Dx() != 128 || img.Bounds().Dy() != 64 {
+			t.Errorf("unexpected ultrahdr jpeg dimensions of %s: got %v", testCase.Name, img.Bounds())
+		}
+
+		// The gain map is ignored by default.
+		renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatJPG,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if renderedFile.GainMap != responses.GainMapTypeNone || bytes.Contains(*renderedFile.Output, []byte("hdrgm")) {
+			t.Errorf("expected the gain map of %s to be ignored", testCase.Name)
+		}
+
+		_, err = library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatJPG,
+			GainMap:      library.RenderFileGainMapApply,
+		})
+		if err == nil {
+			t.Errorf("expected an error for applying the gain map of %s to a jpeg", testCase.Name)
+		}
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe, err := library.Probe(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if probe.Images[0].GainMap != nil {
+		t.Errorf("expected camel.heic to have no gain map: got %+v", probe.Images[0].GainMap)
+	}
+}
+
+func TestRenderPNGOptions(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/gradient_10bit.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		Name    string
+		Options library.RenderOptions
+		Model   color.Model
+	}
+	testCases := []testCase{
+		{Name: "default", Options: library.RenderOptions{}, Model: color.RGBA64Model},
+		{Name: "8 bit", Options: library.RenderOptions{PNGBitDepth: 8}, Model: color.RGBAModel},
+		{Name: "best compression", Options: library.RenderOptions{PNGCompressionLevel: library.RenderFilePNGCompressionLevelBest}, Model: color.RGBA64Model},
+		{Name: "palette", Options: library.RenderOptions{PNGMaxColors: 64}},
+	}
+	sizes := map[string]int{}
+	for _, testCase := range testCases {
+		testCase.Options.OutputFormat = library.RenderFileOutputFormatPNG
+		renderedFile, err := library.RenderFile(&b, testCase.Options)
+		if err != nil {
+			t.Fatalf("unable to render png with %s options: %s", testCase.Name, err)
+		}
+		sizes[testCase.Name] = len(*renderedFile.Output)
+
+		img, err := png.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode png image with %s options: %s", testCase.Name, err)
+		}
+
+		if testCase.Model == nil {
+			paletted, ok := img.(*image.Paletted)
+			if !ok {
+				t.Fatalf("unexpected png image type with %s options: got %T, want *image.Paletted", testCase.Name, img)
+			}
+			if len(paletted.Palette) > 64 {
+				t.Errorf("unexpected palette size: got %d, want at most 64", len(paletted.Palette))
+			}
+		} else if img.ColorModel() != testCase.Model {
+			t.Errorf("unexpected png image type with %s options: got %T", testCase.Name, img)
+		}
+	}
+
+	if sizes["best compression"] > sizes["default"] {
+		t.Errorf("best compression is larger than the default: got %d, default %d", sizes["best compression"], sizes["default"])
+	}
+
+	// The best compression with 16 bits does not fit, so it has to fall back
+	// to 8 bits or a palette.
+	maxFileSize := int64(sizes["best compression"]) - 1
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPNG,
+		MaxFileSize:  maxFileSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := int64(len(*renderedFile.Output)); got > maxFileSize {
+		t.Errorf("rendered png exceeds maximum filesize: got %d, want at most %d", got, maxFileSize)
+	}
+
+	img, err := png.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.ColorModel() == color.RGBA64Model {
+		t.Errorf("unexpected png image type with a maximum filesize: got %T, want 8 bits or a palette", img)
+	}
+}
+
+func TestRenderTIFF(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/receipt.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressions := []library.RenderFileTIFFCompression{
+		library.RenderFileTIFFCompressionNone,
+		library.RenderFileTIFFCompressionLZW,
+		library.RenderFileTIFFCompressionDeflate,
+	}
+	for _, compression := range compressions {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat:    library.RenderFileOutputFormatTIFF,
+			TIFFCompression: compression,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := renderedFile.NewFormat, "tiff"; got != want {
+			t.Errorf("unexpected new format: got %s, want %s", got, want)
+		}
+
+		img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode tiff image with compression %s: %s", compression, err)
+		}
+
+		if got, want := dec, "tiff"; got != want {
+			t.Errorf("unexpected decoder: got %s, want %s", got, want)
+		}
+
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 826 || h != 826 {
+			t.Fatalf("unexpected decoded image size: got %dx%d, want 826x826", w, h)
+		}
+
+		// The TIFF is lossless, so all pixels should be the same as the decoded original.
+		for y := 0; y < 826; y++ {
+			for x := 0; x < 826; x++ {
+				if got, want := color.RGBAModel.Convert(img.At(x, y)), color.RGBAModel.Convert(original.At(x, y)); got != want {
+					t.Fatalf("unexpected pixel at %d,%d with compression %s: got %v, want %v", x, y, compression, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderTIFFFromJPEG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/receipt.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatTIFF,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode tiff image: %s", err)
+	}
+
+	if got, want := dec, "tiff"; got != want {
+		t.Errorf("unexpected decoder: got %s, want %s", got, want)
+	}
+
+	original, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := img.Bounds(), original.Bounds(); got != want {
+		t.Errorf("unexpected bounds: got %v, want %v", got, want)
+	}
+}
+
+func TestRenderTIFFHighBitDepth(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/gradient_10bit.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatTIFF,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+	if err != nil {
+		t.Fatalf("unable to decode tiff image: %s", err)
+	}
+
+	if _, ok := img.(*image.RGBA64); !ok {
+		t.Errorf("unexpected decoded image type: got %T, want *image.RGBA64", img)
+	}
+
+	// The ICC profile and the EXIF data of the image should be embedded.
+	for _, want := range []string{"go-libheif P3 test", "go-libheif\x00", "2024:01:16 12:00:00"} {
+		if !bytes.Contains(*renderedFile.Output, []byte(want)) {
+			t.Errorf("rendered tiff does not contain %q", want)
+		}
+	}
+}
+
+func TestRenderCorruptedEXIF(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/gradient_10bit.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the offset at the start of the EXIF item past its end.
+	exifStart := bytes.Index(b, []byte("II*\x00"))
+	if exifStart < 4 {
+		t.Fatal("test file has no exif item")
+	}
+	copy(b[exifStart-4:], []byte{0xff, 0xff, 0xff, 0xff})
+
+	outputs := []library.RenderFileOutputFormat{
+		library.RenderFileOutputFormatTIFF,
+		library.RenderFileOutputFormatPDF,
+	}
+	for _, output := range outputs {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat:  output,
+			ConvertColors: true,
+		})
+		if err != nil {
+			t.Fatalf("unable to render %s with corrupted exif: %s", output, err)
+		}
+
+		if bytes.Contains(*renderedFile.Output, []byte("2024:01:16 12:00:00")) {
+			t.Errorf("rendered %s contains the corrupted exif", output)
+		}
+	}
+
+	_, err = library.Probe(&b)
+	if err != nil {
+		t.Errorf("unable to probe with corrupted exif: %s", err)
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/receipt.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressions := []library.RenderFilePDFCompression{
+		library.RenderFilePDFCompressionJPEG,
+		library.RenderFilePDFCompressionLossless,
+	}
+	for _, compression := range compressions {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat:   library.RenderFileOutputFormatPDF,
+			PDFCompression: compression,
+			PDFPageSize:    library.RenderFilePDFPageSizeA4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := renderedFile.NewFormat, "pdf"; got != want {
+			t.Errorf("unexpected new format: got %s, want %s", got, want)
+		}
+
+		if !bytes.HasPrefix(*renderedFile.Output, []byte("%PDF-")) {
+			t.Errorf("rendered pdf with compression %s does not start with the PDF header", compression)
+		}
+
+		if !bytes.Contains(*renderedFile.Output, []byte("/MediaBox [0 0 595.2800 841.8900]")) {
+			t.Errorf("rendered pdf with compression %s does not have an A4 page", compression)
+		}
+
+		if got, want := renderedFile.Pages, 1; got != want {
+			t.Errorf("unexpected amount of pages: got %d, want %d", got, want)
+		}
+	}
+}
+
+func TestRenderPDFFromJPEGAndPNG(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jpegFile, err := os.ReadFile("testdata/receipt.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _, err := image.Decode(bytes.NewReader(jpegFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pngBuffer := &bytes.Buffer{}
+	err = png.Encode(pngBuffer, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pngFile := pngBuffer.Bytes()
+
+	inputs := map[string]*[]byte{
+		"jpeg": &jpegFile,
+		"png":  &pngFile,
+	}
+	for name, input := range inputs {
+		renderedFile, err := library.RenderFile(input, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatPDF,
+		})
+		if err != nil {
+			t.Fatalf("unable to render %s to pdf: %s", name, err)
+		}
+
+		if !bytes.HasPrefix(*renderedFile.Output, []byte("%PDF-")) {
+			t.Errorf("rendered pdf of %s does not start with the PDF header", name)
+		}
+
+		if got, want := renderedFile.Pages, 1; got != want {
+			t.Errorf("unexpected amount of pages for %s: got %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestRenderPDFAllImages(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/multi_image.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPDF,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := renderedFile.Pages, 1; got != want {
+		t.Errorf("unexpected amount of pages: got %d, want %d", got, want)
+	}
+
+	renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPDF,
+		AllImages:    true,
+		PDFDPI:       144,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := renderedFile.Pages, 3; got != want {
+		t.Errorf("unexpected amount of pages: got %d, want %d", got, want)
+	}
+
+	// Every image gets its own page, with the size of the image at 144 DPI.
+	for _, want := range []string{"/MediaBox [0 0 32.0000 24.0000]", "/MediaBox [0 0 24.0000 32.0000]", "/MediaBox [0 0 16.0000 16.0000]"} {
+		if !bytes.Contains(*renderedFile.Output, []byte(want)) {
+			t.Errorf("rendered pdf does not contain %q", want)
+		}
+	}
+}
+
+func TestRenderTargetSSIM(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousQuality := 0
+	for _, target := range []float64{0.9, 0.97} {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat:     library.RenderFileOutputFormatJPG,
+			TargetSSIM:       target,
+			MinOutputQuality: 10,
+			OutputQuality:    100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if renderedFile.SSIM < target {
+			t.Errorf("rendered jpeg does not reach the target ssim: got %f, want at least %f", renderedFile.SSIM, target)
+		}
+
+		if renderedFile.Quality < 10 || renderedFile.Quality > 100 || renderedFile.Quality < previousQuality {
+			t.Errorf("unexpected quality for target ssim %f: got %d, previous %d", target, renderedFile.Quality, previousQuality)
+		}
+		previousQuality = renderedFile.Quality
+	}
+
+	_, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatPNG,
+		TargetSSIM:   0.95,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a target ssim with png output")
+	}
+}
+
+func TestRenderMaxFileSize(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullSize := int64(len(*renderedFile.Output))
+
+	// A lower quality should fit without downscaling.
+	maxFileSize := fullSize * 2 / 3
+	renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatJPG,
+		MaxFileSize:  maxFileSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := int64(len(*renderedFile.Output)); got > maxFileSize {
+		t.Errorf("rendered jpeg exceeds maximum filesize: got %d, want at most %d", got, maxFileSize)
+	}
+
+	if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
+		t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+	}
+
+	// Not even the minimum quality fits.
+	maxFileSize = fullSize / 10
+	_, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat:     library.RenderFileOutputFormatJPG,
+		MaxFileSize:      maxFileSize,
+		MinOutputQuality: 80,
+	})
+	if err == nil {
+		t.Fatal("expected an error when the image does not fit in the maximum filesize")
+	}
+
+	formats := []library.RenderFileOutputFormat{
+		library.RenderFileOutputFormatJPG,
+		library.RenderFileOutputFormatPNG,
+		library.RenderFileOutputFormatPDF,
+	}
+	for _, format := range formats {
+		renderedFile, err = library.RenderFile(&b, library.RenderOptions{
+			OutputFormat:     format,
+			MaxFileSize:      maxFileSize,
+			MinOutputQuality: 80,
+			DownscaleToFit:   true,
+		})
+		if err != nil {
+			t.Fatalf("unable to render %s with downscaling: %s", format, err)
+		}
+
+		if got := int64(len(*renderedFile.Output)); got > maxFileSize {
+			t.Errorf("rendered %s exceeds maximum filesize: got %d, want at most %d", format, got, maxFileSize)
+		}
+
+		if w, h := renderedFile.Width, renderedFile.Height; w >= 1596 || h >= 1064 || w == 0 || h == 0 {
+			t.Errorf("unexpected rendered %s image size: got %dx%d, want smaller than 1596x1064", format, w, h)
+		}
+
+		if format == library.RenderFileOutputFormatPDF {
+			continue
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode %s image: %s", format, err)
+		}
+
+		if got, want := img.Bounds().Size(), image.Pt(renderedFile.Width, renderedFile.Height); got != want {
+			t.Errorf("unexpected decoded %s image size: got %v, want %v", format, got, want)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type expectedFile struct {
+		Name        string
+		MajorBrand  string
+		MIMEType    string
+		Compression responses.Compression
+		Width       int
+		Height      int
+		Thumbnails  int
+	}
+	files := []expectedFile{
+		{
+			Name:        "camel.heic",
+			MajorBrand:  "mif1",
+			MIMEType:    "image/heif",
+			Compression: responses.CompressionHEVC,
+			Width:       1596,
+			Height:      1064,
+			Thumbnails:  1,
+		},
+		{
+			Name:        "receipt.avif",
+			MajorBrand:  "avif",
+			MIMEType:    "image/avif",
+			Compression: responses.CompressionAV1,
+			Width:       826,
+			Height:      826,
+			Thumbnails:  0,
+		},
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(fmt.Sprintf("testdata/%s", file.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		probe, err := library.Probe(&b)
+		if err != nil {
+			t.Fatalf("unable to probe %s: %s", file.Name, err)
+		}
+
+		if got, want := probe.MajorBrand, file.MajorBrand; got != want {
+			t.Errorf("unexpected major brand for %s: got %s, want %s", file.Name, got, want)
+		}
+
+		if got, want := probe.MIMEType, file.MIMEType; got != want {
+			t.Errorf("unexpected MIME type for %s: got %s, want %s", file.Name, got, want)
+		}
+
+		if probe.IsSequence {
+			t.Errorf("unexpected sequence for %s", file.Name)
+		}
+
+		if got, want := len(probe.Images), 1; got != want {
+			t.Fatalf("unexpected image count for %s: got %d, want %d", file.Name, got, want)
+		}
+
+		probeImage := probe.Images[0]
+		if !probeImage.IsPrimary || probeImage.ID != probe.PrimaryImageID {
+			t.Errorf("unexpected primary image for %s: got %d, want %d", file.Name, probeImage.ID, probe.PrimaryImageID)
+		}
+
+		if got, want := probeImage.Compression, file.Compression; got != want {
+			t.Errorf("unexpected compression for %s: got %s, want %s", file.Name, got, want)
+		}
+
+		if got, want := probeImage.Chroma, responses.Chroma420; got != want {
+			t.Errorf("unexpected chroma for %s: got %s, want %s", file.Name, got, want)
+		}
+
+		if probeImage.LumaBitDepth != 8 || probeImage.ChromaBitDepth != 8 {
+			t.Errorf("unexpected bit depth for %s: got %d/%d, want 8/8", file.Name, probeImage.LumaBitDepth, probeImage.ChromaBitDepth)
+		}
+
+		if w, h := probeImage.Width, probeImage.Height; w != file.Width || h != file.Height {
+			t.Errorf("unexpected image size for %s: got %dx%d, want %dx%d", file.Name, w, h, file.Width, file.Height)
+		}
+
+		if got, want := probeImage.Thumbnails, file.Thumbnails; got != want {
+			t.Errorf("unexpected thumbnail count for %s: got %d, want %d", file.Name, got, want)
+		}
 	}
 }
 
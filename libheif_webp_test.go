@@ -0,0 +1,138 @@
+//go:build go_libheif_use_libwebp
+
+package libheif
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/klippa-app/go-libheif/library"
+
+	_ "golang.org/x/image/webp"
+)
+
+func init() {
+	workerBuildTags = append(workerBuildTags, "go_libheif_use_libwebp")
+}
+
+func TestRenderWebP(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lossless := range []bool{false, true} {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatWebP,
+			Lossless:     lossless,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := renderedFile.OriginalFormat, "heif"; got != want {
+			t.Errorf("unexpected original format: got %s, want %s", got, want)
+		}
+
+		if got, want := renderedFile.NewFormat, "webp"; got != want {
+			t.Errorf("unexpected new format: got %s, want %s", got, want)
+		}
+
+		if w, h := renderedFile.Width, renderedFile.Height; w != 1596 || h != 1064 {
+			t.Errorf("unexpected rendered image size: got %dx%d, want 1596x1064", w, h)
+		}
+
+		img, dec, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode webp image: %s", err)
+		}
+
+		if got, want := dec, "webp"; got != want {
+			t.Errorf("unexpected decoder: got %s, want %s", got, want)
+		}
+
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 1596 || h != 1064 {
+			t.Errorf("unexpected decoded image size: got %dx%d, want 1596x1064", w, h)
+		}
+	}
+}
+
+func TestRenderWebPAlpha(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/alpha.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lossless := range []bool{false, true} {
+		renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+			OutputFormat: library.RenderFileOutputFormatWebP,
+			Lossless:     lossless,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(*renderedFile.Output))
+		if err != nil {
+			t.Fatalf("unable to decode webp image: %s", err)
+		}
+
+		// The left quarter of the image is transparent, the second quarter
+		// half transparent and the rest opaque.
+		for x, want := range map[int]int{0: 0, 24: 0x8080, 48: 0xffff} {
+			_, _, _, got := img.At(x, 32).RGBA()
+			if diff := int(got) - want; diff < -0x0202 || diff > 0x0202 {
+				t.Errorf("unexpected alpha at x %d: got %#x, want %#x", x, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderWebPTargetSSIM(t *testing.T) {
+	err := initLib()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderedFile, err := library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatWebP,
+		TargetSSIM:   0.9,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renderedFile.SSIM < 0.9 {
+		t.Errorf("rendered webp does not reach the target ssim: got %f, want at least 0.9", renderedFile.SSIM)
+	}
+
+	if renderedFile.Quality < 50 || renderedFile.Quality > 95 {
+		t.Errorf("unexpected quality: got %d, want between 50 and 95", renderedFile.Quality)
+	}
+
+	_, err = library.RenderFile(&b, library.RenderOptions{
+		OutputFormat: library.RenderFileOutputFormatWebP,
+		Lossless:     true,
+		TargetSSIM:   0.9,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a target ssim with lossless webp output")
+	}
+}
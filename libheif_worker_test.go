@@ -0,0 +1,35 @@
+package libheif
+
+import (
+	"strings"
+
+	"github.com/klippa-app/go-libheif/library"
+)
+
+// workerBuildTags are the build tags to run the worker with, the tagged test
+// files add their tag to it, so that the worker is built the same as the tests.
+var workerBuildTags []string
+
+// workerConfig returns the library config that runs the example worker.
+func workerConfig() library.Config {
+	args := []string{"run"}
+	if len(workerBuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(workerBuildTags, ","))
+	}
+	args = append(args, "library/worker_example/main.go")
+
+	return library.Config{
+		Command: library.Command{
+			BinPath: "go",
+			Args:    args,
+		},
+	}
+}
+
+func initLib() error {
+	err := Init(Config{LibraryConfig: workerConfig()})
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package library
+
+import (
+	"image"
+	"io"
+
+	"github.com/klippa-app/go-libheif/library/responses"
+)
+
+// defaultInstance is the instance of the functions of the package, which Init
+// starts and DeInit stops.
+var defaultInstance = &Instance{workers: &supervisor{}}
+
+// Init starts the worker of the default instance, it does nothing when it's
+// running already.
+func Init(config Config) error {
+	return defaultInstance.workers.start(config)
+}
+
+// Close calls Instance.Close on the default instance, Init can start it again
+// afterwards.
+func Close() error {
+	return defaultInstance.Close()
+}
+
+// DeInit is Close without the error.
+func DeInit() {
+	Close()
+}
+
+// RenderFile calls Instance.RenderFile on the default instance.
+func RenderFile(data *[]byte, options RenderOptions) (*responses.RenderFile, error) {
+	return defaultInstance.RenderFile(data, options)
+}
+
+// DecodeImage calls Instance.DecodeImage on the default instance.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	return defaultInstance.DecodeImage(r)
+}
+
+// DecodeImageToProfile calls Instance.DecodeImageToProfile on the default
+// instance.
+func DecodeImageToProfile(r io.Reader, targetICCProfile []byte) (image.Image, error) {
+	return defaultInstance.DecodeImageToProfile(r, targetICCProfile)
+}
+
+// DecodeImageWithOptions calls Instance.DecodeImageWithOptions on the default
+// instance.
+func DecodeImageWithOptions(r io.Reader, options DecodeOptions) (image.Image, error) {
+	return defaultInstance.DecodeImageWithOptions(r, options)
+}
+
+// DecodeConfig calls Instance.DecodeConfig on the default instance.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	return defaultInstance.DecodeConfig(r)
+}
+
+// Probe calls Instance.Probe on the default instance.
+func Probe(data *[]byte) (*responses.Probe, error) {
+	return defaultInstance.Probe(data)
+}
+
+// WorkerInfo calls Instance.WorkerInfo on the default instance.
+func WorkerInfo() (*responses.Handshake, error) {
+	return defaultInstance.WorkerInfo()
+}
+
+// Capabilities calls Instance.Capabilities on the default instance.
+func Capabilities() (*responses.Capabilities, error) {
+	return defaultInstance.Capabilities()
+}
+
+// TransformJPEG calls Instance.TransformJPEG on the default instance.
+func TransformJPEG(data *[]byte, options TransformJPEGOptions) (*responses.TransformJPEG, error) {
+	return defaultInstance.TransformJPEG(data, options)
+}
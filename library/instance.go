@@ -0,0 +1,28 @@
+package library
+
+// Instance runs its own worker with its own config, so that several configs
+// can be used next to each other, like a sandboxed worker for uploads of users
+// and a trusted worker for internal files.
+type Instance struct {
+	workers *supervisor
+}
+
+// New starts a worker with the config and returns the instance that uses it,
+// Close stops the worker.
+func New(config Config) (*Instance, error) {
+	instance := &Instance{workers: &supervisor{}}
+	err := instance.workers.start(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return instance, nil
+}
+
+// Close waits for the requests in flight and stops the worker, requests
+// afterwards fail with NotInitializedError. Closing an instance again does
+// nothing.
+func (i *Instance) Close() error {
+	i.workers.stop()
+	return nil
+}
@@ -0,0 +1,117 @@
+package isobmff
+
+import "errors"
+
+var ErrItemNotFound = errors.New("item not found")
+
+// ReadItemData reads the data of an item of the top level meta box in data,
+// by concatenating its extents from the file or from the idat box. This is
+// meant for small items like metadata, image items are decoded by libheif.
+func ReadItemData(data []byte, id uint32) ([]byte, error) {
+	metaBoxes, err := readMetaBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ilocBox := FindBox(metaBoxes, "iloc")
+	if ilocBox == nil {
+		return nil, ErrItemNotFound
+	}
+
+	var idat []byte
+	if idatBox := FindBox(metaBoxes, "idat"); idatBox != nil {
+		idat = idatBox.Payload
+	}
+
+	version, _, rest, err := ReadFullBoxHeader(ilocBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &fieldReader{data: rest}
+	sizes := r.uint(2)
+	offsetSize, lengthSize := int(sizes>>12), int(sizes>>8&0xf)
+	baseOffsetSize, indexSize := int(sizes>>4&0xf), int(sizes&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+
+	count := r.uint(idSize)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		itemID := r.uint(idSize)
+		constructionMethod := uint64(0)
+		if version != 0 {
+			constructionMethod = r.uint(2) & 0xf
+		}
+		r.uint(2) // The data reference index, only the file itself is supported.
+		baseOffset := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+
+		var itemData []byte
+		for j := uint64(0); j < extentCount && r.err == nil; j++ {
+			r.uint(indexSize)
+			offset := baseOffset + r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			if uint32(itemID) != id {
+				continue
+			}
+
+			source := data
+			switch constructionMethod {
+			case 0:
+			case 1:
+				source = idat
+			default:
+				return nil, errors.New("unsupported item construction method")
+			}
+
+			if length == 0 && offset <= uint64(len(source)) {
+				// The extent runs to the end of the source.
+				length = uint64(len(source)) - offset
+			}
+			if offset > uint64(len(source)) || length > uint64(len(source))-offset {
+				return nil, ErrInvalidBox
+			}
+			itemData = append(itemData, source[offset:offset+length]...)
+		}
+
+		if uint32(itemID) == id && r.err == nil {
+			return itemData, nil
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, ErrItemNotFound
+}
+
+// fieldReader reads big endian unsigned integers of 0 to 8 bytes, it keeps
+// the first error so that it only has to be checked once.
+type fieldReader struct {
+	data []byte
+	err  error
+}
+
+func (r *fieldReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	if size > 8 || len(r.data) < size {
+		r.err = ErrInvalidBox
+		return 0
+	}
+
+	var value uint64
+	for _, b := range r.data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return value
+}
@@ -0,0 +1,94 @@
+// Package isobmff contains a minimal reader for the ISO Base Media File Format
+// boxes that HEIF and AVIF files are built from. It only reads what libheif does
+// not expose through its public API, it's not a full box parser.
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidBox = errors.New("invalid box")
+
+type Box struct {
+	Type    string // The four character code of the box.
+	Payload []byte // The contents of the box, without the box header.
+}
+
+// ReadBoxes reads all the boxes in data. It returns an error when a box
+// header is invalid or when a box runs past the end of data.
+func ReadBoxes(data []byte) ([]Box, error) {
+	boxes := []Box{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrInvalidBox
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, ErrInvalidBox
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		} else if size == 0 {
+			// The box extends to the end of the file.
+			size = uint64(len(data))
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, ErrInvalidBox
+		}
+
+		boxes = append(boxes, Box{
+			Type:    boxType,
+			Payload: data[headerSize:size],
+		})
+
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+// FindBox returns the first box of the given type, or nil when there is none.
+func FindBox(boxes []Box, boxType string) *Box {
+	for i := range boxes {
+		if boxes[i].Type == boxType {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// ReadFullBoxHeader splits the version and flags of a full box from its payload.
+func ReadFullBoxHeader(payload []byte) (version uint8, flags uint32, rest []byte, err error) {
+	if len(payload) < 4 {
+		return 0, 0, nil, ErrInvalidBox
+	}
+	return payload[0], binary.BigEndian.Uint32(payload[0:4]) & 0xffffff, payload[4:], nil
+}
+
+// readMetaBoxes reads the boxes in the top level meta box in data, it returns
+// nil when there is no meta box.
+func readMetaBoxes(data []byte) ([]Box, error) {
+	boxes, err := ReadBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	metaBox := FindBox(boxes, "meta")
+	if metaBox == nil {
+		return nil, nil
+	}
+
+	_, _, metaPayload, err := ReadFullBoxHeader(metaBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadBoxes(metaPayload)
+}
@@ -0,0 +1,137 @@
+package isobmff
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReadBoxes(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := ReadBoxes(b)
+	if err != nil {
+		t.Fatalf("ReadBoxes resulted in error: %s", err.Error())
+	}
+
+	types := []string{}
+	for _, box := range boxes {
+		types = append(types, box.Type)
+	}
+
+	if got, want := len(types), 5; got != want {
+		t.Fatalf("ReadBoxes resulted in wrong box count, got %d (%v), want %d", got, types, want)
+	}
+
+	if types[0] != "ftyp" || types[1] != "meta" {
+		t.Fatalf("ReadBoxes resulted in wrong boxes, got %v, want ftyp and meta first", types)
+	}
+
+	if _, err := ReadBoxes(b[:len(b)-1]); err != ErrInvalidBox {
+		t.Fatalf("ReadBoxes on truncated data resulted in wrong error, got %v, want %v", err, ErrInvalidBox)
+	}
+}
+
+func TestReadItems(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ReadItems(b)
+	if err != nil {
+		t.Fatalf("ReadItems resulted in error: %s", err.Error())
+	}
+
+	if got, want := len(items), 2; got != want {
+		t.Fatalf("ReadItems resulted in wrong item count, got %d, want %d", got, want)
+	}
+
+	primary := FindItem(items, 20002)
+	if primary == nil {
+		t.Fatalf("ReadItems did not return the primary item")
+	}
+
+	if got, want := primary.Type, "hvc1"; got != want {
+		t.Errorf("ReadItems resulted in wrong item type, got %s, want %s", got, want)
+	}
+
+	if primary.Property("hvcC") == nil || primary.Property("ispe") == nil {
+		t.Errorf("ReadItems did not associate the hvcC and ispe properties")
+	}
+
+	thumbnail := FindItem(items, 20003)
+	if thumbnail == nil {
+		t.Fatalf("ReadItems did not return the thumbnail item")
+	}
+
+	if got := thumbnail.References["thmb"]; len(got) != 1 || got[0] != 20002 {
+		t.Errorf("ReadItems resulted in wrong thumbnail reference, got %v, want [20002]", got)
+	}
+}
+
+func TestReadItemData(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/camel.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadItemData(b, 20002)
+	if err != nil {
+		t.Fatalf("ReadItemData resulted in error: %s", err.Error())
+	}
+
+	// The HEVC data starts with the length of the first NAL unit.
+	if len(data) < 4 || int(data[0])<<24|int(data[1])<<16|int(data[2])<<8|int(data[3]) > len(data)-4 {
+		t.Errorf("ReadItemData resulted in invalid HEVC data of %d bytes", len(data))
+	}
+
+	if _, err := ReadItemData(b, 1); err != ErrItemNotFound {
+		t.Errorf("ReadItemData of an unknown item resulted in wrong error, got %v, want %v", err, ErrItemNotFound)
+	}
+}
+
+func TestSetPrimaryItem(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/gainmap_iso.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := SetPrimaryItem(b, 3)
+	if err != nil {
+		t.Fatalf("SetPrimaryItem resulted in error: %s", err.Error())
+	}
+
+	items, err := ReadItems(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item := FindItem(items, 3); item == nil || item.Hidden {
+		t.Errorf("SetPrimaryItem did not unhide the item")
+	}
+
+	metaBoxes, err := readMetaBoxes(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pitm := FindBox(metaBoxes, "pitm"); pitm == nil || !bytes.Equal(pitm.Payload, []byte{0, 0, 0, 0, 0, 3}) {
+		t.Errorf("SetPrimaryItem did not change the primary item")
+	}
+
+	// The original data is not changed.
+	items, err = ReadItems(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := FindItem(items, 3); item == nil || !item.Hidden {
+		t.Errorf("SetPrimaryItem changed the original data")
+	}
+
+	if _, err := SetPrimaryItem(b, 42); err != ErrItemNotFound {
+		t.Errorf("SetPrimaryItem of an unknown item resulted in wrong error, got %v, want %v", err, ErrItemNotFound)
+	}
+}
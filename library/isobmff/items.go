@@ -0,0 +1,260 @@
+package isobmff
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+type Item struct {
+	ID         uint32
+	Type       string              // The item type, like hvc1, av01, jpeg, unci or grid.
+	Hidden     bool                // Whether the item is marked as hidden.
+	References map[string][]uint32 // The items this item references, by reference type (dimg, thmb, auxl, cdsc).
+	Properties []Box               // The properties that are associated with this item.
+}
+
+// ReadItems reads the items of the top level meta box in data.
+func ReadItems(data []byte) ([]Item, error) {
+	metaBoxes, err := readMetaBoxes(data)
+	if err != nil || metaBoxes == nil {
+		return nil, err
+	}
+
+	items := []Item{}
+	if iinfBox := FindBox(metaBoxes, "iinf"); iinfBox != nil {
+		items, err = readItemInfo(iinfBox.Payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	itemIndex := map[uint32]int{}
+	for i := range items {
+		itemIndex[items[i].ID] = i
+	}
+
+	if irefBox := FindBox(metaBoxes, "iref"); irefBox != nil {
+		if err := readItemReferences(irefBox.Payload, items, itemIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	if iprpBox := FindBox(metaBoxes, "iprp"); iprpBox != nil {
+		if err := readItemProperties(iprpBox.Payload, items, itemIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+func readItemInfo(payload []byte) ([]Item, error) {
+	version, _, rest, err := ReadFullBoxHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		if len(rest) < 2 {
+			return nil, ErrInvalidBox
+		}
+		rest = rest[2:]
+	} else {
+		if len(rest) < 4 {
+			return nil, ErrInvalidBox
+		}
+		rest = rest[4:]
+	}
+
+	infeBoxes, err := ReadBoxes(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Item{}
+	for _, infeBox := range infeBoxes {
+		if infeBox.Type != "infe" {
+			continue
+		}
+
+		version, flags, rest, err := ReadFullBoxHeader(infeBox.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		// Version 0 and 1 are only used for files (MPEG-21), not for images.
+		if version < 2 {
+			continue
+		}
+
+		item := Item{
+			Hidden:     flags&1 == 1,
+			References: map[string][]uint32{},
+		}
+
+		if version == 2 {
+			if len(rest) < 8 {
+				return nil, ErrInvalidBox
+			}
+			item.ID = uint32(binary.BigEndian.Uint16(rest[0:2]))
+			item.Type = string(rest[4:8])
+		} else {
+			if len(rest) < 10 {
+				return nil, ErrInvalidBox
+			}
+			item.ID = binary.BigEndian.Uint32(rest[0:4])
+			item.Type = string(rest[6:10])
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func readItemReferences(payload []byte, items []Item, itemIndex map[uint32]int) error {
+	version, _, rest, err := ReadFullBoxHeader(payload)
+	if err != nil {
+		return err
+	}
+
+	idSize := 2
+	if version != 0 {
+		idSize = 4
+	}
+
+	readID := func(b []byte) uint32 {
+		if idSize == 2 {
+			return uint32(binary.BigEndian.Uint16(b))
+		}
+		return binary.BigEndian.Uint32(b)
+	}
+
+	referenceBoxes, err := ReadBoxes(rest)
+	if err != nil {
+		return err
+	}
+
+	for _, referenceBox := range referenceBoxes {
+		data := referenceBox.Payload
+		if len(data) < idSize+2 {
+			return ErrInvalidBox
+		}
+
+		fromID := readID(data)
+		count := int(binary.BigEndian.Uint16(data[idSize:]))
+		data = data[idSize+2:]
+		if len(data) < count*idSize {
+			return ErrInvalidBox
+		}
+
+		index, ok := itemIndex[fromID]
+		if !ok {
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			items[index].References[referenceBox.Type] = append(items[index].References[referenceBox.Type], readID(data[i*idSize:]))
+		}
+	}
+
+	return nil
+}
+
+func readItemProperties(payload []byte, items []Item, itemIndex map[uint32]int) error {
+	boxes, err := ReadBoxes(payload)
+	if err != nil {
+		return err
+	}
+
+	ipcoBox := FindBox(boxes, "ipco")
+	if ipcoBox == nil {
+		return nil
+	}
+
+	properties, err := ReadBoxes(ipcoBox.Payload)
+	if err != nil {
+		return err
+	}
+
+	for _, ipmaBox := range boxes {
+		if ipmaBox.Type != "ipma" {
+			continue
+		}
+
+		version, flags, rest, err := ReadFullBoxHeader(ipmaBox.Payload)
+		if err != nil {
+			return err
+		}
+
+		reader := bytes.NewReader(rest)
+		var entryCount uint32
+		if err := binary.Read(reader, binary.BigEndian, &entryCount); err != nil {
+			return ErrInvalidBox
+		}
+
+		for i := uint32(0); i < entryCount; i++ {
+			var itemID uint32
+			if version < 1 {
+				var id uint16
+				if err := binary.Read(reader, binary.BigEndian, &id); err != nil {
+					return ErrInvalidBox
+				}
+				itemID = uint32(id)
+			} else {
+				if err := binary.Read(reader, binary.BigEndian, &itemID); err != nil {
+					return ErrInvalidBox
+				}
+			}
+
+			associationCount, err := reader.ReadByte()
+			if err != nil {
+				return ErrInvalidBox
+			}
+
+			for j := 0; j < int(associationCount); j++ {
+				var propertyIndex int
+				if flags&1 == 1 {
+					var value uint16
+					if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
+						return ErrInvalidBox
+					}
+					propertyIndex = int(value & 0x7fff)
+				} else {
+					value, err := reader.ReadByte()
+					if err != nil {
+						return ErrInvalidBox
+					}
+					propertyIndex = int(value & 0x7f)
+				}
+
+				// Index 0 means no property, the rest is 1-based.
+				if propertyIndex == 0 || propertyIndex > len(properties) {
+					continue
+				}
+
+				if index, ok := itemIndex[itemID]; ok {
+					items[index].Properties = append(items[index].Properties, properties[propertyIndex-1])
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindItem returns the item with the given ID, or nil when there is none.
+func FindItem(items []Item, id uint32) *Item {
+	for i := range items {
+		if items[i].ID == id {
+			return &items[i]
+		}
+	}
+	return nil
+}
+
+// Property returns the first property of the given type of the item, or nil
+// when the item has no such property.
+func (i *Item) Property(propertyType string) *Box {
+	return FindBox(i.Properties, propertyType)
+}
@@ -0,0 +1,82 @@
+package isobmff
+
+import "encoding/binary"
+
+// SetPrimaryItem returns a copy of data in which the item is the primary item
+// and is not hidden. Older libheif versions only open top level images, this
+// makes hidden images like gain maps available to them.
+func SetPrimaryItem(data []byte, id uint32) ([]byte, error) {
+	// The boxes are slices of the copy, so they are changed in place.
+	data = append([]byte{}, data...)
+	metaBoxes, err := readMetaBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pitmBox := FindBox(metaBoxes, "pitm")
+	if pitmBox == nil {
+		return nil, ErrItemNotFound
+	}
+
+	version, _, rest, err := ReadFullBoxHeader(pitmBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		if len(rest) < 2 || id > 0xffff {
+			return nil, ErrInvalidBox
+		}
+		binary.BigEndian.PutUint16(rest, uint16(id))
+	} else {
+		if len(rest) < 4 {
+			return nil, ErrInvalidBox
+		}
+		binary.BigEndian.PutUint32(rest, id)
+	}
+
+	iinfBox := FindBox(metaBoxes, "iinf")
+	if iinfBox == nil {
+		return nil, ErrItemNotFound
+	}
+
+	version, _, rest, err = ReadFullBoxHeader(iinfBox.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	entryCountSize := 2
+	if version != 0 {
+		entryCountSize = 4
+	}
+	if len(rest) < entryCountSize {
+		return nil, ErrInvalidBox
+	}
+
+	infeBoxes, err := ReadBoxes(rest[entryCountSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, infeBox := range infeBoxes {
+		version, _, rest, err := ReadFullBoxHeader(infeBox.Payload)
+		if err != nil || infeBox.Type != "infe" || version < 2 {
+			continue
+		}
+
+		itemID := uint32(0)
+		if version == 2 && len(rest) >= 2 {
+			itemID = uint32(binary.BigEndian.Uint16(rest))
+		} else if version > 2 && len(rest) >= 4 {
+			itemID = binary.BigEndian.Uint32(rest)
+		}
+
+		if itemID == id {
+			// The hidden flag is the lowest bit of the flags.
+			infeBox.Payload[3] &^= 1
+			return data, nil
+		}
+	}
+
+	return nil, ErrItemNotFound
+}
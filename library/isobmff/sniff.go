@@ -0,0 +1,157 @@
+package isobmff
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+type FileType int // Whether data is a file that libheif can handle, mirrors heif_filetype_result.
+
+const (
+	FileTypeNo             FileType = iota // Not an ISOBMFF file.
+	FileTypeYesSupported                   // A HEIF file that libheif can handle.
+	FileTypeYesUnsupported                 // An ISOBMFF file, but not a HEIF image libheif can handle.
+	FileTypeMaybe                          // Not enough data, or only generic brands, to tell.
+)
+
+type SniffResult struct {
+	FileType         FileType
+	MajorBrand       string
+	MinorVersion     uint32
+	CompatibleBrands []string
+	MIMEType         string // The MIME type, like image/heic or image/avif, empty when unknown.
+	Format           string // The name of the format in the image package, heif or avif, empty when unknown.
+}
+
+type brandInfo struct {
+	mimeType  string
+	format    string
+	supported bool // Whether libheif can decode files with this brand.
+	sequence  bool // Whether the brand is for image sequences.
+	generic   bool // Whether the brand says nothing about the codec.
+}
+
+var brands = map[string]brandInfo{
+	"heic": {mimeType: "image/heic", format: "heif", supported: true},
+	"heix": {mimeType: "image/heic", format: "heif", supported: true},
+	"heim": {mimeType: "image/heic", format: "heif"},
+	"heis": {mimeType: "image/heic", format: "heif"},
+	"hevc": {mimeType: "image/heic-sequence", format: "heif", sequence: true},
+	"hevx": {mimeType: "image/heic-sequence", format: "heif", sequence: true},
+	"hevm": {mimeType: "image/heic-sequence", format: "heif", sequence: true},
+	"hevs": {mimeType: "image/heic-sequence", format: "heif", sequence: true},
+	"avif": {mimeType: "image/avif", format: "avif", supported: true},
+	"avio": {mimeType: "image/avif", format: "avif", supported: true},
+	"avis": {mimeType: "image/avif-sequence", format: "avif", sequence: true},
+	"jpeg": {mimeType: "image/heif", format: "heif", supported: true},
+	"jpgs": {mimeType: "image/heif-sequence", format: "heif", sequence: true},
+	"j2ki": {mimeType: "image/hej2k", format: "heif", supported: true},
+	"j2is": {mimeType: "image/j2is", format: "heif", sequence: true},
+	"mif1": {mimeType: "image/heif", format: "heif", generic: true},
+	"mif2": {mimeType: "image/heif", format: "heif", generic: true},
+	"miaf": {mimeType: "image/heif", format: "heif", generic: true},
+	"unif": {mimeType: "image/heif", format: "heif", generic: true},
+	"msf1": {mimeType: "image/heif-sequence", format: "heif", sequence: true, generic: true},
+}
+
+type ImageBrand struct {
+	Brand  string // The major brand.
+	Format string // The name of the format in the image package.
+}
+
+// ImageBrands returns the major brands that are known to be HEIF images, in
+// a stable order, to register them in the image package.
+func ImageBrands() []ImageBrand {
+	imageBrands := make([]ImageBrand, 0, len(brands))
+	for brand, info := range brands {
+		imageBrands = append(imageBrands, ImageBrand{Brand: brand, Format: info.format})
+	}
+	sort.Slice(imageBrands, func(i, j int) bool {
+		return imageBrands[i].Brand < imageBrands[j].Brand
+	})
+	return imageBrands
+}
+
+// Sniff reads the ftyp box at the start of data, including the compatible
+// brands, and tells whether it's a HEIF file that libheif can handle. Only the
+// start of the file is needed, a truncated ftyp box is read as far as possible.
+//
+// This mirrors heif_check_filetype and heif_get_file_mime_type, but also looks
+// at the compatible brands, so that files with a generic major brand, like
+// mif1 or msf1, are recognized by the codec specific brands.
+func Sniff(data []byte) SniffResult {
+	result := SniffResult{}
+	if len(data) < 8 {
+		result.FileType = FileTypeMaybe
+		return result
+	}
+
+	if string(data[4:8]) != "ftyp" {
+		result.FileType = FileTypeNo
+		return result
+	}
+
+	if len(data) < 12 {
+		result.FileType = FileTypeMaybe
+		return result
+	}
+
+	boxSize := int(binary.BigEndian.Uint32(data[0:4]))
+	if boxSize > len(data) || boxSize < 8 {
+		boxSize = len(data)
+	}
+
+	result.MajorBrand = string(data[8:12])
+	if boxSize >= 16 {
+		result.MinorVersion = binary.BigEndian.Uint32(data[12:16])
+		for offset := 16; offset+4 <= boxSize; offset += 4 {
+			result.CompatibleBrands = append(result.CompatibleBrands, string(data[offset:offset+4]))
+		}
+	}
+
+	allBrands := append([]string{result.MajorBrand}, result.CompatibleBrands...)
+
+	result.FileType = FileTypeYesUnsupported
+	for _, brand := range allBrands {
+		info, ok := brands[brand]
+		if !ok {
+			continue
+		}
+		if info.supported {
+			result.FileType = FileTypeYesSupported
+			break
+		}
+		if info.generic {
+			result.FileType = FileTypeMaybe
+		}
+	}
+
+	info, ok := brands[result.MajorBrand]
+	switch {
+	case ok && !info.generic:
+		// The major brand is specific enough.
+	case ok && info.sequence:
+		info = findBrand(allBrands, info, func(candidate brandInfo) bool { return candidate.sequence && !candidate.generic })
+	case ok:
+		info = findBrand(allBrands, info, func(candidate brandInfo) bool { return !candidate.sequence && !candidate.generic })
+	default:
+		info = findBrand(allBrands, info, func(candidate brandInfo) bool { return !candidate.generic })
+		if info.mimeType == "" {
+			info = findBrand(allBrands, info, func(candidate brandInfo) bool { return true })
+		}
+	}
+
+	result.MIMEType = info.mimeType
+	result.Format = info.format
+
+	return result
+}
+
+func findBrand(allBrands []string, fallback brandInfo, match func(brandInfo) bool) brandInfo {
+	for _, brand := range allBrands {
+		if info, ok := brands[brand]; ok && match(info) {
+			return info
+		}
+	}
+	return fallback
+}
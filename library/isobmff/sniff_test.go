@@ -0,0 +1,132 @@
+package isobmff
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func makeFileTypeBox(majorBrand string, compatibleBrands ...string) []byte {
+	box := make([]byte, 16, 16+4*len(compatibleBrands))
+	binary.BigEndian.PutUint32(box[0:4], uint32(16+4*len(compatibleBrands)))
+	copy(box[4:8], "ftyp")
+	copy(box[8:12], majorBrand)
+	for _, brand := range compatibleBrands {
+		box = append(box, brand...)
+	}
+	return box
+}
+
+func TestSniff(t *testing.T) {
+	type testCase struct {
+		Name     string
+		Data     []byte
+		FileType FileType
+		MIMEType string
+		Format   string
+	}
+	testCases := []testCase{
+		{
+			Name:     "too short",
+			Data:     []byte{0, 0, 0},
+			FileType: FileTypeMaybe,
+		},
+		{
+			Name:     "not isobmff",
+			Data:     []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01},
+			FileType: FileTypeNo,
+		},
+		{
+			Name:     "heic",
+			Data:     makeFileTypeBox("heic", "mif1", "heic"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/heic",
+			Format:   "heif",
+		},
+		{
+			Name:     "mif1 with avif as compatible brand",
+			Data:     makeFileTypeBox("mif1", "mif1", "avif", "miaf"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/avif",
+			Format:   "avif",
+		},
+		{
+			Name:     "mif1 only",
+			Data:     makeFileTypeBox("mif1", "mif1"),
+			FileType: FileTypeMaybe,
+			MIMEType: "image/heif",
+			Format:   "heif",
+		},
+		{
+			Name:     "msf1 with avis as compatible brand",
+			Data:     makeFileTypeBox("msf1", "msf1", "avis", "avif"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/avif-sequence",
+			Format:   "avif",
+		},
+		{
+			Name:     "avio",
+			Data:     makeFileTypeBox("avio", "avio", "avif", "mif1"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/avif",
+			Format:   "avif",
+		},
+		{
+			Name:     "jpeg",
+			Data:     makeFileTypeBox("jpeg", "jpeg", "mif1"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/heif",
+			Format:   "heif",
+		},
+		{
+			Name:     "unknown major brand",
+			Data:     makeFileTypeBox("iso8", "iso8", "mif1", "heic"),
+			FileType: FileTypeYesSupported,
+			MIMEType: "image/heic",
+			Format:   "heif",
+		},
+		{
+			Name:     "mp4",
+			Data:     makeFileTypeBox("isom", "isom", "iso2", "avc1", "mp41"),
+			FileType: FileTypeYesUnsupported,
+		},
+		{
+			Name:     "truncated compatible brands",
+			Data:     makeFileTypeBox("mif1", "mif1", "heic")[:22],
+			FileType: FileTypeMaybe,
+			MIMEType: "image/heif",
+			Format:   "heif",
+		},
+	}
+
+	for _, testCase := range testCases {
+		result := Sniff(testCase.Data)
+		if got, want := result.FileType, testCase.FileType; got != want {
+			t.Errorf("Sniff resulted in wrong file type for %s, got %d, want %d", testCase.Name, got, want)
+		}
+		if got, want := result.MIMEType, testCase.MIMEType; got != want {
+			t.Errorf("Sniff resulted in wrong MIME type for %s, got %s, want %s", testCase.Name, got, want)
+		}
+		if got, want := result.Format, testCase.Format; got != want {
+			t.Errorf("Sniff resulted in wrong format for %s, got %s, want %s", testCase.Name, got, want)
+		}
+	}
+}
+
+func TestSniffFiles(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/receipt.avif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := Sniff(b)
+	if got, want := result.MajorBrand, "avif"; got != want {
+		t.Errorf("Sniff resulted in wrong major brand, got %s, want %s", got, want)
+	}
+	if got, want := len(result.CompatibleBrands), 3; got != want {
+		t.Errorf("Sniff resulted in wrong compatible brand count, got %d, want %d", got, want)
+	}
+	if got, want := result.MIMEType, "image/avif"; got != want {
+		t.Errorf("Sniff resulted in wrong MIME type, got %s, want %s", got, want)
+	}
+}
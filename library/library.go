@@ -1,25 +1,68 @@
 package library
 
 import (
-	"encoding/gob"
 	"errors"
 	"github.com/klippa-app/go-libheif/library/responses"
 	"image"
+	"image/color"
 	"io"
-	"log"
-	"os"
-	"os/exec"
 	"time"
 
 	"github.com/klippa-app/go-libheif/library/requests"
 	"github.com/klippa-app/go-libheif/library/shared"
-
-	"github.com/hashicorp/go-hclog"
-	"github.com/hashicorp/go-plugin"
 )
 
 type Config struct {
 	Command Command
+
+	// RequiredFeatures are the features that the worker must have, like
+	// responses.FeatureWebP, Init fails with IncompatibleWorkerError when the
+	// worker doesn't report them in its handshake.
+	RequiredFeatures []responses.Feature
+
+	// Recycle restarts the worker after it handled a number of requests, grew
+	// too much in memory or ran for too long, to free memory that libheif or
+	// the codecs leaked.
+	Recycle Recycle
+
+	// Retry retries the requests of which the worker crashed, and quarantines
+	// the inputs that crash the worker repeatedly.
+	Retry Retry
+}
+
+type Recycle struct {
+	// MaxRequests is the number of requests after which the worker is
+	// restarted, 0 for no limit.
+	MaxRequests int64
+
+	// MaxRSS is the resident memory of the worker in bytes after a request
+	// above which the worker is restarted, 0 for no limit. The memory is only
+	// known on Linux.
+	MaxRSS uint64
+
+	// MaxAge is the time after which the worker is restarted, 0 for no limit.
+	MaxAge time.Duration
+}
+
+type Retry struct {
+	// MaxAttempts is the number of attempts of a request when the worker
+	// crashes, 0 or 1 to not retry. Requests are only retried when the worker
+	// crashed, not when it returned an error like for invalid input.
+	MaxAttempts int
+
+	// Backoff is the time to wait before the first retry, it's doubled for
+	// every next retry.
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum time to wait before a retry, 0 for no maximum.
+	MaxBackoff time.Duration
+
+	// QuarantineAfter is the number of crashes of the worker on the same input
+	// after which requests with that input fail with QuarantinedError without
+	// being sent to the worker, 0 to not quarantine inputs. Only crashes while
+	// the request was the only one in flight count, a request that crashed
+	// with others in flight is retried alone.
+	QuarantineAfter int
 }
 
 type Command struct {
@@ -31,190 +74,355 @@ type Command struct {
 	StartTimeout time.Duration
 }
 
-var client *plugin.Client
-var gRPCClient plugin.ClientProtocol
-var libheifplugin shared.Libheif
-var currentConfig Config
+var NotInitializedError = errors.New("libheif was not initialized, you must call the Init() method")
+var IncompatibleWorkerError = errors.New("the libheif worker is incompatible with the library")
 
-func init() {
-	// Needed to serialize the image interface.
-	gob.Register(&image.YCbCr{})
-	gob.Register(&image.RGBA64{})
-	gob.Register(&image.RGBA{})
-	gob.Register(&image.Gray{})
-}
+type RenderFileOutputFormat string // The file format to render output as.
 
-func Init(config Config) error {
-	if client != nil {
-		return nil
-	}
+const (
+	RenderFileOutputFormatJPG  RenderFileOutputFormat = "jpg"  // Render the file as a JPEG file.
+	RenderFileOutputFormatPNG  RenderFileOutputFormat = "png"  // Render the file as a PNG file.
+	RenderFileOutputFormatWebP RenderFileOutputFormat = "webp" // Render the file as a WebP file, only available when the worker has been built with build tag go_libheif_use_libwebp.
+	RenderFileOutputFormatTIFF RenderFileOutputFormat = "tiff" // Render the file as a TIFF file, lossless, with the ICC profile and EXIF data of the image.
+	RenderFileOutputFormatPDF  RenderFileOutputFormat = "pdf"  // Render the file as a PDF file, with the image on a page.
+)
 
-	currentConfig = config
+type RenderFileTIFFCompression string // The compression of a TIFF file.
 
-	return startPlugin()
-}
+const (
+	RenderFileTIFFCompressionNone    RenderFileTIFFCompression = "none"    // No compression.
+	RenderFileTIFFCompressionLZW     RenderFileTIFFCompression = "lzw"     // LZW compression.
+	RenderFileTIFFCompressionDeflate RenderFileTIFFCompression = "deflate" // Deflate (zlib) compression.
+)
 
-func DeInit() {
-	client.Kill()
-	client = nil
-	gRPCClient.Close()
-	gRPCClient = nil
-	libheifplugin = nil
-}
+type RenderFilePNGCompressionLevel string // The compression level of a PNG file.
 
-func startPlugin() error {
-	var handshakeConfig = plugin.HandshakeConfig{
-		ProtocolVersion:  1,
-		MagicCookieKey:   "BASIC_PLUGIN",
-		MagicCookieValue: "libheif",
-	}
+const (
+	RenderFilePNGCompressionLevelDefault RenderFilePNGCompressionLevel = ""     // The default compression level.
+	RenderFilePNGCompressionLevelNone    RenderFilePNGCompressionLevel = "none" // No compression.
+	RenderFilePNGCompressionLevelFast    RenderFilePNGCompressionLevel = "fast" // Fast compression, larger files.
+	RenderFilePNGCompressionLevelBest    RenderFilePNGCompressionLevel = "best" // The best compression, slower.
+)
 
-	// pluginMap is the map of plugins we can dispense.
-	var pluginMap = map[string]plugin.Plugin{
-		"libheif": &shared.LibheifPlugin{},
-	}
+type RenderFileToneMapping string // The tone mapping curve to convert HDR images to SDR.
 
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name:   "plugin",
-		Output: os.Stdout,
-		Level:  hclog.Debug,
-	})
+const (
+	RenderFileToneMappingNone     RenderFileToneMapping = ""         // Do not tone map, HDR images keep their PQ or HLG encoded values.
+	RenderFileToneMappingReinhard RenderFileToneMapping = "reinhard" // Extended Reinhard, which maps the peak of the image to the target peak.
+	RenderFileToneMappingHable    RenderFileToneMapping = "hable"    // The filmic curve of John Hable, with more contrast in the shadows.
+	RenderFileToneMappingBT2390   RenderFileToneMapping = "bt2390"   // The EETF of ITU-R BT.2390, which keeps the luminance below the knee and rolls off above it.
+)
 
-	client = plugin.NewClient(&plugin.ClientConfig{
-		HandshakeConfig: handshakeConfig,
-		Plugins:         pluginMap,
-		Cmd:             exec.Command(currentConfig.Command.BinPath, currentConfig.Command.Args...),
-		Logger:          logger,
-		StartTimeout:    currentConfig.Command.StartTimeout,
-	})
+type RenderFileGainMap string // What to do with the HDR gain map of an image.
 
-	rpcClient, err := client.Client()
-	if err != nil {
-		return err
-	}
+const (
+	RenderFileGainMapIgnore   RenderFileGainMap = ""         // Render the SDR image and drop the gain map.
+	RenderFileGainMapApply    RenderFileGainMap = "apply"    // Apply the gain map to render the HDR image, as a 16 bit PNG with the PQ transfer and a cICP chunk. SDR white is at 203 cd/m².
+	RenderFileGainMapUltraHDR RenderFileGainMap = "ultrahdr" // Render the SDR image as an UltraHDR JPEG, with the gain map embedded as a secondary image, so that HDR displays can show the HDR image.
+)
 
-	gRPCClient = rpcClient
+type RenderFileJPEGSubsampling string // The chroma subsampling of a JPEG file.
 
-	raw, err := rpcClient.Dispense("libheif")
-	if err != nil {
-		return err
-	}
+const (
+	RenderFileJPEGSubsampling444  RenderFileJPEGSubsampling = "444"  // No chroma subsampling.
+	RenderFileJPEGSubsampling422  RenderFileJPEGSubsampling = "422"  // Half horizontal chroma resolution.
+	RenderFileJPEGSubsampling420  RenderFileJPEGSubsampling = "420"  // Half horizontal and vertical chroma resolution.
+	RenderFileJPEGSubsamplingGray RenderFileJPEGSubsampling = "gray" // No chroma, a grayscale image.
+)
 
-	pluginInstance := raw.(shared.Libheif)
-	pong, err := pluginInstance.Ping()
-	if err != nil {
-		return err
-	}
+type RenderFilePDFCompression string // The compression of the images in a PDF file.
 
-	if pong != "Pong" {
-		return errors.New("Wrong ping/pong result")
-	}
+const (
+	RenderFilePDFCompressionJPEG     RenderFilePDFCompression = "jpeg"     // JPEG compression.
+	RenderFilePDFCompressionLossless RenderFilePDFCompression = "lossless" // Lossless Flate compression.
+)
 
-	libheifplugin = pluginInstance
+type RenderFilePDFPageSize string // The page size of a PDF file.
 
-	return nil
+const (
+	RenderFilePDFPageSizeImage  RenderFilePDFPageSize = ""       // Every page gets the size of its image at the resolution of the image.
+	RenderFilePDFPageSizeA3     RenderFilePDFPageSize = "a3"     // A3, the image is scaled to fit.
+	RenderFilePDFPageSizeA4     RenderFilePDFPageSize = "a4"     // A4, the image is scaled to fit.
+	RenderFilePDFPageSizeA5     RenderFilePDFPageSize = "a5"     // A5, the image is scaled to fit.
+	RenderFilePDFPageSizeLetter RenderFilePDFPageSize = "letter" // US Letter, the image is scaled to fit.
+	RenderFilePDFPageSizeLegal  RenderFilePDFPageSize = "legal"  // US Legal, the image is scaled to fit.
+)
+
+type RenderOptions struct {
+	OutputFormat         RenderFileOutputFormat        // The format to output the image as
+	MaxFileSize          int64                         // The maximum filesize, if jpg, lossy webp or pdf with JPEG compression is chosen as output format, it will search for the highest quality that fits, down to MinOutputQuality. If png is chosen, it will try the best compression, 8 bits per channel and a palette of 256 colors, in that order. When it doesn't fit it will return an error, unless DownscaleToFit is set.
+	OutputQuality        int                           // Only used when OutputFormat RenderFileOutputFormatJPG, RenderFileOutputFormatWebP or RenderFileOutputFormatPDF with JPEG compression. Ranges from 1 to 100 inclusive, higher is better. The default is 95. For lossless webp this is the compression effort, with a default of 75.
+	Progressive          bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Will render a progressive jpeg.
+	Lossless             bool                          // Only used when OutputFormat RenderFileOutputFormatWebP. Will render a lossless webp.
+	TIFFCompression      RenderFileTIFFCompression     // Only used when OutputFormat RenderFileOutputFormatTIFF. The default is RenderFileTIFFCompressionLZW.
+	PDFCompression       RenderFilePDFCompression      // Only used when OutputFormat RenderFileOutputFormatPDF. The default is RenderFilePDFCompressionJPEG.
+	PDFPageSize          RenderFilePDFPageSize         // Only used when OutputFormat RenderFileOutputFormatPDF. The default is RenderFilePDFPageSizeImage.
+	PDFDPI               float64                       // Only used when OutputFormat RenderFileOutputFormatPDF and PDFPageSize RenderFilePDFPageSizeImage. The resolution of the images, the default is the resolution in the EXIF data of the image, or 72.
+	AllImages            bool                          // Only used when OutputFormat RenderFileOutputFormatPDF. Render every top level image of the file on its own page, instead of only the primary image.
+	MinOutputQuality     int                           // Only used when MaxFileSize or TargetSSIM is set. The lowest quality to try to fit the image in MaxFileSize or to reach TargetSSIM. The default is 50.
+	DownscaleToFit       bool                          // Only used when MaxFileSize is set. Progressively downscale the image when it doesn't fit in MaxFileSize at MinOutputQuality, or for formats without a quality setting. The Width and Height of the result are the downscaled dimensions.
+	TargetSSIM           float64                       // Only used when OutputFormat RenderFileOutputFormatJPG or lossy RenderFileOutputFormatWebP. Picks the lowest quality between MinOutputQuality and OutputQuality of which the output reaches this SSIM compared to the decoded image, from 0 to 1 where 1 is identical. A good target for photos is around 0.95.
+	JPEGSubsampling      RenderFileJPEGSubsampling     // Only used when OutputFormat RenderFileOutputFormatJPG. Only available with build tag go_libheif_use_turbojpeg, except for RenderFileJPEGSubsamplingGray. The default keeps the subsampling of images that are decoded as YCbCr, like most HEIC and AVIF images, and is RenderFileJPEGSubsampling420 for other images.
+	JPEGFastDCT          bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Use the fast but less accurate DCT. The default is the DCT that libturbojpeg picks, which is the fast DCT for TurboJPEG 2.
+	JPEGAccurateDCT      bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Use the slower but more accurate DCT, not together with JPEGFastDCT.
+	JPEGOptimizeCoding   bool                          // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Compute optimal Huffman tables for a smaller file.
+	JPEGArithmeticCoding bool                          // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Use arithmetic coding for a smaller file, not every decoder supports this.
+	JPEGRestartInterval  int                           // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Add a restart marker every this amount of MCU blocks.
+	PNGCompressionLevel  RenderFilePNGCompressionLevel // Only used when OutputFormat RenderFileOutputFormatPNG. The default is RenderFilePNGCompressionLevelDefault.
+	PNGBitDepth          int                           // Only used when OutputFormat RenderFileOutputFormatPNG. The bit depth per channel, 8 or 16. The default keeps the bit depth of the image, so images with more than 8 bits per channel are rendered with 16 bits.
+	PNGMaxColors         int                           // Only used when OutputFormat RenderFileOutputFormatPNG. Quantize the image to a palette of at most this amount of colors, from 2 to 256, for a smaller file. Images with few colors, like screenshots, keep their exact colors. The default does not quantize.
+	Background           *color.RGBA                   // Only used when OutputFormat RenderFileOutputFormatJPG. The color that transparent pixels are composited on, as JPEG has no alpha channel. The alpha of the color is ignored. The default is white.
+	ToneMapping          RenderFileToneMapping         // Convert images with a PQ or HLG transfer in their nclx color profile to SDR sRGB with this curve, for any output format. The default is RenderFileToneMappingNone.
+	TargetPeakLuminance  float64                       // Only used when ToneMapping is set. The luminance in cd/m² that becomes white in the output, the highlights above it are compressed. The default is 203, the reference white of BT.2408, a higher value gives a darker image with more detail in the highlights.
+	GainMap              RenderFileGainMap             // Only used for images with an Apple or ISO 21496-1 HDR gain map. RenderFileGainMapApply requires OutputFormat RenderFileOutputFormatPNG and RenderFileGainMapUltraHDR requires RenderFileOutputFormatJPG. The default is RenderFileGainMapIgnore.
+	ConvertColors        bool                          // Convert the colors from the ICC or nclx color profile of the image to sRGB, or to TargetICCProfile, for any output format. Tone mapped images are converted from sRGB, images of which the gain map is applied are not converted. TIFF and PDF files embed TargetICCProfile instead of the profile of the image.
+	TargetICCProfile     []byte                        // Only used when ConvertColors is set. An RGB ICC profile with matrices and tone curves to convert to, like Display P3 or Adobe RGB. The default is sRGB.
 }
 
-func checkPlugin() error {
-	pong, err := libheifplugin.Ping()
+func (i *Instance) RenderFile(data *[]byte, options RenderOptions) (*responses.RenderFile, error) {
+	var resp *responses.RenderFile
+	err := i.workers.do(data, func(worker shared.Libheif) (err error) {
+		resp, err = worker.RenderFile(&requests.RenderFile{
+			Data:                 data,
+			OutputFormat:         requests.RenderFileOutputFormat(options.OutputFormat),
+			MaxFileSize:          options.MaxFileSize,
+			OutputQuality:        options.OutputQuality,
+			Progressive:          options.Progressive,
+			Lossless:             options.Lossless,
+			TIFFCompression:      requests.RenderFileTIFFCompression(options.TIFFCompression),
+			PDFCompression:       requests.RenderFilePDFCompression(options.PDFCompression),
+			PDFPageSize:          requests.RenderFilePDFPageSize(options.PDFPageSize),
+			PDFDPI:               options.PDFDPI,
+			AllImages:            options.AllImages,
+			MinOutputQuality:     options.MinOutputQuality,
+			DownscaleToFit:       options.DownscaleToFit,
+			TargetSSIM:           options.TargetSSIM,
+			JPEGSubsampling:      requests.RenderFileJPEGSubsampling(options.JPEGSubsampling),
+			JPEGFastDCT:          options.JPEGFastDCT,
+			JPEGAccurateDCT:      options.JPEGAccurateDCT,
+			JPEGOptimizeCoding:   options.JPEGOptimizeCoding,
+			JPEGArithmeticCoding: options.JPEGArithmeticCoding,
+			JPEGRestartInterval:  options.JPEGRestartInterval,
+			PNGCompressionLevel:  requests.RenderFilePNGCompressionLevel(options.PNGCompressionLevel),
+			PNGBitDepth:          options.PNGBitDepth,
+			PNGMaxColors:         options.PNGMaxColors,
+			Background:           options.Background,
+			ToneMapping:          requests.RenderFileToneMapping(options.ToneMapping),
+			TargetPeakLuminance:  options.TargetPeakLuminance,
+			GainMap:              requests.RenderFileGainMap(options.GainMap),
+			ConvertColors:        options.ConvertColors,
+			TargetICCProfile:     options.TargetICCProfile,
+		})
+		return err
+	})
 	if err != nil {
-		log.Printf("restarting libheif plugin due to wrong pong result: %s", err.Error())
-		err = startPlugin()
-		if err != nil {
-			log.Printf("could not restart libheif plugin: %s", err.Error())
-			return err
-		}
+		return nil, err
 	}
+	return resp, nil
+}
 
-	if pong != "Pong" {
-		log.Printf("restarting libheif plugin due to wrong pong result: %s", pong)
-		err = startPlugin()
-		if err != nil {
-			log.Printf("could not restart libheif plugin: %s", err.Error())
-			return err
-		}
-	}
+type DecodeImageColorspace string // The colorspace to decode an image to.
 
-	return nil
-}
+const (
+	DecodeImageColorspaceDefault    DecodeImageColorspace = ""           // The default colorspace, whatever colorspace the image is coded in: image.Gray for monochrome 8 bit images, image.RGBA for other 8 bit images, image.RGBA64 for images with a higher bit depth, and image.NRGBA or image.NRGBA64 for images with alpha.
+	DecodeImageColorspaceRGB        DecodeImageColorspace = "rgb"        // RGB, as image.RGBA or image.RGBA64, or image.NRGBA or image.NRGBA64 for images with alpha.
+	DecodeImageColorspaceYCbCr      DecodeImageColorspace = "ycbcr"      // YCbCr, as image.YCbCr with the subsampling of Chroma. Only for images with 8 bits per channel or ConvertHDRTo8Bit, without alpha.
+	DecodeImageColorspaceMonochrome DecodeImageColorspace = "monochrome" // Gray, as image.Gray or image.Gray16, color images keep their luma. Only for images without alpha.
+)
 
-var NotInitializedError = errors.New("libheif was not initialized, you must call the Init() method")
+type DecodeImageChroma string // The chroma subsampling of YCbCr output.
 
-type RenderFileOutputFormat string // The file format to render output as.
+const (
+	DecodeImageChromaDefault DecodeImageChroma = ""    // 4:2:0, the subsampling of most files.
+	DecodeImageChroma420     DecodeImageChroma = "420" // 4:2:0, the chroma has half the width and height.
+	DecodeImageChroma422     DecodeImageChroma = "422" // 4:2:2, the chroma has half the width.
+	DecodeImageChroma444     DecodeImageChroma = "444" // 4:4:4, no subsampling.
+)
+
+type DecodeImageAlpha string // How to return the alpha channel of an image.
 
 const (
-	RenderFileOutputFormatJPG RenderFileOutputFormat = "jpg" // Render the file as a JPEG file.
-	RenderFileOutputFormatPNG RenderFileOutputFormat = "png" // Render the file as a PNG file.
+	DecodeImageAlphaDefault       DecodeImageAlpha = ""              // As it's stored in the file, straight alpha as image.NRGBA or image.NRGBA64, and premultiplied alpha as image.RGBA or image.RGBA64.
+	DecodeImageAlphaStraight      DecodeImageAlpha = "straight"      // Straight alpha, as image.NRGBA or image.NRGBA64.
+	DecodeImageAlphaPremultiplied DecodeImageAlpha = "premultiplied" // Premultiplied alpha, as image.RGBA or image.RGBA64.
 )
 
-type RenderOptions struct {
-	OutputFormat  RenderFileOutputFormat // The format to output the image as
-	MaxFileSize   int64                  // Only used when OutputFormat RenderFileOutputFormatJPG. The maximum filesize, if jpg is chosen as output format, it will try to lower the quality it until it fits.
-	OutputQuality int                    // Only used when OutputFormat RenderFileOutputFormatJPG. Ranges from 1 to 100 inclusive, higher is better. The default is 95.
-	Progressive   bool                   // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Will render a progressive jpeg.
+type DecodeOptions struct {
+	Colorspace            DecodeImageColorspace // Only used for HEIF and AVIF files. The default is DecodeImageColorspaceDefault.
+	Chroma                DecodeImageChroma     // Only used when Colorspace is DecodeImageColorspaceYCbCr. The default is DecodeImageChromaDefault.
+	IgnoreTransformations bool                  // Only used for HEIF and AVIF files. Do not apply the crop, rotation and mirroring of the file.
+	ConvertHDRTo8Bit      bool                  // Only used for HEIF and AVIF files. Decode images with more than 8 bits per channel to 8 bits per channel.
+	ImageID               int                   // Only used for HEIF and AVIF files. The ID of the top level image to decode, as in the Probe response. The default is the primary image.
+	Alpha                 DecodeImageAlpha      // The default is DecodeImageAlphaDefault.
+	DecoderID             string                // Only used for HEIF and AVIF files. The ID of the libheif decoder plugin to prefer, like libde265 or dav1d, as in the Decoders of Capabilities. When it's not available, or by default, libheif uses the decoder with the highest priority for the compression format.
+	ConvertColors         bool                  // Convert the colors from the ICC or nclx color profile of the image to sRGB, or to TargetICCProfile. Not supported with DecodeImageColorspaceYCbCr and DecodeImageColorspaceMonochrome.
+	TargetICCProfile      []byte                // Only used when ConvertColors is set. An RGB ICC profile with matrices and tone curves to convert to, the default is sRGB.
 }
 
-func RenderFile(data *[]byte, options RenderOptions) (*responses.RenderFile, error) {
-	if libheifplugin == nil {
-		return nil, NotInitializedError
-	}
+func (i *Instance) DecodeImage(r io.Reader) (image.Image, error) {
+	return i.DecodeImageWithOptions(r, DecodeOptions{})
+}
 
-	err := checkPlugin()
+// DecodeImageToProfile decodes the image and converts its colors from its ICC
+// or nclx color profile to the RGB ICC profile targetICCProfile, or to sRGB
+// when targetICCProfile is nil.
+func (i *Instance) DecodeImageToProfile(r io.Reader, targetICCProfile []byte) (image.Image, error) {
+	return i.DecodeImageWithOptions(r, DecodeOptions{
+		ConvertColors:    true,
+		TargetICCProfile: targetICCProfile,
+	})
+}
+
+func (i *Instance) DecodeImageWithOptions(r io.Reader, options DecodeOptions) (image.Image, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, errors.New("could not check or start plugin")
+		return nil, err
 	}
 
-	resp, err := libheifplugin.RenderFile(&requests.RenderFile{Data: data, OutputFormat: requests.RenderFileOutputFormat(options.OutputFormat), MaxFileSize: options.MaxFileSize, OutputQuality: options.OutputQuality, Progressive: options.Progressive})
+	var resp *responses.DecodeImage
+	err = i.workers.do(&data, func(worker shared.Libheif) (err error) {
+		resp, err = worker.DecodeImage(&requests.DecodeImage{
+			Data:                  &data,
+			Colorspace:            requests.DecodeImageColorspace(options.Colorspace),
+			Chroma:                requests.DecodeImageChroma(options.Chroma),
+			IgnoreTransformations: options.IgnoreTransformations,
+			ConvertHDRTo8Bit:      options.ConvertHDRTo8Bit,
+			ImageID:               options.ImageID,
+			Alpha:                 requests.DecodeImageAlpha(options.Alpha),
+			DecoderID:             options.DecoderID,
+			ConvertColors:         options.ConvertColors,
+			TargetICCProfile:      options.TargetICCProfile,
+		})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return resp, nil
-}
 
-func DecodeImage(r io.Reader) (image.Image, error) {
-	if libheifplugin == nil {
-		return nil, NotInitializedError
-	}
+	return resp.Image, nil
+}
 
-	err := checkPlugin()
-	if err != nil {
-		return nil, errors.New("could not check or start plugin")
-	}
+func (i *Instance) DecodeConfig(r io.Reader) (image.Config, error) {
+	var config image.Config
 
 	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return config, err
 	}
 
-	resp, err := libheifplugin.DecodeImage(&requests.DecodeImage{Data: &data})
+	var resp *responses.DecodeConfig
+	err = i.workers.do(&data, func(worker shared.Libheif) (err error) {
+		resp, err = worker.DecodeConfig(&requests.DecodeConfig{Data: &data})
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return config, err
 	}
 
-	return resp.Image, nil
-}
+	config = resp.Config
+	config.ColorModel = colorModel(resp.ColorModel)
 
-func DecodeConfig(r io.Reader) (image.Config, error) {
-	var config image.Config
+	return config, nil
+}
 
-	if libheifplugin == nil {
-		return config, NotInitializedError
+func colorModel(name responses.ColorModel) color.Model {
+	switch name {
+	case responses.ColorModelRGBA:
+		return color.RGBAModel
+	case responses.ColorModelRGBA64:
+		return color.RGBA64Model
+	case responses.ColorModelNRGBA:
+		return color.NRGBAModel
+	case responses.ColorModelNRGBA64:
+		return color.NRGBA64Model
+	case responses.ColorModelGray:
+		return color.GrayModel
+	case responses.ColorModelGray16:
+		return color.Gray16Model
+	case responses.ColorModelYCbCr:
+		return color.YCbCrModel
+	case responses.ColorModelNYCbCrA:
+		return color.NYCbCrAModel
+	case responses.ColorModelCMYK:
+		return color.CMYKModel
 	}
+	return nil
+}
 
-	err := checkPlugin()
+// Probe returns information about the file, like the brands, the images and
+// their codecs, without decoding any of the images.
+func (i *Instance) Probe(data *[]byte) (*responses.Probe, error) {
+	var resp *responses.Probe
+	err := i.workers.do(data, func(worker shared.Libheif) (err error) {
+		resp, err = worker.Probe(&requests.Probe{Data: data})
+		return err
+	})
 	if err != nil {
-		return config, errors.New("could not check or start plugin")
+		return nil, err
 	}
 
-	data, err := io.ReadAll(r)
+	return resp, nil
+}
+
+// WorkerInfo returns the versions and the features that the running worker
+// reported in its handshake at startup.
+func (i *Instance) WorkerInfo() (*responses.Handshake, error) {
+	return i.workers.workerInfo()
+}
+
+// Capabilities returns the version of libheif in the worker and the decoders
+// and encoders that it has for every compression format.
+func (i *Instance) Capabilities() (*responses.Capabilities, error) {
+	var resp *responses.Capabilities
+	err := i.workers.do(nil, func(worker shared.Libheif) (err error) {
+		resp, err = worker.Capabilities(&requests.Capabilities{})
+		return err
+	})
 	if err != nil {
-		return config, err
+		return nil, err
 	}
 
-	resp, err := libheifplugin.DecodeConfig(&requests.DecodeConfig{Data: &data})
+	return resp, nil
+}
+
+type TransformJPEGOperation string // A lossless transform operation on a JPEG file.
+
+const (
+	TransformJPEGOperationNone           TransformJPEGOperation = ""           // Do not transform the image.
+	TransformJPEGOperationFlipHorizontal TransformJPEGOperation = "hflip"      // Mirror the image horizontally.
+	TransformJPEGOperationFlipVertical   TransformJPEGOperation = "vflip"      // Mirror the image vertically.
+	TransformJPEGOperationTranspose      TransformJPEGOperation = "transpose"  // Mirror the image over the top left to bottom right diagonal.
+	TransformJPEGOperationTransverse     TransformJPEGOperation = "transverse" // Mirror the image over the top right to bottom left diagonal.
+	TransformJPEGOperationRotate90       TransformJPEGOperation = "rotate90"   // Rotate the image 90 degrees clockwise.
+	TransformJPEGOperationRotate180      TransformJPEGOperation = "rotate180"  // Rotate the image 180 degrees.
+	TransformJPEGOperationRotate270      TransformJPEGOperation = "rotate270"  // Rotate the image 270 degrees clockwise.
+)
+
+type TransformJPEGOptions struct {
+	Operation  TransformJPEGOperation // The operation to apply.
+	AutoOrient bool                   // Apply the EXIF orientation before Operation, and reset the orientation to normal.
+	Crop       image.Rectangle        // Crop the transformed image to this rectangle, the top left corner is moved up and left to the nearest MCU boundary (8 or 16 pixels). Empty to not crop.
+	Trim       bool                   // Drop the partial MCU blocks on the edges that can't be transformed, instead of returning an error.
+}
+
+// TransformJPEG losslessly transforms a JPEG file, for example to rotate it
+// upright by its EXIF orientation. Only available when the worker has been
+// built with build tag go_libheif_use_turbojpeg.
+func (i *Instance) TransformJPEG(data *[]byte, options TransformJPEGOptions) (*responses.TransformJPEG, error) {
+	var resp *responses.TransformJPEG
+	err := i.workers.do(data, func(worker shared.Libheif) (err error) {
+		resp, err = worker.TransformJPEG(&requests.TransformJPEG{
+			Data:       data,
+			Operation:  requests.TransformJPEGOperation(options.Operation),
+			AutoOrient: options.AutoOrient,
+			Crop:       options.Crop,
+			Trim:       options.Trim,
+		})
+		return err
+	})
 	if err != nil {
-		return config, err
+		return nil, err
 	}
 
-	return resp.Config, nil
+	return resp, nil
 }
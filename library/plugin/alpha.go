@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"errors"
+	"image"
+	"image/color"
+
+	"github.com/klippa-app/go-libheif/library/requests"
+
+	"golang.org/x/image/draw"
+)
+
+// defaultBackground is the color that transparent pixels are composited on
+// for output formats without alpha when no background is given.
+var defaultBackground = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+// hasAlpha returns whether the image has pixels that are not fully opaque.
+func hasAlpha(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	return true
+}
+
+// flatten composites the image on an opaque background, so that encoders
+// without alpha don't drop the alpha and show the colors of transparent
+// pixels, or black for premultiplied images. The alpha of the background is
+// ignored. Opaque images are returned as is.
+func flatten(img image.Image, background *color.RGBA) image.Image {
+	if !hasAlpha(img) {
+		return img
+	}
+
+	fill := defaultBackground
+	if background != nil {
+		fill = color.RGBA{R: background.R, G: background.G, B: background.B, A: 0xff}
+	}
+
+	bounds := img.Bounds()
+	var flattened draw.Image
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		flattened = image.NewRGBA64(bounds)
+	default:
+		flattened = image.NewRGBA(bounds)
+	}
+
+	draw.Draw(flattened, bounds, image.NewUniform(fill), image.Point{}, draw.Src)
+	draw.Draw(flattened, bounds, img, bounds.Min, draw.Over)
+	return flattened
+}
+
+// convertAlpha converts images with alpha to straight or premultiplied alpha.
+// Opaque images and images of which the alpha is already as requested are
+// returned as is.
+func convertAlpha(img image.Image, alpha requests.DecodeImageAlpha) (image.Image, error) {
+	var converted draw.Image
+	bounds := img.Bounds()
+	switch alpha {
+	case requests.DecodeImageAlphaDefault:
+		return img, nil
+	case requests.DecodeImageAlphaStraight:
+		switch img.(type) {
+		case *image.RGBA:
+			converted = image.NewNRGBA(bounds)
+		case *image.RGBA64:
+			converted = image.NewNRGBA64(bounds)
+		}
+	case requests.DecodeImageAlphaPremultiplied:
+		switch img.(type) {
+		case *image.NRGBA:
+			converted = image.NewRGBA(bounds)
+		case *image.NRGBA64:
+			converted = image.NewRGBA64(bounds)
+		}
+	default:
+		return nil, errors.New("invalid alpha given")
+	}
+
+	if converted == nil || !hasAlpha(img) {
+		return img, nil
+	}
+
+	draw.Draw(converted, bounds, img, bounds.Min, draw.Src)
+	return converted, nil
+}
@@ -0,0 +1,121 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"os"
+
+	"github.com/klippa-app/go-libheif/library/plugin/image_jpeg"
+	"github.com/klippa-app/go-libheif/library/plugin/image_webp"
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+	"github.com/klippa-app/go-libheif/library/shared"
+)
+
+// capabilityFormats are the compression formats of which the codecs are
+// listed, in the order of the response.
+var capabilityFormats = []struct {
+	format        uint32
+	compression   responses.Compression
+	decodeFeature responses.Feature
+}{
+	{C.heif_compression_HEVC, responses.CompressionHEVC, responses.FeatureDecodeHEVC},
+	{C.heif_compression_AV1, responses.CompressionAV1, responses.FeatureDecodeAV1},
+	{C.heif_compression_AVC, responses.CompressionAVC, responses.FeatureDecodeAVC},
+	{C.heif_compression_JPEG, responses.CompressionJPEG, responses.FeatureDecodeJPEG},
+	{C.heif_compression_JPEG2000, responses.CompressionJPEG2000, responses.FeatureDecodeJPEG2000},
+	{C.heif_compression_VVC, responses.CompressionVVC, responses.FeatureDecodeVVC},
+	{C.heif_compression_uncompressed, responses.CompressionUncompressed, responses.FeatureDecodeUncompressed},
+}
+
+func (l *libHeifImplementation) Capabilities(request *requests.Capabilities) (*responses.Capabilities, error) {
+	resp := &responses.Capabilities{
+		LibheifVersion: C.GoString(C.heif_get_version()),
+		Formats:        []responses.CapabilitiesFormat{},
+	}
+
+	for _, capabilityFormat := range capabilityFormats {
+		format := responses.CapabilitiesFormat{
+			Compression: capabilityFormat.compression,
+			Decoders:    decoderCodecs(capabilityFormat.format),
+			Encoders:    encoderCodecs(capabilityFormat.format),
+		}
+
+		if len(format.Decoders) > 0 || len(format.Encoders) > 0 {
+			resp.Formats = append(resp.Formats, format)
+		}
+	}
+
+	return resp, nil
+}
+
+// Handshake reports the versions and the features of the worker, the library
+// decides whether it's compatible.
+func (l *libHeifImplementation) Handshake(request *requests.Handshake) (*responses.Handshake, error) {
+	features := []responses.Feature{}
+	if image_jpeg.TurboJPEG {
+		features = append(features, responses.FeatureTurboJPEG)
+	}
+	if image_jpeg.CodingOptions {
+		features = append(features, responses.FeatureJPEGCoding)
+	}
+	if image_webp.Supported {
+		features = append(features, responses.FeatureWebP)
+	}
+	for _, capabilityFormat := range capabilityFormats {
+		if C.heif_have_decoder_for_format(capabilityFormat.format) != 0 {
+			features = append(features, capabilityFormat.decodeFeature)
+		}
+	}
+
+	return &responses.Handshake{
+		Version:         shared.Version(),
+		ProtocolVersion: shared.ProtocolVersion,
+		LibheifVersion:  C.GoString(C.heif_get_version()),
+		Features:        features,
+		PID:             os.Getpid(),
+	}, nil
+}
+
+func decoderCodecs(format uint32) []responses.CapabilitiesCodec {
+	count := C.heif_get_decoder_descriptors(format, nil, 0)
+	if count <= 0 {
+		return []responses.CapabilitiesCodec{}
+	}
+
+	descriptors := make([]*C.struct_heif_decoder_descriptor, int(count))
+	count = C.heif_get_decoder_descriptors(format, &descriptors[0], count)
+
+	codecs := make([]responses.CapabilitiesCodec, 0, int(count))
+	for _, descriptor := range descriptors[:int(count)] {
+		codecs = append(codecs, responses.CapabilitiesCodec{
+			ID:   C.GoString(C.heif_decoder_descriptor_get_id_name(descriptor)),
+			Name: C.GoString(C.heif_decoder_descriptor_get_name(descriptor)),
+		})
+	}
+	return codecs
+}
+
+func encoderCodecs(format uint32) []responses.CapabilitiesCodec {
+	count := C.heif_get_encoder_descriptors(format, nil, nil, 0)
+	if count <= 0 {
+		return []responses.CapabilitiesCodec{}
+	}
+
+	descriptors := make([]*C.struct_heif_encoder_descriptor, int(count))
+	count = C.heif_get_encoder_descriptors(format, nil, &descriptors[0], count)
+
+	codecs := make([]responses.CapabilitiesCodec, 0, int(count))
+	for _, descriptor := range descriptors[:int(count)] {
+		codecs = append(codecs, responses.CapabilitiesCodec{
+			ID:   C.GoString(C.heif_encoder_descriptor_get_id_name(descriptor)),
+			Name: C.GoString(C.heif_encoder_descriptor_get_name(descriptor)),
+		})
+	}
+	return codecs
+}
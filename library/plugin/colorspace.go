@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"image"
+
+	"github.com/klippa-app/go-libheif/library/plugin/colorspace"
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+// sourceProfile returns the color profile of an image with the metadata, the
+// ICC profile takes precedence over the nclx profile. Images without either
+// are sRGB.
+func sourceProfile(metadata *imageMetadata) (*colorspace.Profile, error) {
+	if metadata == nil {
+		return colorspace.SRGB(), nil
+	}
+
+	if len(metadata.ICCProfile) > 0 {
+		return colorspace.ParseICC(metadata.ICCProfile)
+	}
+
+	if metadata.NCLX != nil {
+		primaries := tonemap.BT709
+		if metadata.NCLX.Primaries != nil {
+			primaries = *metadata.NCLX.Primaries
+		}
+		return colorspace.FromNCLX(primaries, metadata.NCLX.TransferCharacteristics)
+	}
+
+	return colorspace.SRGB(), nil
+}
+
+// targetProfile returns the profile to convert to, sRGB when no ICC profile is
+// given.
+func targetProfile(targetICCProfile []byte) (*colorspace.Profile, error) {
+	if len(targetICCProfile) == 0 {
+		return colorspace.SRGB(), nil
+	}
+	return colorspace.ParseICC(targetICCProfile)
+}
+
+// convertColors converts the image from the color profile in the metadata to
+// the target ICC profile, or to sRGB when it's empty. A nil metadata means
+// that the image is sRGB already, like after tone mapping.
+func convertColors(img image.Image, metadata *imageMetadata, targetICCProfile []byte) (image.Image, error) {
+	source, err := sourceProfile(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := targetProfile(targetICCProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	return colorspace.Convert(img, source, target)
+}
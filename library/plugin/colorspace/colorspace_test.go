@@ -0,0 +1,169 @@
+package colorspace
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+var displayP3 = tonemap.Chromaticities{
+	RedX: 0.680, RedY: 0.320,
+	GreenX: 0.265, GreenY: 0.690,
+	BlueX: 0.150, BlueY: 0.060,
+	WhiteX: 0.3127, WhiteY: 0.3290,
+}
+
+// srgbCurve is the sRGB tone curve as a para tag of function type 3.
+func srgbCurve() []byte {
+	curve := append([]byte("para"), 0, 0, 0, 0, 0, 3, 0, 0)
+	for _, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		curve = binary.BigEndian.AppendUint32(curve, uint32(int32(math.Round(p*65536))))
+	}
+	return curve
+}
+
+// testICC returns an RGB ICC profile with the matrix of the profile and the
+// same tone curve for every channel.
+func testICC(profile *Profile, curve []byte) []byte {
+	tags := map[string][]byte{}
+	for c, channel := range []string{"r", "g", "b"} {
+		xyz := append([]byte("XYZ "), 0, 0, 0, 0)
+		for row := 0; row < 3; row++ {
+			xyz = binary.BigEndian.AppendUint32(xyz, uint32(int32(math.Round(profile.toXYZ[row][c]*65536))))
+		}
+		tags[channel+"XYZ"] = xyz
+		tags[channel+"TRC"] = curve
+	}
+
+	signatures := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	data := make([]byte, 132+len(signatures)*12)
+	copy(data[16:], "RGB XYZ ")
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[128:], uint32(len(signatures)))
+	for i, signature := range signatures {
+		entry := 132 + i*12
+		copy(data[entry:], signature)
+		binary.BigEndian.PutUint32(data[entry+4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(data[entry+8:], uint32(len(tags[signature])))
+		data = append(data, tags[signature]...)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+func TestParseICC(t *testing.T) {
+	profile, err := ParseICC(testICC(SRGB(), srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			if math.Abs(profile.toXYZ[row][col]-SRGB().toXYZ[row][col]) > 0.0001 {
+				t.Errorf("Expected matrix entry %d,%d to be %f, got %f", row, col, SRGB().toXYZ[row][col], profile.toXYZ[row][col])
+			}
+		}
+	}
+
+	for _, value := range []float64{0, 0.02, 0.5, 1} {
+		if got, want := profile.curves[0](value), srgbToLinear(value); math.Abs(got-want) > 0.0001 {
+			t.Errorf("Expected the curve to map %f to %f, got %f", value, want, got)
+		}
+	}
+
+	gammaCurve := append([]byte("curv"), 0, 0, 0, 0, 0, 0, 0, 1, 2, 0x33)
+	curve, err := parseCurve(gammaCurve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := curve(0.5); math.Abs(got-math.Pow(0.5, 2.2)) > 0.001 {
+		t.Errorf("Expected a gamma of 2.2, got %f for 0.5", got)
+	}
+
+	tableCurve := append([]byte("curv"), 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0xff, 0xff)
+	curve, err = parseCurve(tableCurve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := curve(0.25); math.Abs(got-0.25) > 0.0001 {
+		t.Errorf("Expected a linear table, got %f for 0.25", got)
+	}
+
+	cmyk := testICC(SRGB(), srgbCurve())
+	copy(cmyk[16:], "CMYK")
+	if _, err := ParseICC(cmyk); !errors.Is(err, UnsupportedProfileError) {
+		t.Errorf("Expected UnsupportedProfileError for a CMYK profile, got %v", err)
+	}
+
+	if _, err := ParseICC([]byte("not a profile")); err == nil {
+		t.Error("Expected an error for invalid data")
+	}
+
+	if _, err := FromNCLX(tonemap.BT2020, int(tonemap.TransferPQ)); !errors.Is(err, UnsupportedTransferError) {
+		t.Errorf("Expected UnsupportedTransferError for PQ, got %v", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	p3, err := FromNCLX(displayP3, transferSRGB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 128})
+
+	converted, err := Convert(img, SRGB(), p3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, ok := converted.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("Expected an NRGBA image for a transparent image, got %T", converted)
+	}
+
+	// The red of sRGB in Display P3.
+	if got, want := out.NRGBAAt(0, 0), (color.NRGBA{R: 234, G: 51, B: 35, A: 255}); !near(got, want, 1) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	back, err := Convert(out, p3, SRGB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x := 0; x < 2; x++ {
+		if got, want := back.(*image.NRGBA).NRGBAAt(x, 0), img.NRGBAAt(x, 0); !near(got, want, 1) {
+			t.Errorf("Expected the round trip of pixel %d to be %v, got %v", x, want, got)
+		}
+	}
+
+	deep := image.NewRGBA64(image.Rect(0, 0, 1, 1))
+	deep.SetRGBA64(0, 0, color.RGBA64{R: 0xffff, A: 0xffff})
+	converted, err = Convert(deep, SRGB(), p3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rgba64, ok := converted.(*image.RGBA64)
+	if !ok {
+		t.Fatalf("Expected an RGBA64 image for an opaque 16 bit image, got %T", converted)
+	}
+	if got := rgba64.RGBA64At(0, 0); math.Abs(float64(got.R)/0xffff-234.0/255) > 0.003 {
+		t.Errorf("Expected the red of sRGB in Display P3, got %v", got)
+	}
+}
+
+func near(a, b color.NRGBA, tolerance int) bool {
+	diff := func(x, y uint8) bool {
+		return math.Abs(float64(x)-float64(y)) <= float64(tolerance)
+	}
+	return diff(a.R, b.R) && diff(a.G, b.G) && diff(a.B, b.B) && a.A == b.A
+}
@@ -0,0 +1,147 @@
+package colorspace
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// curveSamples is the amount of encoded values at which the tone curve of the
+// target profile is sampled to invert it.
+const curveSamples = 4096
+
+// Convert converts the colors of the image from the source profile to the
+// target profile, colors outside of the gamut of the target are clipped.
+// Images with 8 bits per channel are returned as RGBA images and images with
+// more bits per channel as RGBA64 images, or as NRGBA and NRGBA64 images when
+// they are not opaque.
+func Convert(img image.Image, source, target *Profile) (image.Image, error) {
+	fromXYZ, err := invert(target.toXYZ)
+	if err != nil {
+		return nil, err
+	}
+	matrix := multiply(fromXYZ, source.toXYZ)
+
+	var encode [3][]uint16
+	for c := range encode {
+		encode[c] = inverseCurve(target.curves[c])
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	convertPixel := func(values [3]float64) [3]uint16 {
+		var out [3]uint16
+		linear := apply(matrix, values)
+		for c := range linear {
+			value := math.Min(math.Max(linear[c], 0), 1)
+			out[c] = encode[c][int(math.Round(value*0xffff))]
+		}
+		return out
+	}
+
+	if is16Bit(img) {
+		var decode [3][]float64
+		for c := range decode {
+			decode[c] = sampleCurve(source.curves[c], 1<<16)
+		}
+
+		out := image.NewNRGBA64(image.Rect(0, 0, width, height))
+		opaque := true
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				pixel := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				rgb := convertPixel([3]float64{decode[0][pixel.R], decode[1][pixel.G], decode[2][pixel.B]})
+				out.SetNRGBA64(x, y, color.NRGBA64{R: rgb[0], G: rgb[1], B: rgb[2], A: pixel.A})
+				opaque = opaque && pixel.A == 0xffff
+			}
+		}
+
+		if opaque {
+			// Without transparency the premultiplied layout is the same.
+			return &image.RGBA64{Pix: out.Pix, Stride: out.Stride, Rect: out.Rect}, nil
+		}
+		return out, nil
+	}
+
+	var decode [3][]float64
+	for c := range decode {
+		decode[c] = sampleCurve(source.curves[c], 1<<8)
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+	opaque := true
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := nrgbaAt(img, bounds.Min.X+x, bounds.Min.Y+y)
+			rgb := convertPixel([3]float64{decode[0][pixel.R], decode[1][pixel.G], decode[2][pixel.B]})
+			offset := out.PixOffset(x, y)
+			out.Pix[offset] = uint8((uint32(rgb[0])*0xff + 0x7fff) / 0xffff)
+			out.Pix[offset+1] = uint8((uint32(rgb[1])*0xff + 0x7fff) / 0xffff)
+			out.Pix[offset+2] = uint8((uint32(rgb[2])*0xff + 0x7fff) / 0xffff)
+			out.Pix[offset+3] = pixel.A
+			opaque = opaque && pixel.A == 0xff
+		}
+	}
+
+	if opaque {
+		return &image.RGBA{Pix: out.Pix, Stride: out.Stride, Rect: out.Rect}, nil
+	}
+	return out, nil
+}
+
+// nrgbaAt returns the non-premultiplied 8 bit color of a pixel, without the
+// generic color conversion for the image types that libheif decodes to.
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		c := img.YCbCrAt(x, y)
+		r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+		return color.NRGBA{R: r, G: g, B: b, A: 0xff}
+	case *image.NRGBA:
+		return img.NRGBAAt(x, y)
+	case *image.Gray:
+		v := img.GrayAt(x, y).Y
+		return color.NRGBA{R: v, G: v, B: v, A: 0xff}
+	}
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+// sampleCurve returns the linear values of all the encoded values.
+func sampleCurve(curve func(float64) float64, size int) []float64 {
+	values := make([]float64, size)
+	for i := range values {
+		values[i] = curve(float64(i) / float64(size-1))
+	}
+	return values
+}
+
+// inverseCurve returns the 16 bit encoded value for every 16 bit linear value,
+// by interpolating between samples of the tone curve, which must be
+// increasing.
+func inverseCurve(curve func(float64) float64) []uint16 {
+	samples := sampleCurve(curve, curveSamples)
+	encode := make([]uint16, 1<<16)
+	sample := 0
+	for i := range encode {
+		linear := float64(i) / 0xffff
+		for sample < curveSamples-2 && samples[sample+1] < linear {
+			sample++
+		}
+
+		low, high := samples[sample], samples[sample+1]
+		position := float64(sample)
+		if high > low {
+			position += math.Min(math.Max((linear-low)/(high-low), 0), 1)
+		}
+		encode[i] = uint16(math.Round(position / (curveSamples - 1) * 0xffff))
+	}
+	return encode
+}
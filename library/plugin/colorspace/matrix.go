@@ -0,0 +1,96 @@
+package colorspace
+
+import (
+	"errors"
+	"math"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+// bradford is the cone response matrix of the Bradford chromatic adaptation.
+var bradford = [3][3]float64{
+	{0.8951, 0.2664, -0.1614},
+	{-0.7502, 1.7135, 0.0367},
+	{0.0389, -0.0685, 1.0296},
+}
+
+// rgbToXYZ returns the matrix that converts linear RGB with the given
+// chromaticities to CIE XYZ, relative to their own white point.
+func rgbToXYZ(c tonemap.Chromaticities) ([3][3]float64, error) {
+	xyz := func(x, y float64) [3]float64 {
+		return [3]float64{x / y, 1, (1 - x - y) / y}
+	}
+
+	r, g, b := xyz(c.RedX, c.RedY), xyz(c.GreenX, c.GreenY), xyz(c.BlueX, c.BlueY)
+	primaries := [3][3]float64{
+		{r[0], g[0], b[0]},
+		{r[1], g[1], b[1]},
+		{r[2], g[2], b[2]},
+	}
+
+	inverse, err := invert(primaries)
+	if err != nil {
+		return primaries, err
+	}
+
+	// Scale the primaries so that RGB white becomes the white point.
+	white := xyz(c.WhiteX, c.WhiteY)
+	for col := 0; col < 3; col++ {
+		scale := inverse[col][0]*white[0] + inverse[col][1]*white[1] + inverse[col][2]*white[2]
+		for row := 0; row < 3; row++ {
+			primaries[row][col] *= scale
+		}
+	}
+	return primaries, nil
+}
+
+// adaptToD50 returns the Bradford matrix that adapts XYZ with the given white
+// point to D50.
+func adaptToD50(whiteX, whiteY float64) [3][3]float64 {
+	white := [3]float64{whiteX / whiteY, 1, (1 - whiteX - whiteY) / whiteY}
+	source, target := apply(bradford, white), apply(bradford, d50)
+
+	// The inverse of the Bradford matrix always exists.
+	inverse, _ := invert(bradford)
+	scale := [3][3]float64{
+		{target[0] / source[0], 0, 0},
+		{0, target[1] / source[1], 0},
+		{0, 0, target[2] / source[2]},
+	}
+	return multiply(inverse, multiply(scale, bradford))
+}
+
+func apply(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func multiply(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invert(m [3][3]float64) ([3][3]float64, error) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return m, errors.New("invalid color space matrix")
+	}
+
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}, nil
+}
@@ -0,0 +1,245 @@
+// Package colorspace converts images between RGB color spaces that are
+// described by ICC profiles with matrices and tone curves, or by the nclx
+// code points of ITU-T H.273.
+package colorspace
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+// UnsupportedProfileError is returned for ICC profiles that are not RGB
+// profiles with matrices and tone curves, like CMYK, gray and LUT based
+// profiles.
+var UnsupportedProfileError = errors.New("only rgb icc profiles with matrices and tone curves are supported")
+
+// UnsupportedTransferError is returned for nclx transfer characteristics that
+// can't be converted, like PQ and HLG, which have to be tone mapped instead.
+var UnsupportedTransferError = errors.New("unsupported transfer characteristics")
+
+// d50 is the white point of the profile connection space of ICC profiles.
+var d50 = [3]float64{0.9642, 1, 0.8249}
+
+// Profile describes an RGB color space by its tone curves, which convert the
+// encoded values to linear light, and the matrix that converts linear light
+// to the D50 XYZ of the profile connection space of ICC.
+type Profile struct {
+	toXYZ  [3][3]float64
+	curves [3]func(float64) float64
+}
+
+// SRGB returns the profile of sRGB.
+func SRGB() *Profile {
+	profile, _ := FromNCLX(tonemap.BT709, transferSRGB)
+	return profile
+}
+
+// The transfer characteristics of ITU-T H.273 that are supported.
+const (
+	transferBT709       = 1
+	transferUnspecified = 2
+	transferGamma22     = 4
+	transferGamma28     = 5
+	transferBT601       = 6
+	transferLinear      = 8
+	transferSRGB        = 13
+	transferBT2020      = 14
+	transferBT2020_12   = 15
+)
+
+// FromNCLX returns the profile of an nclx color profile with the given
+// primaries and transfer characteristics. An unspecified transfer is treated
+// as sRGB.
+func FromNCLX(primaries tonemap.Chromaticities, transfer int) (*Profile, error) {
+	var curve func(float64) float64
+	switch transfer {
+	case transferBT709, transferBT601, transferBT2020, transferBT2020_12:
+		curve = bt709ToLinear
+	case transferSRGB, transferUnspecified:
+		curve = srgbToLinear
+	case transferGamma22:
+		curve = gamma(2.2)
+	case transferGamma28:
+		curve = gamma(2.8)
+	case transferLinear:
+		curve = func(v float64) float64 { return v }
+	default:
+		return nil, UnsupportedTransferError
+	}
+
+	toXYZ, err := rgbToXYZ(primaries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Profile{
+		toXYZ:  multiply(adaptToD50(primaries.WhiteX, primaries.WhiteY), toXYZ),
+		curves: [3]func(float64) float64{curve, curve, curve},
+	}, nil
+}
+
+// ParseICC parses an ICC profile. Only RGB profiles with the rXYZ, gXYZ and
+// bXYZ matrix columns and rTRC, gTRC and bTRC tone curves are supported, which
+// covers the profiles of cameras and displays, like Display P3 and Adobe RGB.
+func ParseICC(data []byte) (*Profile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("invalid icc profile")
+	}
+
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, UnsupportedProfileError
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errors.New("invalid icc profile")
+		}
+
+		offset := uint64(binary.BigEndian.Uint32(data[entry+4:]))
+		size := uint64(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset+size > uint64(len(data)) {
+			return nil, errors.New("invalid icc profile")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	profile := &Profile{}
+	for c, channel := range []string{"r", "g", "b"} {
+		xyz, ok := tags[channel+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, UnsupportedProfileError
+		}
+
+		for row := 0; row < 3; row++ {
+			profile.toXYZ[row][c] = s15Fixed16(xyz[8+row*4:])
+		}
+
+		trc, ok := tags[channel+"TRC"]
+		if !ok {
+			return nil, UnsupportedProfileError
+		}
+
+		curve, err := parseCurve(trc)
+		if err != nil {
+			return nil, err
+		}
+		profile.curves[c] = curve
+	}
+
+	return profile, nil
+}
+
+// parseCurve parses a curv or para tone curve.
+func parseCurve(data []byte) (func(float64) float64, error) {
+	if len(data) < 12 {
+		return nil, errors.New("invalid icc tone curve")
+	}
+
+	switch string(data[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+count*2 {
+			return nil, errors.New("invalid icc tone curve")
+		}
+
+		switch count {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			// A u8Fixed8Number gamma.
+			return gamma(float64(binary.BigEndian.Uint16(data[12:])) / 256), nil
+		}
+
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+i*2:])) / 0xffff
+		}
+		return func(v float64) float64 {
+			position := v * float64(count-1)
+			i := int(position)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			if i < 0 {
+				return table[0]
+			}
+			fraction := position - float64(i)
+			return table[i]*(1-fraction) + table[i+1]*fraction
+		}, nil
+	case "para":
+		functionType := binary.BigEndian.Uint16(data[8:])
+		parameterCounts := []int{1, 3, 4, 5, 7}
+		if int(functionType) >= len(parameterCounts) || len(data) < 12+parameterCounts[functionType]*4 {
+			return nil, errors.New("invalid icc tone curve")
+		}
+
+		// The parameters are g, a, b, c, d, e and f, unused ones stay at the
+		// value that makes them have no effect.
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < parameterCounts[functionType]; i++ {
+			p[i] = s15Fixed16(data[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		switch functionType {
+		case 0:
+			return gamma(g), nil
+		case 1:
+			return func(v float64) float64 {
+				if a*v+b < 0 {
+					return 0
+				}
+				return math.Pow(a*v+b, g)
+			}, nil
+		case 2:
+			return func(v float64) float64 {
+				if a*v+b < 0 {
+					return c
+				}
+				return math.Pow(a*v+b, g) + c
+			}, nil
+		}
+
+		// Types 3 and 4 have a linear segment below d.
+		return func(v float64) float64 {
+			if v < d {
+				return c*v + f
+			}
+			return math.Pow(math.Max(a*v+b, 0), g) + e
+		}, nil
+	}
+
+	return nil, UnsupportedProfileError
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func gamma(g float64) func(float64) float64 {
+	return func(v float64) float64 {
+		return math.Pow(math.Max(v, 0), g)
+	}
+}
+
+// srgbToLinear is the sRGB EOTF.
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// bt709ToLinear is the inverse of the BT.709 OETF.
+func bt709ToLinear(v float64) float64 {
+	if v < 0.081 {
+		return v / 4.5
+	}
+	return math.Pow((v+0.099)/1.099, 1/0.45)
+}
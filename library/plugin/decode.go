@@ -0,0 +1,598 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"unsafe"
+
+	"github.com/klippa-app/go-libheif/library/isobmff"
+	"github.com/klippa-app/go-libheif/library/requests"
+
+	"golang.org/x/image/draw"
+)
+
+// registerFormats registers all the brands of isobmff.ImageBrands for
+// image.Decode in the worker. There is no catch-all for other ftyp boxes, it
+// would shadow the decoders that are registered later, like for MP4.
+func registerFormats() {
+	for _, imageBrand := range isobmff.ImageBrands() {
+		image.RegisterFormat(imageBrand.Format, "????ftyp"+imageBrand.Brand, decodeHeifImage, decodeHeifConfig)
+	}
+}
+
+// sniffHeif sniffs the data and returns whether it's a HEIF file for libheif,
+// other files, like MP4 videos, are left to image.Decode.
+func sniffHeif(data []byte) (isobmff.SniffResult, bool) {
+	result := isobmff.Sniff(data)
+	return result, result.FileType != isobmff.FileTypeNo && result.MIMEType != ""
+}
+
+func readHeifContext(data []byte) (*heifContext, error) {
+	if _, isHeif := sniffHeif(data); !isHeif {
+		return nil, errors.New("file is not a HEIF file that libheif can handle")
+	}
+
+	return newHeifContext(data)
+}
+
+func decodeHeifImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeHeifImageWithOptions(data, &requests.DecodeImage{})
+}
+
+// decodeHeifImageWithOptions decodes the image with ID request.ImageID, or the
+// primary image, with the options of the request.
+func decodeHeifImageWithOptions(data []byte, request *requests.DecodeImage) (image.Image, error) {
+	ctx, err := readHeifContext(data)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.free()
+
+	id := request.ImageID
+	if id == 0 {
+		id, err = ctx.primaryImageID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	handle, err := ctx.imageHandle(id)
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	img, err := decodeHandleWithOptions(handle, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.ConvertColors {
+		metadata, err := readImageMetadata(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		img, err = convertColors(img, metadata, request.TargetICCProfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+func decodeHeifConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	ctx, err := readHeifContext(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer ctx.free()
+
+	id, err := ctx.primaryImageID()
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	handle, err := ctx.imageHandle(id)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	// The image would be decoded to the default target of decodeTarget.
+	colorspace, chroma, err := decodeTarget(handle, &requests.DecodeImage{})
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{
+		ColorModel: targetColorModel(handle, colorspace, chroma),
+		Width:      int(C.heif_image_handle_get_width(handle)),
+		Height:     int(C.heif_image_handle_get_height(handle)),
+	}, nil
+}
+
+// targetColorModel returns the color model of the Go image that convertImage
+// returns for the image of the handle decoded to colorspace and chroma.
+func targetColorModel(handle *C.struct_heif_image_handle, colorspace, chroma uint32) color.Model {
+	switch colorspace {
+	case C.heif_colorspace_monochrome:
+		if C.heif_image_handle_get_luma_bits_per_pixel(handle) > 8 {
+			return color.Gray16Model
+		}
+		return color.GrayModel
+	case C.heif_colorspace_YCbCr:
+		return color.YCbCrModel
+	}
+
+	switch chroma {
+	case C.heif_chroma_interleaved_RGBA:
+		return color.NRGBAModel
+	case C.heif_chroma_interleaved_RRGGBBAA_BE:
+		return color.NRGBA64Model
+	case C.heif_chroma_interleaved_RRGGBB_BE:
+		return color.RGBA64Model
+	}
+	return color.RGBAModel
+}
+
+// decodeHandle decodes the image of the handle to the default target of
+// decodeTarget: Gray for 8 bit monochrome images, RGBA for other 8 bit images,
+// and RGBA64 for images with a higher bit depth. Images with an alpha channel
+// are decoded to NRGBA or NRGBA64.
+func decodeHandle(handle *C.struct_heif_image_handle) (image.Image, error) {
+	return decodeHandleWithOptions(handle, &requests.DecodeImage{})
+}
+
+var decodeChromas = map[requests.DecodeImageChroma]uint32{
+	requests.DecodeImageChroma420: C.heif_chroma_420,
+	requests.DecodeImageChroma422: C.heif_chroma_422,
+	requests.DecodeImageChroma444: C.heif_chroma_444,
+}
+
+// decodeTarget returns the libheif colorspace and chroma to decode the image
+// of the handle to for the request.
+func decodeTarget(handle *C.struct_heif_image_handle, request *requests.DecodeImage) (uint32, uint32, error) {
+	if request.Chroma != requests.DecodeImageChromaDefault && request.Colorspace != requests.DecodeImageColorspaceYCbCr {
+		return 0, 0, errors.New("chroma is only supported for ycbcr output")
+	}
+
+	alpha := C.heif_image_handle_has_alpha_channel(handle) != 0
+	hdr := C.heif_image_handle_get_luma_bits_per_pixel(handle) > 8
+	highBitDepth := hdr && !request.ConvertHDRTo8Bit
+
+	// By default 8 bit monochrome images stay monochrome and all the other
+	// images are decoded to RGB, whatever colorspace they are coded in, so
+	// that decodeHeifConfig knows the color model without decoding. Go has
+	// no high bit depth or alpha YCbCr image type anyway, and libheif only
+	// converts HDR to 8 bit when it converts the colorspace too.
+	colorspace := request.Colorspace
+	if colorspace == requests.DecodeImageColorspaceDefault {
+		colorspace = requests.DecodeImageColorspaceRGB
+		if !alpha && !hdr && C.heif_image_handle_get_chroma_bits_per_pixel(handle) == -1 {
+			colorspace = requests.DecodeImageColorspaceMonochrome
+		}
+	}
+
+	switch colorspace {
+	case requests.DecodeImageColorspaceRGB:
+		switch {
+		case alpha && highBitDepth:
+			return C.heif_colorspace_RGB, C.heif_chroma_interleaved_RRGGBBAA_BE, nil
+		case alpha:
+			return C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil
+		case highBitDepth:
+			return C.heif_colorspace_RGB, C.heif_chroma_interleaved_RRGGBB_BE, nil
+		}
+		return C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGB, nil
+	case requests.DecodeImageColorspaceYCbCr:
+		if alpha || highBitDepth {
+			return 0, 0, errors.New("ycbcr output is only supported for 8 bit images without alpha")
+		}
+
+		if request.Chroma == requests.DecodeImageChromaDefault {
+			return C.heif_colorspace_YCbCr, C.heif_chroma_420, nil
+		}
+
+		chroma, ok := decodeChromas[request.Chroma]
+		if !ok {
+			return 0, 0, errors.New("invalid chroma given")
+		}
+		return C.heif_colorspace_YCbCr, chroma, nil
+	case requests.DecodeImageColorspaceMonochrome:
+		if alpha {
+			return 0, 0, errors.New("monochrome output is only supported for images without alpha")
+		}
+
+		// libheif can't convert color images to monochrome, so those are
+		// converted by toGray after decoding.
+		if C.heif_image_handle_get_chroma_bits_per_pixel(handle) == -1 {
+			return C.heif_colorspace_monochrome, C.heif_chroma_monochrome, nil
+		} else if highBitDepth {
+			return C.heif_colorspace_RGB, C.heif_chroma_interleaved_RRGGBB_BE, nil
+		}
+		return C.heif_colorspace_YCbCr, C.heif_chroma_420, nil
+	}
+
+	return 0, 0, errors.New("invalid colorspace given")
+}
+
+// decodeHandleWithOptions decodes the image of the handle with the colorspace,
+// decoding options and alpha of the request.
+func decodeHandleWithOptions(handle *C.struct_heif_image_handle, request *requests.DecodeImage) (image.Image, error) {
+	colorspace, chroma, err := decodeTarget(handle, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.ConvertColors && (request.Colorspace == requests.DecodeImageColorspaceYCbCr || request.Colorspace == requests.DecodeImageColorspaceMonochrome) {
+		return nil, errors.New("converting colors is only supported for rgb output")
+	}
+
+	options := C.heif_decoding_options_alloc()
+	defer C.heif_decoding_options_free(options)
+
+	if request.IgnoreTransformations {
+		options.ignore_transformations = 1
+	}
+	if request.ConvertHDRTo8Bit {
+		options.convert_hdr_to_8bit = 1
+	}
+	if request.DecoderID != "" {
+		decoderID := C.CString(request.DecoderID)
+		defer C.free(unsafe.Pointer(decoderID))
+		options.decoder_id = decoderID
+	}
+
+	var img *C.struct_heif_image
+	err = heifError(C.heif_decode_image(handle, &img, colorspace, chroma, options))
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(img)
+
+	decoded, err := convertImage(img)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Colorspace == requests.DecodeImageColorspaceMonochrome {
+		return toGray(decoded), nil
+	}
+	return decoded, nil
+}
+
+// toGray converts a decoded image to Gray, or to Gray16 for images with a
+// higher bit depth. YCbCr images keep their luma plane.
+func toGray(img image.Image) image.Image {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.Gray, *image.Gray16:
+		return img
+	case *image.YCbCr:
+		gray := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(gray.Pix[gray.PixOffset(bounds.Min.X, y):], img.Y[img.YOffset(bounds.Min.X, y):img.YOffset(bounds.Max.X-1, y)+1])
+		}
+		return gray
+	case *image.RGBA64, *image.NRGBA64:
+		gray := image.NewGray16(bounds)
+		draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+		return gray
+	}
+
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+	return gray
+}
+
+type heifPlane struct {
+	data          []byte
+	stride        int
+	width, height int
+	bitDepth      int
+}
+
+func getPlane(img *C.struct_heif_image, channel uint32) (*heifPlane, error) {
+	var stride C.int
+	data := C.heif_image_get_plane_readonly(img, channel, &stride)
+	if data == nil {
+		return nil, fmt.Errorf("image has no channel %d", channel)
+	}
+
+	height := int(C.heif_image_get_height(img, channel))
+	return &heifPlane{
+		data:     unsafe.Slice((*byte)(unsafe.Pointer(data)), int(stride)*height),
+		stride:   int(stride),
+		width:    int(C.heif_image_get_width(img, channel)),
+		height:   height,
+		bitDepth: int(C.heif_image_get_bits_per_pixel_range(img, channel)),
+	}, nil
+}
+
+// copyPlane copies the plane out of the libheif memory.
+func (p *heifPlane) copyPlane() []byte {
+	data := make([]byte, len(p.data))
+	copy(data, p.data)
+	return data
+}
+
+// copyRows copies the plane out of the libheif memory with another stride,
+// which must be at least the width of the plane.
+func (p *heifPlane) copyRows(stride int) []byte {
+	data := make([]byte, stride*p.height)
+	for y := 0; y < p.height; y++ {
+		copy(data[y*stride:y*stride+p.width], p.data[y*p.stride:])
+	}
+	return data
+}
+
+// convertImage converts a decoded libheif image to a Go image, all the pixel
+// data is copied, so the libheif image can be released afterwards.
+func convertImage(img *C.struct_heif_image) (image.Image, error) {
+	colorspace := C.heif_image_get_colorspace(img)
+	chroma := C.heif_image_get_chroma_format(img)
+
+	switch colorspace {
+	case C.heif_colorspace_YCbCr:
+		var subsampleRatio image.YCbCrSubsampleRatio
+		switch chroma {
+		case C.heif_chroma_420:
+			subsampleRatio = image.YCbCrSubsampleRatio420
+		case C.heif_chroma_422:
+			subsampleRatio = image.YCbCrSubsampleRatio422
+		case C.heif_chroma_444:
+			subsampleRatio = image.YCbCrSubsampleRatio444
+		default:
+			return nil, fmt.Errorf("unsupported YCbCr chroma format: %d", chroma)
+		}
+
+		y, err := getPlane(img, C.heif_channel_Y)
+		if err != nil {
+			return nil, err
+		}
+		cb, err := getPlane(img, C.heif_channel_Cb)
+		if err != nil {
+			return nil, err
+		}
+		cr, err := getPlane(img, C.heif_channel_Cr)
+		if err != nil {
+			return nil, err
+		}
+		if y.bitDepth > 8 {
+			return nil, fmt.Errorf("unsupported YCbCr bit depth: %d", y.bitDepth)
+		}
+
+		// image.YCbCr has one stride for both chroma planes, libheif could
+		// pad them differently.
+		cStride, cbData, crData := cb.stride, cb.copyPlane(), cr.copyPlane()
+		if cr.stride != cb.stride {
+			cStride, cbData, crData = cb.width, cb.copyRows(cb.width), cr.copyRows(cb.width)
+		}
+
+		return &image.YCbCr{
+			Y:              y.copyPlane(),
+			Cb:             cbData,
+			Cr:             crData,
+			YStride:        y.stride,
+			CStride:        cStride,
+			SubsampleRatio: subsampleRatio,
+			Rect:           image.Rect(0, 0, y.width, y.height),
+		}, nil
+	case C.heif_colorspace_monochrome:
+		y, err := getPlane(img, C.heif_channel_Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if y.bitDepth > 8 {
+			gray := image.NewGray16(image.Rect(0, 0, y.width, y.height))
+			for row := 0; row < y.height; row++ {
+				for x := 0; x < y.width; x++ {
+					// Planes with more than 8 bits are stored in native (little) endian.
+					value := uint16(y.data[row*y.stride+x*2]) | uint16(y.data[row*y.stride+x*2+1])<<8
+					value = scaleTo16Bit(value, y.bitDepth)
+					gray.Pix[row*gray.Stride+x*2] = byte(value >> 8)
+					gray.Pix[row*gray.Stride+x*2+1] = byte(value)
+				}
+			}
+			return gray, nil
+		}
+
+		return &image.Gray{
+			Pix:    y.copyPlane(),
+			Stride: y.stride,
+			Rect:   image.Rect(0, 0, y.width, y.height),
+		}, nil
+	case C.heif_colorspace_RGB:
+		return convertRGBImage(img, chroma)
+	}
+
+	return nil, fmt.Errorf("unsupported colorspace: %d", colorspace)
+}
+
+func convertRGBImage(img *C.struct_heif_image, chroma uint32) (image.Image, error) {
+	switch chroma {
+	case C.heif_chroma_interleaved_RGB:
+		plane, err := getPlane(img, C.heif_channel_interleaved)
+		if err != nil {
+			return nil, err
+		}
+
+		rgba := image.NewRGBA(image.Rect(0, 0, plane.width, plane.height))
+		for y := 0; y < plane.height; y++ {
+			for x := 0; x < plane.width; x++ {
+				src := y*plane.stride + x*3
+				dst := y*rgba.Stride + x*4
+				copy(rgba.Pix[dst:dst+3], plane.data[src:src+3])
+				rgba.Pix[dst+3] = 0xff
+			}
+		}
+		return rgba, nil
+	case C.heif_chroma_interleaved_RGBA:
+		plane, err := getPlane(img, C.heif_channel_interleaved)
+		if err != nil {
+			return nil, err
+		}
+
+		// The alpha is only premultiplied when the file says so.
+		rect := image.Rect(0, 0, plane.width, plane.height)
+		var rgba image.Image
+		var pix []byte
+		var stride int
+		if C.heif_image_is_premultiplied_alpha(img) != 0 {
+			premultiplied := image.NewRGBA(rect)
+			rgba, pix, stride = premultiplied, premultiplied.Pix, premultiplied.Stride
+		} else {
+			nrgba := image.NewNRGBA(rect)
+			rgba, pix, stride = nrgba, nrgba.Pix, nrgba.Stride
+		}
+		for y := 0; y < plane.height; y++ {
+			row := pix[y*stride : y*stride+plane.width*4]
+			copy(row, plane.data[y*plane.stride:])
+			if _, ok := rgba.(*image.RGBA); ok {
+				clampPremultiplied(row)
+			}
+		}
+		return rgba, nil
+	case C.heif_chroma_interleaved_RRGGBB_BE, C.heif_chroma_interleaved_RRGGBBAA_BE:
+		plane, err := getPlane(img, C.heif_channel_interleaved)
+		if err != nil {
+			return nil, err
+		}
+
+		channels := 3
+		if chroma == C.heif_chroma_interleaved_RRGGBBAA_BE {
+			channels = 4
+		}
+
+		rect := image.Rect(0, 0, plane.width, plane.height)
+		var rgba image.Image
+		var pix []byte
+		var stride int
+		if channels == 4 && C.heif_image_is_premultiplied_alpha(img) == 0 {
+			nrgba := image.NewNRGBA64(rect)
+			rgba, pix, stride = nrgba, nrgba.Pix, nrgba.Stride
+		} else {
+			premultiplied := image.NewRGBA64(rect)
+			rgba, pix, stride = premultiplied, premultiplied.Pix, premultiplied.Stride
+		}
+		for y := 0; y < plane.height; y++ {
+			for x := 0; x < plane.width; x++ {
+				src := y*plane.stride + x*channels*2
+				dst := y*stride + x*8
+				for c := 0; c < channels; c++ {
+					value := scaleTo16Bit(uint16(plane.data[src+c*2])<<8|uint16(plane.data[src+c*2+1]), plane.bitDepth)
+					pix[dst+c*2] = byte(value >> 8)
+					pix[dst+c*2+1] = byte(value)
+				}
+				if channels == 3 {
+					pix[dst+6] = 0xff
+					pix[dst+7] = 0xff
+				} else if _, ok := rgba.(*image.RGBA64); ok {
+					clampPremultiplied16(pix[dst : dst+8])
+				}
+			}
+		}
+		return rgba, nil
+	case C.heif_chroma_444:
+		r, err := getPlane(img, C.heif_channel_R)
+		if err != nil {
+			return nil, err
+		}
+		g, err := getPlane(img, C.heif_channel_G)
+		if err != nil {
+			return nil, err
+		}
+		b, err := getPlane(img, C.heif_channel_B)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.bitDepth > 8 {
+			rgba := image.NewRGBA64(image.Rect(0, 0, r.width, r.height))
+			for y := 0; y < r.height; y++ {
+				for x := 0; x < r.width; x++ {
+					dst := y*rgba.Stride + x*8
+					for c, plane := range []*heifPlane{r, g, b} {
+						src := y*plane.stride + x*2
+						value := scaleTo16Bit(uint16(plane.data[src])|uint16(plane.data[src+1])<<8, plane.bitDepth)
+						rgba.Pix[dst+c*2] = byte(value >> 8)
+						rgba.Pix[dst+c*2+1] = byte(value)
+					}
+					rgba.Pix[dst+6] = 0xff
+					rgba.Pix[dst+7] = 0xff
+				}
+			}
+			return rgba, nil
+		}
+
+		rgba := image.NewRGBA(image.Rect(0, 0, r.width, r.height))
+		for y := 0; y < r.height; y++ {
+			for x := 0; x < r.width; x++ {
+				dst := y*rgba.Stride + x*4
+				rgba.Pix[dst] = r.data[y*r.stride+x]
+				rgba.Pix[dst+1] = g.data[y*g.stride+x]
+				rgba.Pix[dst+2] = b.data[y*b.stride+x]
+				rgba.Pix[dst+3] = 0xff
+			}
+		}
+		return rgba, nil
+	}
+
+	return nil, fmt.Errorf("unsupported RGB chroma format: %d", chroma)
+}
+
+// scaleTo16Bit scales a value with the given bit depth to the full 16 bit range.
+func scaleTo16Bit(value uint16, bitDepth int) uint16 {
+	if bitDepth >= 16 || bitDepth <= 0 {
+		return value
+	}
+	return uint16(uint32(value) * 0xffff / (1<<bitDepth - 1))
+}
+
+// clampPremultiplied clamps the colors of 8 bit premultiplied RGBA pixels to
+// their alpha. Rounding in the encoder can make them exceed it, which Go
+// images do not allow, and which would overflow when compositing.
+func clampPremultiplied(pix []byte) {
+	for i := 0; i+4 <= len(pix); i += 4 {
+		alpha := pix[i+3]
+		for c := i; c < i+3; c++ {
+			if pix[c] > alpha {
+				pix[c] = alpha
+			}
+		}
+	}
+}
+
+// clampPremultiplied16 clamps the colors of a 16 bit big endian premultiplied
+// RGBA pixel to its alpha.
+func clampPremultiplied16(pixel []byte) {
+	alpha := uint16(pixel[6])<<8 | uint16(pixel[7])
+	for c := 0; c < 6; c += 2 {
+		if uint16(pixel[c])<<8|uint16(pixel[c+1]) > alpha {
+			pixel[c], pixel[c+1] = pixel[6], pixel[7]
+		}
+	}
+}
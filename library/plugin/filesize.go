@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+var errMaxFileSize = errors.New("image would exceed maximum filesize")
+
+// defaultMinQuality is the lowest quality that is tried to fit an image in
+// the maximum filesize when no minimum quality is given.
+const defaultMinQuality = 50
+
+// encodeFunc encodes the image with the given quality, the quality is 0 for
+// encoders without a quality setting.
+type encodeFunc func(w io.Writer, img image.Image, quality int) error
+
+// fileSizeFitter finds the best output that fits in a maximum filesize.
+type fileSizeFitter struct {
+	MaxFileSize int64 // The maximum filesize, 0 for no maximum.
+	Quality     int   // The preferred quality, 0 when the encoder has no quality setting.
+	MinQuality  int   // The lowest quality to try.
+	Downscale   bool  // Whether to downscale the image when the lowest quality does not fit.
+}
+
+// fit encodes the image, when the output does not fit it searches for the
+// highest quality that does fit, and when no quality fits and downscaling is
+// allowed, for the largest dimensions that do fit. It returns the output, the
+// image that was encoded, which is the scaled image when it had to be
+// downscaled, and the quality of the output.
+func (f fileSizeFitter) fit(img image.Image, encode encodeFunc) (*bytes.Buffer, image.Image, int, error) {
+	output, quality, fits, err := f.search(img, encode)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if fits {
+		return output, img, quality, nil
+	}
+
+	if !f.Downscale {
+		return nil, nil, 0, errMaxFileSize
+	}
+
+	bounds := img.Bounds()
+	scale := 1.0
+	for {
+		// The filesize scales about linearly with the amount of pixels, aim a
+		// bit lower to not need too many steps.
+		scale *= math.Min(math.Sqrt(float64(f.MaxFileSize)/float64(output.Len()))*0.9, 0.9)
+		width := int(math.Round(float64(bounds.Dx()) * scale))
+		height := int(math.Round(float64(bounds.Dy()) * scale))
+		if width < 1 || height < 1 {
+			return nil, nil, 0, errMaxFileSize
+		}
+
+		// Always scale from the original image to not stack up blur.
+		scaledImage := resizeImage(img, width, height)
+		output, quality, fits, err = f.search(scaledImage, encode)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		if fits {
+			return output, scaledImage, quality, nil
+		}
+	}
+}
+
+// search does a binary search over the quality for the highest quality that
+// fits. When nothing fits it returns the output with the lowest quality.
+func (f fileSizeFitter) search(img image.Image, encode encodeFunc) (*bytes.Buffer, int, bool, error) {
+	output := &bytes.Buffer{}
+	err := encode(output, img, f.Quality)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if f.fits(output) {
+		return output, f.Quality, true, nil
+	}
+
+	minQuality := f.MinQuality
+	if minQuality <= 0 {
+		minQuality = defaultMinQuality
+	}
+
+	if f.Quality == 0 || minQuality >= f.Quality {
+		return output, f.Quality, false, nil
+	}
+
+	output = &bytes.Buffer{}
+	err = encode(output, img, minQuality)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if !f.fits(output) {
+		return output, minQuality, false, nil
+	}
+
+	bestQuality := minQuality
+	low, high := minQuality+1, f.Quality-1
+	for low <= high {
+		quality := (low + high) / 2
+		candidate := &bytes.Buffer{}
+		err = encode(candidate, img, quality)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if f.fits(candidate) {
+			output, bestQuality = candidate, quality
+			low = quality + 1
+		} else {
+			high = quality - 1
+		}
+	}
+
+	return output, bestQuality, true, nil
+}
+
+func (f fileSizeFitter) fits(output *bytes.Buffer) bool {
+	return f.MaxFileSize == 0 || int64(output.Len()) <= f.MaxFileSize
+}
+
+// resizeImage scales the image to the given dimensions, keeping the bit depth
+// of the image.
+func resizeImage(img image.Image, width, height int) image.Image {
+	rect := image.Rect(0, 0, width, height)
+	var scaledImage draw.Image
+	switch img.(type) {
+	case *image.Gray:
+		scaledImage = image.NewGray(rect)
+	case *image.Gray16:
+		scaledImage = image.NewGray16(rect)
+	case *image.RGBA64, *image.NRGBA64:
+		scaledImage = image.NewRGBA64(rect)
+	default:
+		scaledImage = image.NewRGBA(rect)
+	}
+
+	draw.BiLinear.Scale(scaledImage, rect, img, img.Bounds(), draw.Src, nil)
+	return scaledImage
+}
@@ -0,0 +1,297 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+
+	"github.com/klippa-app/go-libheif/library/isobmff"
+	"github.com/klippa-app/go-libheif/library/plugin/gainmap"
+	"github.com/klippa-app/go-libheif/library/plugin/image_jpeg"
+	"github.com/klippa-app/go-libheif/library/plugin/image_png"
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+)
+
+// The color primaries of ITU-T H.273 for the cICP chunk of HDR PNG files.
+const (
+	colorPrimariesBT709       = 1
+	colorPrimariesUnspecified = 2
+	colorPrimariesDisplayP3   = 12
+)
+
+// imageGainMap is the HDR gain map of an image.
+type imageGainMap struct {
+	Type     responses.GainMapType
+	ID       int              // The item ID of the gain map image.
+	Metadata gainmap.Metadata // For Apple gain maps this is the metadata after gainmap.FromApple.
+}
+
+// findGainMap finds the gain map of the primary image in the items. ISO
+// 21496-1 gain maps are referenced by a tmap item, of which the inputs are the
+// primary image and the gain map. Apple gain maps are auxiliary images of the
+// primary image, their headroom is read from the EXIF data of the primary
+// image or the XMP data of the gain map. It returns nil when there is none.
+func findGainMap(data []byte, items []isobmff.Item, primaryID uint32, exif []byte) (*imageGainMap, error) {
+	for _, item := range items {
+		inputs := item.References["dimg"]
+		if item.Type != "tmap" || len(inputs) != 2 || inputs[0] != primaryID {
+			continue
+		}
+
+		metadata, err := isobmff.ReadItemData(data, item.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := gainmap.ParseISO21496(metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		return &imageGainMap{Type: responses.GainMapTypeISO21496, ID: int(inputs[1]), Metadata: *m}, nil
+	}
+
+	for _, item := range items {
+		if !isAppleGainMap(&item) || !containsID(item.References["auxl"], primaryID) {
+			continue
+		}
+
+		// Newer files store the headroom in the XMP data of the gain map.
+		var xmp []byte
+		for _, metadataItem := range items {
+			if metadataItem.Type == "mime" && containsID(metadataItem.References["cdsc"], item.ID) {
+				xmp, _ = isobmff.ReadItemData(data, metadataItem.ID)
+			}
+		}
+
+		return &imageGainMap{
+			Type:     responses.GainMapTypeApple,
+			ID:       int(item.ID),
+			Metadata: gainmap.AppleMetadata(gainmap.AppleHeadroom(exif, xmp)),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// isAppleGainMap returns whether the item is an auxiliary image with the
+// auxiliary type of Apple gain maps.
+func isAppleGainMap(item *isobmff.Item) bool {
+	auxC := item.Property("auxC")
+	if auxC == nil {
+		return false
+	}
+
+	_, _, auxType, err := isobmff.ReadFullBoxHeader(auxC.Payload)
+	if err != nil {
+		return false
+	}
+
+	if end := bytes.IndexByte(auxType, 0); end >= 0 {
+		auxType = auxType[:end]
+	}
+	return string(auxType) == gainmap.AppleAuxiliaryType
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// headroom returns the headroom of the HDR image as a factor of SDR white.
+func (g *imageGainMap) headroom() float64 {
+	return math.Exp2(g.Metadata.AlternateHDRHeadroom)
+}
+
+// gainMapHandle returns the handle of the gain map image and a function that
+// releases it. libheif only returns handles of top level images, so Apple gain
+// maps are opened as auxiliary images of the primary image, and ISO 21496-1
+// gain maps are opened as the primary image of a patched copy of the file.
+func gainMapHandle(data []byte, primaryHandle *C.struct_heif_image_handle, g *imageGainMap) (*C.struct_heif_image_handle, func(), error) {
+	if g.Type == responses.GainMapTypeApple {
+		var handle *C.struct_heif_image_handle
+		err := heifError(C.heif_image_handle_get_auxiliary_image_handle(primaryHandle, C.heif_item_id(g.ID), &handle))
+		if err != nil {
+			return nil, nil, err
+		}
+		return handle, func() { C.heif_image_handle_release(handle) }, nil
+	}
+
+	patched, err := isobmff.SetPrimaryItem(data, uint32(g.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, err := newHeifContext(patched)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handle, err := ctx.imageHandle(g.ID)
+	if err != nil {
+		ctx.free()
+		return nil, nil, err
+	}
+	return handle, func() {
+		C.heif_image_handle_release(handle)
+		ctx.free()
+	}, nil
+}
+
+// readGainMap finds and decodes the gain map of the primary image of the
+// file. Apple gain maps are converted to ISO 21496-1 gain maps. It returns nil
+// when the image has no gain map.
+func readGainMap(data []byte) (*imageGainMap, image.Image, error) {
+	items, err := isobmff.ReadItems(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, err := newHeifContext(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ctx.free()
+
+	id, err := ctx.primaryImageID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	primaryHandle, err := ctx.imageHandle(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer C.heif_image_handle_release(primaryHandle)
+
+	exif, err := readEXIF(primaryHandle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g, err := findGainMap(data, items, uint32(id), exif)
+	if err != nil || g == nil {
+		return nil, nil, err
+	}
+
+	handle, release, err := gainMapHandle(data, primaryHandle, g)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	gainMapImage, err := decodeHandle(handle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if g.Type == responses.GainMapTypeApple {
+		gainMapImage = gainmap.FromApple(gainMapImage, g.headroom())
+	}
+
+	return g, gainMapImage, nil
+}
+
+// probeGainMap returns the gain map of the primary image for Probe, or nil
+// when it has none.
+func probeGainMap(data []byte, items []isobmff.Item, primaryHandle *C.struct_heif_image_handle, primaryID int) (*responses.ProbeGainMap, error) {
+	exif, err := readEXIF(primaryHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := findGainMap(data, items, uint32(primaryID), exif)
+	if err != nil || g == nil {
+		return nil, err
+	}
+
+	handle, release, err := gainMapHandle(data, primaryHandle, g)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return &responses.ProbeGainMap{
+		Type:     g.Type,
+		ID:       g.ID,
+		Width:    int(C.heif_image_handle_get_width(handle)),
+		Height:   int(C.heif_image_handle_get_height(handle)),
+		Headroom: g.headroom(),
+	}, nil
+}
+
+// gainMapCICP returns the code points of the HDR PNG file of an applied gain
+// map. The primaries are those of the base image, Apple photos without an
+// nclx color profile are Display P3.
+func gainMapCICP(g *imageGainMap, metadata *imageMetadata) *image_png.CICP {
+	primaries := colorPrimariesBT709
+	if metadata.NCLX != nil && metadata.NCLX.ColorPrimaries != colorPrimariesUnspecified {
+		primaries = metadata.NCLX.ColorPrimaries
+	} else if g.Type == responses.GainMapTypeApple {
+		primaries = colorPrimariesDisplayP3
+	}
+
+	return &image_png.CICP{
+		ColorPrimaries:          uint8(primaries),
+		TransferCharacteristics: uint8(tonemap.TransferPQ),
+		FullRange:               true,
+	}
+}
+
+// checkGainMapRequest validates the gain map mode against the output format.
+func checkGainMapRequest(request *requests.RenderFile) error {
+	switch request.GainMap {
+	case requests.RenderFileGainMapIgnore:
+	case requests.RenderFileGainMapApply:
+		if request.OutputFormat != requests.RenderFileOutputFormatPNG {
+			return errors.New("applying the gain map is only supported for png output")
+		}
+	case requests.RenderFileGainMapUltraHDR:
+		if request.OutputFormat != requests.RenderFileOutputFormatJPG {
+			return errors.New("ultrahdr is only supported for jpg output")
+		}
+	default:
+		return errors.New("invalid gain map mode given")
+	}
+	return nil
+}
+
+// ultraHDREncoder wraps the JPEG encoder to write UltraHDR files, the gain map
+// is encoded with the same quality as the image.
+func ultraHDREncoder(encode encodeFunc, gainMapImage image.Image, m gainmap.Metadata) encodeFunc {
+	return func(w io.Writer, img image.Image, quality int) error {
+		primary := &bytes.Buffer{}
+		err := encode(primary, img, quality)
+		if err != nil {
+			return err
+		}
+
+		gainMapJPEG := &bytes.Buffer{}
+		err = image_jpeg.Encode(gainMapJPEG, gainMapImage, image_jpeg.Options{
+			Options: &jpeg.Options{
+				Quality: quality,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return gainmap.EncodeUltraHDR(w, primary.Bytes(), gainMapJPEG.Bytes(), m)
+	}
+}
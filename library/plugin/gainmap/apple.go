@@ -0,0 +1,166 @@
+package gainmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// AppleAuxiliaryType is the auxiliary type of the gain map image in HEIF
+// files of Apple devices.
+const AppleAuxiliaryType = "urn:com:apple:photo:2020:aux:hdrgainmap"
+
+// defaultAppleStops is the headroom in stops when the file does not say, the
+// highest headroom of the formula for photos that are not overexposed.
+const defaultAppleStops = 1.8
+
+// The EXIF tags that lead to the Apple maker note.
+const (
+	tagExifIFD   = 0x8769
+	tagMakerNote = 0x927c
+
+	tagAppleHDRHeadroom = 0x21
+	tagAppleHDRGain     = 0x30
+)
+
+var appleXMPHeadroom = regexp.MustCompile(`HDRGainMapHeadroom(?:="|>)([0-9.]+)`)
+
+// AppleHeadroom returns the HDR headroom of an Apple gain map, as a linear
+// factor over SDR white. It's computed from the HDR values in the maker note
+// of the EXIF data of the base image, as Apple documents, or taken from the
+// XMP data of the gain map image of newer files, where it's in stops.
+func AppleHeadroom(exif, xmp []byte) float64 {
+	if headroom, gain, ok := appleMakerNoteValues(exif); ok {
+		var stops float64
+		switch {
+		case headroom < 1 && gain <= 0.01:
+			stops = -20*gain + 1.8
+		case headroom < 1:
+			stops = -0.101*gain + 1.601
+		case gain <= 0.01:
+			stops = -70*gain + 3
+		default:
+			stops = -0.303*gain + 2.303
+		}
+		return math.Exp2(math.Max(stops, 0))
+	}
+
+	if match := appleXMPHeadroom.FindSubmatch(xmp); match != nil {
+		if stops, err := strconv.ParseFloat(string(match[1]), 64); err == nil {
+			return math.Exp2(math.Max(stops, 0))
+		}
+	}
+
+	return math.Exp2(defaultAppleStops)
+}
+
+// appleMakerNoteValues reads the HDR headroom and gain tags of the Apple maker
+// note in the EXIF data, which is a TIFF structure.
+func appleMakerNoteValues(exif []byte) (float64, float64, bool) {
+	order, ifd, ok := tiffHeader(exif)
+	if !ok {
+		return 0, 0, false
+	}
+
+	exifIFD, ok := findEntry(exif, order, ifd, tagExifIFD)
+	if !ok {
+		return 0, 0, false
+	}
+
+	makerNote, ok := findEntry(exif, order, int(order.Uint32(exif[exifIFD+8:])), tagMakerNote)
+	if !ok {
+		return 0, 0, false
+	}
+
+	// The maker note starts with a signature and has its own byte order,
+	// its offsets are relative to its start.
+	start := int(order.Uint32(exif[makerNote+8:]))
+	if start < 0 || start+14 > len(exif) || !bytes.HasPrefix(exif[start:], []byte("Apple iOS\x00")) {
+		return 0, 0, false
+	}
+
+	note := exif[start:]
+	var noteOrder binary.ByteOrder = binary.BigEndian
+	if string(note[12:14]) == "II" {
+		noteOrder = binary.LittleEndian
+	}
+
+	headroom, ok := rationalEntry(note, noteOrder, 14, tagAppleHDRHeadroom)
+	if !ok {
+		return 0, 0, false
+	}
+
+	gain, ok := rationalEntry(note, noteOrder, 14, tagAppleHDRGain)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return headroom, gain, true
+}
+
+// tiffHeader reads the byte order and the offset of the first IFD of a TIFF
+// structure.
+func tiffHeader(tiff []byte) (binary.ByteOrder, int, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+
+	return order, int(order.Uint32(tiff[4:])), true
+}
+
+// findEntry returns the offset of the entry with the tag in the IFD.
+func findEntry(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) (int, bool) {
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+
+		if order.Uint16(tiff[entry:]) == tag {
+			return entry, true
+		}
+	}
+
+	return 0, false
+}
+
+// rationalEntry reads a rational or signed rational value of an IFD entry.
+func rationalEntry(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) (float64, bool) {
+	entry, ok := findEntry(tiff, order, ifd, tag)
+	if !ok {
+		return 0, false
+	}
+
+	valueType := order.Uint16(tiff[entry+2:])
+	offset := int(order.Uint32(tiff[entry+8:]))
+	if (valueType != 5 && valueType != 10) || offset < 0 || offset+8 > len(tiff) {
+		return 0, false
+	}
+
+	denominator := order.Uint32(tiff[offset+4:])
+	if denominator == 0 {
+		return 0, false
+	}
+
+	if valueType == 10 {
+		return float64(int32(order.Uint32(tiff[offset:]))) / float64(int32(denominator)), true
+	}
+	return float64(order.Uint32(tiff[offset:])) / float64(denominator), true
+}
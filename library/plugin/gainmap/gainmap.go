@@ -0,0 +1,184 @@
+// Package gainmap reads HDR gain maps, applies them to SDR images and writes
+// them into UltraHDR JPEG files. The metadata follows ISO 21496-1, Apple gain
+// maps are converted to it.
+package gainmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+	"golang.org/x/image/draw"
+)
+
+// HDRBaseUnsupportedError is returned when the base image is the HDR image
+// and the gain map maps it to SDR.
+var HDRBaseUnsupportedError = errors.New("gain maps with an HDR base image are not supported")
+
+// sdrWhiteLuminance is the luminance of SDR white in the HDR output, the
+// reference white of BT.2408.
+const sdrWhiteLuminance = 203
+
+type Metadata struct {
+	Channels             int        // The amount of channels of the gain map, 1 or 3.
+	GainMapMin           [3]float64 // The log2 of the boost at a gain map value of 0, per channel.
+	GainMapMax           [3]float64 // The log2 of the boost at a gain map value of 1, per channel.
+	Gamma                [3]float64 // The gamma that the gain map values are encoded with, per channel.
+	OffsetSDR            [3]float64 // Added to the SDR values before they are boosted, per channel.
+	OffsetHDR            [3]float64 // Subtracted from the boosted values, per channel.
+	BaseHDRHeadroom      float64    // The log2 of the HDR headroom of the base image, 0 for an SDR base image.
+	AlternateHDRHeadroom float64    // The log2 of the HDR headroom of the image with the gain map fully applied.
+}
+
+// ParseISO21496 parses the binary gain map metadata of ISO 21496-1, as it's
+// stored in the tmap item of a HEIF file.
+func ParseISO21496(data []byte) (*Metadata, error) {
+	if len(data) < 6 {
+		return nil, errors.New("gain map metadata is too short")
+	}
+
+	if data[0] != 0 || binary.BigEndian.Uint16(data[1:]) != 0 {
+		return nil, errors.New("unsupported gain map metadata version")
+	}
+
+	m := &Metadata{Channels: 1}
+	if data[5]&0x80 != 0 {
+		m.Channels = 3
+	}
+
+	data = data[6:]
+	fractions := make([]float64, 0, 2+5*m.Channels)
+	for i := 0; i < cap(fractions); i++ {
+		if len(data) < 8 {
+			return nil, errors.New("gain map metadata is too short")
+		}
+
+		denominator := binary.BigEndian.Uint32(data[4:])
+		if denominator == 0 {
+			return nil, errors.New("gain map metadata has a zero denominator")
+		}
+
+		// The headrooms and the gamma are unsigned, the rest is signed.
+		numerator := float64(int32(binary.BigEndian.Uint32(data)))
+		if i < 2 || (i-2)%5 == 2 {
+			numerator = float64(binary.BigEndian.Uint32(data))
+		}
+		fractions = append(fractions, numerator/float64(denominator))
+		data = data[8:]
+	}
+
+	m.BaseHDRHeadroom, m.AlternateHDRHeadroom = fractions[0], fractions[1]
+	for c := 0; c < 3; c++ {
+		channel := fractions[2+5*(c%m.Channels):]
+		m.GainMapMin[c] = channel[0]
+		m.GainMapMax[c] = channel[1]
+		m.Gamma[c] = channel[2]
+		m.OffsetSDR[c] = channel[3]
+		m.OffsetHDR[c] = channel[4]
+		if m.Gamma[c] <= 0 {
+			return nil, errors.New("gain map metadata has an invalid gamma")
+		}
+	}
+
+	return m, nil
+}
+
+// AppleMetadata returns the metadata of an Apple gain map that has been
+// converted with FromApple.
+func AppleMetadata(headroom float64) Metadata {
+	stops := math.Max(math.Log2(headroom), 0)
+	return Metadata{
+		Channels:             1,
+		GainMapMax:           [3]float64{stops, stops, stops},
+		Gamma:                [3]float64{1, 1, 1},
+		AlternateHDRHeadroom: stops,
+	}
+}
+
+// FromApple converts an Apple gain map to a gain map with the metadata of
+// AppleMetadata. Apple gain maps are encoded with the sRGB transfer and boost
+// the linear SDR values by 1 + (headroom - 1) * gain, while ISO 21496-1 gain
+// maps boost them by 2 to the power of the gain in stops.
+func FromApple(gainMap image.Image, headroom float64) *image.Gray {
+	var values [256]uint8
+	if headroom > 1 {
+		for i := range values {
+			boost := 1 + (headroom-1)*srgbToLinear(float64(i)/255)
+			values[i] = uint8(math.Round(math.Log2(boost) / math.Log2(headroom) * 255))
+		}
+	}
+
+	bounds := gainMap.Bounds()
+	out := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray := color.GrayModel.Convert(gainMap.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			out.Pix[y*out.Stride+x] = values[gray.Y]
+		}
+	}
+	return out
+}
+
+// Apply fully applies the gain map to the base image, which has the sRGB
+// transfer. It returns the HDR image with the PQ transfer, where SDR white is
+// at 203 cd/m². The primaries stay those of the base image.
+func Apply(base, gainMap image.Image, m Metadata) (*image.NRGBA64, error) {
+	if m.AlternateHDRHeadroom <= m.BaseHDRHeadroom {
+		return nil, HDRBaseUnsupportedError
+	}
+
+	bounds := base.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// The gain map usually has a lower resolution than the base image.
+	gain := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(gain, gain.Bounds(), gainMap, gainMap.Bounds(), draw.Src, nil)
+
+	var boosts [3][256]float64
+	for c := range boosts {
+		for v := range boosts[c] {
+			recovery := math.Pow(float64(v)/255, 1/m.Gamma[c])
+			boosts[c][v] = math.Exp2(m.GainMapMin[c] + (m.GainMapMax[c]-m.GainMapMin[c])*recovery)
+		}
+	}
+
+	linear := make([]float64, 1<<16)
+	for i := range linear {
+		linear[i] = srgbToLinear(float64(i) / 0xffff)
+	}
+
+	out := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := color.NRGBA64Model.Convert(base.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+			sdr := [3]uint16{pixel.R, pixel.G, pixel.B}
+			gainOffset := gain.PixOffset(x, y)
+
+			var hdr [3]uint16
+			for c := range sdr {
+				g := gain.Pix[gainOffset+c]
+				if m.Channels == 1 {
+					g = gain.Pix[gainOffset]
+				}
+
+				value := (linear[sdr[c]]+m.OffsetSDR[c])*boosts[c][g] - m.OffsetHDR[c]
+				hdr[c] = uint16(math.Round(tonemap.EncodePQ(value*sdrWhiteLuminance) * 0xffff))
+			}
+
+			out.SetNRGBA64(x, y, color.NRGBA64{R: hdr[0], G: hdr[1], B: hdr[2], A: pixel.A})
+		}
+	}
+
+	return out, nil
+}
+
+// srgbToLinear is the sRGB EOTF.
+func srgbToLinear(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
@@ -0,0 +1,224 @@
+package gainmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+// iso21496 returns the binary metadata of a single channel gain map.
+func iso21496(baseHeadroom, alternateHeadroom, min, max, gamma, offsetSDR, offsetHDR float64) []byte {
+	data := []byte{0, 0, 0, 0, 0, 0}
+	for _, value := range []float64{baseHeadroom, alternateHeadroom, min, max, gamma, offsetSDR, offsetHDR} {
+		data = binary.BigEndian.AppendUint32(data, uint32(int32(math.Round(value*10000))))
+		data = binary.BigEndian.AppendUint32(data, 10000)
+	}
+	return data
+}
+
+func TestParseISO21496(t *testing.T) {
+	m, err := ParseISO21496(iso21496(0, 2.5, -0.5, 2.5, 1.25, 1.0/64, 1.0/64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Channels != 1 || m.BaseHDRHeadroom != 0 || m.AlternateHDRHeadroom != 2.5 {
+		t.Errorf("Unexpected metadata %+v", m)
+	}
+
+	for c := 0; c < 3; c++ {
+		if m.GainMapMin[c] != -0.5 || m.GainMapMax[c] != 2.5 || m.Gamma[c] != 1.25 || m.OffsetSDR[c] != 0.0156 {
+			t.Errorf("Unexpected values of channel %d in %+v", c, m)
+		}
+	}
+
+	_, err = ParseISO21496(iso21496(0, 2.5, 0, 2.5, 1, 0, 0)[:30])
+	if err == nil {
+		t.Error("Expected an error for truncated metadata")
+	}
+
+	_, err = ParseISO21496(iso21496(0, 2.5, 0, 2.5, 0, 0, 0))
+	if err == nil {
+		t.Error("Expected an error for a zero gamma")
+	}
+
+	_, err = ParseISO21496(append([]byte{1}, iso21496(0, 2.5, 0, 2.5, 1, 0, 0)[1:]...))
+	if err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestFromApple(t *testing.T) {
+	gainMap := image.NewGray(image.Rect(0, 0, 3, 1))
+	gainMap.Pix = []uint8{0, 128, 255}
+
+	converted := FromApple(gainMap, 4)
+	if converted.Pix[0] != 0 || converted.Pix[2] != 255 {
+		t.Errorf("Expected the ends of the gain map to stay, got %v", converted.Pix)
+	}
+
+	// Both encodings have to give the same boost.
+	m := AppleMetadata(4)
+	apple := 1 + 3*srgbToLinear(128.0/255)
+	iso := math.Exp2(m.GainMapMax[0] * float64(converted.Pix[1]) / 255)
+	if math.Abs(apple-iso)/apple > 0.01 {
+		t.Errorf("Expected a boost of %f, got %f", apple, iso)
+	}
+}
+
+// appleExif returns big endian EXIF data with an Apple maker note that has
+// the HDR headroom and gain tags.
+func appleExif(headroom, gain float64) []byte {
+	note := []byte("Apple iOS\x00\x00\x01MM")
+	note = binary.BigEndian.AppendUint16(note, 2)
+	valueOffset := uint32(len(note) + 2*12 + 4)
+	for i, tag := range []uint16{tagAppleHDRHeadroom, tagAppleHDRGain} {
+		note = binary.BigEndian.AppendUint16(note, tag)
+		note = binary.BigEndian.AppendUint16(note, 10)
+		note = binary.BigEndian.AppendUint32(note, 1)
+		note = binary.BigEndian.AppendUint32(note, valueOffset+uint32(i*8))
+	}
+	note = binary.BigEndian.AppendUint32(note, 0)
+	for _, value := range []float64{headroom, gain} {
+		note = binary.BigEndian.AppendUint32(note, uint32(int32(math.Round(value*100000))))
+		note = binary.BigEndian.AppendUint32(note, 100000)
+	}
+
+	// The TIFF header, IFD0 with the EXIF IFD and the EXIF IFD with the
+	// maker note, followed by the maker note.
+	exif := []byte("MM\x00*\x00\x00\x00\x08")
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = append(exif, 0x87, 0x69, 0, 4, 0, 0, 0, 1, 0, 0, 0, 26)
+	exif = binary.BigEndian.AppendUint32(exif, 0)
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = append(exif, 0x92, 0x7c, 0, 7)
+	exif = binary.BigEndian.AppendUint32(exif, uint32(len(note)))
+	exif = binary.BigEndian.AppendUint32(exif, 44)
+	exif = binary.BigEndian.AppendUint32(exif, 0)
+	return append(exif, note...)
+}
+
+func TestAppleHeadroom(t *testing.T) {
+	tests := []struct {
+		name  string
+		exif  []byte
+		xmp   []byte
+		stops float64
+	}{
+		{name: "maker note, low headroom", exif: appleExif(0.5, 0.005), stops: 1.7},
+		{name: "maker note, high headroom", exif: appleExif(1.5, 0.5), stops: 2.1515},
+		{name: "xmp", xmp: []byte(`<rdf:Description HDRGainMapHeadroom="2.5"/>`), stops: 2.5},
+		{name: "nothing", stops: defaultAppleStops},
+	}
+
+	for _, test := range tests {
+		if got := math.Log2(AppleHeadroom(test.exif, test.xmp)); math.Abs(got-test.stops) > 0.0001 {
+			t.Errorf("%s: expected %f stops, got %f", test.name, test.stops, got)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	base := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for i := range base.Pix {
+		base.Pix[i] = 255
+	}
+
+	// No boost on the left half, a full boost on the right half.
+	gainMap := image.NewGray(image.Rect(0, 0, 2, 1))
+	gainMap.Pix = []uint8{0, 255}
+
+	out, err := Apply(base, gainMap, AppleMetadata(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x, luminance := range map[int]float64{0: 203, 3: 4 * 203} {
+		want := uint16(math.Round(tonemap.EncodePQ(luminance) * 0xffff))
+		if got := out.NRGBA64At(x, 0); got.R != want || got.G != want || got.B != want || got.A != 0xffff {
+			t.Errorf("Expected %f cd/m² at %d, got %+v instead of %d", luminance, x, got, want)
+		}
+	}
+
+	m := AppleMetadata(4)
+	m.BaseHDRHeadroom = m.AlternateHDRHeadroom
+	if _, err = Apply(base, gainMap, m); err != HDRBaseUnsupportedError {
+		t.Errorf("Expected HDRBaseUnsupportedError, got %v", err)
+	}
+}
+
+func TestEncodeUltraHDR(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	base := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for i := range base.Pix {
+		base.Pix[i] = 200
+	}
+	gainMap := image.NewGray(image.Rect(0, 0, 8, 4))
+
+	primary, gainMapJPEG := encode(base), encode(gainMap)
+	m := AppleMetadata(4)
+	m.Channels = 3
+	m.GainMapMin = [3]float64{0, 0.5, 1}
+
+	buf := &bytes.Buffer{}
+	if err := EncodeUltraHDR(buf, primary, gainMapJPEG, m); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.Bytes()
+
+	// Go decodes the primary image and ignores the rest.
+	img, err := jpeg.Decode(bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != base.Bounds() {
+		t.Errorf("Expected the primary image bounds %v, got %v", base.Bounds(), img.Bounds())
+	}
+
+	// The second MP entry points at the gain map, relative to the TIFF
+	// header of the MPF segment.
+	mpfStart := bytes.Index(output, []byte("MPF\x00")) + 4
+	entries := mpfStart + 8 + 2 + 3*12 + 4
+	size := int(binary.BigEndian.Uint32(output[entries+16+4:]))
+	offset := mpfStart + int(binary.BigEndian.Uint32(output[entries+16+8:]))
+	if offset+size != len(output) {
+		t.Fatalf("Expected the gain map to end at %d, got %d", len(output), offset+size)
+	}
+
+	if primaryLength := int(binary.BigEndian.Uint32(output[entries+4:])); primaryLength != offset {
+		t.Errorf("Expected the primary image to be %d bytes, got %d", offset, primaryLength)
+	}
+
+	gainMapFile := output[offset:]
+	if _, err = jpeg.Decode(bytes.NewReader(gainMapFile)); err != nil {
+		t.Errorf("Could not decode the gain map: %v", err)
+	}
+
+	for _, want := range []string{`hdrgm:HDRCapacityMax="2"`, `hdrgm:GainMapMax="2"`, `<rdf:li>0.5</rdf:li>`} {
+		if !strings.Contains(string(gainMapFile), want) {
+			t.Errorf("Expected the gain map XMP data to contain %s", want)
+		}
+	}
+
+	if !strings.Contains(string(output[:offset]), `Item:Length="`+strconv.Itoa(size)+`"`) {
+		t.Error("Expected the primary XMP data to contain the length of the gain map")
+	}
+
+	if err = EncodeUltraHDR(&bytes.Buffer{}, []byte("not a jpeg"), gainMapJPEG, m); err == nil {
+		t.Error("Expected an error for an invalid primary image")
+	}
+}
@@ -0,0 +1,152 @@
+package gainmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// xmpSignature starts the APP1 segment of XMP data in a JPEG file.
+const xmpSignature = "http://ns.adobe.com/xap/1.0/\x00"
+
+// The MP entry attribute of the primary image: a baseline JPEG that is the
+// representative image.
+const mpPrimaryAttribute = 0x20030000
+
+// EncodeUltraHDR writes an UltraHDR JPEG file, which is the primary JPEG file
+// with the gain map JPEG file appended. The files are linked with XMP data in
+// the format of Google and Adobe, and a Multi-Picture Format segment.
+func EncodeUltraHDR(w io.Writer, primary, gainMap []byte, m Metadata) error {
+	if !bytes.HasPrefix(primary, []byte{0xff, 0xd8}) || !bytes.HasPrefix(gainMap, []byte{0xff, 0xd8}) {
+		return errors.New("the primary image and the gain map must be JPEG files")
+	}
+
+	gainMapXMP, err := app1XMP(gainMapXMPData(m))
+	if err != nil {
+		return err
+	}
+	gainMapFile := append(append([]byte{0xff, 0xd8}, gainMapXMP...), gainMap[2:]...)
+
+	primaryXMP, err := app1XMP(primaryXMPData(len(gainMapFile)))
+	if err != nil {
+		return err
+	}
+
+	// The JFIF segment has to stay the first segment.
+	insert := 2
+	if len(primary) > 6 && primary[2] == 0xff && primary[3] == 0xe0 {
+		insert += 2 + int(binary.BigEndian.Uint16(primary[4:]))
+		if insert > len(primary) {
+			return errors.New("invalid primary JPEG file")
+		}
+	}
+
+	// The MPF segment is 4 bytes of marker and length, 4 bytes of signature
+	// and then the TIFF structure, of which the offsets are relative to its
+	// start.
+	const mpfLength = 2 + 4 + 8 + 2 + 3*12 + 4 + 2*16
+	mpfStart := insert + len(primaryXMP) + 8
+	primaryLength := len(primary) + len(primaryXMP) + 2 + mpfLength
+
+	mpf := make([]byte, 0, 2+mpfLength)
+	mpf = append(mpf, 0xff, 0xe2)
+	mpf = binary.BigEndian.AppendUint16(mpf, mpfLength)
+	mpf = append(mpf, "MPF\x00MM\x00\x2a"...)
+	mpf = binary.BigEndian.AppendUint32(mpf, 8)
+	mpf = binary.BigEndian.AppendUint16(mpf, 3)
+	mpf = appendMPFEntry(mpf, 0xb000, 7, 4, binary.BigEndian.Uint32([]byte("0100")))
+	mpf = appendMPFEntry(mpf, 0xb001, 4, 1, 2)
+	mpf = appendMPFEntry(mpf, 0xb002, 7, 2*16, 8+2+3*12+4)
+	mpf = binary.BigEndian.AppendUint32(mpf, 0)
+	mpf = appendMPEntry(mpf, mpPrimaryAttribute, primaryLength, 0)
+	mpf = appendMPEntry(mpf, 0, len(gainMapFile), primaryLength-mpfStart)
+
+	output := make([]byte, 0, primaryLength+len(gainMapFile))
+	output = append(output, primary[:insert]...)
+	output = append(output, primaryXMP...)
+	output = append(output, mpf...)
+	output = append(output, primary[insert:]...)
+	output = append(output, gainMapFile...)
+
+	_, err = w.Write(output)
+	return err
+}
+
+func appendMPFEntry(b []byte, tag, valueType uint16, count, value uint32) []byte {
+	b = binary.BigEndian.AppendUint16(b, tag)
+	b = binary.BigEndian.AppendUint16(b, valueType)
+	b = binary.BigEndian.AppendUint32(b, count)
+	return binary.BigEndian.AppendUint32(b, value)
+}
+
+func appendMPEntry(b []byte, attribute uint32, size, offset int) []byte {
+	b = binary.BigEndian.AppendUint32(b, attribute)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = binary.BigEndian.AppendUint32(b, uint32(offset))
+	return append(b, 0, 0, 0, 0)
+}
+
+// app1XMP returns an APP1 segment with the XMP data.
+func app1XMP(xmp string) ([]byte, error) {
+	length := 2 + len(xmpSignature) + len(xmp)
+	if length > 0xffff {
+		return nil, errors.New("xmp data is too large for a jpeg segment")
+	}
+
+	segment := []byte{0xff, 0xe1, byte(length >> 8), byte(length)}
+	segment = append(segment, xmpSignature...)
+	return append(segment, xmp...), nil
+}
+
+// primaryXMPData returns the XMP data of the primary image, which lists the
+// images in the file.
+func primaryXMPData(gainMapLength int) string {
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/">` +
+		`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:Container="http://ns.google.com/photos/1.0/container/" xmlns:Item="http://ns.google.com/photos/1.0/container/item/" xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="1.0">` +
+		`<Container:Directory><rdf:Seq>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg"/></rdf:li>` +
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="GainMap" Item:Mime="image/jpeg" Item:Length="` + strconv.Itoa(gainMapLength) + `"/></rdf:li>` +
+		`</rdf:Seq></Container:Directory>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+}
+
+// gainMapXMPData returns the XMP data of the gain map image, which holds the
+// metadata. Values that differ per channel are written as a sequence.
+func gainMapXMPData(m Metadata) string {
+	attributes := ""
+	elements := ""
+	add := func(name string, values [3]float64) {
+		if m.Channels == 1 || (values[0] == values[1] && values[1] == values[2]) {
+			attributes += fmt.Sprintf(` hdrgm:%s="%s"`, name, formatFloat(values[0]))
+			return
+		}
+
+		elements += fmt.Sprintf(`<hdrgm:%s><rdf:Seq>`, name)
+		for _, value := range values {
+			elements += `<rdf:li>` + formatFloat(value) + `</rdf:li>`
+		}
+		elements += fmt.Sprintf(`</rdf:Seq></hdrgm:%s>`, name)
+	}
+
+	add("GainMapMin", m.GainMapMin)
+	add("GainMapMax", m.GainMapMax)
+	add("Gamma", m.Gamma)
+	add("OffsetSDR", m.OffsetSDR)
+	add("OffsetHDR", m.OffsetHDR)
+
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/">` +
+		`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:hdrgm="http://ns.adobe.com/hdr-gain-map/1.0/" hdrgm:Version="1.0"` + attributes +
+		` hdrgm:HDRCapacityMin="` + formatFloat(m.BaseHDRHeadroom) + `"` +
+		` hdrgm:HDRCapacityMax="` + formatFloat(m.AlternateHDRHeadroom) + `"` +
+		` hdrgm:BaseRenditionIsHDR="False">` + elements +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
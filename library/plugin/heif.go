@@ -0,0 +1,98 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+func heifError(err C.struct_heif_error) error {
+	if err.code == C.heif_error_Ok {
+		return nil
+	}
+	return fmt.Errorf("libheif error: %s", C.GoString(err.message))
+}
+
+// heifContext wraps the libheif C API directly instead of using the Go binding
+// of libheif: the binding requires a libheif version as new as its own Go
+// module version, it can't convert monochrome images, which JPEG coded and
+// uncompressed images often are, and it doesn't give access to the auxiliary
+// images and the decoding options that the worker needs.
+type heifContext struct {
+	context *C.struct_heif_context
+}
+
+// newHeifContext reads the given data into a new libheif context. The data is
+// copied by libheif, the context must be freed when done.
+func newHeifContext(data []byte) (*heifContext, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data given")
+	}
+
+	context := C.heif_context_alloc()
+	if context == nil {
+		return nil, errors.New("could not allocate libheif context")
+	}
+
+	err := heifError(C.heif_context_read_from_memory(context, unsafe.Pointer(&data[0]), C.size_t(len(data)), nil))
+	if err != nil {
+		C.heif_context_free(context)
+		return nil, err
+	}
+
+	return &heifContext{context: context}, nil
+}
+
+func (c *heifContext) free() {
+	C.heif_context_free(c.context)
+	c.context = nil
+}
+
+func (c *heifContext) primaryImageID() (int, error) {
+	var id C.heif_item_id
+	err := heifError(C.heif_context_get_primary_image_ID(c.context, &id))
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func (c *heifContext) topLevelImageIDs() []int {
+	count := C.heif_context_get_number_of_top_level_images(c.context)
+	if count <= 0 {
+		return nil
+	}
+
+	ids := make([]C.heif_item_id, count)
+	count = C.heif_context_get_list_of_top_level_image_IDs(c.context, &ids[0], count)
+
+	result := make([]int, count)
+	for i := range result {
+		result[i] = int(ids[i])
+	}
+	return result
+}
+
+// imageHandle returns the handle of the image with the given ID, the handle
+// must be released when done.
+func (c *heifContext) imageHandle(id int) (*C.struct_heif_image_handle, error) {
+	var handle *C.struct_heif_image_handle
+	err := heifError(C.heif_context_get_image_handle(c.context, C.heif_item_id(id), &handle))
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+func brandToString(brand C.heif_brand2) string {
+	fourcc := make([]byte, 4)
+	C.heif_brand_to_fourcc(brand, (*C.char)(unsafe.Pointer(&fourcc[0])))
+	return string(fourcc)
+}
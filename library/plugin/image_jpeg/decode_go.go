@@ -0,0 +1,24 @@
+//go:build !go_libheif_use_turbojpeg
+
+package image_jpeg
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// TurboJPEG is whether JPEG files are encoded and decoded with libjpeg-turbo.
+const TurboJPEG = false
+
+// CodingOptions is whether OptimizeCoding, ArithmeticCoding and
+// RestartInterval are available, they need TurboJPEG 3.
+const CodingOptions = false
+
+func Decode(r io.Reader) (image.Image, error) {
+	return jpeg.Decode(r)
+}
+
+func Transform(data []byte, o TransformOptions) ([]byte, error) {
+	return nil, TransformUnsupportedError
+}
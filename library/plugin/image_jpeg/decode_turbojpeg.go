@@ -0,0 +1,190 @@
+//go:build go_libheif_use_turbojpeg
+
+package image_jpeg
+
+/*
+#cgo pkg-config: libturbojpeg
+#include <turbojpeg.h>
+
+static int decompressToYUVPlanes(tjhandle handle, const unsigned char *jpegBuf, unsigned long jpegSize,
+	unsigned char *y, unsigned char *cb, unsigned char *cr, int width, int yStride, int cStride, int height) {
+	unsigned char *planes[3] = {y, cb, cr};
+	int strides[3] = {yStride, cStride, cStride};
+	return tjDecompressToYUVPlanes(handle, jpegBuf, jpegSize, planes, width, strides, height, 0);
+}
+
+static int mcuWidth(int subsamp) {
+	return tjMCUWidth[subsamp];
+}
+
+static int mcuHeight(int subsamp) {
+	return tjMCUHeight[subsamp];
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"unsafe"
+)
+
+var samplingRatios = map[Sampling]image.YCbCrSubsampleRatio{
+	Sampling444: image.YCbCrSubsampleRatio444,
+	Sampling422: image.YCbCrSubsampleRatio422,
+	Sampling420: image.YCbCrSubsampleRatio420,
+	Sampling440: image.YCbCrSubsampleRatio440,
+	Sampling411: image.YCbCrSubsampleRatio411,
+}
+
+// Decode decodes a JPEG image with turbojpeg. Like the Go decoder, it returns
+// an *image.YCbCr for color images and an *image.Gray for grayscale images.
+// CMYK images are decoded by the Go decoder.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("no data given")
+	}
+
+	decoder := C.tjInitDecompress()
+	defer C.tjDestroy(decoder)
+
+	jpegBuf, jpegSize := (*C.uchar)(&data[0]), C.ulong(len(data))
+
+	var width, height, subsamp, colorspace C.int
+	err = makeError(decoder, C.tjDecompressHeader3(decoder, jpegBuf, jpegSize, &width, &height, &subsamp, &colorspace))
+	if err != nil {
+		return nil, err
+	}
+
+	rect := image.Rect(0, 0, int(width), int(height))
+	switch colorspace {
+	case C.TJCS_GRAY:
+		img := image.NewGray(rect)
+		err = makeError(decoder, C.tjDecompress2(decoder, jpegBuf, jpegSize, (*C.uchar)(&img.Pix[0]), width, C.int(img.Stride), height, C.TJPF_GRAY, 0))
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	case C.TJCS_YCbCr:
+		if ratio, ok := samplingRatios[Sampling(subsamp)]; ok {
+			img := image.NewYCbCr(rect, ratio)
+			err = makeError(decoder, C.decompressToYUVPlanes(decoder, jpegBuf, jpegSize, (*C.uchar)(&img.Y[0]), (*C.uchar)(&img.Cb[0]), (*C.uchar)(&img.Cr[0]),
+				width, C.int(img.YStride), C.int(img.CStride), height))
+			if err != nil {
+				return nil, err
+			}
+			return img, nil
+		}
+	case C.TJCS_CMYK, C.TJCS_YCCK:
+		// The Go decoder knows how to handle the inverted CMYK of Adobe.
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+
+	img := image.NewRGBA(rect)
+	err = makeError(decoder, C.tjDecompress2(decoder, jpegBuf, jpegSize, (*C.uchar)(&img.Pix[0]), width, C.int(img.Stride), height, C.TJPF_RGBA, 0))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+var transformOperations = map[Operation]C.int{
+	OperationNone:           C.TJXOP_NONE,
+	OperationFlipHorizontal: C.TJXOP_HFLIP,
+	OperationFlipVertical:   C.TJXOP_VFLIP,
+	OperationTranspose:      C.TJXOP_TRANSPOSE,
+	OperationTransverse:     C.TJXOP_TRANSVERSE,
+	OperationRotate90:       C.TJXOP_ROT90,
+	OperationRotate180:      C.TJXOP_ROT180,
+	OperationRotate270:      C.TJXOP_ROT270,
+}
+
+// Transform losslessly transforms a JPEG image with turbojpeg.
+func Transform(data []byte, o TransformOptions) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data given")
+	}
+
+	operation := o.Operation
+	if o.AutoOrient {
+		orientation, _, _ := exifOrientation(data)
+		if orientationOperation, ok := orientationOperations[orientation]; ok {
+			var err error
+			operation, err = combineOperations(orientationOperation, o.Operation)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	op, ok := transformOperations[operation]
+	if !ok {
+		return nil, errors.New("unsupported transform operation")
+	}
+
+	transformer := C.tjInitTransform()
+	defer C.tjDestroy(transformer)
+
+	jpegBuf, jpegSize := (*C.uchar)(&data[0]), C.ulong(len(data))
+
+	var width, height, subsamp, colorspace C.int
+	err := makeError(transformer, C.tjDecompressHeader3(transformer, jpegBuf, jpegSize, &width, &height, &subsamp, &colorspace))
+	if err != nil {
+		return nil, err
+	}
+
+	transform := C.tjtransform{op: op, options: C.TJXOPT_PERFECT}
+	if o.Trim {
+		transform.options = C.TJXOPT_TRIM
+	}
+
+	if !o.Crop.Empty() {
+		// The crop region is in the coordinates of the transformed image.
+		bounds := image.Rect(0, 0, int(width), int(height))
+		mcu := image.Pt(int(C.mcuWidth(subsamp)), int(C.mcuHeight(subsamp)))
+		if operation.transposes() {
+			bounds = image.Rect(0, 0, int(height), int(width))
+			mcu = image.Pt(mcu.Y, mcu.X)
+		}
+
+		crop := o.Crop.Intersect(bounds)
+		if crop.Empty() {
+			return nil, errors.New("crop region is outside of the image")
+		}
+		crop.Min.X -= crop.Min.X % mcu.X
+		crop.Min.Y -= crop.Min.Y % mcu.Y
+
+		transform.r = C.tjregion{x: C.int(crop.Min.X), y: C.int(crop.Min.Y), w: C.int(crop.Dx()), h: C.int(crop.Dy())}
+		transform.options |= C.TJXOPT_CROP
+	}
+
+	var outBuf *C.uchar
+	var outBufSize C.ulong
+	res := C.tjTransform(transformer, jpegBuf, jpegSize, 1, &outBuf, &outBufSize, &transform, 0)
+
+	var out []byte
+	err = makeError(transformer, res)
+	if outBuf != nil {
+		out = C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize))
+		C.tjFree(outBuf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The orientation has been applied to the pixels.
+	if o.AutoOrient {
+		resetOrientation(out)
+	}
+
+	return out, nil
+}
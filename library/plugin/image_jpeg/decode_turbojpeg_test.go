@@ -0,0 +1,189 @@
+//go:build go_libheif_use_turbojpeg
+
+package image_jpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio422} {
+		img := testYCbCr(ratio, 101, 99)
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, Options{Options: &jpeg.Options{Quality: 100}})
+		if err != nil {
+			t.Fatalf("Encode of %s resulted in error: %s", ratio, err.Error())
+		}
+
+		decoded, err := Decode(bytes.NewReader(testWriter.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode of %s resulted in error: %s", ratio, err.Error())
+		}
+
+		decodedYCbCr, ok := decoded.(*image.YCbCr)
+		if !ok || decodedYCbCr.SubsampleRatio != ratio || decodedYCbCr.Rect != img.Rect {
+			t.Fatalf("Decode of %s resulted in wrong image, got %T", ratio, decoded)
+		}
+
+		// It should decode the same as the Go decoder.
+		goDecoded, err := jpeg.Decode(bytes.NewReader(testWriter.Bytes()))
+		if err != nil {
+			t.Fatalf("Go decode of %s resulted in error: %s", ratio, err.Error())
+		}
+		for y := 0; y < 99; y++ {
+			for x := 0; x < 101; x++ {
+				got, want := decodedYCbCr.YCbCrAt(x, y), goDecoded.(*image.YCbCr).YCbCrAt(x, y)
+				if diff := int(got.Y) - int(want.Y); diff > 1 || diff < -1 {
+					t.Fatalf("Decode of %s resulted in wrong pixel at %d,%d, got %v, want %v", ratio, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 20, 10))
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, gray, Options{})
+	if err != nil {
+		t.Fatalf("Encode of gray resulted in error: %s", err.Error())
+	}
+
+	decoded, err := Decode(testWriter)
+	if err != nil {
+		t.Fatalf("Decode of gray resulted in error: %s", err.Error())
+	}
+	if _, ok := decoded.(*image.Gray); !ok {
+		t.Fatalf("Decode of gray resulted in wrong type %T", decoded)
+	}
+
+	_, err = Decode(bytes.NewReader([]byte("not a jpeg")))
+	if err == nil {
+		t.Fatal("Decode of invalid data did not result in an error")
+	}
+}
+
+// quadrantJPEG returns a JPEG image of 32x16 with a red top left quadrant and
+// a blue bottom right quadrant.
+func quadrantJPEG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			if x < 16 && y < 8 {
+				c = color.RGBA{R: 0xff, A: 0xff}
+			} else if x >= 16 && y >= 8 {
+				c = color.RGBA{B: 0xff, A: 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{Options: &jpeg.Options{Quality: 100}, Subsampling: Subsampling444})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	return testWriter.Bytes()
+}
+
+// checkPixel checks whether the pixel is about the given color.
+func checkPixel(t *testing.T, name string, img image.Image, x, y int, want color.RGBA) {
+	r, g, b, _ := img.At(x, y).RGBA()
+	for i, diff := range []int{int(r>>8) - int(want.R), int(g>>8) - int(want.G), int(b>>8) - int(want.B)} {
+		if diff > 16 || diff < -16 {
+			t.Errorf("%s resulted in wrong pixel at %d,%d channel %d, got %v, want %v", name, x, y, i, img.At(x, y), want)
+			return
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	data := quadrantJPEG(t)
+
+	type testCase struct {
+		Name    string
+		Options TransformOptions
+		Size    image.Point
+		Red     image.Point // A pixel that should be red.
+		Blue    image.Point // A pixel that should be blue.
+	}
+	testCases := []testCase{
+		{Name: "none", Options: TransformOptions{}, Size: image.Pt(32, 16), Red: image.Pt(2, 2), Blue: image.Pt(30, 14)},
+		{Name: "rotate90", Options: TransformOptions{Operation: OperationRotate90}, Size: image.Pt(16, 32), Red: image.Pt(14, 2), Blue: image.Pt(2, 30)},
+		{Name: "hflip", Options: TransformOptions{Operation: OperationFlipHorizontal}, Size: image.Pt(32, 16), Red: image.Pt(30, 2), Blue: image.Pt(2, 14)},
+		{Name: "crop", Options: TransformOptions{Crop: image.Rect(10, 0, 32, 16)}, Size: image.Pt(24, 16), Red: image.Pt(2, 2), Blue: image.Pt(22, 14)},
+		{Name: "rotate180 crop", Options: TransformOptions{Operation: OperationRotate180, Crop: image.Rect(8, 0, 32, 16)}, Size: image.Pt(24, 16), Red: image.Pt(22, 14), Blue: image.Pt(2, 2)},
+	}
+	for _, testCase := range testCases {
+		out, err := Transform(data, testCase.Options)
+		if err != nil {
+			t.Fatalf("Transform %s resulted in error: %s", testCase.Name, err.Error())
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("Decode of transform %s resulted in error: %s", testCase.Name, err.Error())
+		}
+
+		if got := img.Bounds().Size(); got != testCase.Size {
+			t.Fatalf("Transform %s resulted in wrong size, got %v, want %v", testCase.Name, got, testCase.Size)
+		}
+
+		checkPixel(t, "Transform "+testCase.Name, img, testCase.Red.X, testCase.Red.Y, red)
+		checkPixel(t, "Transform "+testCase.Name, img, testCase.Blue.X, testCase.Blue.Y, blue)
+	}
+
+	_, err := Transform(data, TransformOptions{Operation: "rotate45"})
+	if err == nil {
+		t.Fatal("Transform with an unsupported operation did not result in an error")
+	}
+}
+
+func TestTransformAutoOrient(t *testing.T) {
+	data := quadrantJPEG(t)
+
+	// Insert an EXIF segment with orientation 6 after the start of image.
+	exif := exifJPEG(binary.BigEndian, 6)
+	exif = exif[8 : len(exif)-4]
+	data = append(append(append([]byte{}, data[:2]...), exif...), data[2:]...)
+
+	out, err := Transform(data, TransformOptions{AutoOrient: true})
+	if err != nil {
+		t.Fatalf("Transform resulted in error: %s", err.Error())
+	}
+
+	if orientation, _, _ := exifOrientation(out); orientation != 1 {
+		t.Errorf("Transform resulted in wrong orientation, got %d, want 1", orientation)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Decode resulted in error: %s", err.Error())
+	}
+
+	if got, want := img.Bounds().Size(), image.Pt(16, 32); got != want {
+		t.Fatalf("Transform resulted in wrong size, got %v, want %v", got, want)
+	}
+	checkPixel(t, "Transform", img, 14, 2, color.RGBA{R: 0xff, A: 0xff})
+
+	// The operation is applied after the orientation.
+	out, err = Transform(data, TransformOptions{AutoOrient: true, Operation: OperationRotate270})
+	if err != nil {
+		t.Fatalf("Transform resulted in error: %s", err.Error())
+	}
+
+	img, err = jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Decode resulted in error: %s", err.Error())
+	}
+	if got, want := img.Bounds().Size(), image.Pt(32, 16); got != want {
+		t.Fatalf("Transform resulted in wrong size, got %v, want %v", got, want)
+	}
+	checkPixel(t, "Transform", img, 2, 2, color.RGBA{R: 0xff, A: 0xff})
+}
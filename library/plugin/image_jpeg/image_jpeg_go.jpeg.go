@@ -4,10 +4,18 @@ package image_jpeg
 
 import (
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"io"
 )
 
 func Encode(w io.Writer, m image.Image, o Options) error {
+	// The Go encoder writes a grayscale image for a gray source.
+	if _, ok := m.(*image.Gray); !ok && o.Subsampling == SubsamplingGray {
+		gray := image.NewGray(m.Bounds())
+		draw.Draw(gray, gray.Bounds(), m, m.Bounds().Min, draw.Src)
+		m = gray
+	}
+
 	return jpeg.Encode(w, m, o.Options)
 }
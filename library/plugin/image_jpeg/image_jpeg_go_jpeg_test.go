@@ -5,6 +5,7 @@ package image_jpeg
 import (
 	"bytes"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"testing"
 )
@@ -36,3 +37,27 @@ func TestEncodeQuality(t *testing.T) {
 		t.Fatalf("Encode resulted in wrong byte result, got %d, want %d", testWriter.Len(), 791)
 	}
 }
+
+func TestEncodeGray(t *testing.T) {
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{Subsampling: SubsamplingGray})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+
+	config, err := jpeg.DecodeConfig(testWriter)
+	if err != nil {
+		t.Fatalf("DecodeConfig resulted in error: %s", err.Error())
+	}
+	if config.ColorModel != color.GrayModel {
+		t.Fatalf("Encode resulted in wrong color model, got %v, want %v", config.ColorModel, color.GrayModel)
+	}
+}
+
+func TestTransformUnsupported(t *testing.T) {
+	_, err := Transform([]byte{0xff, 0xd8}, TransformOptions{Operation: OperationRotate90})
+	if err != TransformUnsupportedError {
+		t.Fatalf("Transform resulted in wrong error, got %v, want %v", err, TransformUnsupportedError)
+	}
+}
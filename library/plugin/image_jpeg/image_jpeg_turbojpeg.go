@@ -4,19 +4,67 @@ package image_jpeg
 
 import (
 	"bufio"
+	"errors"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"io"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
 /*
 #cgo pkg-config: libturbojpeg
 #include <turbojpeg.h>
+
+static int compressFromYUVPlanes(tjhandle handle, const unsigned char *y, const unsigned char *cb, const unsigned char *cr,
+	int width, int yStride, int cStride, int height, int subsamp, unsigned char **jpegBuf, unsigned long *jpegSize,
+	int jpegQual, int flags) {
+	const unsigned char *planes[3] = {y, cb, cr};
+	int strides[3] = {yStride, cStride, cStride};
+	return tjCompressFromYUVPlanes(handle, planes, width, strides, height, subsamp, jpegBuf, jpegSize, jpegQual, flags);
+}
+
+// TJ_NUMINIT is only defined by TurboJPEG 3, which has tj3Set to change the
+// coding parameters of a handle. TurboJPEG 2 only reads them from the
+// environment, which can't be changed safely in a multithreaded process.
+#ifdef TJ_NUMINIT
+static int codingParamsSupported() {
+	return 1;
+}
+
+static int setCodingParams(tjhandle handle, int optimize, int arithmetic, int restartBlocks) {
+	if (tj3Set(handle, TJPARAM_OPTIMIZE, optimize) != 0) {
+		return -1;
+	}
+	if (tj3Set(handle, TJPARAM_ARITHMETIC, arithmetic) != 0) {
+		return -1;
+	}
+	return tj3Set(handle, TJPARAM_RESTARTBLOCKS, restartBlocks);
+}
+#else
+static int codingParamsSupported() {
+	return 0;
+}
+
+static int setCodingParams(tjhandle handle, int optimize, int arithmetic, int restartBlocks) {
+	return 0;
+}
+#endif
 */
 import "C"
 import "fmt"
 
+// TurboJPEG is whether JPEG files are encoded and decoded with libjpeg-turbo.
+const TurboJPEG = true
+
+// CodingOptions is whether OptimizeCoding, ArithmeticCoding and
+// RestartInterval are available, they need TurboJPEG 3.
+var CodingOptions = C.codingParamsSupported() != 0
+
+var UnsupportedCodingOptionError = errors.New("optimized Huffman coding, arithmetic coding and restart intervals need TurboJPEG 3")
+
 type Sampling C.int
 
 const (
@@ -24,6 +72,8 @@ const (
 	Sampling422  Sampling = C.TJSAMP_422
 	Sampling420  Sampling = C.TJSAMP_420
 	SamplingGray Sampling = C.TJSAMP_GRAY
+	Sampling440  Sampling = C.TJSAMP_440
+	Sampling411  Sampling = C.TJSAMP_411
 )
 
 type PixelFormat C.int
@@ -56,6 +106,14 @@ const (
 	FlagStopOnWarning Flags = C.TJFLAG_STOPONWARNING
 )
 
+var samplings = map[Subsampling]Sampling{
+	"":              Sampling420,
+	Subsampling444:  Sampling444,
+	Subsampling422:  Sampling422,
+	Subsampling420:  Sampling420,
+	SubsamplingGray: SamplingGray,
+}
+
 func makeError(handler C.tjhandle, returnVal C.int) error {
 	if returnVal == 0 {
 		return nil
@@ -65,17 +123,33 @@ func makeError(handler C.tjhandle, returnVal C.int) error {
 }
 
 type Image struct {
-	Width  int
-	Height int
-	Stride int
-	Pixels []byte
+	Width       int
+	Height      int
+	Stride      int
+	Pixels      []byte
+	PixelFormat PixelFormat
+}
+
+// YUVImage contains the planes of a YCbCr image.
+type YUVImage struct {
+	Width    int
+	Height   int
+	Sampling Sampling
+	Y        []byte
+	Cb       []byte // Not used for SamplingGray.
+	Cr       []byte // Not used for SamplingGray.
+	YStride  int
+	CStride  int
 }
 
 type CompressParams struct {
-	PixelFormat PixelFormat
-	Sampling    Sampling
-	Quality     int // 1 .. 100
-	Flags       Flags
+	PixelFormat      PixelFormat
+	Sampling         Sampling
+	Quality          int // 1 .. 100
+	Flags            Flags
+	OptimizeCoding   bool // Compute optimal Huffman tables, needs TurboJPEG 3.
+	ArithmeticCoding bool // Use arithmetic coding instead of Huffman coding, needs TurboJPEG 3.
+	RestartInterval  int  // Add a restart marker every this amount of MCU blocks, 0 for none, needs TurboJPEG 3.
 }
 
 func MakeCompressParams(pixelFormat PixelFormat, sampling Sampling, quality int, flags Flags) CompressParams {
@@ -87,29 +161,149 @@ func MakeCompressParams(pixelFormat PixelFormat, sampling Sampling, quality int,
 	}
 }
 
-func Compress(img *Image, params CompressParams) ([]byte, error) {
-	encoder := C.tjInitCompress()
-	defer C.tjDestroy(encoder)
+// compressor is a turbojpeg compression handle with an output buffer that is
+// reused between compressions.
+type compressor struct {
+	handle  C.tjhandle
+	used    *Flags // The flags of the last compression, turbojpeg keeps the progressive scans in the handle.
+	buf     *C.uchar
+	bufSize C.ulong
+}
+
+func newCompressor() *compressor {
+	c := &compressor{handle: C.tjInitCompress()}
+	runtime.SetFinalizer(c, (*compressor).free)
+	return c
+}
+
+// ensureBuffer makes sure that the output buffer can hold size bytes.
+func (c *compressor) ensureBuffer(size C.ulong) error {
+	if c.buf != nil && c.bufSize >= size {
+		return nil
+	}
+
+	if c.buf != nil {
+		C.tjFree(c.buf)
+	}
+
+	c.buf = C.tjAlloc(C.int(size))
+	if c.buf == nil {
+		c.bufSize = 0
+		return errors.New("turbojpeg error: could not allocate output buffer")
+	}
+	c.bufSize = size
+	return nil
+}
+
+func (c *compressor) free() {
+	if c.buf != nil {
+		C.tjFree(c.buf)
+		c.buf = nil
+	}
+	if c.handle != nil {
+		C.tjDestroy(c.handle)
+		c.handle = nil
+	}
+}
 
-	var outBuf *C.uchar
-	var outBufSize C.ulong
+// compressorPool contains the idle compressors, the pool can drop them at any
+// time, the finalizer then frees them.
+var compressorPool = sync.Pool{
+	New: func() interface{} {
+		return newCompressor()
+	},
+}
 
+func Compress(img *Image, params CompressParams) ([]byte, error) {
 	// int tjCompress2(tjhandle handle, const unsigned char *srcBuf, int width, int pitch, int height, int pixelFormat,
 	// unsigned char **jpegBuf, unsigned long *jpegSize, int jpegSubsamp, int jpegQual, int flags);
-	res := C.tjCompress2(encoder, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(params.PixelFormat),
-		&outBuf, &outBufSize, C.int(params.Sampling), C.int(params.Quality), C.int(params.Flags))
+	return compress(params, img.Width, img.Height, params.Sampling, func(encoder C.tjhandle, outBuf **C.uchar, outBufSize *C.ulong, flags C.int) C.int {
+		return C.tjCompress2(encoder, (*C.uchar)(&img.Pixels[0]), C.int(img.Width), C.int(img.Stride), C.int(img.Height), C.int(params.PixelFormat),
+			outBuf, outBufSize, C.int(params.Sampling), C.int(params.Quality), flags)
+	})
+}
+
+// CompressFromYUVPlanes compresses the planes of a YCbCr image without
+// converting them, the PixelFormat and Sampling of the params are not used.
+func CompressFromYUVPlanes(img *YUVImage, params CompressParams) ([]byte, error) {
+	var cb, cr *C.uchar
+	if img.Sampling != SamplingGray {
+		cb, cr = (*C.uchar)(&img.Cb[0]), (*C.uchar)(&img.Cr[0])
+	}
+
+	return compress(params, img.Width, img.Height, img.Sampling, func(encoder C.tjhandle, outBuf **C.uchar, outBufSize *C.ulong, flags C.int) C.int {
+		return C.compressFromYUVPlanes(encoder, (*C.uchar)(&img.Y[0]), cb, cr, C.int(img.Width), C.int(img.YStride), C.int(img.CStride), C.int(img.Height),
+			C.int(img.Sampling), outBuf, outBufSize, C.int(params.Quality), flags)
+	})
+}
+
+// compress runs a turbojpeg compression function with a pooled compressor and
+// the coding parameters of the params, and returns a copy of the JPEG data. The
+// output buffer of the compressor is made large enough for the worst case, so
+// turbojpeg never has to reallocate it.
+func compress(params CompressParams, width, height int, sampling Sampling, f func(encoder C.tjhandle, outBuf **C.uchar, outBufSize *C.ulong, flags C.int) C.int) ([]byte, error) {
+	c := compressorPool.Get().(*compressor)
+	defer func() {
+		// A compressor of which the handle could not be initialized again is
+		// useless, the pool creates a new one instead.
+		if c.handle == nil {
+			c.free()
+			return
+		}
+		compressorPool.Put(c)
+	}()
+
+	if c.handle == nil {
+		return nil, errors.New("turbojpeg error: could not initialize compressor")
+	}
+
+	err := c.ensureBuffer(C.tjBufSize(C.int(width), C.int(height), C.int(sampling)))
+	if err != nil {
+		return nil, err
+	}
+
+	codingOptions := params.OptimizeCoding || params.ArithmeticCoding || params.RestartInterval > 0
+	if codingOptions && !CodingOptions {
+		return nil, UnsupportedCodingOptionError
+	}
+
+	// A handle keeps the progressive scans, so it can only be reused with the
+	// same flags.
+	flags := params.Flags
+	if c.used != nil && *c.used != flags {
+		C.tjDestroy(c.handle)
+		c.handle = C.tjInitCompress()
+		if c.handle == nil {
+			return nil, errors.New("turbojpeg error: could not initialize compressor")
+		}
+	}
+	c.used = &flags
 
-	var enc []byte
-	err := makeError(encoder, res)
-	if outBuf != nil {
-		enc = C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize))
-		C.tjFree(outBuf)
+	// The coding parameters are kept in the handle too, so they are always
+	// set to those of the params.
+	if CodingOptions {
+		res := C.setCodingParams(c.handle, C.int(boolToInt(params.OptimizeCoding)), C.int(boolToInt(params.ArithmeticCoding)), C.int(params.RestartInterval))
+		if err := makeError(c.handle, res); err != nil {
+			return nil, err
+		}
 	}
 
+	outBuf, outBufSize := c.buf, c.bufSize
+	res := f(c.handle, &outBuf, &outBufSize, C.int(params.Flags|FlagNoRealloc))
+
+	err = makeError(c.handle, res)
 	if err != nil {
 		return nil, err
 	}
-	return enc, nil
+
+	return C.GoBytes(unsafe.Pointer(outBuf), C.int(outBufSize)), nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func Encode(w io.Writer, m image.Image, o Options) error {
@@ -126,15 +320,50 @@ func Encode(w io.Writer, m image.Image, o Options) error {
 		}
 	}
 
-	raw := FromImage(m, true)
-
 	flags := Flags(0)
 	if o.Progressive {
 		flags |= FlagProgressive
 	}
 
-	params := MakeCompressParams(PixelFormatRGBA, Sampling420, quality, flags)
-	jpg, err := Compress(raw, params)
+	// Without a DCT flag turbojpeg uses its default, which is the fast DCT
+	// for compression with turbojpeg 2.
+	if o.FastDCT && o.AccurateDCT {
+		return errors.New("FastDCT and AccurateDCT can't be used together")
+	}
+	if o.FastDCT {
+		flags |= FlagFastDCT
+	}
+	if o.AccurateDCT {
+		flags |= FlagAccurateDCT
+	}
+
+	sampling, ok := samplings[o.Subsampling]
+	if !ok {
+		return fmt.Errorf("unsupported subsampling %q", o.Subsampling)
+	}
+
+	params := MakeCompressParams(PixelFormatRGBA, sampling, quality, flags)
+	params.OptimizeCoding = o.OptimizeCoding
+	params.ArithmeticCoding = o.ArithmeticCoding
+	params.RestartInterval = o.RestartInterval
+
+	var yuv *YUVImage
+	if ycbcr, ok := m.(*image.YCbCr); ok {
+		yuv = FromYCbCr(ycbcr, o.Subsampling)
+	}
+
+	var jpg []byte
+	var err error
+	if yuv != nil {
+		jpg, err = CompressFromYUVPlanes(yuv, params)
+	} else {
+		raw := FromImage(m, true)
+		params.PixelFormat = raw.PixelFormat
+		if raw.PixelFormat == PixelFormatGRAY {
+			params.Sampling = SamplingGray
+		}
+		jpg, err = Compress(raw, params)
+	}
 	if err != nil {
 		return err
 	}
@@ -152,47 +381,123 @@ func Encode(w io.Writer, m image.Image, o Options) error {
 	return nil
 }
 
+var yCbCrSamplings = map[image.YCbCrSubsampleRatio]Sampling{
+	image.YCbCrSubsampleRatio444: Sampling444,
+	image.YCbCrSubsampleRatio422: Sampling422,
+	image.YCbCrSubsampleRatio420: Sampling420,
+	image.YCbCrSubsampleRatio440: Sampling440,
+	image.YCbCrSubsampleRatio411: Sampling411,
+}
+
+// FromYCbCr returns the planes of a YCbCr image without copying them, or nil
+// when turbojpeg can't compress them directly. With an empty subsampling the
+// subsampling of the image is kept, otherwise it has to match the image,
+// except for SubsamplingGray, which only uses the luma plane.
+func FromYCbCr(src *image.YCbCr, subsampling Subsampling) *YUVImage {
+	if src.Rect.Empty() {
+		return nil
+	}
+
+	dst := &YUVImage{
+		Width:   src.Rect.Dx(),
+		Height:  src.Rect.Dy(),
+		Y:       src.Y[src.YOffset(src.Rect.Min.X, src.Rect.Min.Y):],
+		YStride: src.YStride,
+	}
+
+	if subsampling == SubsamplingGray {
+		dst.Sampling = SamplingGray
+		return dst
+	}
+
+	sampling, ok := yCbCrSamplings[src.SubsampleRatio]
+	if !ok || (subsampling != "" && samplings[subsampling] != sampling) {
+		return nil
+	}
+
+	// The chroma samples of a sub image that does not start on a chroma
+	// sample boundary are not aligned to the luma samples.
+	horizontal, vertical := 1, 1
+	switch src.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		horizontal = 2
+	case image.YCbCrSubsampleRatio420:
+		horizontal, vertical = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		vertical = 2
+	case image.YCbCrSubsampleRatio411:
+		horizontal = 4
+	}
+	if src.Rect.Min.X%horizontal != 0 || src.Rect.Min.Y%vertical != 0 {
+		return nil
+	}
+
+	offset := src.COffset(src.Rect.Min.X, src.Rect.Min.Y)
+	dst.Sampling = sampling
+	dst.Cb = src.Cb[offset:]
+	dst.Cr = src.Cr[offset:]
+	dst.CStride = src.CStride
+	return dst
+}
+
 // Convert a Go image.Image into a turbo.Image
-// If allowDeepClone is true, and the source image is type NRGBA or RGBA,
+// If allowDeepClone is true, and the source image is type NRGBA, RGBA or Gray,
 // then the resulting Image points directly to the pixel buffer of the source image.
 func FromImage(src image.Image, allowDeepClone bool) *Image {
+	bounds := src.Bounds()
 	dst := &Image{
-		Width:  src.Bounds().Dx(),
-		Height: src.Bounds().Dy(),
-		Stride: src.Bounds().Dx() * 4,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Stride:      bounds.Dx() * 4,
+		PixelFormat: PixelFormatRGBA,
 	}
-	switch v := src.(type) {
-	case *image.RGBA:
+
+	shared := func(pix []byte, stride int) *Image {
 		if allowDeepClone {
-			dst.Pixels = v.Pix
+			dst.Pixels = pix
+			dst.Stride = stride
 		} else {
 			dst.Pixels = make([]byte, dst.Stride*dst.Height)
-			copy(dst.Pixels, v.Pix)
+			for y := 0; y < dst.Height; y++ {
+				copy(dst.Pixels[y*dst.Stride:(y+1)*dst.Stride], pix[y*stride:])
+			}
 		}
 		return dst
+	}
+
+	switch v := src.(type) {
+	case *image.RGBA:
+		return shared(v.Pix[v.PixOffset(bounds.Min.X, bounds.Min.Y):], v.Stride)
 	case *image.NRGBA:
-		if allowDeepClone {
-			dst.Pixels = v.Pix
-		} else {
-			dst.Pixels = make([]byte, dst.Stride*dst.Height)
-			copy(dst.Pixels, v.Pix)
-		}
+		return shared(v.Pix[v.PixOffset(bounds.Min.X, bounds.Min.Y):], v.Stride)
+	case *image.Gray:
+		dst.PixelFormat = PixelFormatGRAY
+		dst.Stride = dst.Width
+		return shared(v.Pix[v.PixOffset(bounds.Min.X, bounds.Min.Y):], v.Stride)
+	case *image.RGBA64:
+		dst.Pixels = pixels16To8(v.Pix[v.PixOffset(bounds.Min.X, bounds.Min.Y):], v.Stride, dst.Width, dst.Height)
+		return dst
+	case *image.NRGBA64:
+		dst.Pixels = pixels16To8(v.Pix[v.PixOffset(bounds.Min.X, bounds.Min.Y):], v.Stride, dst.Width, dst.Height)
 		return dst
 	}
 
-	// This must be super slow - I haven't tested
-	dst.Pixels = make([]byte, dst.Stride*dst.Height)
-	p := 0
-	for y := 0; y < dst.Height; y++ {
-		for x := 0; x < dst.Width; x++ {
-			r, g, b, a := src.At(x, y).RGBA()
-			dst.Pixels[p] = byte(r >> 8)
-			dst.Pixels[p+1] = byte(g >> 8)
-			dst.Pixels[p+2] = byte(b >> 8)
-			dst.Pixels[p+3] = byte(a >> 8)
-			p += 4
+	rgba := image.NewRGBA(image.Rect(0, 0, dst.Width, dst.Height))
+	draw.Draw(rgba, rgba.Rect, src, bounds.Min, draw.Src)
+	dst.Pixels = rgba.Pix
+	return dst
+}
+
+// pixels16To8 converts 16-bit RGBA pixels to 8-bit by taking the most
+// significant byte of every sample.
+func pixels16To8(pix []byte, stride, width, height int) []byte {
+	out := make([]byte, width*height*4)
+	for y := 0; y < height; y++ {
+		row := pix[y*stride : y*stride+width*8]
+		outRow := out[y*width*4 : (y+1)*width*4]
+		for i := range outRow {
+			outRow[i] = row[i*2]
 		}
 	}
-
-	return dst
+	return out
 }
@@ -4,8 +4,14 @@ package image_jpeg
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
+	"io"
+	"sync"
 	"testing"
 )
 
@@ -53,3 +59,396 @@ func TestEncodeProgressive(t *testing.T) {
 		t.Fatalf("Encode resulted in wrong byte result, got %d, want %d", testWriter.Len(), 592)
 	}
 }
+
+// jpegMarkers returns the markers of the JPEG data up to the start of scan,
+// with their segment data.
+func jpegMarkers(t *testing.T, data []byte) map[byte][]byte {
+	markers := map[byte][]byte{}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			t.Fatalf("invalid marker at offset %d", i)
+		}
+		marker := data[i+1]
+		length := int(data[i+2])<<8 | int(data[i+3])
+		markers[marker] = data[i+4 : i+2+length]
+		if marker == 0xda {
+			break
+		}
+		i += 2 + length
+	}
+	return markers
+}
+
+func TestEncodeSubsampling(t *testing.T) {
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+
+	type testCase struct {
+		Subsampling Subsampling
+		Components  int
+		Sampling    byte // The sampling factors of the luma component.
+	}
+	testCases := []testCase{
+		{Subsampling: "", Components: 3, Sampling: 0x22},
+		{Subsampling: Subsampling444, Components: 3, Sampling: 0x11},
+		{Subsampling: Subsampling422, Components: 3, Sampling: 0x21},
+		{Subsampling: Subsampling420, Components: 3, Sampling: 0x22},
+		{Subsampling: SubsamplingGray, Components: 1, Sampling: 0x11},
+	}
+	for _, testCase := range testCases {
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, Options{Subsampling: testCase.Subsampling})
+		if err != nil {
+			t.Fatalf("Encode with subsampling %q resulted in error: %s", testCase.Subsampling, err.Error())
+		}
+
+		sof := jpegMarkers(t, testWriter.Bytes())[0xc0]
+		if got := int(sof[5]); got != testCase.Components {
+			t.Errorf("Encode with subsampling %q resulted in wrong components, got %d, want %d", testCase.Subsampling, got, testCase.Components)
+		}
+		if got := sof[7]; got != testCase.Sampling {
+			t.Errorf("Encode with subsampling %q resulted in wrong sampling factors, got %x, want %x", testCase.Subsampling, got, testCase.Sampling)
+		}
+	}
+
+	err := Encode(bytes.NewBuffer(nil), img, Options{Subsampling: "411"})
+	if err == nil {
+		t.Fatal("Encode with unsupported subsampling did not result in an error")
+	}
+}
+
+func TestEncodeCoding(t *testing.T) {
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 100; y++ {
+			img.Pix[img.PixOffset(x, y)] = uint8(x * y)
+			img.Pix[img.PixOffset(x, y)+3] = 0xff
+		}
+	}
+
+	encode := func(o Options) []byte {
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, o)
+		if err != nil {
+			t.Fatalf("Encode resulted in error: %s", err.Error())
+		}
+		return testWriter.Bytes()
+	}
+
+	plain := encode(Options{})
+	if _, ok := jpegMarkers(t, plain)[0xdd]; ok {
+		t.Error("Encode without restart interval resulted in a restart interval")
+	}
+
+	fast := encode(Options{FastDCT: true})
+	if _, err := jpeg.Decode(bytes.NewReader(fast)); err != nil {
+		t.Errorf("Encode with fast DCT resulted in an invalid image: %s", err.Error())
+	}
+
+	accurate := encode(Options{AccurateDCT: true})
+	if _, err := jpeg.Decode(bytes.NewReader(accurate)); err != nil {
+		t.Errorf("Encode with accurate DCT resulted in an invalid image: %s", err.Error())
+	}
+
+	// Without a DCT option the default of turbojpeg is kept, which is the
+	// fast DCT for turbojpeg 2.
+	if !CodingOptions && !bytes.Equal(plain, fast) {
+		t.Error("Encode without DCT option did not result in the default fast DCT of turbojpeg 2")
+	}
+	if bytes.Equal(accurate, fast) {
+		t.Error("Encode with accurate DCT resulted in the same image as the fast DCT")
+	}
+
+	if err := Encode(bytes.NewBuffer(nil), img, Options{FastDCT: true, AccurateDCT: true}); err == nil {
+		t.Error("Encode with fast and accurate DCT did not result in an error")
+	}
+
+	if !CodingOptions {
+		for _, o := range []Options{{OptimizeCoding: true}, {ArithmeticCoding: true}, {RestartInterval: 4}} {
+			err := Encode(bytes.NewBuffer(nil), img, o)
+			if !errors.Is(err, UnsupportedCodingOptionError) {
+				t.Errorf("Encode with coding options %+v without TurboJPEG 3 did not result in UnsupportedCodingOptionError, got %v", o, err)
+			}
+		}
+		return
+	}
+
+	optimized := encode(Options{OptimizeCoding: true})
+	if len(optimized) >= len(plain) {
+		t.Errorf("Encode with optimized coding did not result in a smaller image, got %d, plain %d", len(optimized), len(plain))
+	}
+
+	arithmetic := encode(Options{ArithmeticCoding: true})
+	if _, ok := jpegMarkers(t, arithmetic)[0xc9]; !ok {
+		t.Error("Encode with arithmetic coding did not result in an arithmetic coded frame")
+	}
+
+	restart := encode(Options{RestartInterval: 4})
+	if got, want := jpegMarkers(t, restart)[0xdd], []byte{0, 4}; !bytes.Equal(got, want) {
+		t.Errorf("Encode with restart interval resulted in wrong restart interval, got %v, want %v", got, want)
+	}
+
+	// The coding parameters should be reset in the handle for the next encode.
+	if got := encode(Options{}); !bytes.Equal(got, plain) {
+		t.Error("Encode after other coding options did not result in the same image")
+	}
+
+}
+
+func testYCbCr(ratio image.YCbCrSubsampleRatio, width, height int) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), ratio)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Y[img.YOffset(x, y)] = uint8(32 + (x+y)%192)
+			img.Cb[img.COffset(x, y)] = uint8(120 + x%16)
+			img.Cr[img.COffset(x, y)] = uint8(120 + y%16)
+		}
+	}
+	return img
+}
+
+func TestEncodeYCbCr(t *testing.T) {
+	type testCase struct {
+		Ratio       image.YCbCrSubsampleRatio
+		Subsampling Subsampling
+		Sampling    byte // The sampling factors of the luma component.
+	}
+	testCases := []testCase{
+		{Ratio: image.YCbCrSubsampleRatio444, Sampling: 0x11},
+		{Ratio: image.YCbCrSubsampleRatio422, Sampling: 0x21},
+		{Ratio: image.YCbCrSubsampleRatio420, Sampling: 0x22},
+		{Ratio: image.YCbCrSubsampleRatio440, Sampling: 0x12},
+		{Ratio: image.YCbCrSubsampleRatio411, Sampling: 0x41},
+		{Ratio: image.YCbCrSubsampleRatio420, Subsampling: Subsampling420, Sampling: 0x22},
+		{Ratio: image.YCbCrSubsampleRatio420, Subsampling: Subsampling444, Sampling: 0x11},
+		{Ratio: image.YCbCrSubsampleRatio410, Sampling: 0x22},
+	}
+	for _, testCase := range testCases {
+		img := testYCbCr(testCase.Ratio, 101, 99)
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, Options{Options: &jpeg.Options{Quality: 100}, Subsampling: testCase.Subsampling})
+		if err != nil {
+			t.Fatalf("Encode of %s with subsampling %q resulted in error: %s", testCase.Ratio, testCase.Subsampling, err.Error())
+		}
+
+		sof := jpegMarkers(t, testWriter.Bytes())[0xc0]
+		if got := sof[7]; got != testCase.Sampling {
+			t.Errorf("Encode of %s with subsampling %q resulted in wrong sampling factors, got %x, want %x", testCase.Ratio, testCase.Subsampling, got, testCase.Sampling)
+		}
+
+		decoded, err := jpeg.Decode(testWriter)
+		if err != nil {
+			t.Fatalf("Decode of %s with subsampling %q resulted in error: %s", testCase.Ratio, testCase.Subsampling, err.Error())
+		}
+
+		decodedYCbCr, ok := decoded.(*image.YCbCr)
+		if !ok {
+			t.Fatalf("Decode of %s with subsampling %q resulted in wrong type %T", testCase.Ratio, testCase.Subsampling, decoded)
+		}
+
+		for y := 0; y < 99; y++ {
+			for x := 0; x < 101; x++ {
+				want := int(img.Y[img.YOffset(x, y)])
+				got := int(decodedYCbCr.Y[decodedYCbCr.YOffset(x, y)])
+				if got-want > 3 || want-got > 3 {
+					t.Fatalf("Decode of %s with subsampling %q resulted in wrong luma at %d,%d, got %d, want %d", testCase.Ratio, testCase.Subsampling, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFromYCbCr(t *testing.T) {
+	img := testYCbCr(image.YCbCrSubsampleRatio420, 100, 100)
+
+	if FromYCbCr(img, "") == nil {
+		t.Error("FromYCbCr of a 4:2:0 image did not result in planes")
+	}
+
+	if FromYCbCr(img, Subsampling422) != nil {
+		t.Error("FromYCbCr of a 4:2:0 image with another subsampling resulted in planes")
+	}
+
+	if planes := FromYCbCr(img, SubsamplingGray); planes == nil || planes.Sampling != SamplingGray {
+		t.Error("FromYCbCr of a 4:2:0 image with gray subsampling did not result in a luma plane")
+	}
+
+	// A sub image that starts between chroma samples.
+	if FromYCbCr(img.SubImage(image.Rect(1, 1, 50, 50)).(*image.YCbCr), "") != nil {
+		t.Error("FromYCbCr of an unaligned sub image resulted in planes")
+	}
+
+	sub := img.SubImage(image.Rect(10, 20, 50, 50)).(*image.YCbCr)
+	planes := FromYCbCr(sub, "")
+	if planes == nil {
+		t.Fatal("FromYCbCr of an aligned sub image did not result in planes")
+	}
+	if planes.Y[0] != sub.Y[sub.YOffset(10, 20)] || planes.Cb[0] != sub.Cb[sub.COffset(10, 20)] {
+		t.Error("FromYCbCr of an aligned sub image resulted in wrong planes")
+	}
+}
+
+func TestEncodeFastPaths(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 64, 64))
+	rgba64 := image.NewRGBA64(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			gray.Pix[gray.PixOffset(x, y)] = uint8(x * 4)
+			rgba64.SetRGBA64(x, y, color.RGBA64{R: uint16(x) << 10, G: uint16(y) << 10, B: 0x8000, A: 0xffff})
+		}
+	}
+
+	for _, img := range []image.Image{gray, rgba64, gray.SubImage(image.Rect(5, 5, 40, 40))} {
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, Options{Options: &jpeg.Options{Quality: 100}, Subsampling: Subsampling444})
+		if err != nil {
+			t.Fatalf("Encode of %T resulted in error: %s", img, err.Error())
+		}
+
+		decoded, err := jpeg.Decode(testWriter)
+		if err != nil {
+			t.Fatalf("Decode of %T resulted in error: %s", img, err.Error())
+		}
+
+		if got, want := decoded.Bounds().Size(), img.Bounds().Size(); got != want {
+			t.Fatalf("Decode of %T resulted in wrong size, got %v, want %v", img, got, want)
+		}
+
+		if _, ok := img.(*image.Gray); ok {
+			if _, ok := decoded.(*image.Gray); !ok {
+				t.Errorf("Decode of %T resulted in wrong type %T", img, decoded)
+			}
+		}
+
+		bounds := img.Bounds()
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				wr, wg, wb, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				gr, gg, gb, _ := decoded.At(x, y).RGBA()
+				for _, diff := range []int{int(wr>>8) - int(gr>>8), int(wg>>8) - int(gg>>8), int(wb>>8) - int(gb>>8)} {
+					if diff > 4 || diff < -4 {
+						t.Fatalf("Decode of %T resulted in wrong pixel at %d,%d", img, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+// opaqueImage hides the type of an image, to force the generic conversion.
+type opaqueImage struct {
+	image.Image
+}
+
+func BenchmarkEncode(b *testing.B) {
+	const width, height = 1600, 1200
+	ycbcr := testYCbCr(image.YCbCrSubsampleRatio420, width, height)
+
+	rgba := image.NewRGBA(ycbcr.Rect)
+	draw.Draw(rgba, rgba.Rect, ycbcr, image.Point{}, draw.Src)
+
+	gray := image.NewGray(ycbcr.Rect)
+	draw.Draw(gray, gray.Rect, ycbcr, image.Point{}, draw.Src)
+
+	rgba64 := image.NewRGBA64(ycbcr.Rect)
+	draw.Draw(rgba64, rgba64.Rect, ycbcr, image.Point{}, draw.Src)
+
+	images := []struct {
+		Name  string
+		Image image.Image
+	}{
+		{Name: "ycbcr", Image: ycbcr},
+		{Name: "ycbcr-generic", Image: opaqueImage{ycbcr}},
+		{Name: "rgba", Image: rgba},
+		{Name: "gray", Image: gray},
+		{Name: "gray-generic", Image: opaqueImage{gray}},
+		{Name: "rgba64", Image: rgba64},
+		{Name: "rgba64-generic", Image: opaqueImage{rgba64}},
+	}
+	for _, benchImage := range images {
+		b.Run(benchImage.Name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := Encode(io.Discard, benchImage.Image, Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeConcurrent(t *testing.T) {
+	img := testYCbCr(image.YCbCrSubsampleRatio420, 200, 150)
+	options := []Options{
+		{},
+		{Progressive: true},
+		{Subsampling: Subsampling444},
+		{Options: &jpeg.Options{Quality: 50}},
+	}
+	if CodingOptions {
+		options = append(options, Options{OptimizeCoding: true}, Options{RestartInterval: 8})
+	}
+
+	// The expected output of every option, compressors are reused between
+	// options here too.
+	expected := make([][]byte, len(options))
+	for i, o := range options {
+		testWriter := bytes.NewBuffer(nil)
+		err := Encode(testWriter, img, o)
+		if err != nil {
+			t.Fatalf("Encode with options %d resulted in error: %s", i, err.Error())
+		}
+		expected[i] = testWriter.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*len(options))
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := range options {
+				index := (i + worker) % len(options)
+				testWriter := bytes.NewBuffer(nil)
+				err := Encode(testWriter, img, options[index])
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(testWriter.Bytes(), expected[index]) {
+					errs <- fmt.Errorf("Encode with options %d resulted in a different image", index)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkEncodeSmall(b *testing.B) {
+	img := testYCbCr(image.YCbCrSubsampleRatio420, 64, 64)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := Encode(io.Discard, img, Options{})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				err := Encode(io.Discard, img, Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
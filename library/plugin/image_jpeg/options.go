@@ -2,7 +2,22 @@ package image_jpeg
 
 import "image/jpeg"
 
+type Subsampling string // The chroma subsampling of a JPEG image.
+
+const (
+	Subsampling444  Subsampling = "444"  // No chroma subsampling.
+	Subsampling422  Subsampling = "422"  // Half horizontal chroma resolution.
+	Subsampling420  Subsampling = "420"  // Half horizontal and vertical chroma resolution.
+	SubsamplingGray Subsampling = "gray" // No chroma, a grayscale image.
+)
+
 type Options struct {
 	*jpeg.Options
-	Progressive bool // Render in progressive mode, only available with libturbojpeg.
+	Progressive      bool        // Render in progressive mode, only available with libturbojpeg.
+	Subsampling      Subsampling // The chroma subsampling, only available with libturbojpeg, except for SubsamplingGray. The default keeps the subsampling of YCbCr images, and is Subsampling420 for other images.
+	FastDCT          bool        // Use the fast but less accurate DCT, only available with libturbojpeg. The default is the DCT that libturbojpeg picks.
+	AccurateDCT      bool        // Use the slower but more accurate DCT, only available with libturbojpeg. Not together with FastDCT.
+	OptimizeCoding   bool        // Compute optimal Huffman tables, only available with TurboJPEG 3, see CodingOptions.
+	ArithmeticCoding bool        // Use arithmetic coding instead of Huffman coding, only available with TurboJPEG 3, see CodingOptions. Not every decoder supports this.
+	RestartInterval  int         // Add a restart marker every this amount of MCU blocks, only available with TurboJPEG 3, see CodingOptions. The default is 0, no restart markers.
 }
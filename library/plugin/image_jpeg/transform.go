@@ -0,0 +1,174 @@
+package image_jpeg
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// TransformUnsupportedError is returned by Transform when the plugin has been
+// built without libturbojpeg.
+var TransformUnsupportedError = errors.New("lossless jpeg transforms are only available with build tag go_libheif_use_turbojpeg")
+
+type Operation string // A lossless transform operation.
+
+const (
+	OperationNone           Operation = ""           // Do not transform the image.
+	OperationFlipHorizontal Operation = "hflip"      // Mirror the image horizontally.
+	OperationFlipVertical   Operation = "vflip"      // Mirror the image vertically.
+	OperationTranspose      Operation = "transpose"  // Mirror the image over the top left to bottom right diagonal.
+	OperationTransverse     Operation = "transverse" // Mirror the image over the top right to bottom left diagonal.
+	OperationRotate90       Operation = "rotate90"   // Rotate the image 90 degrees clockwise.
+	OperationRotate180      Operation = "rotate180"  // Rotate the image 180 degrees.
+	OperationRotate270      Operation = "rotate270"  // Rotate the image 270 degrees clockwise.
+)
+
+type TransformOptions struct {
+	Operation  Operation       // The operation to apply.
+	AutoOrient bool            // Apply the EXIF orientation before Operation, and reset the orientation to normal.
+	Crop       image.Rectangle // Crop the transformed image to this rectangle, the top left corner is moved up and left to the nearest MCU boundary (8 or 16 pixels). Empty to not crop.
+	Trim       bool            // Drop the partial MCU blocks on the edges that can't be transformed, instead of returning an error.
+}
+
+// operationMatrices maps the operations to the matrix that they apply to the
+// coordinates of a pixel, relative to the center of the image with y down.
+var operationMatrices = map[Operation][4]int{
+	OperationNone:           {1, 0, 0, 1},
+	OperationFlipHorizontal: {-1, 0, 0, 1},
+	OperationFlipVertical:   {1, 0, 0, -1},
+	OperationTranspose:      {0, 1, 1, 0},
+	OperationTransverse:     {0, -1, -1, 0},
+	OperationRotate90:       {0, -1, 1, 0},
+	OperationRotate180:      {-1, 0, 0, -1},
+	OperationRotate270:      {0, 1, -1, 0},
+}
+
+// combineOperations returns the operation that has the same result as first
+// applying a and then b.
+func combineOperations(a, b Operation) (Operation, error) {
+	ma, ok := operationMatrices[a]
+	if !ok {
+		return "", errors.New("unsupported transform operation")
+	}
+
+	mb, ok := operationMatrices[b]
+	if !ok {
+		return "", errors.New("unsupported transform operation")
+	}
+
+	combined := [4]int{
+		mb[0]*ma[0] + mb[1]*ma[2], mb[0]*ma[1] + mb[1]*ma[3],
+		mb[2]*ma[0] + mb[3]*ma[2], mb[2]*ma[1] + mb[3]*ma[3],
+	}
+	for operation, matrix := range operationMatrices {
+		if matrix == combined {
+			return operation, nil
+		}
+	}
+
+	// Unreachable, the operations form a closed group.
+	return "", errors.New("unsupported transform operation")
+}
+
+// transposes returns whether the operation swaps the width and the height.
+func (o Operation) transposes() bool {
+	return operationMatrices[o][0] == 0
+}
+
+// orientationOperations maps the EXIF orientations to the operation that
+// displays the image upright.
+var orientationOperations = map[uint16]Operation{
+	1: OperationNone,
+	2: OperationFlipHorizontal,
+	3: OperationRotate180,
+	4: OperationFlipVertical,
+	5: OperationTranspose,
+	6: OperationRotate90,
+	7: OperationTransverse,
+	8: OperationRotate270,
+}
+
+// exifOrientation finds the orientation in the EXIF data of a JPEG file. It
+// returns the orientation, the offset of its value in the data and its byte
+// order, or 0 when the file has no orientation.
+func exifOrientation(data []byte) (uint16, int, binary.ByteOrder) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, 0, nil
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 0, 0, nil
+		}
+
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// The image data starts, there are no more metadata segments.
+			return 0, 0, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 0, 0, nil
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			orientation, offset, order := tiffOrientation(segment[6:])
+			if orientation == 0 {
+				return 0, 0, nil
+			}
+			return orientation, i + 4 + 6 + offset, order
+		}
+
+		i += 2 + length
+	}
+
+	return 0, 0, nil
+}
+
+// tiffOrientation finds the orientation in the first IFD of a TIFF structure.
+func tiffOrientation(tiff []byte) (uint16, int, binary.ByteOrder) {
+	if len(tiff) < 8 {
+		return 0, 0, nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0, 0, nil
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0, 0, nil
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, 0, nil
+		}
+
+		// The orientation is a single SHORT, which is stored in the entry.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:]), entry + 8, order
+		}
+	}
+
+	return 0, 0, nil
+}
+
+// resetOrientation sets the EXIF orientation of a JPEG file to normal, when
+// it has one.
+func resetOrientation(data []byte) {
+	orientation, offset, order := exifOrientation(data)
+	if orientation != 0 {
+		order.PutUint16(data[offset:], 1)
+	}
+}
@@ -0,0 +1,80 @@
+package image_jpeg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestCombineOperations(t *testing.T) {
+	type testCase struct {
+		A, B, Want Operation
+	}
+	testCases := []testCase{
+		{A: OperationNone, B: OperationRotate90, Want: OperationRotate90},
+		{A: OperationRotate90, B: OperationRotate90, Want: OperationRotate180},
+		{A: OperationRotate90, B: OperationRotate270, Want: OperationNone},
+		{A: OperationRotate180, B: OperationRotate90, Want: OperationRotate270},
+		{A: OperationFlipHorizontal, B: OperationFlipVertical, Want: OperationRotate180},
+		{A: OperationFlipHorizontal, B: OperationRotate90, Want: OperationTransverse},
+		{A: OperationRotate90, B: OperationFlipHorizontal, Want: OperationTranspose},
+		{A: OperationTranspose, B: OperationTranspose, Want: OperationNone},
+	}
+	for _, testCase := range testCases {
+		got, err := combineOperations(testCase.A, testCase.B)
+		if err != nil {
+			t.Fatalf("combineOperations of %q and %q resulted in error: %s", testCase.A, testCase.B, err.Error())
+		}
+		if got != testCase.Want {
+			t.Errorf("combineOperations of %q and %q resulted in wrong operation, got %q, want %q", testCase.A, testCase.B, got, testCase.Want)
+		}
+	}
+
+	_, err := combineOperations("rotate45", OperationNone)
+	if err == nil {
+		t.Fatal("combineOperations with an unsupported operation did not result in an error")
+	}
+}
+
+type testByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// exifJPEG returns the start of a JPEG file with an EXIF segment that contains
+// the orientation.
+func exifJPEG(order testByteOrder, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	if order == binary.BigEndian {
+		tiff = []byte("MM\x00*\x00\x00\x00\x08")
+	}
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	data := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x04, 0x00, 0x00, 0xff, 0xe1}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, 0xff, 0xda, 0x00, 0x02)
+}
+
+func TestExifOrientation(t *testing.T) {
+	for _, order := range []testByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := exifJPEG(order, 6)
+		if orientation, _, _ := exifOrientation(data); orientation != 6 {
+			t.Fatalf("exifOrientation with %s resulted in wrong orientation, got %d, want 6", order, orientation)
+		}
+
+		resetOrientation(data)
+		if orientation, _, _ := exifOrientation(data); orientation != 1 {
+			t.Fatalf("exifOrientation after resetOrientation with %s resulted in wrong orientation, got %d, want 1", order, orientation)
+		}
+	}
+
+	if orientation, _, _ := exifOrientation([]byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02}); orientation != 0 {
+		t.Fatalf("exifOrientation without EXIF resulted in orientation %d", orientation)
+	}
+}
@@ -0,0 +1,387 @@
+package image_pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+
+	"github.com/klippa-app/go-libheif/library/plugin/image_jpeg"
+)
+
+// pdfWriter writes the objects of a PDF file and keeps track of their offsets
+// for the cross-reference table.
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int // The offset of every object, object i+1 is at index i.
+}
+
+// newObject reserves an object number, so that it can be referenced before it
+// has been written.
+func (p *pdfWriter) newObject() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets)
+}
+
+func (p *pdfWriter) writeObject(id int, dict string) {
+	p.offsets[id-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", id, dict)
+}
+
+func (p *pdfWriter) writeStream(id int, dict string, data []byte) {
+	p.offsets[id-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", id, dict, len(data))
+	p.buf.Write(data)
+	p.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// Encode writes a PDF file with a page for every given image.
+func Encode(w io.Writer, pages []Page, o Options) error {
+	if len(pages) == 0 {
+		return errors.New("no pages given")
+	}
+
+	switch o.Compression {
+	case CompressionJPEG, CompressionLossless, "":
+	default:
+		return fmt.Errorf("unsupported pdf compression: %s", o.Compression)
+	}
+
+	p := &pdfWriter{}
+	p.buf.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+
+	catalog := p.newObject()
+	pageTree := p.newObject()
+	info := p.newObject()
+
+	kids := make([]string, 0, len(pages))
+	for _, page := range pages {
+		id, err := p.writePage(page, pageTree, o)
+		if err != nil {
+			return err
+		}
+		kids = append(kids, fmt.Sprintf("%d 0 R", id))
+	}
+
+	p.writeObject(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pageTree))
+	p.writeObject(pageTree, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	p.writeObject(info, "<< /Producer (go-libheif) >>")
+
+	xref := p.buf.Len()
+	fmt.Fprintf(&p.buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, offset := range p.offsets {
+		fmt.Fprintf(&p.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&p.buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, catalog, info, xref)
+
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+func (p *pdfWriter) writePage(page Page, pageTree int, o Options) (int, error) {
+	bounds := page.Image.Bounds()
+	if bounds.Empty() {
+		return 0, errors.New("image is empty")
+	}
+
+	imageID, err := p.writeImage(page, o)
+	if err != nil {
+		return 0, err
+	}
+
+	dpi := page.DPI
+	if dpi <= 0 {
+		dpi = 72
+	}
+
+	// The size of the image in points.
+	imageWidth := float64(bounds.Dx()) * 72 / dpi
+	imageHeight := float64(bounds.Dy()) * 72 / dpi
+
+	pageWidth, pageHeight := imageWidth, imageHeight
+	x, y := 0.0, 0.0
+	if o.PageSize.Width > 0 && o.PageSize.Height > 0 {
+		pageWidth, pageHeight = o.PageSize.Width, o.PageSize.Height
+		if (imageWidth > imageHeight) != (pageWidth > pageHeight) {
+			pageWidth, pageHeight = pageHeight, pageWidth
+		}
+
+		scale := pageWidth / imageWidth
+		if pageHeight/imageHeight < scale {
+			scale = pageHeight / imageHeight
+		}
+		imageWidth *= scale
+		imageHeight *= scale
+		x = (pageWidth - imageWidth) / 2
+		y = (pageHeight - imageHeight) / 2
+	}
+
+	contents := p.newObject()
+	p.writeStream(contents, "", []byte(fmt.Sprintf("q %.4f 0 0 %.4f %.4f %.4f cm /Im0 Do Q", imageWidth, imageHeight, x, y)))
+
+	id := p.newObject()
+	p.writeObject(id, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.4f %.4f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>", pageTree, pageWidth, pageHeight, imageID, contents))
+	return id, nil
+}
+
+// writeImage writes the image XObject of the page, with a soft mask when the
+// image has alpha.
+func (p *pdfWriter) writeImage(page Page, o Options) (int, error) {
+	s := readSamples(page.Image)
+	bounds := page.Image.Bounds()
+
+	var data []byte
+	var filter string
+	components, bitsPerComponent := s.components, s.bitsPerComponent
+	if o.Compression == CompressionLossless {
+		var err error
+		data, err = deflate(s.colors)
+		if err != nil {
+			return 0, err
+		}
+		filter = "/FlateDecode"
+	} else {
+		quality := o.Quality
+		if quality <= 0 {
+			quality = 95
+		}
+
+		// The alpha is in the soft mask, so the JPEG is made from the
+		// samples, which are not premultiplied.
+		jpegImage := page.Image
+		if s.alpha != nil || s.bitsPerComponent == 16 {
+			jpegImage = s.toImage(bounds.Dx(), bounds.Dy())
+		}
+
+		var buf bytes.Buffer
+		err := image_jpeg.Encode(&buf, jpegImage, image_jpeg.Options{
+			Options: &jpeg.Options{
+				Quality: quality,
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		data = buf.Bytes()
+		filter = "/DCTDecode"
+
+		// The JPEG encoder decides on the amount of components itself.
+		components, bitsPerComponent = jpegComponents(data), 8
+	}
+
+	colorSpace := "/DeviceRGB"
+	if components == 1 {
+		colorSpace = "/DeviceGray"
+	}
+	if iccComponents(page.ICCProfile) == components {
+		profile, err := deflate(page.ICCProfile)
+		if err != nil {
+			return 0, err
+		}
+		profileID := p.newObject()
+		p.writeStream(profileID, fmt.Sprintf("/N %d /Alternate %s /Filter /FlateDecode", components, colorSpace), profile)
+		colorSpace = fmt.Sprintf("[/ICCBased %d 0 R]", profileID)
+	}
+
+	softMask := ""
+	if s.alpha != nil {
+		mask, err := deflate(s.alpha)
+		if err != nil {
+			return 0, err
+		}
+		maskID := p.newObject()
+		p.writeStream(maskID, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent %d /Filter /FlateDecode", bounds.Dx(), bounds.Dy(), s.bitsPerComponent), mask)
+		softMask = fmt.Sprintf(" /SMask %d 0 R", maskID)
+	}
+
+	id := p.newObject()
+	p.writeStream(id, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent %d /Filter %s%s", bounds.Dx(), bounds.Dy(), colorSpace, bitsPerComponent, filter, softMask), data)
+	return id, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// iccComponents returns the amount of components of the color space of the
+// ICC profile, or 0 when the profile is not usable.
+func iccComponents(profile []byte) int {
+	if len(profile) < 128 {
+		return 0
+	}
+	switch string(profile[16:20]) {
+	case "GRAY":
+		return 1
+	case "RGB ":
+		return 3
+	}
+	return 0
+}
+
+// jpegComponents returns the amount of components from the start of frame
+// marker of the JPEG data.
+func jpegComponents(data []byte) int {
+	for i := 2; i+9 < len(data); {
+		if data[i] != 0xff {
+			return 0
+		}
+		marker := data[i+1]
+		length := int(data[i+2])<<8 | int(data[i+3])
+		// SOF0 to SOF15, except DHT, JPG and DAC.
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			return int(data[i+9])
+		}
+		i += 2 + length
+	}
+	return 0
+}
+
+// samples are the pixels of an image in the sample format of PDF.
+type samples struct {
+	colors           []byte
+	alpha            []byte // Nil when the image is opaque.
+	components       int
+	bitsPerComponent int
+}
+
+func readSamples(m image.Image) *samples {
+	bounds := m.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	switch img := m.(type) {
+	case *image.Gray:
+		s := &samples{colors: make([]byte, 0, width*height), components: 1, bitsPerComponent: 8}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := img.PixOffset(bounds.Min.X, y)
+			s.colors = append(s.colors, img.Pix[offset:offset+width]...)
+		}
+		return s
+	case *image.Gray16:
+		s := &samples{colors: make([]byte, 0, width*height*2), components: 1, bitsPerComponent: 16}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := img.PixOffset(bounds.Min.X, y)
+			s.colors = append(s.colors, img.Pix[offset:offset+width*2]...)
+		}
+		return s
+	}
+
+	opaque := false
+	if o, ok := m.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+
+	switch img := m.(type) {
+	case *image.YCbCr:
+		s := &samples{colors: make([]byte, 0, width*height*3), components: 3, bitsPerComponent: 8}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				yi, ci := img.YOffset(x, y), img.COffset(x, y)
+				r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+				s.colors = append(s.colors, r, g, b)
+			}
+		}
+		return s
+	case *image.RGBA:
+		if opaque {
+			s := &samples{colors: make([]byte, 0, width*height*3), components: 3, bitsPerComponent: 8}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+				for x := 0; x < width; x++ {
+					s.colors = append(s.colors, row[x*4:x*4+3]...)
+				}
+			}
+			return s
+		}
+	case *image.NRGBA:
+		s := &samples{colors: make([]byte, 0, width*height*3), components: 3, bitsPerComponent: 8}
+		if !opaque {
+			s.alpha = make([]byte, 0, width*height)
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < width; x++ {
+				s.colors = append(s.colors, row[x*4:x*4+3]...)
+				if s.alpha != nil {
+					s.alpha = append(s.alpha, row[x*4+3])
+				}
+			}
+		}
+		return s
+	}
+
+	bytesPerComponent := 1
+	switch m.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		bytesPerComponent = 2
+	}
+
+	s := &samples{
+		colors:           make([]byte, width*height*3*bytesPerComponent),
+		components:       3,
+		bitsPerComponent: bytesPerComponent * 8,
+	}
+	if !opaque {
+		s.alpha = make([]byte, width*height*bytesPerComponent)
+	}
+
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+			if bytesPerComponent == 1 {
+				s.colors[i*3] = byte(c.R >> 8)
+				s.colors[i*3+1] = byte(c.G >> 8)
+				s.colors[i*3+2] = byte(c.B >> 8)
+				if s.alpha != nil {
+					s.alpha[i] = byte(c.A >> 8)
+				}
+			} else {
+				for component, value := range []uint16{c.R, c.G, c.B} {
+					s.colors[i*6+component*2] = byte(value >> 8)
+					s.colors[i*6+component*2+1] = byte(value)
+				}
+				if s.alpha != nil {
+					s.alpha[i*2] = byte(c.A >> 8)
+					s.alpha[i*2+1] = byte(c.A)
+				}
+			}
+			i++
+		}
+	}
+
+	return s
+}
+
+// toImage returns an opaque 8 bit image of the color samples.
+func (s *samples) toImage(width, height int) image.Image {
+	if s.components == 1 {
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		for i := range gray.Pix {
+			gray.Pix[i] = s.colors[i*s.bitsPerComponent/8]
+		}
+		return gray
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	step := s.bitsPerComponent / 8
+	for i := 0; i < width*height; i++ {
+		rgba.Pix[i*4] = s.colors[i*3*step]
+		rgba.Pix[i*4+1] = s.colors[(i*3+1)*step]
+		rgba.Pix[i*4+2] = s.colors[(i*3+2)*step]
+		rgba.Pix[i*4+3] = 0xff
+	}
+	return rgba
+}
@@ -0,0 +1,159 @@
+package image_pdf
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// checkPDF checks that the cross-reference table points to the objects and
+// returns the MediaBox of every page.
+func checkPDF(t *testing.T, data []byte) []string {
+	if !bytes.HasPrefix(data, []byte("%PDF-1.5\n")) {
+		t.Fatalf("PDF does not start with the header")
+	}
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	if startxref == nil {
+		t.Fatalf("PDF does not end with startxref")
+	}
+	xref, _ := strconv.Atoi(string(startxref[1]))
+
+	table := regexp.MustCompile(`^xref\n0 (\d+)\n`).FindSubmatch(data[xref:])
+	if table == nil {
+		t.Fatalf("startxref does not point to the cross-reference table")
+	}
+	count, _ := strconv.Atoi(string(table[1]))
+	entries := data[xref+len(table[0]):]
+	for i := 1; i < count; i++ {
+		offset, _ := strconv.Atoi(string(entries[i*20 : i*20+10]))
+		if want := fmt.Sprintf("%d 0 obj\n", i); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Fatalf("cross-reference entry of object %d does not point to the object", i)
+		}
+	}
+
+	var mediaBoxes []string
+	for _, match := range regexp.MustCompile(`/Type /Page /Parent \d+ 0 R /MediaBox \[([^\]]+)\]`).FindAllSubmatch(data, -1) {
+		mediaBoxes = append(mediaBoxes, string(match[1]))
+	}
+	return mediaBoxes
+}
+
+func TestEncode(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 100, 50))
+	rgba := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	rgba64 := image.NewRGBA64(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			gray.SetGray(x, y, color.Gray{Y: uint8(x)})
+			rgba.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+			nrgba.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 0x80, A: uint8(y * 5)})
+			rgba64.SetRGBA64(x, y, color.RGBA64{R: uint16(x) << 8, G: uint16(y) << 8, B: 0x8000, A: 0xffff})
+		}
+	}
+
+	type testCase struct {
+		Name       string
+		Image      image.Image
+		ColorSpace string
+		SoftMask   bool
+	}
+	testCases := []testCase{
+		{Name: "gray", Image: gray, ColorSpace: "/DeviceGray"},
+		{Name: "rgba", Image: rgba, ColorSpace: "/DeviceRGB"},
+		{Name: "nrgba", Image: nrgba, ColorSpace: "/DeviceRGB", SoftMask: true},
+		{Name: "rgba64", Image: rgba64, ColorSpace: "/DeviceRGB"},
+	}
+	for _, testCase := range testCases {
+		for _, compression := range []Compression{CompressionJPEG, CompressionLossless} {
+			testWriter := bytes.NewBuffer(nil)
+			err := Encode(testWriter, []Page{{Image: testCase.Image}}, Options{Compression: compression})
+			if err != nil {
+				t.Fatalf("Encode of %s with %s resulted in error: %s", testCase.Name, compression, err.Error())
+			}
+
+			mediaBoxes := checkPDF(t, testWriter.Bytes())
+			if got, want := fmt.Sprint(mediaBoxes), "[0 0 100.0000 50.0000]"; got != want {
+				t.Errorf("Encode of %s with %s resulted in wrong pages, got %s, want %s", testCase.Name, compression, got, want)
+			}
+
+			filter := "/DCTDecode"
+			if compression == CompressionLossless {
+				filter = "/FlateDecode"
+			}
+			colorSpace := testCase.ColorSpace
+			if compression == CompressionJPEG && colorSpace == "/DeviceGray" && !bytes.Contains(testWriter.Bytes(), []byte("/ColorSpace "+colorSpace)) {
+				// The turbojpeg encoder always writes 3 components.
+				colorSpace = "/DeviceRGB"
+			}
+			if want := "/ColorSpace " + colorSpace; !bytes.Contains(testWriter.Bytes(), []byte(want)) {
+				t.Errorf("Encode of %s with %s did not result in color space %s", testCase.Name, compression, colorSpace)
+			}
+			if !bytes.Contains(testWriter.Bytes(), []byte("/Filter "+filter)) {
+				t.Errorf("Encode of %s with %s did not result in filter %s", testCase.Name, compression, filter)
+			}
+			if got := bytes.Contains(testWriter.Bytes(), []byte("/SMask")); got != testCase.SoftMask {
+				t.Errorf("Encode of %s with %s resulted in wrong soft mask, got %t, want %t", testCase.Name, compression, got, testCase.SoftMask)
+			}
+		}
+	}
+}
+
+func TestEncodePages(t *testing.T) {
+	landscape := image.NewGray(image.Rect(0, 0, 300, 150))
+	portrait := image.NewGray(image.Rect(0, 0, 150, 300))
+	pages := []Page{
+		{Image: landscape, DPI: 300},
+		{Image: portrait, DPI: 150},
+	}
+
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, pages, Options{})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	if got, want := fmt.Sprint(checkPDF(t, testWriter.Bytes())), "[0 0 72.0000 36.0000 0 0 72.0000 144.0000]"; got != want {
+		t.Errorf("Encode resulted in wrong pages, got %s, want %s", got, want)
+	}
+
+	// With a page size, the page is turned for landscape images.
+	testWriter.Reset()
+	err = Encode(testWriter, pages, Options{PageSize: PageSizeA4})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	if got, want := fmt.Sprint(checkPDF(t, testWriter.Bytes())), "[0 0 841.8900 595.2800 0 0 595.2800 841.8900]"; got != want {
+		t.Errorf("Encode resulted in wrong pages, got %s, want %s", got, want)
+	}
+}
+
+func TestEncodeICCProfile(t *testing.T) {
+	profile := make([]byte, 128)
+	copy(profile[16:], "RGB ")
+
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, []Page{{Image: image.NewRGBA(image.Rect(0, 0, 10, 10)), ICCProfile: profile}}, Options{Compression: CompressionLossless})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	checkPDF(t, testWriter.Bytes())
+	if !regexp.MustCompile(`/ColorSpace \[/ICCBased \d+ 0 R\]`).Match(testWriter.Bytes()) {
+		t.Errorf("Encode did not result in an ICC based color space")
+	}
+
+	// A gray profile can't be used for RGB images.
+	copy(profile[16:], "GRAY")
+	testWriter.Reset()
+	err = Encode(testWriter, []Page{{Image: image.NewRGBA(image.Rect(0, 0, 10, 10)), ICCProfile: profile}}, Options{Compression: CompressionLossless})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	if bytes.Contains(testWriter.Bytes(), []byte("/ICCBased")) {
+		t.Errorf("Encode resulted in an ICC based color space for a gray profile")
+	}
+}
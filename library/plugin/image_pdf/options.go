@@ -0,0 +1,35 @@
+package image_pdf
+
+import "image"
+
+type Compression string // The compression of the images in the PDF.
+
+const (
+	CompressionJPEG     Compression = "jpeg"     // JPEG compression, the default.
+	CompressionLossless Compression = "lossless" // Lossless Flate compression.
+)
+
+type PageSize struct {
+	Width  float64 // The width in points (1/72 inch).
+	Height float64 // The height in points (1/72 inch).
+}
+
+var (
+	PageSizeA3     = PageSize{Width: 841.89, Height: 1190.55}
+	PageSizeA4     = PageSize{Width: 595.28, Height: 841.89}
+	PageSizeA5     = PageSize{Width: 419.53, Height: 595.28}
+	PageSizeLetter = PageSize{Width: 612, Height: 792}
+	PageSizeLegal  = PageSize{Width: 612, Height: 1008}
+)
+
+type Options struct {
+	Compression Compression // The compression of the images, the default is CompressionJPEG.
+	Quality     int         // Only used with CompressionJPEG. Ranges from 1 to 100 inclusive, higher is better. The default is 95.
+	PageSize    PageSize    // The size of the pages, the images are scaled to fit and centered, and the page is turned when the image is landscape. When empty, every page gets the size of its image.
+}
+
+type Page struct {
+	Image      image.Image // The image to put on the page.
+	DPI        float64     // The resolution of the image, to get the page size when no PageSize is given. The default is 72.
+	ICCProfile []byte      // The ICC profile of the image, only used for RGB images.
+}
@@ -0,0 +1,37 @@
+package image_png
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ihdrEnd is the offset after the signature and the IHDR chunk, which is
+// always the first chunk and has 13 bytes of data.
+const ihdrEnd = 8 + 4 + 4 + 13 + 4
+
+// writeCICP writes the PNG file with a cICP chunk, which has to come before
+// the PLTE and IDAT chunks, so it's placed right after the IHDR chunk.
+func writeCICP(w io.Writer, data []byte, cicp *CICP) error {
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return errors.New("invalid png data")
+	}
+
+	fullRange := uint8(0)
+	if cicp.FullRange {
+		fullRange = 1
+	}
+
+	chunk := binary.BigEndian.AppendUint32(nil, 4)
+	chunk = append(chunk, "cICP"...)
+	chunk = append(chunk, cicp.ColorPrimaries, cicp.TransferCharacteristics, cicp.MatrixCoefficients, fullRange)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	for _, part := range [][]byte{data[:ihdrEnd], chunk, data[ihdrEnd:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
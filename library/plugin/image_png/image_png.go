@@ -0,0 +1,106 @@
+package image_png
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+var compressionLevels = map[CompressionLevel]png.CompressionLevel{
+	CompressionLevelDefault: png.DefaultCompression,
+	CompressionLevelNone:    png.NoCompression,
+	CompressionLevelFast:    png.BestSpeed,
+	CompressionLevelBest:    png.BestCompression,
+}
+
+// Encode writes the image to w in PNG format.
+func Encode(w io.Writer, img image.Image, o Options) error {
+	level, ok := compressionLevels[o.CompressionLevel]
+	if !ok {
+		return errors.New("unsupported png compression level")
+	}
+
+	if o.MaxColors != 0 {
+		if o.MaxColors < 2 || o.MaxColors > 256 {
+			return errors.New("png max colors must be between 2 and 256")
+		}
+		if o.BitDepth == 16 {
+			return errors.New("a png palette can't have a bit depth of 16")
+		}
+		img = Quantize(img, o.MaxColors)
+	} else {
+		switch o.BitDepth {
+		case 0:
+		case 8:
+			img = to8Bit(img)
+		case 16:
+			img = to16Bit(img)
+		default:
+			return errors.New("png bit depth must be 8 or 16")
+		}
+	}
+
+	encoder := png.Encoder{CompressionLevel: level}
+	if o.CICP == nil {
+		return encoder.Encode(w, img)
+	}
+
+	output := &bytes.Buffer{}
+	err := encoder.Encode(output, img)
+	if err != nil {
+		return err
+	}
+	return writeCICP(w, output.Bytes(), o.CICP)
+}
+
+// Is16Bit returns whether the image has 16 bits per channel.
+func Is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+// to8Bit converts images with 16 bits per channel to 8 bits per channel.
+func to8Bit(img image.Image) image.Image {
+	if !Is16Bit(img) {
+		return img
+	}
+
+	var converted draw.Image
+	switch img.(type) {
+	case *image.Gray16:
+		converted = image.NewGray(img.Bounds())
+	case *image.RGBA64:
+		converted = image.NewRGBA(img.Bounds())
+	default:
+		converted = image.NewNRGBA(img.Bounds())
+	}
+
+	draw.Draw(converted, converted.Bounds(), img, img.Bounds().Min, draw.Src)
+	return converted
+}
+
+// to16Bit converts images with 8 bits per channel to 16 bits per channel.
+func to16Bit(img image.Image) image.Image {
+	if Is16Bit(img) {
+		return img
+	}
+
+	var converted draw.Image
+	switch img.(type) {
+	case *image.Gray:
+		converted = image.NewGray16(img.Bounds())
+	case *image.NRGBA:
+		converted = image.NewNRGBA64(img.Bounds())
+	default:
+		converted = image.NewRGBA64(img.Bounds())
+	}
+
+	draw.Draw(converted, converted.Bounds(), img, img.Bounds().Min, draw.Src)
+	return converted
+}
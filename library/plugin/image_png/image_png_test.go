@@ -0,0 +1,176 @@
+package image_png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testGradient(width, height int) *image.NRGBA64 {
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(x * 0xffff / width),
+				G: uint16(y * 0xffff / height),
+				B: 0x8000,
+				A: uint16(0xffff - y*0x100),
+			})
+		}
+	}
+	return img
+}
+
+func testScreenshot(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	colors := []color.RGBA{
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		{R: 0x20, G: 0x20, B: 0x20, A: 0xff},
+		{R: 0x1a, G: 0x73, B: 0xe8, A: 0xff},
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, colors[(x/7+y/13)%len(colors)])
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, img image.Image, o Options) (*bytes.Buffer, image.Image) {
+	t.Helper()
+	output := &bytes.Buffer{}
+	err := Encode(output, img, o)
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+
+	data := output.Bytes()
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode resulted in error: %s", err.Error())
+	}
+	return bytes.NewBuffer(data), decoded
+}
+
+func TestEncodeBitDepth(t *testing.T) {
+	type testCase struct {
+		Name     string
+		Image    image.Image
+		BitDepth int
+		Want     color.Model
+	}
+	testCases := []testCase{
+		{Name: "keep 16", Image: testGradient(64, 32), Want: color.NRGBA64Model},
+		{Name: "keep 8", Image: testScreenshot(64, 32), Want: color.RGBAModel},
+		{Name: "16 to 8", Image: testGradient(64, 32), BitDepth: 8, Want: color.NRGBAModel},
+		{Name: "8 to 16", Image: testScreenshot(64, 32), BitDepth: 16, Want: color.RGBA64Model},
+		{Name: "gray16 to 8", Image: image.NewGray16(image.Rect(0, 0, 64, 32)), BitDepth: 8, Want: color.GrayModel},
+	}
+	for _, testCase := range testCases {
+		_, decoded := encode(t, testCase.Image, Options{BitDepth: testCase.BitDepth})
+		if decoded.ColorModel() != testCase.Want {
+			t.Errorf("Encode of %s resulted in color model %T", testCase.Name, decoded)
+		}
+	}
+}
+
+func TestEncodeCompressionLevel(t *testing.T) {
+	img := testGradient(256, 128)
+	none, _ := encode(t, img, Options{CompressionLevel: CompressionLevelNone})
+	best, _ := encode(t, img, Options{CompressionLevel: CompressionLevelBest})
+	if best.Len() >= none.Len() {
+		t.Errorf("Expected best compression to be smaller than no compression, got %d and %d bytes", best.Len(), none.Len())
+	}
+
+	err := Encode(&bytes.Buffer{}, img, Options{CompressionLevel: "unknown"})
+	if err == nil {
+		t.Error("Expected an error for an unknown compression level")
+	}
+}
+
+func TestQuantizeExact(t *testing.T) {
+	img := testScreenshot(100, 60)
+	_, decoded := encode(t, img, Options{MaxColors: 16})
+	paletted, ok := decoded.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Expected a paletted image, got %T", decoded)
+	}
+
+	if len(paletted.Palette) != 3 {
+		t.Errorf("Expected a palette of 3 colors, got %d", len(paletted.Palette))
+	}
+
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 100; x++ {
+			want := color.NRGBAModel.Convert(img.At(x, y))
+			if got := color.NRGBAModel.Convert(paletted.At(x, y)); got != want {
+				t.Fatalf("Expected pixel %d,%d to be %v, got %v", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestQuantizeMedianCut(t *testing.T) {
+	img := testGradient(256, 128)
+	for _, maxColors := range []int{2, 16, 256} {
+		quantized := Quantize(img, maxColors)
+		if len(quantized.Palette) > maxColors {
+			t.Errorf("Expected at most %d colors, got %d", maxColors, len(quantized.Palette))
+		}
+
+		if maxColors == 2 {
+			continue
+		}
+
+		// The dithering keeps the average color of an area within the range
+		// of the palette about the same.
+		for _, area := range []image.Rectangle{image.Rect(64, 32, 96, 64), image.Rect(160, 64, 192, 96)} {
+			var want, got [4]float64
+			for y := area.Min.Y; y < area.Max.Y; y++ {
+				for x := area.Min.X; x < area.Max.X; x++ {
+					w := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+					g := quantized.Palette[quantized.ColorIndexAt(x, y)].(color.NRGBA)
+					want[0], want[1], want[2], want[3] = want[0]+float64(w.R), want[1]+float64(w.G), want[2]+float64(w.B), want[3]+float64(w.A)
+					got[0], got[1], got[2], got[3] = got[0]+float64(g.R), got[1]+float64(g.G), got[2]+float64(g.B), got[3]+float64(g.A)
+				}
+			}
+
+			pixels := float64(area.Dx() * area.Dy())
+			for c := range want {
+				if diff := (want[c] - got[c]) / pixels; diff > 12 || diff < -12 {
+					t.Errorf("Expected the average of channel %d of %v with %d colors to be about %.1f, got %.1f", c, area, maxColors, want[c]/pixels, got[c]/pixels)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeInvalidOptions(t *testing.T) {
+	img := testScreenshot(16, 16)
+	for _, o := range []Options{{MaxColors: 1}, {MaxColors: 257}, {BitDepth: 4}, {MaxColors: 16, BitDepth: 16}} {
+		err := Encode(&bytes.Buffer{}, img, o)
+		if err == nil {
+			t.Errorf("Expected an error for options %+v", o)
+		}
+	}
+}
+
+func TestEncodeCICP(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := Encode(buf, testGradient(16, 16), Options{CICP: &CICP{ColorPrimaries: 9, TransferCharacteristics: 16, FullRange: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunk follows the IHDR chunk, Go checks its CRC when decoding.
+	data := buf.Bytes()
+	if string(data[ihdrEnd+4:ihdrEnd+8]) != "cICP" || !bytes.Equal(data[ihdrEnd+8:ihdrEnd+12], []byte{9, 16, 0, 1}) {
+		t.Errorf("Expected a cICP chunk after the IHDR chunk, got %q", data[ihdrEnd:ihdrEnd+12])
+	}
+
+	if _, err = png.Decode(buf); err != nil {
+		t.Errorf("Could not decode the png: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package image_png
+
+type CompressionLevel string // The zlib compression level of the image data.
+
+const (
+	CompressionLevelDefault CompressionLevel = ""     // The default compression level.
+	CompressionLevelNone    CompressionLevel = "none" // No compression.
+	CompressionLevelFast    CompressionLevel = "fast" // Fast compression, larger files.
+	CompressionLevelBest    CompressionLevel = "best" // The best compression, slower.
+)
+
+type Options struct {
+	CompressionLevel CompressionLevel // The compression level to use.
+	BitDepth         int              // The bit depth per channel, 8 or 16. The default, 0, keeps the bit depth of the image.
+	MaxColors        int              // Quantize the image to a palette of at most this amount of colors, from 2 to 256. The default, 0, does not quantize the image.
+	CICP             *CICP            // Write a cICP chunk with the coding-independent code points of the image, for HDR images. The default, nil, writes no chunk.
+}
+
+// CICP are the coding-independent code points of ITU-T H.273 that describe the
+// colors of an image.
+type CICP struct {
+	ColorPrimaries          uint8
+	TransferCharacteristics uint8
+	MatrixCoefficients      uint8 // Always 0 in PNG, as the image data is RGB.
+	FullRange               bool
+}
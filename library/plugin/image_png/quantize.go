@@ -0,0 +1,313 @@
+package image_png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// The histogram of the median cut works on 5 bits per channel, so that it
+// fits in a fixed size table.
+const (
+	histogramBits = 5
+	histogramSize = 1 << (4 * histogramBits)
+)
+
+// bucket is an entry of the histogram, the channels are 5 bit values.
+type bucket struct {
+	channels [4]uint8
+	count    uint32
+}
+
+// box is a set of buckets that will become a single palette color.
+type box struct {
+	buckets []bucket
+	count   uint64
+}
+
+// Quantize converts the image to an image with a palette of at most maxColors
+// colors. When the image has no more colors than that, every color is kept
+// exactly. Otherwise the palette is picked with a median cut and the image is
+// dithered with Floyd-Steinberg error diffusion.
+func Quantize(img image.Image, maxColors int) *image.Paletted {
+	pixels := toNRGBA(img)
+	bounds := pixels.Bounds()
+
+	if paletted := exactPalette(pixels, maxColors); paletted != nil {
+		return paletted
+	}
+
+	palette := medianCut(pixels, maxColors)
+	paletted := image.NewPaletted(bounds, palette)
+	ditherer := newDitherer(palette)
+	width := bounds.Dx()
+
+	// The errors of the current and the next row, with a pixel of padding on
+	// both sides.
+	current := make([][4]int32, width+2)
+	next := make([][4]int32, width+2)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := pixels.Pix[y*pixels.Stride : y*pixels.Stride+width*4]
+		out := paletted.Pix[y*paletted.Stride : y*paletted.Stride+width]
+		for x := 0; x < width; x++ {
+			var wanted [4]int32
+			for c := 0; c < 4; c++ {
+				wanted[c] = clamp(int32(row[x*4+c]) + current[x+1][c]/16)
+			}
+
+			index := ditherer.index(wanted)
+			out[x] = index
+
+			chosen := palette[index].(color.NRGBA)
+			actual := [4]int32{int32(chosen.R), int32(chosen.G), int32(chosen.B), int32(chosen.A)}
+			for c := 0; c < 4; c++ {
+				e := wanted[c] - actual[c]
+				current[x+2][c] += e * 7
+				next[x][c] += e * 3
+				next[x+1][c] += e * 5
+				next[x+2][c] += e
+			}
+		}
+
+		current, next = next, current
+		for i := range next {
+			next[i] = [4]int32{}
+		}
+	}
+
+	return paletted
+}
+
+// toNRGBA returns the image as an NRGBA image that starts at the origin.
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA); ok && bounds.Min == (image.Point{}) {
+		return nrgba
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// exactPalette returns the image with a palette of all its colors, or nil
+// when it has more than maxColors colors.
+func exactPalette(pixels *image.NRGBA, maxColors int) *image.Paletted {
+	bounds := pixels.Bounds()
+	indexes := map[uint32]uint8{}
+	palette := color.Palette{}
+	paletted := image.NewPaletted(bounds, nil)
+	width := bounds.Dx()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := pixels.Pix[y*pixels.Stride : y*pixels.Stride+width*4]
+		out := paletted.Pix[y*paletted.Stride : y*paletted.Stride+width]
+		for x := 0; x < width; x++ {
+			r, g, b, a := row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]
+			if a == 0 {
+				// All fully transparent pixels look the same.
+				r, g, b = 0, 0, 0
+			}
+
+			key := uint32(r)<<24 | uint32(g)<<16 | uint32(b)<<8 | uint32(a)
+			index, ok := indexes[key]
+			if !ok {
+				if len(palette) == maxColors {
+					return nil
+				}
+				index = uint8(len(palette))
+				indexes[key] = index
+				palette = append(palette, color.NRGBA{R: r, G: g, B: b, A: a})
+			}
+			out[x] = index
+		}
+	}
+
+	paletted.Palette = palette
+	return paletted
+}
+
+// histogramIndex returns the index in the histogram of a color.
+func histogramIndex(r, g, b, a uint8) int {
+	const shift = 8 - histogramBits
+	return int(r>>shift)<<(3*histogramBits) | int(g>>shift)<<(2*histogramBits) | int(b>>shift)<<histogramBits | int(a>>shift)
+}
+
+// medianCut picks a palette of at most maxColors colors, by repeatedly
+// splitting the box of colors with the largest weighted range at its median.
+func medianCut(pixels *image.NRGBA, maxColors int) color.Palette {
+	bounds := pixels.Bounds()
+	histogram := make([]uint32, histogramSize)
+	width := bounds.Dx()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := pixels.Pix[y*pixels.Stride : y*pixels.Stride+width*4]
+		for x := 0; x < width; x++ {
+			histogram[histogramIndex(row[x*4], row[x*4+1], row[x*4+2], row[x*4+3])]++
+		}
+	}
+
+	const mask = 1<<histogramBits - 1
+	initial := box{}
+	for index, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		initial.buckets = append(initial.buckets, bucket{
+			channels: [4]uint8{
+				uint8(index >> (3 * histogramBits) & mask),
+				uint8(index >> (2 * histogramBits) & mask),
+				uint8(index >> histogramBits & mask),
+				uint8(index & mask),
+			},
+			count: count,
+		})
+		initial.count += uint64(count)
+	}
+
+	boxes := []box{initial}
+	for len(boxes) < maxColors {
+		best, bestChannel, bestScore := -1, 0, uint64(0)
+		for i := range boxes {
+			if len(boxes[i].buckets) < 2 {
+				continue
+			}
+			channel, spread := boxes[i].widestChannel()
+			if score := uint64(spread) * boxes[i].count; score > bestScore {
+				best, bestChannel, bestScore = i, channel, score
+			}
+		}
+
+		if best == -1 {
+			// Every box is a single color.
+			break
+		}
+
+		low, high := boxes[best].split(bestChannel)
+		boxes[best] = low
+		boxes = append(boxes, high)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		palette = append(palette, b.average())
+	}
+	return palette
+}
+
+// widestChannel returns the channel with the largest range of values, and
+// that range.
+func (b box) widestChannel() (int, uint8) {
+	low := [4]uint8{255, 255, 255, 255}
+	high := [4]uint8{}
+	for _, entry := range b.buckets {
+		for c, value := range entry.channels {
+			if value < low[c] {
+				low[c] = value
+			}
+			if value > high[c] {
+				high[c] = value
+			}
+		}
+	}
+
+	channel, spread := 0, uint8(0)
+	for c := range low {
+		if high[c]-low[c] > spread {
+			channel, spread = c, high[c]-low[c]
+		}
+	}
+	return channel, spread
+}
+
+// split splits the box in two at the weighted median of the channel.
+func (b box) split(channel int) (box, box) {
+	sort.Slice(b.buckets, func(i, j int) bool {
+		return b.buckets[i].channels[channel] < b.buckets[j].channels[channel]
+	})
+
+	var count uint64
+	median := 1
+	for i, entry := range b.buckets[:len(b.buckets)-1] {
+		count += uint64(entry.count)
+		median = i + 1
+		if count*2 >= b.count {
+			break
+		}
+	}
+
+	low := box{buckets: b.buckets[:median], count: count}
+	high := box{buckets: b.buckets[median:], count: b.count - count}
+	return low, high
+}
+
+// average returns the weighted average color of the box.
+func (b box) average() color.NRGBA {
+	var sums [4]uint64
+	for _, entry := range b.buckets {
+		for c, value := range entry.channels {
+			// Use the center of the range of 8 bit values of the bucket.
+			sums[c] += (uint64(value)<<(8-histogramBits) + 1<<(7-histogramBits)) * uint64(entry.count)
+		}
+	}
+
+	return color.NRGBA{
+		R: uint8(sums[0] / b.count),
+		G: uint8(sums[1] / b.count),
+		B: uint8(sums[2] / b.count),
+		A: uint8(sums[3] / b.count),
+	}
+}
+
+// ditherer finds the nearest palette color, with a cache per histogram
+// bucket, which is close enough to the nearest color for error diffusion.
+type ditherer struct {
+	palette [][4]int32
+	cache   []int16
+}
+
+func newDitherer(palette color.Palette) *ditherer {
+	d := &ditherer{
+		palette: make([][4]int32, len(palette)),
+		cache:   make([]int16, histogramSize),
+	}
+	for i, c := range palette {
+		nrgba := c.(color.NRGBA)
+		d.palette[i] = [4]int32{int32(nrgba.R), int32(nrgba.G), int32(nrgba.B), int32(nrgba.A)}
+	}
+	for i := range d.cache {
+		d.cache[i] = -1
+	}
+	return d
+}
+
+func (d *ditherer) index(wanted [4]int32) uint8 {
+	key := histogramIndex(uint8(wanted[0]), uint8(wanted[1]), uint8(wanted[2]), uint8(wanted[3]))
+	if cached := d.cache[key]; cached >= 0 {
+		return uint8(cached)
+	}
+
+	best, bestDistance := 0, int32(-1)
+	for i, c := range d.palette {
+		var distance int32
+		for channel := range c {
+			diff := wanted[channel] - c[channel]
+			distance += diff * diff
+		}
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+
+	d.cache[key] = int16(best)
+	return uint8(best)
+}
+
+func clamp(value int32) int32 {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+	return value
+}
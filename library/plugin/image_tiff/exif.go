@@ -0,0 +1,177 @@
+package image_tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The tags from the main IFD of the EXIF data that we copy, the other tags
+// describe the image data of the EXIF thumbnail or are about the orientation,
+// which has already been applied to the rendered image.
+var exifMainTags = map[uint16]bool{
+	270:   true, // ImageDescription
+	271:   true, // Make
+	272:   true, // Model
+	305:   true, // Software
+	306:   true, // DateTime
+	315:   true, // Artist
+	33432: true, // Copyright
+}
+
+// The size of the values of the field types, and the size in which they have
+// to be swapped when changing the byte order.
+var fieldSizes = map[uint16]struct{ size, swap int }{
+	typeByte:      {1, 1},
+	typeASCII:     {1, 1},
+	typeShort:     {2, 2},
+	typeLong:      {4, 4},
+	typeRational:  {8, 4},
+	typeSByte:     {1, 1},
+	typeUndefined: {1, 1},
+	typeSShort:    {2, 2},
+	typeSLong:     {4, 4},
+	typeSRational: {8, 4},
+	typeFloat:     {4, 4},
+	typeDouble:    {8, 8},
+}
+
+// The tags of the EXIF IFD that are not copied or are rewritten. The
+// interoperability IFD and the maker note have offsets into the original EXIF
+// data, the pixel dimensions change when the image is scaled.
+const (
+	tagMakerNote           = 37500
+	tagPixelXDimension     = 40962
+	tagPixelYDimension     = 40963
+	tagInteroperabilityIFD = 40965
+)
+
+type exifData struct {
+	main ifd
+	exif ifd
+	gps  ifd
+}
+
+// readEXIF reads the EXIF data, which is a TIFF structure itself, and converts
+// the entries that we copy to our byte order. The pixel dimensions are set to
+// the size of the image that is written.
+func readEXIF(data []byte, width, height int) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, errors.New("exif data is too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("exif data does not start with a tiff header")
+	}
+
+	reader := exifReader{data: data, order: order}
+	mainEntries, err := reader.readIFD(order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &exifData{}
+	for _, e := range mainEntries {
+		switch {
+		case e.tag == tagExifIFD:
+			if exif.exif, err = reader.readSubIFD(e); err != nil {
+				return nil, err
+			}
+		case e.tag == tagGPSIFD:
+			if exif.gps, err = reader.readSubIFD(e); err != nil {
+				return nil, err
+			}
+		case exifMainTags[e.tag]:
+			exif.main = append(exif.main, e)
+		}
+	}
+
+	filtered := exif.exif[:0]
+	for _, e := range exif.exif {
+		switch e.tag {
+		case tagInteroperabilityIFD, tagMakerNote:
+			continue
+		case tagPixelXDimension:
+			e = longEntry(e.tag, uint32(width))
+		case tagPixelYDimension:
+			e = longEntry(e.tag, uint32(height))
+		}
+		filtered = append(filtered, e)
+	}
+	exif.exif = filtered
+
+	return exif, nil
+}
+
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (r exifReader) readSubIFD(e entry) (ifd, error) {
+	if e.typ != typeLong || e.count != 1 {
+		return nil, fmt.Errorf("invalid sub IFD pointer for tag %d", e.tag)
+	}
+	return r.readIFD(byteOrder.Uint32(e.data))
+}
+
+func (r exifReader) readIFD(offset uint32) (ifd, error) {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return nil, errors.New("IFD offset is out of bounds")
+	}
+
+	count := int(r.order.Uint16(r.data[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(r.data)) {
+		return nil, errors.New("IFD is out of bounds")
+	}
+
+	entries := make(ifd, 0, count)
+	for i := 0; i < count; i++ {
+		raw := r.data[int(offset)+2+i*12:]
+		e := entry{
+			tag:   r.order.Uint16(raw),
+			typ:   r.order.Uint16(raw[2:]),
+			count: r.order.Uint32(raw[4:]),
+		}
+
+		sizes, ok := fieldSizes[e.typ]
+		if !ok {
+			// Unknown types can't be converted, so we skip them.
+			continue
+		}
+
+		size := uint64(sizes.size) * uint64(e.count)
+		value := raw[8:12]
+		if size > 4 {
+			valueOffset := uint64(r.order.Uint32(raw[8:]))
+			if valueOffset+size > uint64(len(r.data)) {
+				return nil, fmt.Errorf("value of tag %d is out of bounds", e.tag)
+			}
+			value = r.data[valueOffset : valueOffset+size]
+		}
+
+		e.data = make([]byte, size)
+		copy(e.data, value)
+		if r.order != byteOrder && sizes.swap > 1 {
+			for start := 0; start < len(e.data); start += sizes.swap {
+				reverse(e.data[start : start+sizes.swap])
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
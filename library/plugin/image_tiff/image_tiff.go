@@ -0,0 +1,403 @@
+package image_tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"sort"
+)
+
+// The TIFF tags that we write.
+const (
+	tagImageWidth                = 256
+	tagImageLength               = 257
+	tagBitsPerSample             = 258
+	tagCompression               = 259
+	tagPhotometricInterpretation = 262
+	tagStripOffsets              = 273
+	tagSamplesPerPixel           = 277
+	tagRowsPerStrip              = 278
+	tagStripByteCounts           = 279
+	tagXResolution               = 282
+	tagYResolution               = 283
+	tagPlanarConfiguration       = 284
+	tagResolutionUnit            = 296
+	tagPredictor                 = 317
+	tagExtraSamples              = 338
+	tagExifIFD                   = 34665
+	tagGPSIFD                    = 34853
+	tagICCProfile                = 34675
+)
+
+// The TIFF field types.
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeSByte     = 6
+	typeUndefined = 7
+	typeSShort    = 8
+	typeSLong     = 9
+	typeSRational = 10
+	typeFloat     = 11
+	typeDouble    = 12
+)
+
+// stripSize is the approximate size of the uncompressed strips.
+const stripSize = 64 * 1024
+
+// We write big endian files, so that 16 bit samples can be copied from the Go
+// images as is.
+var byteOrder = binary.BigEndian
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte // The value, in byteOrder.
+}
+
+func shortEntry(tag uint16, values ...uint16) entry {
+	data := make([]byte, 2*len(values))
+	for i, value := range values {
+		byteOrder.PutUint16(data[i*2:], value)
+	}
+	return entry{tag: tag, typ: typeShort, count: uint32(len(values)), data: data}
+}
+
+func longEntry(tag uint16, values ...uint32) entry {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		byteOrder.PutUint32(data[i*4:], value)
+	}
+	return entry{tag: tag, typ: typeLong, count: uint32(len(values)), data: data}
+}
+
+func rationalEntry(tag uint16, numerator, denominator uint32) entry {
+	data := make([]byte, 8)
+	byteOrder.PutUint32(data, numerator)
+	byteOrder.PutUint32(data[4:], denominator)
+	return entry{tag: tag, typ: typeRational, count: 1, data: data}
+}
+
+type ifd []entry
+
+// size returns the size of the IFD including the values that don't fit in
+// the entries.
+func (d ifd) size() int {
+	size := 2 + 12*len(d) + 4
+	for _, e := range d {
+		if len(e.data) > 4 {
+			size += len(e.data) + len(e.data)%2
+		}
+	}
+	return size
+}
+
+// write writes the IFD that is placed at the given offset in the file.
+func (d ifd) write(w *bytes.Buffer, offset int) {
+	sort.Slice(d, func(i, j int) bool { return d[i].tag < d[j].tag })
+
+	valueOffset := offset + 2 + 12*len(d) + 4
+	var values bytes.Buffer
+	binary.Write(w, byteOrder, uint16(len(d)))
+	for _, e := range d {
+		binary.Write(w, byteOrder, e.tag)
+		binary.Write(w, byteOrder, e.typ)
+		binary.Write(w, byteOrder, e.count)
+		if len(e.data) > 4 {
+			binary.Write(w, byteOrder, uint32(valueOffset+values.Len()))
+			values.Write(e.data)
+			if len(e.data)%2 == 1 {
+				values.WriteByte(0)
+			}
+		} else {
+			value := make([]byte, 4)
+			copy(value, e.data)
+			w.Write(value)
+		}
+	}
+	// There is no next IFD.
+	binary.Write(w, byteOrder, uint32(0))
+	w.Write(values.Bytes())
+}
+
+// Encode writes the image m to w in TIFF format. Images with a high bit depth
+// are written with 16 bits per sample, images with an alpha channel get an
+// extra alpha sample.
+func Encode(w io.Writer, m image.Image, o Options) error {
+	compression := uint16(0)
+	switch o.Compression {
+	case CompressionNone:
+		compression = 1
+	case CompressionLZW, "":
+		compression = 5
+	case CompressionDeflate:
+		compression = 8
+	default:
+		return fmt.Errorf("unsupported tiff compression: %s", o.Compression)
+	}
+
+	bounds := m.Bounds()
+	if bounds.Empty() {
+		return errors.New("image is empty")
+	}
+
+	layout := newSampleLayout(m)
+	rowSize := bounds.Dx() * layout.samples * layout.bitsPerSample / 8
+	rowsPerStrip := stripSize / rowSize
+	if rowsPerStrip < 1 {
+		rowsPerStrip = 1
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("MM\x00\x2a")
+	// Placeholder for the offset of the first IFD.
+	buf.Write([]byte{0, 0, 0, 0})
+
+	var stripOffsets, stripByteCounts []uint32
+	row := make([]byte, rowSize)
+	strip := make([]byte, 0, rowsPerStrip*rowSize)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += rowsPerStrip {
+		strip = strip[:0]
+		for stripY := y; stripY < y+rowsPerStrip && stripY < bounds.Max.Y; stripY++ {
+			layout.readRow(row, m, stripY)
+			if compression != 1 {
+				layout.predict(row)
+			}
+			strip = append(strip, row...)
+		}
+
+		data, err := compress(strip, compression)
+		if err != nil {
+			return err
+		}
+
+		stripOffsets = append(stripOffsets, uint32(buf.Len()))
+		stripByteCounts = append(stripByteCounts, uint32(len(data)))
+		buf.Write(data)
+		if buf.Len()%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+
+	bitsPerSample := make([]uint16, layout.samples)
+	for i := range bitsPerSample {
+		bitsPerSample[i] = uint16(layout.bitsPerSample)
+	}
+
+	mainIFD := ifd{
+		longEntry(tagImageWidth, uint32(bounds.Dx())),
+		longEntry(tagImageLength, uint32(bounds.Dy())),
+		shortEntry(tagBitsPerSample, bitsPerSample...),
+		shortEntry(tagCompression, compression),
+		shortEntry(tagPhotometricInterpretation, layout.photometricInterpretation),
+		longEntry(tagStripOffsets, stripOffsets...),
+		shortEntry(tagSamplesPerPixel, uint16(layout.samples)),
+		longEntry(tagRowsPerStrip, uint32(rowsPerStrip)),
+		longEntry(tagStripByteCounts, stripByteCounts...),
+		rationalEntry(tagXResolution, 72, 1),
+		rationalEntry(tagYResolution, 72, 1),
+		shortEntry(tagPlanarConfiguration, 1),
+		shortEntry(tagResolutionUnit, 2),
+	}
+	if compression != 1 {
+		// Horizontal differencing.
+		mainIFD = append(mainIFD, shortEntry(tagPredictor, 2))
+	}
+	if layout.extraSample != 0 {
+		mainIFD = append(mainIFD, shortEntry(tagExtraSamples, layout.extraSample))
+	}
+	if len(o.ICCProfile) > 0 {
+		mainIFD = append(mainIFD, entry{tag: tagICCProfile, typ: typeUndefined, count: uint32(len(o.ICCProfile)), data: o.ICCProfile})
+	}
+
+	var exifIFD, gpsIFD ifd
+	if len(o.EXIF) > 0 {
+		// The image is still worth more than broken EXIF data.
+		exif, err := readEXIF(o.EXIF, bounds.Dx(), bounds.Dy())
+		if err != nil {
+			log.Printf("dropping exif that could not be read: %s", err.Error())
+		} else {
+			mainIFD = append(mainIFD, exif.main...)
+			exifIFD = exif.exif
+			gpsIFD = exif.gps
+		}
+	}
+
+	// The sub IFDs are written after the main IFD, their offsets have to be
+	// known before the main IFD is written.
+	mainOffset := buf.Len()
+	subOffset := mainOffset + mainIFD.size()
+	if len(exifIFD) > 0 {
+		subOffset += 12
+	}
+	if len(gpsIFD) > 0 {
+		subOffset += 12
+	}
+	if len(exifIFD) > 0 {
+		mainIFD = append(mainIFD, longEntry(tagExifIFD, uint32(subOffset)))
+		subOffset += exifIFD.size()
+	}
+	if len(gpsIFD) > 0 {
+		mainIFD = append(mainIFD, longEntry(tagGPSIFD, uint32(subOffset)))
+	}
+
+	mainIFD.write(&buf, mainOffset)
+	if len(exifIFD) > 0 {
+		exifIFD.write(&buf, buf.Len())
+	}
+	if len(gpsIFD) > 0 {
+		gpsIFD.write(&buf, buf.Len())
+	}
+
+	output := buf.Bytes()
+	byteOrder.PutUint32(output[4:], uint32(mainOffset))
+
+	_, err := w.Write(output)
+	return err
+}
+
+func compress(data []byte, compression uint16) ([]byte, error) {
+	switch compression {
+	case 5:
+		return lzwEncode(data), nil
+	case 8:
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// sampleLayout describes how the pixels of an image are written.
+type sampleLayout struct {
+	samples                   int
+	bitsPerSample             int
+	photometricInterpretation uint16
+	extraSample               uint16 // 0 when there is no alpha, 1 for premultiplied alpha and 2 for straight alpha.
+}
+
+func newSampleLayout(m image.Image) sampleLayout {
+	layout := sampleLayout{
+		samples:                   3,
+		bitsPerSample:             8,
+		photometricInterpretation: 2,
+	}
+
+	switch m.(type) {
+	case *image.Gray:
+		layout.samples = 1
+		layout.photometricInterpretation = 1
+		return layout
+	case *image.Gray16:
+		layout.samples = 1
+		layout.bitsPerSample = 16
+		layout.photometricInterpretation = 1
+		return layout
+	case *image.RGBA64, *image.NRGBA64:
+		layout.bitsPerSample = 16
+	}
+
+	if opaque, ok := m.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return layout
+	}
+
+	layout.samples = 4
+	layout.extraSample = 1
+	switch m.(type) {
+	case *image.NRGBA, *image.NRGBA64:
+		layout.extraSample = 2
+	}
+	return layout
+}
+
+// readRow fills row with the samples of row y of the image.
+func (l sampleLayout) readRow(row []byte, m image.Image, y int) {
+	bounds := m.Bounds()
+	switch img := m.(type) {
+	case *image.Gray:
+		copy(row, img.Pix[img.PixOffset(bounds.Min.X, y):])
+		return
+	case *image.Gray16:
+		copy(row, img.Pix[img.PixOffset(bounds.Min.X, y):])
+		return
+	case *image.RGBA:
+		l.copyRow(row, img.Pix[img.PixOffset(bounds.Min.X, y):], bounds.Dx())
+		return
+	case *image.NRGBA:
+		l.copyRow(row, img.Pix[img.PixOffset(bounds.Min.X, y):], bounds.Dx())
+		return
+	case *image.RGBA64:
+		l.copyRow(row, img.Pix[img.PixOffset(bounds.Min.X, y):], bounds.Dx())
+		return
+	case *image.NRGBA64:
+		l.copyRow(row, img.Pix[img.PixOffset(bounds.Min.X, y):], bounds.Dx())
+		return
+	case *image.YCbCr:
+		for x := 0; x < bounds.Dx(); x++ {
+			yi := img.YOffset(bounds.Min.X+x, y)
+			ci := img.COffset(bounds.Min.X+x, y)
+			row[x*3], row[x*3+1], row[x*3+2] = color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+		}
+		return
+	}
+
+	// Other images are always written with 8 bits per sample.
+	for x := 0; x < bounds.Dx(); x++ {
+		c := m.At(bounds.Min.X+x, y)
+		if l.samples == 3 {
+			r, g, b, _ := c.RGBA()
+			row[x*3] = byte(r >> 8)
+			row[x*3+1] = byte(g >> 8)
+			row[x*3+2] = byte(b >> 8)
+			continue
+		}
+		r, g, b, a := c.RGBA()
+		row[x*4] = byte(r >> 8)
+		row[x*4+1] = byte(g >> 8)
+		row[x*4+2] = byte(b >> 8)
+		row[x*4+3] = byte(a >> 8)
+	}
+}
+
+// copyRow copies a row of RGBA pixels, without the alpha if the layout has no
+// alpha sample.
+func (l sampleLayout) copyRow(row []byte, pix []byte, width int) {
+	sampleSize := l.bitsPerSample / 8
+	if l.samples == 4 {
+		copy(row, pix[:width*4*sampleSize])
+		return
+	}
+	for x := 0; x < width; x++ {
+		copy(row[x*3*sampleSize:(x+1)*3*sampleSize], pix[x*4*sampleSize:])
+	}
+}
+
+// predict applies the horizontal differencing predictor to the row.
+func (l sampleLayout) predict(row []byte) {
+	if l.bitsPerSample == 16 {
+		for i := len(row) - 2; i >= l.samples*2; i -= 2 {
+			value := byteOrder.Uint16(row[i:]) - byteOrder.Uint16(row[i-l.samples*2:])
+			byteOrder.PutUint16(row[i:], value)
+		}
+		return
+	}
+	for i := len(row) - 1; i >= l.samples; i-- {
+		row[i] -= row[i-l.samples]
+	}
+}
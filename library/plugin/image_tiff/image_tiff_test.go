@@ -0,0 +1,187 @@
+package image_tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func testImage(m settableImage, width, height int) {
+	random := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Noise on the right half, to get enough different LZW codes to
+			// increase the code width and clear the table.
+			value := uint16(x * 0xffff / width)
+			if x > width/2 {
+				value = uint16(random.Intn(0x10000))
+			}
+			m.Set(x, y, color.NRGBA64{R: value, G: uint16(y * 0xffff / height), B: 0x8000, A: uint16(0xffff - y*0x100)})
+		}
+	}
+}
+
+type settableImage interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}
+
+func TestEncode(t *testing.T) {
+	type testCase struct {
+		Name  string
+		Image settableImage
+		Model color.Model
+	}
+	testCases := []testCase{
+		{Name: "gray", Image: image.NewGray(image.Rect(0, 0, 200, 100)), Model: color.GrayModel},
+		{Name: "gray16", Image: image.NewGray16(image.Rect(0, 0, 200, 100)), Model: color.Gray16Model},
+		{Name: "rgba", Image: image.NewRGBA(image.Rect(0, 0, 200, 100)), Model: color.RGBAModel},
+		{Name: "nrgba", Image: image.NewNRGBA(image.Rect(0, 0, 200, 100)), Model: color.NRGBAModel},
+		{Name: "rgba64", Image: image.NewRGBA64(image.Rect(0, 0, 200, 100)), Model: color.RGBA64Model},
+		{Name: "nrgba64", Image: image.NewNRGBA64(image.Rect(0, 0, 200, 100)), Model: color.NRGBA64Model},
+		{Name: "cmyk", Image: image.NewCMYK(image.Rect(0, 0, 200, 100)), Model: color.RGBAModel},
+	}
+	for _, testCase := range testCases {
+		testImage(testCase.Image, 200, 100)
+		for _, compression := range []Compression{CompressionNone, CompressionLZW, CompressionDeflate} {
+			testWriter := bytes.NewBuffer(nil)
+			err := Encode(testWriter, testCase.Image, Options{Compression: compression})
+			if err != nil {
+				t.Fatalf("Encode of %s with %s resulted in error: %s", testCase.Name, compression, err.Error())
+			}
+
+			decoded, err := tiff.Decode(testWriter)
+			if err != nil {
+				t.Fatalf("Decode of %s with %s resulted in error: %s", testCase.Name, compression, err.Error())
+			}
+
+			if got, want := decoded.Bounds(), testCase.Image.Bounds(); got != want {
+				t.Fatalf("Decode of %s with %s resulted in wrong bounds, got %v, want %v", testCase.Name, compression, got, want)
+			}
+
+			for y := 0; y < 100; y++ {
+				for x := 0; x < 200; x++ {
+					want := testCase.Model.Convert(testCase.Image.At(x, y))
+					got := testCase.Model.Convert(decoded.At(x, y))
+					if got != want {
+						t.Fatalf("Decode of %s with %s resulted in wrong pixel at %d,%d, got %v, want %v", testCase.Name, compression, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeUnsupportedCompression(t *testing.T) {
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	err := Encode(bytes.NewBuffer(nil), img, Options{Compression: "jpeg"})
+	if err == nil {
+		t.Fatal("Encode with unsupported compression did not result in an error")
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	le := binary.LittleEndian
+	// A little endian EXIF structure with Make, Orientation and an EXIF IFD
+	// with DateTimeOriginal, a MakerNote and the pixel dimensions.
+	exif := []byte("II*\x00\x08\x00\x00\x00")
+	exif = le.AppendUint16(exif, 3)
+	exif = append(exif, 0x0f, 0x01, 2, 0, 4, 0, 0, 0, 'A', 'B', 'C', 0)
+	exif = append(exif, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0)
+	exif = append(exif, 0x69, 0x87, 4, 0, 1, 0, 0, 0, 50, 0, 0, 0)
+	exif = le.AppendUint32(exif, 0)
+	exif = le.AppendUint16(exif, 4)
+	exif = append(exif, 0x03, 0x90, 2, 0, 20, 0, 0, 0, 104, 0, 0, 0)
+	exif = append(exif, 0x7c, 0x92, 7, 0, 4, 0, 0, 0, 'M', 'N', 0, 0)
+	exif = append(exif, 0x02, 0xa0, 4, 0, 1, 0, 0, 0, 0xa0, 0x0f, 0, 0)
+	exif = append(exif, 0x03, 0xa0, 3, 0, 1, 0, 0, 0, 0xb8, 0x0b, 0, 0)
+	exif = le.AppendUint32(exif, 0)
+	exif = append(exif, "2024:01:16 12:00:00\x00"...)
+
+	icc := bytes.Repeat([]byte("icc"), 100)
+
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{ICCProfile: icc, EXIF: exif})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+
+	data := testWriter.Bytes()
+	mainIFD := readTestIFD(data, binary.BigEndian.Uint32(data[4:]))
+
+	if got := mainIFD[34675]; !bytes.Equal(got, icc) {
+		t.Errorf("Encode resulted in wrong ICC profile, got %d bytes, want %d bytes", len(got), len(icc))
+	}
+
+	if got, want := string(mainIFD[271]), "ABC\x00"; got != want {
+		t.Errorf("Encode resulted in wrong make, got %q, want %q", got, want)
+	}
+
+	if _, ok := mainIFD[274]; ok {
+		t.Errorf("Encode resulted in an orientation tag")
+	}
+
+	exifIFD := readTestIFD(data, binary.BigEndian.Uint32(mainIFD[34665]))
+	if got, want := string(exifIFD[36867]), "2024:01:16 12:00:00\x00"; got != want {
+		t.Errorf("Encode resulted in wrong DateTimeOriginal, got %q, want %q", got, want)
+	}
+
+	if _, ok := exifIFD[37500]; ok {
+		t.Errorf("Encode resulted in a MakerNote tag")
+	}
+
+	for _, tag := range []uint16{40962, 40963} {
+		if got, want := binary.BigEndian.Uint32(exifIFD[tag]), uint32(100); got != want {
+			t.Errorf("Encode resulted in wrong pixel dimension %d, got %d, want %d", tag, got, want)
+		}
+	}
+}
+
+func TestEncodeInvalidMetadata(t *testing.T) {
+	// A truncated EXIF structure of which the IFD is out of bounds.
+	exif := []byte("II*\x00\x08\x00\x00\x00\x03\x00")
+
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{EXIF: exif})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+
+	data := testWriter.Bytes()
+	mainIFD := readTestIFD(data, binary.BigEndian.Uint32(data[4:]))
+	if _, ok := mainIFD[34665]; ok {
+		t.Errorf("Encode resulted in an EXIF IFD for invalid EXIF data")
+	}
+
+	_, err = tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("could not decode the TIFF without EXIF: %s", err)
+	}
+}
+
+// readTestIFD reads the values of a big endian IFD by tag.
+func readTestIFD(data []byte, offset uint32) map[uint16][]byte {
+	order := binary.BigEndian
+	sizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1}
+	values := map[uint16][]byte{}
+	count := int(order.Uint16(data[offset:]))
+	for i := 0; i < count; i++ {
+		raw := data[int(offset)+2+i*12:]
+		tag, typ, n := order.Uint16(raw), order.Uint16(raw[2:]), order.Uint32(raw[4:])
+		size := sizes[typ] * int(n)
+		if size <= 4 {
+			values[tag] = raw[8 : 8+size]
+			continue
+		}
+		valueOffset := order.Uint32(raw[8:])
+		values[tag] = data[valueOffset : int(valueOffset)+size]
+	}
+	return values
+}
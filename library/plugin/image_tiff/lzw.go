@@ -0,0 +1,77 @@
+package image_tiff
+
+import "bytes"
+
+const (
+	lzwClearCode = 256
+	lzwEOICode   = 257
+	lzwFirstCode = 258
+	lzwMaxCode   = 4094
+)
+
+// lzwEncode compresses the data with the LZW variant of TIFF, which differs
+// from compress/lzw: the decoder increases the code width one code earlier,
+// so the encoder has to increase it one code earlier too.
+func lzwEncode(data []byte) []byte {
+	var out bytes.Buffer
+	var bits uint32
+	var nBits uint
+	width := uint(9)
+
+	write := func(code int) {
+		bits |= uint32(code) << (32 - width - nBits)
+		nBits += width
+		for nBits >= 8 {
+			out.WriteByte(byte(bits >> 24))
+			bits <<= 8
+			nBits -= 8
+		}
+	}
+
+	table := make(map[uint32]int)
+	next := lzwFirstCode
+	write(lzwClearCode)
+
+	if len(data) > 0 {
+		prefix := int(data[0])
+		for _, b := range data[1:] {
+			key := uint32(prefix)<<8 | uint32(b)
+			if code, ok := table[key]; ok {
+				prefix = code
+				continue
+			}
+
+			write(prefix)
+			table[key] = next
+			next++
+			prefix = int(b)
+
+			switch next {
+			case 512, 1024, 2048:
+				width++
+			case lzwMaxCode:
+				write(lzwClearCode)
+				table = make(map[uint32]int)
+				next = lzwFirstCode
+				width = 9
+			}
+		}
+		write(prefix)
+
+		// The decoder adds a table entry for the last code too, which might
+		// increase the code width for the end of information code.
+		switch next + 1 {
+		case 512, 1024, 2048:
+			width++
+		case lzwMaxCode:
+			write(lzwClearCode)
+			width = 9
+		}
+	}
+
+	write(lzwEOICode)
+	if nBits > 0 {
+		out.WriteByte(byte(bits >> 24))
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,15 @@
+package image_tiff
+
+type Compression string // The compression of the image data.
+
+const (
+	CompressionNone    Compression = "none"    // No compression.
+	CompressionLZW     Compression = "lzw"     // LZW compression, the default.
+	CompressionDeflate Compression = "deflate" // Deflate (zlib) compression.
+)
+
+type Options struct {
+	Compression Compression // The compression to use, the default is LZW.
+	ICCProfile  []byte      // An ICC profile to embed in the image.
+	EXIF        []byte      // EXIF data to embed in the image, as a TIFF structure starting with the byte order mark.
+}
@@ -0,0 +1,124 @@
+//go:build go_libheif_use_libwebp
+
+package image_webp
+
+/*
+#cgo pkg-config: libwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+
+// encode encodes the RGBA pixels with the given config, on success the output
+// has to be freed with WebPFree.
+static int encode(const WebPConfig* config, const uint8_t* rgba, int width, int height, int stride, uint8_t** output, size_t* output_size) {
+	WebPPicture picture;
+	WebPMemoryWriter writer;
+
+	if (!WebPPictureInit(&picture)) {
+		return VP8_ENC_ERROR_OUT_OF_MEMORY;
+	}
+
+	picture.use_argb = config->lossless;
+	picture.width = width;
+	picture.height = height;
+	if (!WebPPictureImportRGBA(&picture, rgba, stride)) {
+		WebPPictureFree(&picture);
+		return VP8_ENC_ERROR_OUT_OF_MEMORY;
+	}
+
+	WebPMemoryWriterInit(&writer);
+	picture.writer = WebPMemoryWrite;
+	picture.custom_ptr = &writer;
+
+	int ok = WebPEncode(config, &picture);
+	int error_code = picture.error_code;
+	WebPPictureFree(&picture);
+	if (!ok) {
+		WebPMemoryWriterClear(&writer);
+		return error_code;
+	}
+
+	*output = writer.mem;
+	*output_size = writer.size;
+	return VP8_ENC_OK;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// Supported is whether WebP encoding is available.
+const Supported = true
+
+var encodingErrors = map[C.int]string{
+	C.VP8_ENC_ERROR_OUT_OF_MEMORY:           "out of memory",
+	C.VP8_ENC_ERROR_BITSTREAM_OUT_OF_MEMORY: "out of memory while flushing bits",
+	C.VP8_ENC_ERROR_NULL_PARAMETER:          "missing parameter",
+	C.VP8_ENC_ERROR_INVALID_CONFIGURATION:   "invalid configuration",
+	C.VP8_ENC_ERROR_BAD_DIMENSION:           "invalid picture dimension",
+	C.VP8_ENC_ERROR_PARTITION0_OVERFLOW:     "partition is bigger than 512k",
+	C.VP8_ENC_ERROR_PARTITION_OVERFLOW:      "partition is bigger than 16M",
+	C.VP8_ENC_ERROR_BAD_WRITE:               "error while flushing bytes",
+	C.VP8_ENC_ERROR_FILE_TOO_BIG:            "file is bigger than 4G",
+	C.VP8_ENC_ERROR_USER_ABORT:              "abort request by user",
+}
+
+func Encode(w io.Writer, m image.Image, o Options) error {
+	var config C.WebPConfig
+	if C.WebPConfigInit(&config) == 0 {
+		return errors.New("libwebp error: could not initialize config, version mismatch")
+	}
+
+	if o.Lossless {
+		config.lossless = 1
+	}
+	if o.Quality > 0 {
+		config.quality = C.float(o.Quality)
+	}
+	if o.Exact {
+		config.exact = 1
+	}
+
+	if C.WebPValidateConfig(&config) == 0 {
+		return errors.New("libwebp error: invalid config")
+	}
+
+	img := toNRGBA(m)
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return errors.New("libwebp error: image is empty")
+	}
+
+	var output *C.uint8_t
+	var outputSize C.size_t
+	res := C.encode(&config, (*C.uint8_t)(unsafe.Pointer(&img.Pix[0])), C.int(bounds.Dx()), C.int(bounds.Dy()), C.int(img.Stride), &output, &outputSize)
+	if res != C.VP8_ENC_OK {
+		if message, ok := encodingErrors[C.int(res)]; ok {
+			return fmt.Errorf("libwebp error: %s", message)
+		}
+		return fmt.Errorf("libwebp error: encoding failed with code %d", int(res))
+	}
+	defer C.WebPFree(unsafe.Pointer(output))
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(output), C.int(outputSize)))
+	return err
+}
+
+// toNRGBA converts the image to non-alpha-premultiplied RGBA, which is what
+// libwebp expects. NRGBA images that start at the origin are used as is.
+func toNRGBA(m image.Image) *image.NRGBA {
+	if nrgba, ok := m.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+
+	bounds := m.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, m, bounds.Min, draw.Src)
+	return nrgba
+}
@@ -0,0 +1,57 @@
+//go:build go_libheif_use_libwebp
+
+package image_webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	img := image.NewGray(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	if got, want := string(testWriter.Bytes()[8:16]), "WEBPVP8 "; got != want {
+		t.Fatalf("Encode resulted in wrong chunk, got %q, want %q", got, want)
+	}
+}
+
+func TestEncodeLossless(t *testing.T) {
+	img := image.NewGray(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{
+		Lossless: true,
+	})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	if got, want := string(testWriter.Bytes()[8:16]), "WEBPVP8L"; got != want {
+		t.Fatalf("Encode resulted in wrong chunk, got %q, want %q", got, want)
+	}
+}
+
+func TestEncodeAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	for x := 0; x < 100; x++ {
+		img.SetNRGBA(x, 0, color.NRGBA{R: 0xff, A: 0x80})
+	}
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{
+		Quality: 100,
+	})
+	if err != nil {
+		t.Fatalf("Encode resulted in error: %s", err.Error())
+	}
+	// Lossy images with alpha are stored in the extended format with an ALPH chunk.
+	if got, want := string(testWriter.Bytes()[8:16]), "WEBPVP8X"; got != want {
+		t.Fatalf("Encode resulted in wrong chunk, got %q, want %q", got, want)
+	}
+	if !bytes.Contains(testWriter.Bytes(), []byte("ALPH")) {
+		t.Fatalf("Encode resulted in image without alpha")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !go_libheif_use_libwebp
+
+package image_webp
+
+import (
+	"image"
+	"io"
+)
+
+// Supported is whether WebP encoding is available.
+const Supported = false
+
+func Encode(w io.Writer, m image.Image, o Options) error {
+	return UnsupportedError
+}
@@ -0,0 +1,18 @@
+//go:build !go_libheif_use_libwebp
+
+package image_webp
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	img := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{100, 100}})
+	testWriter := bytes.NewBuffer(nil)
+	err := Encode(testWriter, img, Options{})
+	if err != UnsupportedError {
+		t.Fatalf("Encode resulted in wrong error, got %v, want %v", err, UnsupportedError)
+	}
+}
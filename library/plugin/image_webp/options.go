@@ -0,0 +1,13 @@
+package image_webp
+
+import "errors"
+
+// UnsupportedError is returned by Encode when the plugin has been built
+// without libwebp.
+var UnsupportedError = errors.New("webp encoding is only available with build tag go_libheif_use_libwebp")
+
+type Options struct {
+	Lossless bool // Render a lossless image instead of a lossy one.
+	Quality  int  // Ranges from 1 to 100 inclusive, higher is better. For lossless images this is the compression effort. The default is 75.
+	Exact    bool // Keep the RGB values under transparent areas, by default they are changed for better compression.
+}
@@ -0,0 +1,197 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+)
+
+// imageMetadata is the metadata of an image that we can carry over to the
+// rendered file.
+type imageMetadata struct {
+	ICCProfile []byte // The raw ICC profile, if the image has one.
+	EXIF       []byte // The EXIF data as a TIFF structure, without the offset header of HEIF.
+	NCLX       *nclx  // The nclx color profile, if the image has one.
+}
+
+// nclx is an nclx color profile, the codes are as in ITU-T H.273.
+type nclx struct {
+	ColorPrimaries          int
+	TransferCharacteristics int
+	MatrixCoefficients      int
+	Primaries               *tonemap.Chromaticities // The chromaticities of the primaries, nil when they are unspecified.
+}
+
+// readPrimaryImageMetadata reads the metadata of the primary image of the file.
+func readPrimaryImageMetadata(data []byte) (*imageMetadata, error) {
+	ctx, err := newHeifContext(data)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.free()
+
+	id, err := ctx.primaryImageID()
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := ctx.imageHandle(id)
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	return readImageMetadata(handle)
+}
+
+func readImageMetadata(handle *C.struct_heif_image_handle) (*imageMetadata, error) {
+	var err error
+	metadata := &imageMetadata{}
+	metadata.ICCProfile, err = readICCProfile(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.EXIF, err = readEXIF(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.NCLX = readNCLX(handle)
+
+	return metadata, nil
+}
+
+// dpi returns the resolution from the EXIF data, or 0 when it's not known.
+func (m *imageMetadata) dpi() float64 {
+	exif := m.EXIF
+	if len(exif) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(exif[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := uint64(order.Uint32(exif[4:]))
+	if offset+2 > uint64(len(exif)) {
+		return 0
+	}
+
+	var resolution float64
+	unit := uint16(2)
+	count := uint64(order.Uint16(exif[offset:]))
+	for i := uint64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > uint64(len(exif)) {
+			return 0
+		}
+
+		switch order.Uint16(exif[entry:]) {
+		case 282: // XResolution, a rational.
+			valueOffset := uint64(order.Uint32(exif[entry+8:]))
+			if valueOffset+8 > uint64(len(exif)) {
+				return 0
+			}
+			numerator, denominator := order.Uint32(exif[valueOffset:]), order.Uint32(exif[valueOffset+4:])
+			if denominator != 0 {
+				resolution = float64(numerator) / float64(denominator)
+			}
+		case 296: // ResolutionUnit, 2 is inch and 3 is centimeter.
+			unit = order.Uint16(exif[entry+8:])
+		}
+	}
+
+	switch unit {
+	case 2:
+		return resolution
+	case 3:
+		return resolution * 2.54
+	}
+	return 0
+}
+
+func readICCProfile(handle *C.struct_heif_image_handle) ([]byte, error) {
+	profileType := C.heif_image_handle_get_color_profile_type(handle)
+	if profileType != C.heif_color_profile_type_prof && profileType != C.heif_color_profile_type_rICC {
+		return nil, nil
+	}
+
+	size := C.heif_image_handle_get_raw_color_profile_size(handle)
+	if size == 0 {
+		return nil, nil
+	}
+
+	profile := make([]byte, int(size))
+	err := heifError(C.heif_image_handle_get_raw_color_profile(handle, unsafe.Pointer(&profile[0])))
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func readNCLX(handle *C.struct_heif_image_handle) *nclx {
+	var profile *C.struct_heif_color_profile_nclx
+	if C.heif_image_handle_get_nclx_color_profile(handle, &profile).code != C.heif_error_Ok {
+		return nil
+	}
+	defer C.heif_nclx_color_profile_free(profile)
+
+	result := &nclx{
+		ColorPrimaries:          int(profile.color_primaries),
+		TransferCharacteristics: int(profile.transfer_characteristics),
+		MatrixCoefficients:      int(profile.matrix_coefficients),
+	}
+	if profile.color_primaries != C.heif_color_primaries_unspecified {
+		result.Primaries = &tonemap.Chromaticities{
+			RedX: float64(profile.color_primary_red_x), RedY: float64(profile.color_primary_red_y),
+			GreenX: float64(profile.color_primary_green_x), GreenY: float64(profile.color_primary_green_y),
+			BlueX: float64(profile.color_primary_blue_x), BlueY: float64(profile.color_primary_blue_y),
+			WhiteX: float64(profile.color_primary_white_x), WhiteY: float64(profile.color_primary_white_y),
+		}
+	}
+	return result
+}
+
+func readEXIF(handle *C.struct_heif_image_handle) ([]byte, error) {
+	exifType := C.CString("Exif")
+	defer C.free(unsafe.Pointer(exifType))
+
+	var id C.heif_item_id
+	if C.heif_image_handle_get_list_of_metadata_block_IDs(handle, exifType, &id, 1) == 0 {
+		return nil, nil
+	}
+
+	size := C.heif_image_handle_get_metadata_size(handle, id)
+	if size < 4 {
+		return nil, nil
+	}
+
+	block := make([]byte, int(size))
+	err := heifError(C.heif_image_handle_get_metadata(handle, id, unsafe.Pointer(&block[0])))
+	if err != nil {
+		return nil, err
+	}
+
+	// The EXIF block starts with the offset to the TIFF header. A broken
+	// offset only loses the EXIF data, the image itself can still be used.
+	offset := uint64(binary.BigEndian.Uint32(block)) + 4
+	if offset >= uint64(len(block)) {
+		return nil, nil
+	}
+	return block[offset:], nil
+}
@@ -0,0 +1,174 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"math"
+
+	"github.com/klippa-app/go-libheif/library/plugin/image_pdf"
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+	"github.com/klippa-app/go-libheif/library/requests"
+)
+
+var pdfPageSizes = map[requests.RenderFilePDFPageSize]image_pdf.PageSize{
+	requests.RenderFilePDFPageSizeImage:  {},
+	requests.RenderFilePDFPageSizeA3:     image_pdf.PageSizeA3,
+	requests.RenderFilePDFPageSizeA4:     image_pdf.PageSizeA4,
+	requests.RenderFilePDFPageSizeA5:     image_pdf.PageSizeA5,
+	requests.RenderFilePDFPageSizeLetter: image_pdf.PageSizeLetter,
+	requests.RenderFilePDFPageSizeLegal:  image_pdf.PageSizeLegal,
+}
+
+// preparePDF collects the pages for the primary image, or all top level
+// images, of the file. The primary image has already been decoded.
+func preparePDF(request *requests.RenderFile, primaryImage image.Image) ([]image_pdf.Page, image_pdf.Options, error) {
+	opt := image_pdf.Options{
+		Compression: image_pdf.Compression(request.PDFCompression),
+	}
+
+	pageSize, ok := pdfPageSizes[request.PDFPageSize]
+	if !ok {
+		return nil, opt, errors.New("invalid pdf page size given")
+	}
+	opt.PageSize = pageSize
+
+	// Other inputs than HEIF have a single image without metadata.
+	if _, isHeif := sniffHeif(*request.Data); !isHeif {
+		page := image_pdf.Page{
+			Image: primaryImage,
+			DPI:   request.PDFDPI,
+		}
+		if request.ConvertColors {
+			page.ICCProfile = request.TargetICCProfile
+		}
+		return []image_pdf.Page{page}, opt, nil
+	}
+
+	ctx, err := newHeifContext(*request.Data)
+	if err != nil {
+		return nil, opt, err
+	}
+	defer ctx.free()
+
+	primaryID, err := ctx.primaryImageID()
+	if err != nil {
+		return nil, opt, err
+	}
+
+	ids := []int{primaryID}
+	if request.AllImages {
+		ids = ctx.topLevelImageIDs()
+	}
+
+	pages := make([]image_pdf.Page, 0, len(ids))
+	for _, id := range ids {
+		page, err := pdfPage(ctx, id, primaryID, primaryImage, request)
+		if err != nil {
+			return nil, opt, err
+		}
+
+		if request.PDFDPI > 0 {
+			page.DPI = request.PDFDPI
+		}
+		pages = append(pages, *page)
+	}
+
+	return pages, opt, nil
+}
+
+// scalePDFPages scales the images of the pages by the same factor as the
+// primary image has been scaled to scaledImage, the resolution is scaled too
+// so that the pages keep their size.
+func scalePDFPages(pages []image_pdf.Page, primaryImage, scaledImage image.Image) []image_pdf.Page {
+	if scaledImage == primaryImage {
+		return pages
+	}
+
+	scale := float64(scaledImage.Bounds().Dx()) / float64(primaryImage.Bounds().Dx())
+	scaledPages := make([]image_pdf.Page, len(pages))
+	for i, page := range pages {
+		scaledPages[i] = page
+		if page.DPI == 0 {
+			page.DPI = 72
+		}
+		scaledPages[i].DPI = page.DPI * scale
+
+		if page.Image == primaryImage {
+			scaledPages[i].Image = scaledImage
+			continue
+		}
+
+		bounds := page.Image.Bounds()
+		width := int(math.Max(math.Round(float64(bounds.Dx())*scale), 1))
+		height := int(math.Max(math.Round(float64(bounds.Dy())*scale), 1))
+		scaledPages[i].Image = resizeImage(page.Image, width, height)
+	}
+
+	return scaledPages
+}
+
+func pdfPage(ctx *heifContext, id, primaryID int, primaryImage image.Image, request *requests.RenderFile) (*image_pdf.Page, error) {
+	handle, err := ctx.imageHandle(id)
+	if err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	metadata, err := readImageMetadata(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	// The primary image has been tone mapped and converted already.
+	toneMapOpt, toneMapped, err := toneMapOptions(metadata, request)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &image_pdf.Page{
+		Image:      primaryImage,
+		DPI:        metadata.dpi(),
+		ICCProfile: metadata.ICCProfile,
+	}
+	if request.ConvertColors {
+		// The profile describes the colors before tone mapping or conversion.
+		page.ICCProfile = request.TargetICCProfile
+	} else if toneMapped {
+		page.ICCProfile = nil
+	}
+
+	if id != primaryID {
+		page.Image, err = decodeHandle(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		if toneMapped {
+			page.Image, err = tonemap.Map(page.Image, toneMapOpt)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if request.ConvertColors {
+			sourceMetadata := metadata
+			if toneMapped {
+				sourceMetadata = nil
+			}
+
+			page.Image, err = convertColors(page.Image, sourceMetadata, request.TargetICCProfile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, nil
+}
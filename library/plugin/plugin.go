@@ -8,35 +8,30 @@ import "C"
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"image"
+	"image/color"
 	"image/jpeg"
-	"image/png"
+	"io"
 
+	"github.com/klippa-app/go-libheif/library/plugin/gainmap"
 	"github.com/klippa-app/go-libheif/library/plugin/image_jpeg"
+	"github.com/klippa-app/go-libheif/library/plugin/image_pdf"
+	"github.com/klippa-app/go-libheif/library/plugin/image_png"
+	"github.com/klippa-app/go-libheif/library/plugin/image_tiff"
+	"github.com/klippa-app/go-libheif/library/plugin/image_webp"
 	"github.com/klippa-app/go-libheif/library/requests"
 	"github.com/klippa-app/go-libheif/library/responses"
 	"github.com/klippa-app/go-libheif/library/shared"
 
 	"github.com/hashicorp/go-plugin"
-	_ "github.com/strukturag/libheif/go/heif"
+	"golang.org/x/image/webp"
 )
 
 func init() {
-	// Needed to serialize the image interface.
-	gob.Register(&image.YCbCr{})
-	gob.Register(&image.RGBA64{})
-	gob.Register(&image.RGBA{})
-	gob.Register(&image.Gray{})
-
 	C.heif_init(nil)
-}
 
-var handshakeConfig = plugin.HandshakeConfig{
-	ProtocolVersion:  1,
-	MagicCookieKey:   "BASIC_PLUGIN",
-	MagicCookieValue: "libheif",
+	registerFormats()
 }
 
 func StartPlugin() {
@@ -45,7 +40,7 @@ func StartPlugin() {
 	}
 
 	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: handshakeConfig,
+		HandshakeConfig: shared.HandshakeConfig,
 		Plugins:         pluginMap,
 	})
 }
@@ -57,7 +52,31 @@ func (l *libHeifImplementation) Ping() (string, error) {
 }
 
 func (l *libHeifImplementation) DecodeImage(request *requests.DecodeImage) (*responses.DecodeImage, error) {
-	decodedImage, format, err := image.Decode(bytes.NewReader(*request.Data))
+	var decodedImage image.Image
+	var format string
+	var err error
+	if sniffed, isHeif := sniffHeif(*request.Data); isHeif {
+		format = sniffed.Format
+		decodedImage, err = decodeHeifImageWithOptions(*request.Data, request)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		decodedImage, format, err = image.Decode(bytes.NewReader(*request.Data))
+		if err != nil {
+			return nil, err
+		}
+
+		// Images without a color profile are sRGB.
+		if request.ConvertColors {
+			decodedImage, err = convertColors(decodedImage, nil, request.TargetICCProfile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	decodedImage, err = convertAlpha(decodedImage, request.Alpha)
 	if err != nil {
 		return nil, err
 	}
@@ -69,77 +88,328 @@ func (l *libHeifImplementation) DecodeImage(request *requests.DecodeImage) (*res
 }
 
 func (l *libHeifImplementation) DecodeConfig(request *requests.DecodeConfig) (*responses.DecodeConfig, error) {
-	config, format, err := image.DecodeConfig(bytes.NewReader(*request.Data))
+	var config image.Config
+	var format string
+	var err error
+	if sniffed, isHeif := sniffHeif(*request.Data); isHeif {
+		format = sniffed.Format
+		config, err = decodeHeifConfig(bytes.NewReader(*request.Data))
+	} else {
+		config, format, err = image.DecodeConfig(bytes.NewReader(*request.Data))
+	}
 	if err != nil {
 		return nil, err
 	}
+	colorModel := colorModelName(config.ColorModel)
+	config.ColorModel = nil
 	return &responses.DecodeConfig{
-		Format: format,
-		Config: config,
+		Format:     format,
+		Config:     config,
+		ColorModel: colorModel,
 	}, nil
 }
 
 func (l *libHeifImplementation) RenderFile(request *requests.RenderFile) (*responses.RenderFile, error) {
-	decodedImage, format, err := image.Decode(bytes.NewReader(*request.Data))
+	decodedImage, format, err := decodeInput(*request.Data)
 	if err != nil {
 		return nil, err
 	}
+	alpha := hasAlpha(decodedImage)
 
-	var newFormat string
-	var imgBuf bytes.Buffer
-	if request.OutputFormat == requests.RenderFileOutputFormatJPG {
-		newFormat = "jpeg"
-		opt := image_jpeg.Options{
-			Options: &jpeg.Options{
-				Quality: 95,
-			},
-			Progressive: request.Progressive,
+	err = checkGainMapRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	_, isHeif := sniffHeif(*request.Data)
+
+	var gainMap *imageGainMap
+	var gainMapImage image.Image
+	if request.GainMap != requests.RenderFileGainMapIgnore && isHeif {
+		gainMap, gainMapImage, err = readGainMap(*request.Data)
+		if err != nil {
+			return nil, err
 		}
 
-		if request.OutputQuality > 0 {
-			opt.Options.Quality = request.OutputQuality
+		if gainMap != nil && gainMap.Metadata.AlternateHDRHeadroom <= gainMap.Metadata.BaseHDRHeadroom {
+			return nil, gainmap.HDRBaseUnsupportedError
 		}
+	}
 
-		for {
-			err := image_jpeg.Encode(&imgBuf, decodedImage, opt)
+	var gainMapType responses.GainMapType
+	var cicp *image_png.CICP
+	if gainMap != nil {
+		gainMapType = gainMap.Type
+		if request.GainMap == requests.RenderFileGainMapApply {
+			metadata, err := readPrimaryImageMetadata(*request.Data)
 			if err != nil {
 				return nil, err
 			}
 
-			if request.MaxFileSize == 0 || int64(imgBuf.Len()) < request.MaxFileSize {
-				break
+			decodedImage, err = gainmap.Apply(decodedImage, gainMapImage, gainMap.Metadata)
+			if err != nil {
+				return nil, err
 			}
+			cicp = gainMapCICP(gainMap, metadata)
+		}
+	}
 
-			opt.Quality -= 10
+	var toneMapped bool
+	if request.ToneMapping != requests.RenderFileToneMappingNone && isHeif && cicp == nil {
+		metadata, err := readPrimaryImageMetadata(*request.Data)
+		if err != nil {
+			return nil, err
+		}
 
-			if opt.Quality <= 45 {
-				return nil, errors.New("image would exceed maximum filesize")
+		decodedImage, toneMapped, err = toneMap(decodedImage, metadata, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Tone mapped images are sRGB already.
+	if request.ConvertColors && cicp == nil {
+		var metadata *imageMetadata
+		if isHeif && !toneMapped {
+			metadata, err = readPrimaryImageMetadata(*request.Data)
+			if err != nil {
+				return nil, err
 			}
+		}
+
+		decodedImage, err = convertColors(decodedImage, metadata, request.TargetICCProfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fitter := fileSizeFitter{
+		MaxFileSize: request.MaxFileSize,
+		MinQuality:  request.MinOutputQuality,
+		Downscale:   request.DownscaleToFit,
+	}
+
+	var newFormat string
+	var pages int
+	var encode encodeFunc
+	var decode decodeFunc
+	if request.OutputFormat == requests.RenderFileOutputFormatJPG {
+		newFormat = "jpeg"
+		decodedImage = flatten(decodedImage, request.Background)
+		fitter.Quality = 95
+		if request.OutputQuality > 0 {
+			fitter.Quality = request.OutputQuality
+		}
+
+		encode = func(w io.Writer, img image.Image, quality int) error {
+			return image_jpeg.Encode(w, img, image_jpeg.Options{
+				Options: &jpeg.Options{
+					Quality: quality,
+				},
+				Progressive:      request.Progressive,
+				Subsampling:      image_jpeg.Subsampling(request.JPEGSubsampling),
+				FastDCT:          request.JPEGFastDCT,
+				AccurateDCT:      request.JPEGAccurateDCT,
+				OptimizeCoding:   request.JPEGOptimizeCoding,
+				ArithmeticCoding: request.JPEGArithmeticCoding,
+				RestartInterval:  request.JPEGRestartInterval,
+			})
+		}
+		decode = image_jpeg.Decode
 
-			imgBuf.Reset()
+		if gainMap != nil {
+			encode = ultraHDREncoder(encode, gainMapImage, gainMap.Metadata)
 		}
 	} else if request.OutputFormat == requests.RenderFileOutputFormatPNG {
 		newFormat = "png"
-		err := png.Encode(&imgBuf, decodedImage)
+		opt := image_png.Options{
+			CompressionLevel: image_png.CompressionLevel(request.PNGCompressionLevel),
+			BitDepth:         request.PNGBitDepth,
+			MaxColors:        request.PNGMaxColors,
+			CICP:             cicp,
+		}
+
+		encode = func(w io.Writer, img image.Image, quality int) error {
+			return encodePNG(w, img, opt, request.MaxFileSize)
+		}
+	} else if request.OutputFormat == requests.RenderFileOutputFormatWebP {
+		newFormat = "webp"
+		opt := image_webp.Options{
+			Lossless: request.Lossless,
+			Quality:  request.OutputQuality,
+		}
+
+		if !opt.Lossless {
+			fitter.Quality = 95
+			if request.OutputQuality > 0 {
+				fitter.Quality = request.OutputQuality
+			}
+		}
+
+		encode = func(w io.Writer, img image.Image, quality int) error {
+			if !opt.Lossless {
+				opt.Quality = quality
+			}
+			return image_webp.Encode(w, img, opt)
+		}
+
+		if !opt.Lossless {
+			decode = webp.Decode
+		}
+	} else if request.OutputFormat == requests.RenderFileOutputFormatTIFF {
+		newFormat = "tiff"
+
+		// Other inputs than HEIF have no metadata for libheif to read.
+		metadata := &imageMetadata{}
+		if isHeif {
+			metadata, err = readPrimaryImageMetadata(*request.Data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// The profile describes the colors before tone mapping or conversion.
+		iccProfile := metadata.ICCProfile
+		if request.ConvertColors {
+			iccProfile = request.TargetICCProfile
+		} else if toneMapped {
+			iccProfile = nil
+		}
+
+		encode = func(w io.Writer, img image.Image, quality int) error {
+			return image_tiff.Encode(w, img, image_tiff.Options{
+				Compression: image_tiff.Compression(request.TIFFCompression),
+				ICCProfile:  iccProfile,
+				EXIF:        metadata.EXIF,
+			})
+		}
+	} else if request.OutputFormat == requests.RenderFileOutputFormatPDF {
+		newFormat = "pdf"
+		pdfPages, opt, err := preparePDF(request, decodedImage)
 		if err != nil {
 			return nil, err
 		}
+		pages = len(pdfPages)
 
-		if request.MaxFileSize != 0 && int64(imgBuf.Len()) > request.MaxFileSize {
-			return nil, errors.New("image would exceed maximum filesize")
+		if opt.Compression != image_pdf.CompressionLossless {
+			fitter.Quality = 95
+			if request.OutputQuality > 0 {
+				fitter.Quality = request.OutputQuality
+			}
+		}
+
+		scaledImage, scaledPages := decodedImage, pdfPages
+		encode = func(w io.Writer, img image.Image, quality int) error {
+			if img != scaledImage {
+				scaledImage, scaledPages = img, scalePDFPages(pdfPages, decodedImage, img)
+			}
+			opt.Quality = quality
+			return image_pdf.Encode(w, scaledPages, opt)
 		}
 	} else {
 		return nil, errors.New("invalid output format given")
 	}
 
+	var ssimQuality int
+	var score float64
+	if request.TargetSSIM != 0 {
+		if decode == nil {
+			return nil, errors.New("target ssim is only supported for jpeg and lossy webp output")
+		}
+
+		if request.TargetSSIM < 0 || request.TargetSSIM > 1 {
+			return nil, errors.New("target ssim must be between 0 and 1")
+		}
+
+		minQuality := request.MinOutputQuality
+		if minQuality <= 0 {
+			minQuality = defaultMinQuality
+		}
+		if minQuality > fitter.Quality {
+			minQuality = fitter.Quality
+		}
+
+		ssimQuality, score, err = searchSSIM(decodedImage, encode, decode, request.TargetSSIM, minQuality, fitter.Quality)
+		if err != nil {
+			return nil, err
+		}
+		fitter.Quality = ssimQuality
+	}
+
+	imgBuf, renderedImage, quality, err := fitter.fit(decodedImage, encode)
+	if err != nil {
+		return nil, err
+	}
+
+	// The maximum filesize can have lowered the quality or the dimensions.
+	if request.TargetSSIM != 0 && (quality != ssimQuality || renderedImage != decodedImage) {
+		score, err = compareOutput(renderedImage, imgBuf.Bytes(), decode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	output := imgBuf.Bytes()
 
-	bounds := decodedImage.Bounds()
+	bounds := renderedImage.Bounds()
 	return &responses.RenderFile{
 		Output:         &output,
 		OriginalFormat: format,
 		NewFormat:      newFormat,
 		Width:          bounds.Size().X,
 		Height:         bounds.Size().Y,
+		Pages:          pages,
+		Quality:        quality,
+		SSIM:           score,
+		HasAlpha:       alpha,
+		GainMap:        gainMapType,
 	}, nil
 }
+
+// decodeInput decodes the input of RenderFile, JPEG files are decoded by
+// image_jpeg, which uses libturbojpeg when it's available. HEIF files are
+// decided on by sniffHeif, so that files with a major brand that is not
+// registered are found by their compatible brands.
+func decodeInput(data []byte) (image.Image, string, error) {
+	if sniffed, isHeif := sniffHeif(data); isHeif {
+		img, err := decodeHeifImage(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		return img, sniffed.Format, nil
+	}
+
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}) {
+		img, err := image_jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		return img, "jpeg", nil
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+func colorModelName(model color.Model) responses.ColorModel {
+	switch model {
+	case color.RGBAModel:
+		return responses.ColorModelRGBA
+	case color.RGBA64Model:
+		return responses.ColorModelRGBA64
+	case color.NRGBAModel:
+		return responses.ColorModelNRGBA
+	case color.NRGBA64Model:
+		return responses.ColorModelNRGBA64
+	case color.GrayModel:
+		return responses.ColorModelGray
+	case color.Gray16Model:
+		return responses.ColorModelGray16
+	case color.YCbCrModel:
+		return responses.ColorModelYCbCr
+	case color.NYCbCrAModel:
+		return responses.ColorModelNYCbCrA
+	case color.CMYKModel:
+		return responses.ColorModelCMYK
+	}
+	return responses.ColorModelUnknown
+}
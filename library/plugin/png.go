@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	"github.com/klippa-app/go-libheif/library/plugin/image_png"
+)
+
+// pngPaletteColors is the size of the palette that is tried to fit a PNG
+// image in the maximum filesize.
+const pngPaletteColors = 256
+
+// pngStrategies returns the options to try, in order, to fit the image in the
+// maximum filesize: the requested options, the best compression, 8 bits per
+// channel and a palette.
+func pngStrategies(img image.Image, opt image_png.Options) []image_png.Options {
+	strategies := []image_png.Options{opt}
+	if opt.CompressionLevel != image_png.CompressionLevelBest {
+		opt.CompressionLevel = image_png.CompressionLevelBest
+		strategies = append(strategies, opt)
+	}
+
+	if opt.MaxColors != 0 {
+		return strategies
+	}
+
+	if image_png.Is16Bit(img) && opt.BitDepth != 8 {
+		opt.BitDepth = 8
+		strategies = append(strategies, opt)
+	}
+
+	opt.BitDepth = 0
+	opt.MaxColors = pngPaletteColors
+	return append(strategies, opt)
+}
+
+// encodePNG encodes the image with the first strategy of which the output fits
+// in the maximum filesize. When none fits it writes the output of the last
+// strategy, which is the smallest.
+func encodePNG(w io.Writer, img image.Image, opt image_png.Options, maxFileSize int64) error {
+	if maxFileSize == 0 {
+		return image_png.Encode(w, img, opt)
+	}
+
+	var output *bytes.Buffer
+	for _, strategy := range pngStrategies(img, opt) {
+		output = &bytes.Buffer{}
+		err := image_png.Encode(output, img, strategy)
+		if err != nil {
+			return err
+		}
+
+		if int64(output.Len()) <= maxFileSize {
+			break
+		}
+	}
+
+	_, err := output.WriteTo(w)
+	return err
+}
@@ -0,0 +1,230 @@
+package plugin
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/klippa-app/go-libheif/library/isobmff"
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+)
+
+func (l *libHeifImplementation) Probe(request *requests.Probe) (*responses.Probe, error) {
+	if request.Data == nil || len(*request.Data) == 0 {
+		return nil, errors.New("no data given")
+	}
+
+	data := *request.Data
+	dataPointer := (*C.uint8_t)(unsafe.Pointer(&data[0]))
+
+	resp := &responses.Probe{
+		MajorBrand: brandToString(C.heif_read_main_brand(dataPointer, C.int(len(data)))),
+		MIMEType:   C.GoString(C.heif_get_file_mime_type(dataPointer, C.int(len(data)))),
+		Images:     []responses.ProbeImage{},
+	}
+
+	var brands *C.heif_brand2
+	var brandCount C.int
+	err := heifError(C.heif_list_compatible_brands(dataPointer, C.int(len(data)), &brands, &brandCount))
+	if err != nil {
+		return nil, err
+	}
+	resp.CompatibleBrands = make([]string, int(brandCount))
+	for i, brand := range unsafe.Slice(brands, int(brandCount)) {
+		resp.CompatibleBrands[i] = brandToString(brand)
+	}
+	C.heif_free_list_of_compatible_brands(brands)
+
+	// Older libheif versions don't know the MIME type of every brand.
+	if resp.MIMEType == "" {
+		resp.MIMEType = isobmff.Sniff(data).MIMEType
+	}
+
+	// The item types and codec configurations are not exposed by libheif, so
+	// we read them from the boxes ourselves.
+	boxes, err := isobmff.ReadBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	resp.IsSequence = isobmff.FindBox(boxes, "moov") != nil
+
+	items, err := isobmff.ReadItems(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := newHeifContext(data)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.free()
+
+	resp.PrimaryImageID, err = ctx.primaryImageID()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ctx.topLevelImageIDs() {
+		handle, err := ctx.imageHandle(id)
+		if err != nil {
+			return nil, err
+		}
+
+		probeImage := responses.ProbeImage{
+			ID:             id,
+			IsPrimary:      C.heif_image_handle_is_primary_image(handle) == 1,
+			Width:          int(C.heif_image_handle_get_width(handle)),
+			Height:         int(C.heif_image_handle_get_height(handle)),
+			LumaBitDepth:   int(C.heif_image_handle_get_luma_bits_per_pixel(handle)),
+			ChromaBitDepth: int(C.heif_image_handle_get_chroma_bits_per_pixel(handle)),
+			HasAlpha:       C.heif_image_handle_has_alpha_channel(handle) == 1,
+			HasDepth:       C.heif_image_handle_has_depth_image(handle) == 1,
+			Thumbnails:     int(C.heif_image_handle_get_number_of_thumbnails(handle)),
+			MetadataBlocks: probeMetadataBlocks(handle),
+		}
+
+		probeImage.Compression, probeImage.Chroma = probeCodec(items, uint32(id))
+		if probeImage.Chroma == responses.ChromaUnknown && probeImage.ChromaBitDepth == -1 {
+			probeImage.Chroma = responses.ChromaMonochrome
+		}
+
+		if probeImage.IsPrimary {
+			probeImage.GainMap, err = probeGainMap(data, items, handle, id)
+		}
+
+		C.heif_image_handle_release(handle)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Images = append(resp.Images, probeImage)
+	}
+
+	return resp, nil
+}
+
+func probeMetadataBlocks(handle *C.struct_heif_image_handle) []responses.ProbeMetadataBlock {
+	blocks := []responses.ProbeMetadataBlock{}
+
+	count := C.heif_image_handle_get_number_of_metadata_blocks(handle, nil)
+	if count <= 0 {
+		return blocks
+	}
+
+	ids := make([]C.heif_item_id, count)
+	count = C.heif_image_handle_get_list_of_metadata_block_IDs(handle, nil, &ids[0], count)
+	for _, id := range ids[:count] {
+		blocks = append(blocks, responses.ProbeMetadataBlock{
+			ID:          int(id),
+			Type:        C.GoString(C.heif_image_handle_get_metadata_type(handle, id)),
+			ContentType: C.GoString(C.heif_image_handle_get_metadata_content_type(handle, id)),
+		})
+	}
+
+	return blocks
+}
+
+var itemTypeCompressions = map[string]responses.Compression{
+	"hvc1": responses.CompressionHEVC,
+	"avc1": responses.CompressionAVC,
+	"av01": responses.CompressionAV1,
+	"jpeg": responses.CompressionJPEG,
+	"j2k1": responses.CompressionJPEG2000,
+	"vvc1": responses.CompressionVVC,
+	"unci": responses.CompressionUncompressed,
+}
+
+// probeCodec returns the compression and chroma format of an item, for
+// derived images it looks at the first input image.
+func probeCodec(items []isobmff.Item, id uint32) (responses.Compression, responses.Chroma) {
+	item := isobmff.FindItem(items, id)
+
+	// Derived images can reference other derived images, but never in a cycle.
+	for depth := 0; item != nil && depth < 8; depth++ {
+		if compression, ok := itemTypeCompressions[item.Type]; ok {
+			return compression, probeChroma(item)
+		}
+
+		inputs := item.References["dimg"]
+		if len(inputs) == 0 {
+			break
+		}
+		item = isobmff.FindItem(items, inputs[0])
+	}
+
+	return responses.CompressionUnknown, responses.ChromaUnknown
+}
+
+// probeChroma reads the chroma format from the codec configuration property.
+func probeChroma(item *isobmff.Item) responses.Chroma {
+	if hvcC := item.Property("hvcC"); hvcC != nil && len(hvcC.Payload) > 16 {
+		switch hvcC.Payload[16] & 0x03 {
+		case 0:
+			return responses.ChromaMonochrome
+		case 1:
+			return responses.Chroma420
+		case 2:
+			return responses.Chroma422
+		case 3:
+			return responses.Chroma444
+		}
+	}
+
+	if av1C := item.Property("av1C"); av1C != nil && len(av1C.Payload) > 2 {
+		monochrome := av1C.Payload[2]&0x10 != 0
+		subsamplingX := av1C.Payload[2]&0x08 != 0
+		subsamplingY := av1C.Payload[2]&0x04 != 0
+		switch {
+		case monochrome:
+			return responses.ChromaMonochrome
+		case subsamplingX && subsamplingY:
+			return responses.Chroma420
+		case subsamplingX:
+			return responses.Chroma422
+		default:
+			return responses.Chroma444
+		}
+	}
+
+	if uncC := item.Property("uncC"); uncC != nil {
+		return probeUncompressedChroma(uncC)
+	}
+
+	return responses.ChromaUnknown
+}
+
+// probeUncompressedChroma reads the sampling type of an ISO/IEC 23001-17 uncC box.
+func probeUncompressedChroma(uncC *isobmff.Box) responses.Chroma {
+	version, _, rest, err := isobmff.ReadFullBoxHeader(uncC.Payload)
+	if err != nil || version != 0 || len(rest) < 8 {
+		return responses.ChromaUnknown
+	}
+
+	// Skip the profile and the component definitions.
+	componentCount := int(rest[4])<<24 | int(rest[5])<<16 | int(rest[6])<<8 | int(rest[7])
+	offset := 8 + componentCount*5
+	if len(rest) <= offset {
+		return responses.ChromaUnknown
+	}
+
+	switch rest[offset] {
+	case 0:
+		if componentCount == 1 {
+			return responses.ChromaMonochrome
+		}
+		return responses.Chroma444
+	case 1:
+		return responses.Chroma422
+	case 2:
+		return responses.Chroma420
+	}
+
+	return responses.ChromaUnknown
+}
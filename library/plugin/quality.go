@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	"github.com/klippa-app/go-libheif/library/plugin/ssim"
+)
+
+// decodeFunc decodes the output of an encodeFunc.
+type decodeFunc func(r io.Reader) (image.Image, error)
+
+// searchSSIM does a binary search for the lowest quality between minQuality
+// and maxQuality of which the output has at least the target SSIM compared to
+// the image. When no quality reaches the target it returns maxQuality. It also
+// returns the SSIM of the output at that quality.
+func searchSSIM(img image.Image, encode encodeFunc, decode decodeFunc, target float64, minQuality, maxQuality int) (int, float64, error) {
+	scores := map[int]float64{}
+	low, high := minQuality, maxQuality
+	for low < high {
+		quality := (low + high) / 2
+		score, err := outputSSIM(img, encode, decode, quality)
+		if err != nil {
+			return 0, 0, err
+		}
+		scores[quality] = score
+
+		if score >= target {
+			high = quality
+		} else {
+			low = quality + 1
+		}
+	}
+
+	if score, ok := scores[low]; ok {
+		return low, score, nil
+	}
+
+	score, err := outputSSIM(img, encode, decode, low)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return low, score, nil
+}
+
+// outputSSIM encodes the image with the given quality and returns the SSIM of
+// the decoded output compared to the image.
+func outputSSIM(img image.Image, encode encodeFunc, decode decodeFunc, quality int) (float64, error) {
+	var output bytes.Buffer
+	err := encode(&output, img, quality)
+	if err != nil {
+		return 0, err
+	}
+
+	return compareOutput(img, output.Bytes(), decode)
+}
+
+// compareOutput returns the SSIM of the decoded output compared to the image.
+func compareOutput(img image.Image, output []byte, decode decodeFunc) (float64, error) {
+	decodedOutput, err := decode(bytes.NewReader(output))
+	if err != nil {
+		return 0, err
+	}
+
+	return ssim.Compare(img, decodedOutput)
+}
@@ -0,0 +1,131 @@
+// Package ssim computes the structural similarity (SSIM) of two images.
+package ssim
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// SizeMismatchError is returned by Compare when the images do not have the
+// same dimensions.
+var SizeMismatchError = errors.New("images do not have the same dimensions")
+
+const (
+	windowSize = 8 // The width and height of the windows that are compared.
+	windowStep = 4 // The distance between windows, so they overlap by half.
+
+	c1 = (0.01 * 255) * (0.01 * 255)
+	c2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// Compare returns the mean SSIM of the luma of both images, from -1 to 1,
+// where 1 means that the images are identical. The luma is compared in 8x8
+// windows that overlap by half.
+func Compare(a, b image.Image) (float64, error) {
+	size := a.Bounds().Size()
+	if size != b.Bounds().Size() {
+		return 0, SizeMismatchError
+	}
+
+	if size.X == 0 || size.Y == 0 {
+		return 1, nil
+	}
+
+	lumaA, lumaB := luma(a), luma(b)
+
+	// Small images are compared as a single window.
+	windowWidth, windowHeight := windowSize, windowSize
+	if size.X < windowWidth {
+		windowWidth = size.X
+	}
+	if size.Y < windowHeight {
+		windowHeight = size.Y
+	}
+
+	var total float64
+	var windows int
+	for y := 0; y+windowHeight <= size.Y; y += windowStep {
+		for x := 0; x+windowWidth <= size.X; x += windowStep {
+			total += window(lumaA, lumaB, size.X, x, y, windowWidth, windowHeight)
+			windows++
+		}
+	}
+
+	return total / float64(windows), nil
+}
+
+// window returns the SSIM of a single window.
+func window(a, b []uint8, stride, x, y, width, height int) float64 {
+	var sumA, sumB, sumAA, sumBB, sumAB float64
+	for wy := y; wy < y+height; wy++ {
+		rowA := a[wy*stride+x : wy*stride+x+width]
+		rowB := b[wy*stride+x : wy*stride+x+width]
+		for i := range rowA {
+			va, vb := float64(rowA[i]), float64(rowB[i])
+			sumA += va
+			sumB += vb
+			sumAA += va * va
+			sumBB += vb * vb
+			sumAB += va * vb
+		}
+	}
+
+	n := float64(width * height)
+	meanA, meanB := sumA/n, sumB/n
+	varianceA := sumAA/n - meanA*meanA
+	varianceB := sumBB/n - meanB*meanB
+	covariance := sumAB/n - meanA*meanB
+
+	return ((2*meanA*meanB + c1) * (2*covariance + c2)) /
+		((meanA*meanA + meanB*meanB + c1) * (varianceA + varianceB + c2))
+}
+
+// luma returns the 8-bit luma of the image, with the same weights as
+// color.GrayModel.
+func luma(img image.Image) []uint8 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	switch img := img.(type) {
+	case *image.YCbCr:
+		out := make([]uint8, 0, width*height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := img.YOffset(bounds.Min.X, y)
+			out = append(out, img.Y[offset:offset+width]...)
+		}
+		return out
+	case *image.Gray:
+		out := make([]uint8, 0, width*height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			offset := img.PixOffset(bounds.Min.X, y)
+			out = append(out, img.Pix[offset:offset+width]...)
+		}
+		return out
+	case *image.RGBA:
+		return rgbLuma(img.Pix, img.Stride, img.PixOffset(bounds.Min.X, bounds.Min.Y), width, height)
+	case *image.NRGBA:
+		return rgbLuma(img.Pix, img.Stride, img.PixOffset(bounds.Min.X, bounds.Min.Y), width, height)
+	}
+
+	out := make([]uint8, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			out = append(out, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return out
+}
+
+// rgbLuma returns the luma of 8-bit RGBA pixels.
+func rgbLuma(pix []uint8, stride, offset, width, height int) []uint8 {
+	out := make([]uint8, 0, width*height)
+	for y := 0; y < height; y++ {
+		row := pix[offset+y*stride : offset+y*stride+width*4]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := uint32(row[i])*0x101, uint32(row[i+1])*0x101, uint32(row[i+2])*0x101
+			out = append(out, uint8((19595*r+38470*g+7471*b+1<<15)>>24))
+		}
+	}
+	return out
+}
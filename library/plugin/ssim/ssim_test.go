@@ -0,0 +1,95 @@
+package ssim
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: uint8((x ^ y) * 4), A: 0xff})
+		}
+	}
+	return img
+}
+
+func TestCompareIdentical(t *testing.T) {
+	img := testImage()
+
+	// The same image in another type should be identical too.
+	gray := image.NewGray(img.Bounds())
+	ycbcr := image.NewYCbCr(img.Bounds(), image.YCbCrSubsampleRatio444)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			gray.Set(x, y, img.At(x, y))
+			ycbcr.Y[ycbcr.YOffset(x, y)] = gray.GrayAt(x, y).Y
+		}
+	}
+
+	for _, other := range []image.Image{img, gray, ycbcr} {
+		score, err := Compare(img, other)
+		if err != nil {
+			t.Fatalf("Compare with %T resulted in error: %s", other, err.Error())
+		}
+
+		if score < 0.9999 {
+			t.Errorf("Compare with %T resulted in wrong score, got %f, want 1", other, score)
+		}
+	}
+}
+
+func TestCompareNoise(t *testing.T) {
+	img := testImage()
+	random := rand.New(rand.NewSource(1))
+
+	var previous float64 = 1
+	for _, amount := range []int{4, 16, 64} {
+		noisy := image.NewRGBA(img.Bounds())
+		copy(noisy.Pix, img.Pix)
+		for i := range noisy.Pix {
+			if i%4 == 3 {
+				continue
+			}
+			value := int(noisy.Pix[i]) + random.Intn(amount*2+1) - amount
+			if value < 0 {
+				value = 0
+			} else if value > 255 {
+				value = 255
+			}
+			noisy.Pix[i] = uint8(value)
+		}
+
+		score, err := Compare(img, noisy)
+		if err != nil {
+			t.Fatalf("Compare with noise %d resulted in error: %s", amount, err.Error())
+		}
+
+		if score >= previous {
+			t.Errorf("Compare with noise %d resulted in a score that did not decrease, got %f, previous %f", amount, score, previous)
+		}
+		previous = score
+	}
+}
+
+func TestCompareSizeMismatch(t *testing.T) {
+	_, err := Compare(testImage(), image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	if err != SizeMismatchError {
+		t.Fatalf("Compare with different sizes resulted in wrong error, got %v, want %v", err, SizeMismatchError)
+	}
+}
+
+func TestCompareSmall(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	score, err := Compare(img, img)
+	if err != nil {
+		t.Fatalf("Compare of a small image resulted in error: %s", err.Error())
+	}
+
+	if score < 0.9999 {
+		t.Errorf("Compare of a small image resulted in wrong score, got %f, want 1", score)
+	}
+}
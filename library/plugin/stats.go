@@ -0,0 +1,37 @@
+package plugin
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+)
+
+func (l *libHeifImplementation) Stats(request *requests.Stats) (*responses.Stats, error) {
+	return &responses.Stats{
+		RSS: residentMemory(),
+	}, nil
+}
+
+// residentMemory returns the resident memory of the worker in bytes from
+// /proc, which is only available on Linux, or 0 when it can't be read.
+func residentMemory() uint64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return pages * uint64(os.Getpagesize())
+}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"errors"
+	"image"
+
+	"github.com/klippa-app/go-libheif/library/plugin/tonemap"
+	"github.com/klippa-app/go-libheif/library/requests"
+)
+
+var toneMappingOperators = map[requests.RenderFileToneMapping]tonemap.Operator{
+	requests.RenderFileToneMappingReinhard: tonemap.OperatorReinhard,
+	requests.RenderFileToneMappingHable:    tonemap.OperatorHable,
+	requests.RenderFileToneMappingBT2390:   tonemap.OperatorBT2390,
+}
+
+// toneMapOptions returns the options to tone map an image with the metadata,
+// or false when tone mapping is not requested or the image is not HDR.
+func toneMapOptions(metadata *imageMetadata, request *requests.RenderFile) (tonemap.Options, bool, error) {
+	if request.ToneMapping == requests.RenderFileToneMappingNone {
+		return tonemap.Options{}, false, nil
+	}
+
+	operator, ok := toneMappingOperators[request.ToneMapping]
+	if !ok {
+		return tonemap.Options{}, false, errors.New("invalid tone mapping given")
+	}
+
+	if metadata.NCLX == nil {
+		return tonemap.Options{}, false, nil
+	}
+
+	transfer := tonemap.Transfer(metadata.NCLX.TransferCharacteristics)
+	if transfer != tonemap.TransferPQ && transfer != tonemap.TransferHLG {
+		return tonemap.Options{}, false, nil
+	}
+
+	return tonemap.Options{
+		Transfer:            transfer,
+		Operator:            operator,
+		Primaries:           metadata.NCLX.Primaries,
+		TargetPeakLuminance: request.TargetPeakLuminance,
+	}, true, nil
+}
+
+// toneMap converts the image to SDR when tone mapping is requested and the
+// image has a PQ or HLG transfer. It returns whether the image was converted.
+func toneMap(img image.Image, metadata *imageMetadata, request *requests.RenderFile) (image.Image, bool, error) {
+	opt, ok, err := toneMapOptions(metadata, request)
+	if err != nil || !ok {
+		return img, false, err
+	}
+
+	mapped, err := tonemap.Map(img, opt)
+	if err != nil {
+		return nil, false, err
+	}
+	return mapped, true, nil
+}
@@ -0,0 +1,50 @@
+package tonemap
+
+type Transfer int // The transfer characteristics of the source, as in ITU-T H.273.
+
+const (
+	TransferPQ  Transfer = 16 // SMPTE ST 2084 perceptual quantizer, as in BT.2100.
+	TransferHLG Transfer = 18 // ARIB STD-B67 hybrid log-gamma, as in BT.2100.
+)
+
+type Operator string // The curve that compresses the luminance range.
+
+const (
+	OperatorReinhard Operator = "reinhard" // Extended Reinhard, which maps the source peak to the target peak.
+	OperatorHable    Operator = "hable"    // The filmic curve of John Hable, with more contrast in the shadows.
+	OperatorBT2390   Operator = "bt2390"   // The EETF of ITU-R BT.2390, which keeps the luminance below the knee and rolls off above it.
+)
+
+// Chromaticities are the CIE 1931 xy coordinates of the primaries and the
+// white point of an RGB color space.
+type Chromaticities struct {
+	RedX, RedY     float64
+	GreenX, GreenY float64
+	BlueX, BlueY   float64
+	WhiteX, WhiteY float64
+}
+
+// BT709 are the chromaticities of BT.709 and sRGB, which is the color space of
+// the output.
+var BT709 = Chromaticities{
+	RedX: 0.64, RedY: 0.33,
+	GreenX: 0.30, GreenY: 0.60,
+	BlueX: 0.15, BlueY: 0.06,
+	WhiteX: 0.3127, WhiteY: 0.3290,
+}
+
+// BT2020 are the chromaticities of BT.2020 and BT.2100.
+var BT2020 = Chromaticities{
+	RedX: 0.708, RedY: 0.292,
+	GreenX: 0.170, GreenY: 0.797,
+	BlueX: 0.131, BlueY: 0.046,
+	WhiteX: 0.3127, WhiteY: 0.3290,
+}
+
+type Options struct {
+	Transfer            Transfer        // The transfer characteristics of the image.
+	Operator            Operator        // The tone mapping curve, the default is OperatorBT2390.
+	Primaries           *Chromaticities // The primaries of the image, the default is BT2020.
+	SourcePeakLuminance float64         // The peak luminance of the image in cd/m², the default is 1000.
+	TargetPeakLuminance float64         // The peak luminance of the output in cd/m², the default is 203, the reference white of BT.2408.
+}
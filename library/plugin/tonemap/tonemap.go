@@ -0,0 +1,381 @@
+// Package tonemap converts PQ and HLG encoded HDR images to SDR sRGB images.
+package tonemap
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	defaultSourcePeakLuminance = 1000
+	defaultTargetPeakLuminance = 203
+
+	// The constants of SMPTE ST 2084.
+	pqM1 = 2610.0 / 16384
+	pqM2 = 2523.0 / 4096 * 128
+	pqC1 = 3424.0 / 4096
+	pqC2 = 2413.0 / 4096 * 32
+	pqC3 = 2392.0 / 4096 * 32
+
+	// The peak luminance of the PQ signal in cd/m².
+	pqPeakLuminance = 10000
+
+	// The constants of the HLG OETF.
+	hlgA = 0.17883277
+	hlgB = 1 - 4*hlgA
+	hlgC = 0.55991073
+)
+
+// Map converts the image from the PQ or HLG transfer and the given primaries
+// to SDR with the sRGB transfer and primaries. The luminance is scaled so
+// that the target peak luminance becomes white, and the highlights above it
+// are compressed with the tone mapping curve. The curve is applied to the
+// largest of the red, green and blue components, and all components are
+// scaled by the same factor to keep the hue. It returns an NRGBA64 image, or
+// an RGBA64 image when the image is opaque.
+func Map(img image.Image, o Options) (image.Image, error) {
+	m, err := newMapper(o)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	opaque := true
+	for y := 0; y < height; y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+width*8]
+		readRow(img, bounds.Min.Y+y, row)
+		for i := 0; i < len(row); i += 8 {
+			r := uint16(row[i])<<8 | uint16(row[i+1])
+			g := uint16(row[i+2])<<8 | uint16(row[i+3])
+			b := uint16(row[i+4])<<8 | uint16(row[i+5])
+			if row[i+6] != 0xff || row[i+7] != 0xff {
+				opaque = false
+			}
+
+			r, g, b = m.mapPixel(r, g, b)
+			row[i], row[i+1] = byte(r>>8), byte(r)
+			row[i+2], row[i+3] = byte(g>>8), byte(g)
+			row[i+4], row[i+5] = byte(b>>8), byte(b)
+		}
+	}
+
+	if opaque {
+		// Without transparency the premultiplied layout is the same.
+		return &image.RGBA64{Pix: out.Pix, Stride: out.Stride, Rect: out.Rect}, nil
+	}
+	return out, nil
+}
+
+// readRow reads a row of the image as 16 bit big endian non-premultiplied
+// RGBA pixels.
+func readRow(img image.Image, y int, row []byte) {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.NRGBA64:
+		offset := img.PixOffset(bounds.Min.X, y)
+		copy(row, img.Pix[offset:offset+len(row)])
+		return
+	case *image.RGBA64:
+		offset := img.PixOffset(bounds.Min.X, y)
+		copy(row, img.Pix[offset:offset+len(row)])
+		for i := 0; i < len(row); i += 8 {
+			a := uint32(row[i+6])<<8 | uint32(row[i+7])
+			if a == 0xffff {
+				continue
+			}
+			for c := i; c < i+6; c += 2 {
+				value := uint32(0)
+				if a != 0 {
+					value = (uint32(row[c])<<8 | uint32(row[c+1])) * 0xffff / a
+					if value > 0xffff {
+						value = 0xffff
+					}
+				}
+				row[c], row[c+1] = byte(value>>8), byte(value)
+			}
+		}
+		return
+	}
+
+	for x := 0; x < bounds.Dx(); x++ {
+		c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, y)).(color.NRGBA64)
+		i := x * 8
+		row[i], row[i+1] = byte(c.R>>8), byte(c.R)
+		row[i+2], row[i+3] = byte(c.G>>8), byte(c.G)
+		row[i+4], row[i+5] = byte(c.B>>8), byte(c.B)
+		row[i+6], row[i+7] = byte(c.A>>8), byte(c.A)
+	}
+}
+
+// mapper maps 16 bit HDR pixels to 16 bit sRGB pixels.
+type mapper struct {
+	transfer  Transfer
+	curve     func(x float64) float64
+	linear    []float64 // The linear value of every 16 bit code value, in cd/m² for PQ and relative scene light for HLG.
+	primaries [3][3]float64
+	convert   bool // Whether the primaries have to be converted.
+	target    float64
+	hlgPeak   float64 // The nominal peak luminance of the HLG display.
+	hlgGamma  float64 // The system gamma of the HLG OOTF.
+	srgb      []uint16
+}
+
+func newMapper(o Options) (*mapper, error) {
+	source := o.SourcePeakLuminance
+	if source <= 0 {
+		source = defaultSourcePeakLuminance
+	}
+
+	target := o.TargetPeakLuminance
+	if target <= 0 {
+		target = defaultTargetPeakLuminance
+	}
+
+	m := &mapper{
+		transfer: o.Transfer,
+		linear:   make([]float64, 1<<16),
+		target:   target,
+		srgb:     make([]uint16, 1<<16),
+	}
+
+	switch o.Transfer {
+	case TransferPQ:
+		for i := range m.linear {
+			m.linear[i] = pqToLinear(float64(i)/0xffff) * pqPeakLuminance
+		}
+	case TransferHLG:
+		for i := range m.linear {
+			m.linear[i] = hlgToLinear(float64(i) / 0xffff)
+		}
+		m.hlgPeak = source
+		m.hlgGamma = 1.2 + 0.42*math.Log10(source/1000)
+	default:
+		return nil, errors.New("unsupported transfer characteristics for tone mapping")
+	}
+
+	// The curve works on values relative to the target peak, where peak is
+	// the source peak.
+	peak := source / target
+	switch o.Operator {
+	case OperatorReinhard:
+		m.curve = func(x float64) float64 {
+			return x * (1 + x/(peak*peak)) / (1 + x)
+		}
+	case OperatorHable:
+		scale := 1 / hable(2*peak)
+		m.curve = func(x float64) float64 {
+			return hable(2*x) * scale
+		}
+	case OperatorBT2390, "":
+		m.curve = bt2390(source, target)
+	default:
+		return nil, errors.New("unsupported tone mapping operator")
+	}
+
+	if peak <= 1 {
+		// The target can show the whole range, so there is nothing to
+		// compress.
+		m.curve = func(x float64) float64 {
+			return x
+		}
+	}
+
+	primaries := BT2020
+	if o.Primaries != nil {
+		primaries = *o.Primaries
+	}
+	if primaries != BT709 {
+		toXYZ, err := rgbToXYZ(primaries)
+		if err != nil {
+			return nil, err
+		}
+
+		sRGBToXYZ, err := rgbToXYZ(BT709)
+		if err != nil {
+			return nil, err
+		}
+
+		fromXYZ, err := invert(sRGBToXYZ)
+		if err != nil {
+			return nil, err
+		}
+
+		m.primaries = multiply(fromXYZ, toXYZ)
+		m.convert = true
+	}
+
+	for i := range m.srgb {
+		m.srgb[i] = uint16(math.Round(linearToSRGB(float64(i)/0xffff) * 0xffff))
+	}
+
+	return m, nil
+}
+
+func (m *mapper) mapPixel(r, g, b uint16) (uint16, uint16, uint16) {
+	rgb := [3]float64{m.linear[r], m.linear[g], m.linear[b]}
+
+	if m.transfer == TransferHLG {
+		// The OOTF of BT.2100 turns the scene light into display light.
+		luminance := 0.2627*rgb[0] + 0.6780*rgb[1] + 0.0593*rgb[2]
+		scale := 0.0
+		if luminance > 0 {
+			scale = m.hlgPeak * math.Pow(luminance, m.hlgGamma-1)
+		}
+		for c := range rgb {
+			rgb[c] *= scale
+		}
+	}
+
+	if m.convert {
+		p := m.primaries
+		rgb = [3]float64{
+			p[0][0]*rgb[0] + p[0][1]*rgb[1] + p[0][2]*rgb[2],
+			p[1][0]*rgb[0] + p[1][1]*rgb[1] + p[1][2]*rgb[2],
+			p[2][0]*rgb[0] + p[2][1]*rgb[1] + p[2][2]*rgb[2],
+		}
+	}
+
+	largest := 0.0
+	for c := range rgb {
+		// Colors outside of the sRGB gamut are clipped.
+		rgb[c] = math.Max(rgb[c], 0) / m.target
+		largest = math.Max(largest, rgb[c])
+	}
+
+	if largest > 0 {
+		scale := m.curve(largest) / largest
+		for c := range rgb {
+			rgb[c] *= scale
+		}
+	}
+
+	return m.encode(rgb[0]), m.encode(rgb[1]), m.encode(rgb[2])
+}
+
+// encode returns the 16 bit sRGB code value of a linear value.
+func (m *mapper) encode(value float64) uint16 {
+	if value >= 1 {
+		return 0xffff
+	}
+	return m.srgb[int(value*0xffff+0.5)]
+}
+
+// EncodePQ returns the PQ signal value, from 0 to 1, of a luminance in cd/m².
+func EncodePQ(luminance float64) float64 {
+	return linearToPQ(math.Min(math.Max(luminance, 0)/pqPeakLuminance, 1))
+}
+
+// pqToLinear is the EOTF of SMPTE ST 2084, it returns the luminance relative
+// to 10000 cd/m².
+func pqToLinear(value float64) float64 {
+	p := math.Pow(value, 1/pqM2)
+	return math.Pow(math.Max(p-pqC1, 0)/(pqC2-pqC3*p), 1/pqM1)
+}
+
+// linearToPQ is the inverse EOTF of SMPTE ST 2084.
+func linearToPQ(value float64) float64 {
+	p := math.Pow(value, pqM1)
+	return math.Pow((pqC1+pqC2*p)/(1+pqC3*p), pqM2)
+}
+
+// hlgToLinear is the inverse OETF of HLG, it returns the relative scene light.
+func hlgToLinear(value float64) float64 {
+	if value <= 0.5 {
+		return value * value / 3
+	}
+	return (math.Exp((value-hlgC)/hlgA) + hlgB) / 12
+}
+
+// linearToSRGB is the sRGB OETF.
+func linearToSRGB(value float64) float64 {
+	if value <= 0.0031308 {
+		return value * 12.92
+	}
+	return 1.055*math.Pow(value, 1/2.4) - 0.055
+}
+
+// hable is the filmic curve of John Hable.
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
+
+// bt2390 returns the EETF of ITU-R BT.2390 for a black level of 0, for values
+// relative to the target peak.
+func bt2390(source, target float64) func(x float64) float64 {
+	sourcePQ := linearToPQ(source / pqPeakLuminance)
+	maxLuminance := linearToPQ(target/pqPeakLuminance) / sourcePQ
+	kneeStart := math.Max(1.5*maxLuminance-0.5, 0)
+
+	return func(x float64) float64 {
+		e := math.Min(linearToPQ(x*target/pqPeakLuminance)/sourcePQ, 1)
+		if e >= kneeStart {
+			// Roll off with a Hermite spline from the knee to the target peak.
+			t := (e - kneeStart) / (1 - kneeStart)
+			t2, t3 := t*t, t*t*t
+			e = (2*t3-3*t2+1)*kneeStart + (t3-2*t2+t)*(1-kneeStart) + (-2*t3+3*t2)*maxLuminance
+		}
+		return pqToLinear(e*sourcePQ) * pqPeakLuminance / target
+	}
+}
+
+// rgbToXYZ returns the matrix that converts linear RGB with the given
+// chromaticities to CIE XYZ.
+func rgbToXYZ(c Chromaticities) ([3][3]float64, error) {
+	xyz := func(x, y float64) [3]float64 {
+		return [3]float64{x / y, 1, (1 - x - y) / y}
+	}
+
+	r, g, b := xyz(c.RedX, c.RedY), xyz(c.GreenX, c.GreenY), xyz(c.BlueX, c.BlueY)
+	primaries := [3][3]float64{
+		{r[0], g[0], b[0]},
+		{r[1], g[1], b[1]},
+		{r[2], g[2], b[2]},
+	}
+
+	inverse, err := invert(primaries)
+	if err != nil {
+		return primaries, err
+	}
+
+	// Scale the primaries so that RGB white becomes the white point.
+	white := xyz(c.WhiteX, c.WhiteY)
+	for col := 0; col < 3; col++ {
+		scale := inverse[col][0]*white[0] + inverse[col][1]*white[1] + inverse[col][2]*white[2]
+		for row := 0; row < 3; row++ {
+			primaries[row][col] *= scale
+		}
+	}
+	return primaries, nil
+}
+
+func multiply(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invert(m [3][3]float64) ([3][3]float64, error) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return m, errors.New("invalid chromaticities")
+	}
+
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}, nil
+}
@@ -0,0 +1,191 @@
+package tonemap
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestTransfers(t *testing.T) {
+	for _, value := range []float64{0, 0.0001, 0.01, 0.0203, 0.1, 1} {
+		if got := pqToLinear(linearToPQ(value)); math.Abs(got-value) > 1e-9 {
+			t.Errorf("PQ round trip of %f resulted in %f", value, got)
+		}
+	}
+
+	// The reference white of BT.2408 is at 58% of the PQ signal.
+	if got := linearToPQ(203.0 / pqPeakLuminance); math.Abs(got-0.58) > 0.005 {
+		t.Errorf("Expected 203 cd/m² to be at about 0.58 PQ, got %f", got)
+	}
+
+	// HLG is continuous at the switch from the square root to the log curve.
+	if below, above := hlgToLinear(0.5), hlgToLinear(0.5+1e-9); math.Abs(below-above) > 1e-6 {
+		t.Errorf("Expected HLG to be continuous at 0.5, got %f and %f", below, above)
+	}
+
+	if got := hlgToLinear(1); math.Abs(got-1) > 1e-6 {
+		t.Errorf("Expected the HLG peak to be 1, got %f", got)
+	}
+}
+
+func TestRGBToXYZ(t *testing.T) {
+	m, err := rgbToXYZ(BT709)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second row is the luminance of the primaries.
+	for i, want := range []float64{0.2126, 0.7152, 0.0722} {
+		if math.Abs(m[1][i]-want) > 0.0005 {
+			t.Errorf("Expected luminance coefficient %d to be %f, got %f", i, want, m[1][i])
+		}
+	}
+
+	_, err = rgbToXYZ(Chromaticities{WhiteX: 0.3127, WhiteY: 0.3290, RedY: 1, GreenY: 1, BlueY: 1})
+	if err == nil {
+		t.Error("Expected an error for primaries on a line")
+	}
+}
+
+func TestCurves(t *testing.T) {
+	for _, operator := range []Operator{OperatorReinhard, OperatorHable, OperatorBT2390} {
+		m, err := newMapper(Options{Transfer: TransferPQ, Operator: operator})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peak := 1000.0 / 203
+		if got := m.curve(peak); math.Abs(got-1) > 0.001 {
+			t.Errorf("Expected %s to map the source peak to 1, got %f", operator, got)
+		}
+
+		previous := 0.0
+		for x := 0.01; x <= peak; x += 0.01 {
+			got := m.curve(x)
+			if got < previous {
+				t.Fatalf("Expected %s to be increasing, got %f after %f at %f", operator, got, previous, x)
+			}
+			previous = got
+		}
+	}
+
+	// BT.2390 keeps the luminance below the knee.
+	m, err := newMapper(Options{Transfer: TransferPQ, Operator: OperatorBT2390})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.curve(0.2); math.Abs(got-0.2) > 1e-6 {
+		t.Errorf("Expected BT.2390 to keep 0.2, got %f", got)
+	}
+
+	_, err = newMapper(Options{Transfer: TransferPQ, Operator: "unknown"})
+	if err == nil {
+		t.Error("Expected an error for an unknown operator")
+	}
+
+	_, err = newMapper(Options{Transfer: 1})
+	if err == nil {
+		t.Error("Expected an error for an unsupported transfer")
+	}
+}
+
+func pqGray(luminance float64) uint16 {
+	return uint16(math.Round(linearToPQ(luminance/pqPeakLuminance) * 0xffff))
+}
+
+func TestMap(t *testing.T) {
+	luminances := []float64{1, 20, 100, 203, 500, 1000, 4000}
+	img := image.NewRGBA64(image.Rect(0, 0, len(luminances), 1))
+	for x, luminance := range luminances {
+		value := pqGray(luminance)
+		img.SetRGBA64(x, 0, color.RGBA64{R: value, G: value, B: value, A: 0xffff})
+	}
+
+	for _, operator := range []Operator{OperatorReinhard, OperatorHable, OperatorBT2390} {
+		mapped, err := Map(img, Options{Transfer: TransferPQ, Operator: operator})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rgba64, ok := mapped.(*image.RGBA64)
+		if !ok {
+			t.Fatalf("Expected an RGBA64 image for an opaque image, got %T", mapped)
+		}
+
+		previous := uint16(0)
+		for x, luminance := range luminances {
+			c := rgba64.RGBA64At(x, 0)
+			if c.R != c.G || c.G != c.B {
+				t.Errorf("Expected %s to keep %f cd/m² gray, got %v", operator, luminance, c)
+			}
+			if x > 0 && c.R <= previous && previous != 0xffff {
+				t.Errorf("Expected %s to map %f cd/m² brighter than %f cd/m², got %#x and %#x", operator, luminance, luminances[x-1], c.R, previous)
+			}
+			previous = c.R
+		}
+
+		if c := rgba64.RGBA64At(5, 0); c.R < 0xfe00 {
+			t.Errorf("Expected %s to map the source peak to white, got %#x", operator, c.R)
+		}
+	}
+
+	// A higher target peak makes the output darker.
+	bright, err := Map(img, Options{Transfer: TransferPQ})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dark, err := Map(img, Options{Transfer: TransferPQ, TargetPeakLuminance: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, d := bright.(*image.RGBA64).RGBA64At(3, 0).R, dark.(*image.RGBA64).RGBA64At(3, 0).R; d >= b {
+		t.Errorf("Expected a higher target peak to be darker, got %#x and %#x", d, b)
+	}
+
+	// With the target peak at the source peak, the reference white is at its
+	// plain sRGB value.
+	if got, want := dark.(*image.RGBA64).RGBA64At(3, 0).R, linearToSRGB(0.203); math.Abs(float64(got)/0xffff-want) > 0.002 {
+		t.Errorf("Expected 203 cd/m² at %f, got %f", want, float64(got)/0xffff)
+	}
+}
+
+func TestMapPrimaries(t *testing.T) {
+	// Pure BT.2020 green is outside of sRGB, it becomes the sRGB green with
+	// some negative red and blue clipped off.
+	img := image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA64(0, 0, color.NRGBA64{G: pqGray(100), A: 0xffff})
+	img.SetNRGBA64(1, 0, color.NRGBA64{R: pqGray(100), G: pqGray(100), B: pqGray(100), A: 0x8000})
+
+	mapped, err := Map(img, Options{Transfer: TransferPQ})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nrgba64, ok := mapped.(*image.NRGBA64)
+	if !ok {
+		t.Fatalf("Expected an NRGBA64 image for a transparent image, got %T", mapped)
+	}
+
+	if c := nrgba64.NRGBA64At(0, 0); c.R != 0 || c.B != 0 || c.G == 0 {
+		t.Errorf("Expected BT.2020 green to be sRGB green, got %v", c)
+	}
+
+	if c := nrgba64.NRGBA64At(1, 0); c.A != 0x8000 || c.R != c.G || c.G != c.B {
+		t.Errorf("Expected a half transparent gray, got %v", c)
+	}
+
+	// HLG at its nominal peak is white.
+	img.SetNRGBA64(0, 0, color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0xffff})
+	mapped, err = Map(img, Options{Transfer: TransferHLG, Primaries: &BT709})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := mapped.(*image.NRGBA64).NRGBA64At(0, 0); c.R < 0xfe00 || c.G < 0xfe00 || c.B < 0xfe00 {
+		t.Errorf("Expected the HLG peak to be white, got %v", c)
+	}
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+
+	"github.com/klippa-app/go-libheif/library/plugin/image_jpeg"
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+)
+
+func (l *libHeifImplementation) TransformJPEG(request *requests.TransformJPEG) (*responses.TransformJPEG, error) {
+	if request.Data == nil {
+		return nil, errors.New("no data given")
+	}
+
+	output, err := image_jpeg.Transform(*request.Data, image_jpeg.TransformOptions{
+		Operation:  image_jpeg.Operation(request.Operation),
+		AutoOrient: request.AutoOrient,
+		Crop:       request.Crop,
+		Trim:       request.Trim,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(output))
+	if err != nil {
+		return nil, err
+	}
+
+	return &responses.TransformJPEG{
+		Output: &output,
+		Width:  config.Width,
+		Height: config.Height,
+	}, nil
+}
@@ -1,7 +1,47 @@
 package requests
 
+import (
+	"image"
+	"image/color"
+)
+
+type DecodeImageColorspace string // The colorspace to decode an image to.
+
+const (
+	DecodeImageColorspaceDefault    DecodeImageColorspace = ""           // The default colorspace, whatever colorspace the image is coded in: image.Gray for monochrome 8 bit images, image.RGBA for other 8 bit images, image.RGBA64 for images with a higher bit depth, and image.NRGBA or image.NRGBA64 for images with alpha.
+	DecodeImageColorspaceRGB        DecodeImageColorspace = "rgb"        // RGB, as image.RGBA or image.RGBA64, or image.NRGBA or image.NRGBA64 for images with alpha.
+	DecodeImageColorspaceYCbCr      DecodeImageColorspace = "ycbcr"      // YCbCr, as image.YCbCr with the subsampling of Chroma. Only for images with 8 bits per channel or ConvertHDRTo8Bit, without alpha.
+	DecodeImageColorspaceMonochrome DecodeImageColorspace = "monochrome" // Gray, as image.Gray or image.Gray16, color images keep their luma. Only for images without alpha.
+)
+
+type DecodeImageChroma string // The chroma subsampling of YCbCr output.
+
+const (
+	DecodeImageChromaDefault DecodeImageChroma = ""    // 4:2:0, the subsampling of most files.
+	DecodeImageChroma420     DecodeImageChroma = "420" // 4:2:0, the chroma has half the width and height.
+	DecodeImageChroma422     DecodeImageChroma = "422" // 4:2:2, the chroma has half the width.
+	DecodeImageChroma444     DecodeImageChroma = "444" // 4:4:4, no subsampling.
+)
+
+type DecodeImageAlpha string // How to return the alpha channel of an image.
+
+const (
+	DecodeImageAlphaDefault       DecodeImageAlpha = ""              // As it's stored in the file, straight alpha as image.NRGBA or image.NRGBA64, and premultiplied alpha as image.RGBA or image.RGBA64.
+	DecodeImageAlphaStraight      DecodeImageAlpha = "straight"      // Straight alpha, as image.NRGBA or image.NRGBA64.
+	DecodeImageAlphaPremultiplied DecodeImageAlpha = "premultiplied" // Premultiplied alpha, as image.RGBA or image.RGBA64.
+)
+
 type DecodeImage struct {
-	Data *[]byte
+	Data                  *[]byte
+	Colorspace            DecodeImageColorspace // Only used for HEIF and AVIF files. The default is DecodeImageColorspaceDefault.
+	Chroma                DecodeImageChroma     // Only used when Colorspace is DecodeImageColorspaceYCbCr. The default is DecodeImageChromaDefault.
+	IgnoreTransformations bool                  // Only used for HEIF and AVIF files. Do not apply the crop, rotation and mirroring of the file.
+	ConvertHDRTo8Bit      bool                  // Only used for HEIF and AVIF files. Decode images with more than 8 bits per channel to 8 bits per channel.
+	ImageID               int                   // Only used for HEIF and AVIF files. The ID of the top level image to decode, as in the Probe response. The default is the primary image.
+	Alpha                 DecodeImageAlpha      // The default is DecodeImageAlphaDefault.
+	DecoderID             string                // Only used for HEIF and AVIF files. The ID of the libheif decoder plugin to prefer, like libde265 or dav1d, as in the Decoders of Capabilities. When it's not available, or by default, libheif uses the decoder with the highest priority for the compression format.
+	ConvertColors         bool                  // Convert the colors from the ICC or nclx color profile of the image to sRGB, or to TargetICCProfile. Not supported with DecodeImageColorspaceYCbCr and DecodeImageColorspaceMonochrome.
+	TargetICCProfile      []byte                // Only used when ConvertColors is set. An RGB ICC profile with matrices and tone curves to convert to, the default is sRGB.
 }
 
 type DecodeConfig struct {
@@ -11,14 +51,136 @@ type DecodeConfig struct {
 type RenderFileOutputFormat string // The file format to render output as.
 
 const (
-	RenderFileOutputFormatJPG RenderFileOutputFormat = "jpg" // Render the file as a JPEG file.
-	RenderFileOutputFormatPNG RenderFileOutputFormat = "png" // Render the file as a PNG file.
+	RenderFileOutputFormatJPG  RenderFileOutputFormat = "jpg"  // Render the file as a JPEG file.
+	RenderFileOutputFormatPNG  RenderFileOutputFormat = "png"  // Render the file as a PNG file.
+	RenderFileOutputFormatWebP RenderFileOutputFormat = "webp" // Render the file as a WebP file, only available when the worker has been built with build tag go_libheif_use_libwebp.
+	RenderFileOutputFormatTIFF RenderFileOutputFormat = "tiff" // Render the file as a TIFF file, lossless, with the ICC profile and EXIF data of the image.
+	RenderFileOutputFormatPDF  RenderFileOutputFormat = "pdf"  // Render the file as a PDF file, with the image on a page.
+)
+
+type RenderFileTIFFCompression string // The compression of a TIFF file.
+
+const (
+	RenderFileTIFFCompressionNone    RenderFileTIFFCompression = "none"    // No compression.
+	RenderFileTIFFCompressionLZW     RenderFileTIFFCompression = "lzw"     // LZW compression.
+	RenderFileTIFFCompressionDeflate RenderFileTIFFCompression = "deflate" // Deflate (zlib) compression.
+)
+
+type RenderFilePNGCompressionLevel string // The compression level of a PNG file.
+
+const (
+	RenderFilePNGCompressionLevelDefault RenderFilePNGCompressionLevel = ""     // The default compression level.
+	RenderFilePNGCompressionLevelNone    RenderFilePNGCompressionLevel = "none" // No compression.
+	RenderFilePNGCompressionLevelFast    RenderFilePNGCompressionLevel = "fast" // Fast compression, larger files.
+	RenderFilePNGCompressionLevelBest    RenderFilePNGCompressionLevel = "best" // The best compression, slower.
+)
+
+type RenderFileToneMapping string // The tone mapping curve to convert HDR images to SDR.
+
+const (
+	RenderFileToneMappingNone     RenderFileToneMapping = ""         // Do not tone map, HDR images keep their PQ or HLG encoded values.
+	RenderFileToneMappingReinhard RenderFileToneMapping = "reinhard" // Extended Reinhard, which maps the peak of the image to the target peak.
+	RenderFileToneMappingHable    RenderFileToneMapping = "hable"    // The filmic curve of John Hable, with more contrast in the shadows.
+	RenderFileToneMappingBT2390   RenderFileToneMapping = "bt2390"   // The EETF of ITU-R BT.2390, which keeps the luminance below the knee and rolls off above it.
+)
+
+type RenderFileGainMap string // What to do with the HDR gain map of an image.
+
+const (
+	RenderFileGainMapIgnore   RenderFileGainMap = ""         // Render the SDR image and drop the gain map.
+	RenderFileGainMapApply    RenderFileGainMap = "apply"    // Apply the gain map to render the HDR image, as a 16 bit PNG with the PQ transfer and a cICP chunk. SDR white is at 203 cd/m².
+	RenderFileGainMapUltraHDR RenderFileGainMap = "ultrahdr" // Render the SDR image as an UltraHDR JPEG, with the gain map embedded as a secondary image, so that HDR displays can show the HDR image.
+)
+
+type RenderFileJPEGSubsampling string // The chroma subsampling of a JPEG file.
+
+const (
+	RenderFileJPEGSubsampling444  RenderFileJPEGSubsampling = "444"  // No chroma subsampling.
+	RenderFileJPEGSubsampling422  RenderFileJPEGSubsampling = "422"  // Half horizontal chroma resolution.
+	RenderFileJPEGSubsampling420  RenderFileJPEGSubsampling = "420"  // Half horizontal and vertical chroma resolution.
+	RenderFileJPEGSubsamplingGray RenderFileJPEGSubsampling = "gray" // No chroma, a grayscale image.
+)
+
+type RenderFilePDFCompression string // The compression of the images in a PDF file.
+
+const (
+	RenderFilePDFCompressionJPEG     RenderFilePDFCompression = "jpeg"     // JPEG compression.
+	RenderFilePDFCompressionLossless RenderFilePDFCompression = "lossless" // Lossless Flate compression.
+)
+
+type RenderFilePDFPageSize string // The page size of a PDF file.
+
+const (
+	RenderFilePDFPageSizeImage  RenderFilePDFPageSize = ""       // Every page gets the size of its image at the resolution of the image.
+	RenderFilePDFPageSizeA3     RenderFilePDFPageSize = "a3"     // A3, the image is scaled to fit.
+	RenderFilePDFPageSizeA4     RenderFilePDFPageSize = "a4"     // A4, the image is scaled to fit.
+	RenderFilePDFPageSizeA5     RenderFilePDFPageSize = "a5"     // A5, the image is scaled to fit.
+	RenderFilePDFPageSizeLetter RenderFilePDFPageSize = "letter" // US Letter, the image is scaled to fit.
+	RenderFilePDFPageSizeLegal  RenderFilePDFPageSize = "legal"  // US Legal, the image is scaled to fit.
 )
 
 type RenderFile struct {
-	Data          *[]byte                // The file data.
-	OutputFormat  RenderFileOutputFormat // The format to output the image as
-	MaxFileSize   int64                  // Only used when OutputFormat RenderFileOutputFormatJPG. The maximum filesize, if jpg is chosen as output format, it will try to lower the quality it until it fits.
-	OutputQuality int                    // Only used when OutputFormat RenderFileOutputFormatJPG. Ranges from 1 to 100 inclusive, higher is better. The default is 95.
-	Progressive   bool                   // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Will render a progressive jpeg.
+	Data                 *[]byte                       // The file data.
+	OutputFormat         RenderFileOutputFormat        // The format to output the image as
+	MaxFileSize          int64                         // The maximum filesize, if jpg, lossy webp or pdf with JPEG compression is chosen as output format, it will search for the highest quality that fits, down to MinOutputQuality. If png is chosen, it will try the best compression, 8 bits per channel and a palette of 256 colors, in that order. When it doesn't fit it will return an error, unless DownscaleToFit is set.
+	OutputQuality        int                           // Only used when OutputFormat RenderFileOutputFormatJPG, RenderFileOutputFormatWebP or RenderFileOutputFormatPDF with JPEG compression. Ranges from 1 to 100 inclusive, higher is better. The default is 95. For lossless webp this is the compression effort, with a default of 75.
+	Progressive          bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Will render a progressive jpeg.
+	Lossless             bool                          // Only used when OutputFormat RenderFileOutputFormatWebP. Will render a lossless webp.
+	TIFFCompression      RenderFileTIFFCompression     // Only used when OutputFormat RenderFileOutputFormatTIFF. The default is RenderFileTIFFCompressionLZW.
+	PDFCompression       RenderFilePDFCompression      // Only used when OutputFormat RenderFileOutputFormatPDF. The default is RenderFilePDFCompressionJPEG.
+	PDFPageSize          RenderFilePDFPageSize         // Only used when OutputFormat RenderFileOutputFormatPDF. The default is RenderFilePDFPageSizeImage.
+	PDFDPI               float64                       // Only used when OutputFormat RenderFileOutputFormatPDF and PDFPageSize RenderFilePDFPageSizeImage. The resolution of the images, the default is the resolution in the EXIF data of the image, or 72.
+	AllImages            bool                          // Only used when OutputFormat RenderFileOutputFormatPDF. Render every top level image of the file on its own page, instead of only the primary image.
+	MinOutputQuality     int                           // Only used when MaxFileSize or TargetSSIM is set. The lowest quality to try to fit the image in MaxFileSize or to reach TargetSSIM. The default is 50.
+	DownscaleToFit       bool                          // Only used when MaxFileSize is set. Progressively downscale the image when it doesn't fit in MaxFileSize at MinOutputQuality, or for formats without a quality setting. The Width and Height of the result are the downscaled dimensions.
+	TargetSSIM           float64                       // Only used when OutputFormat RenderFileOutputFormatJPG or lossy RenderFileOutputFormatWebP. Picks the lowest quality between MinOutputQuality and OutputQuality of which the output reaches this SSIM compared to the decoded image, from 0 to 1 where 1 is identical. A good target for photos is around 0.95.
+	JPEGSubsampling      RenderFileJPEGSubsampling     // Only used when OutputFormat RenderFileOutputFormatJPG. Only available with build tag go_libheif_use_turbojpeg, except for RenderFileJPEGSubsamplingGray. The default keeps the subsampling of images that are decoded as YCbCr, like most HEIC and AVIF images, and is RenderFileJPEGSubsampling420 for other images.
+	JPEGFastDCT          bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Use the fast but less accurate DCT. The default is the DCT that libturbojpeg picks, which is the fast DCT for TurboJPEG 2.
+	JPEGAccurateDCT      bool                          // Only used when OutputFormat RenderFileOutputFormatJPG and with build tag go_libheif_use_turbojpeg. Use the slower but more accurate DCT, not together with JPEGFastDCT.
+	JPEGOptimizeCoding   bool                          // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Compute optimal Huffman tables for a smaller file.
+	JPEGArithmeticCoding bool                          // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Use arithmetic coding for a smaller file, not every decoder supports this.
+	JPEGRestartInterval  int                           // Only used when OutputFormat RenderFileOutputFormatJPG, needs build tag go_libheif_use_turbojpeg and TurboJPEG 3, see FeatureJPEGCoding. Add a restart marker every this amount of MCU blocks.
+	PNGCompressionLevel  RenderFilePNGCompressionLevel // Only used when OutputFormat RenderFileOutputFormatPNG. The default is RenderFilePNGCompressionLevelDefault.
+	PNGBitDepth          int                           // Only used when OutputFormat RenderFileOutputFormatPNG. The bit depth per channel, 8 or 16. The default keeps the bit depth of the image, so images with more than 8 bits per channel are rendered with 16 bits.
+	PNGMaxColors         int                           // Only used when OutputFormat RenderFileOutputFormatPNG. Quantize the image to a palette of at most this amount of colors, from 2 to 256, for a smaller file. Images with few colors, like screenshots, keep their exact colors. The default does not quantize.
+	Background           *color.RGBA                   // Only used when OutputFormat RenderFileOutputFormatJPG. The color that transparent pixels are composited on, as JPEG has no alpha channel. The alpha of the color is ignored. The default is white.
+	ToneMapping          RenderFileToneMapping         // Convert images with a PQ or HLG transfer in their nclx color profile to SDR sRGB with this curve, for any output format. The default is RenderFileToneMappingNone.
+	TargetPeakLuminance  float64                       // Only used when ToneMapping is set. The luminance in cd/m² that becomes white in the output, the highlights above it are compressed. The default is 203, the reference white of BT.2408, a higher value gives a darker image with more detail in the highlights.
+	GainMap              RenderFileGainMap             // Only used for images with an Apple or ISO 21496-1 HDR gain map. RenderFileGainMapApply requires OutputFormat RenderFileOutputFormatPNG and RenderFileGainMapUltraHDR requires RenderFileOutputFormatJPG. The default is RenderFileGainMapIgnore.
+	ConvertColors        bool                          // Convert the colors from the ICC or nclx color profile of the image to sRGB, or to TargetICCProfile, for any output format. Tone mapped images are converted from sRGB, images of which the gain map is applied are not converted. TIFF and PDF files embed TargetICCProfile instead of the profile of the image.
+	TargetICCProfile     []byte                        // Only used when ConvertColors is set. An RGB ICC profile with matrices and tone curves to convert to, like Display P3 or Adobe RGB. The default is sRGB.
+}
+
+type Probe struct {
+	Data *[]byte
+}
+
+type Capabilities struct{}
+
+type Stats struct{}
+
+type Handshake struct {
+	Version         string // The go-libheif version of the library, see shared.Version.
+	ProtocolVersion int    // The protocol version of the library, see shared.ProtocolVersion.
+}
+
+type TransformJPEGOperation string // A lossless transform operation on a JPEG file.
+
+const (
+	TransformJPEGOperationNone           TransformJPEGOperation = ""           // Do not transform the image.
+	TransformJPEGOperationFlipHorizontal TransformJPEGOperation = "hflip"      // Mirror the image horizontally.
+	TransformJPEGOperationFlipVertical   TransformJPEGOperation = "vflip"      // Mirror the image vertically.
+	TransformJPEGOperationTranspose      TransformJPEGOperation = "transpose"  // Mirror the image over the top left to bottom right diagonal.
+	TransformJPEGOperationTransverse     TransformJPEGOperation = "transverse" // Mirror the image over the top right to bottom left diagonal.
+	TransformJPEGOperationRotate90       TransformJPEGOperation = "rotate90"   // Rotate the image 90 degrees clockwise.
+	TransformJPEGOperationRotate180      TransformJPEGOperation = "rotate180"  // Rotate the image 180 degrees.
+	TransformJPEGOperationRotate270      TransformJPEGOperation = "rotate270"  // Rotate the image 270 degrees clockwise.
+)
+
+type TransformJPEG struct {
+	Data       *[]byte                // The JPEG file data.
+	Operation  TransformJPEGOperation // The operation to apply.
+	AutoOrient bool                   // Apply the EXIF orientation before Operation, and reset the orientation to normal.
+	Crop       image.Rectangle        // Crop the transformed image to this rectangle, the top left corner is moved up and left to the nearest MCU boundary (8 or 16 pixels). Empty to not crop.
+	Trim       bool                   // Drop the partial MCU blocks on the edges that can't be transformed, instead of returning an error.
 }
@@ -8,13 +8,151 @@ type DecodeImage struct {
 }
 
 type DecodeConfig struct {
-	Format string
-	Config image.Config
+	Format     string
+	Config     image.Config // Config.ColorModel is always nil, as color models can't be transported by gob.
+	ColorModel ColorModel   // The name of the color model of the image.
 }
 
+// ColorModel is the name of one of the color models of the image/color package.
+type ColorModel string
+
+const (
+	ColorModelUnknown ColorModel = ""
+	ColorModelRGBA    ColorModel = "rgba"
+	ColorModelRGBA64  ColorModel = "rgba64"
+	ColorModelNRGBA   ColorModel = "nrgba"
+	ColorModelNRGBA64 ColorModel = "nrgba64"
+	ColorModelGray    ColorModel = "gray"
+	ColorModelGray16  ColorModel = "gray16"
+	ColorModelYCbCr   ColorModel = "ycbcr"
+	ColorModelNYCbCrA ColorModel = "nycbcra"
+	ColorModelCMYK    ColorModel = "cmyk"
+)
+
 type RenderFile struct {
 	Width, Height  int
 	OriginalFormat string
 	NewFormat      string
 	Output         *[]byte
+	Pages          int         // The amount of pages, only set when the output is a PDF.
+	Quality        int         // The quality of the output, only set for output formats with a quality setting.
+	SSIM           float64     // The SSIM of the output compared to the decoded image, from -1 to 1 where 1 is identical, only set when TargetSSIM is set.
+	HasAlpha       bool        // Whether the decoded image has pixels that are not fully opaque. For JPEG output they have been composited on the background.
+	GainMap        GainMapType // The type of the gain map that was applied or embedded, GainMapTypeNone when GainMap was not requested or the image has none.
+}
+
+type TransformJPEG struct {
+	Width, Height int
+	Output        *[]byte
+}
+
+type Compression string // The compression format of an image.
+
+const (
+	CompressionUnknown      Compression = ""             // The compression format is not known.
+	CompressionHEVC         Compression = "hevc"         // H.265 compressed image.
+	CompressionAVC          Compression = "avc"          // H.264 compressed image.
+	CompressionAV1          Compression = "av1"          // AV1 compressed image.
+	CompressionJPEG         Compression = "jpeg"         // JPEG compressed image.
+	CompressionJPEG2000     Compression = "jpeg2000"     // JPEG 2000 compressed image.
+	CompressionVVC          Compression = "vvc"          // H.266 compressed image.
+	CompressionUncompressed Compression = "uncompressed" // ISO/IEC 23001-17 uncompressed image.
+)
+
+type Capabilities struct {
+	LibheifVersion string               // The version of libheif in the worker, like 1.17.6.
+	Formats        []CapabilitiesFormat // The compression formats that have a decoder or an encoder.
+}
+
+type CapabilitiesFormat struct {
+	Compression Compression
+	Decoders    []CapabilitiesCodec // Sorted by priority, libheif uses the first one unless another one is preferred.
+	Encoders    []CapabilitiesCodec // Sorted by priority.
+}
+
+type CapabilitiesCodec struct {
+	ID   string // The ID of the libheif plugin, like libde265, dav1d or x265. Empty for old plugins that don't have one.
+	Name string // The descriptive name of the plugin, with its version.
+}
+
+type Feature string // A feature of the worker.
+
+const (
+	FeatureTurboJPEG          Feature = "turbojpeg"           // JPEG files are encoded and decoded with libjpeg-turbo, the worker has been built with build tag go_libheif_use_turbojpeg.
+	FeatureJPEGCoding         Feature = "jpeg_coding"         // The JPEG options for optimized Huffman coding, arithmetic coding and restart intervals are available, the worker has been built with build tag go_libheif_use_turbojpeg against TurboJPEG 3.
+	FeatureWebP               Feature = "webp"                // WebP output is available, the worker has been built with build tag go_libheif_use_libwebp.
+	FeatureDecodeHEVC         Feature = "decode_hevc"         // libheif can decode H.265 images.
+	FeatureDecodeAV1          Feature = "decode_av1"          // libheif can decode AV1 images.
+	FeatureDecodeAVC          Feature = "decode_avc"          // libheif can decode H.264 images.
+	FeatureDecodeJPEG         Feature = "decode_jpeg"         // libheif can decode JPEG images.
+	FeatureDecodeJPEG2000     Feature = "decode_jpeg2000"     // libheif can decode JPEG 2000 images.
+	FeatureDecodeVVC          Feature = "decode_vvc"          // libheif can decode H.266 images.
+	FeatureDecodeUncompressed Feature = "decode_uncompressed" // libheif can decode uncompressed images.
+)
+
+type Handshake struct {
+	Version         string    // The go-libheif version of the worker, like v1.2.0. It's (devel) when the worker has been built inside go-libheif, and empty when it's not known.
+	ProtocolVersion int       // The protocol version of the worker.
+	LibheifVersion  string    // The version of libheif in the worker, like 1.17.6.
+	Features        []Feature // The features of the worker.
+	PID             int       // The process ID of the worker.
+}
+
+type Stats struct {
+	RSS uint64 // The resident memory of the worker in bytes, 0 when it's not known, it's only available on Linux.
+}
+
+type Chroma string // The chroma format of an image.
+
+const (
+	ChromaUnknown    Chroma = ""           // The chroma format is not known.
+	ChromaMonochrome Chroma = "monochrome" // Only a luma channel.
+	Chroma420        Chroma = "420"        // Chroma subsampled horizontally and vertically.
+	Chroma422        Chroma = "422"        // Chroma subsampled horizontally.
+	Chroma444        Chroma = "444"        // No chroma subsampling.
+)
+
+type Probe struct {
+	MajorBrand       string
+	CompatibleBrands []string
+	MIMEType         string
+	PrimaryImageID   int
+	Images           []ProbeImage // The top level images in the file.
+	IsSequence       bool         // Whether the file contains an image sequence (a moov box).
+}
+
+type ProbeImage struct {
+	ID             int
+	IsPrimary      bool
+	Width, Height  int
+	Compression    Compression // For derived images (grids, overlays) this is the compression of the input images.
+	Chroma         Chroma
+	LumaBitDepth   int
+	ChromaBitDepth int
+	HasAlpha       bool
+	HasDepth       bool
+	Thumbnails     int
+	MetadataBlocks []ProbeMetadataBlock
+	GainMap        *ProbeGainMap // The HDR gain map of the image, nil when it has none. Only set for the primary image.
+}
+
+type GainMapType string // The format of an HDR gain map.
+
+const (
+	GainMapTypeNone     GainMapType = ""         // No gain map.
+	GainMapTypeApple    GainMapType = "apple"    // The auxiliary gain map image of Apple devices.
+	GainMapTypeISO21496 GainMapType = "iso21496" // An ISO 21496-1 gain map, referenced by a tmap item.
+)
+
+type ProbeGainMap struct {
+	Type          GainMapType
+	ID            int     // The item ID of the gain map image.
+	Width, Height int     // The dimensions of the gain map image, usually smaller than the image.
+	Headroom      float64 // How much brighter than SDR white the highlights of the HDR image are, as a factor. For Apple gain maps this is derived from the EXIF data.
+}
+
+type ProbeMetadataBlock struct {
+	ID          int
+	Type        string // The item type of the block, like Exif or mime.
+	ContentType string // The content type for mime blocks, like application/rdf+xml for XMP.
 }
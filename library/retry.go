@@ -0,0 +1,191 @@
+package library
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"syscall"
+	"time"
+
+	"github.com/klippa-app/go-libheif/library/shared"
+)
+
+// quarantineSize is the number of inputs of which the crashes are
+// remembered, the oldest input is forgotten first.
+const quarantineSize = 1024
+
+var WorkerCrashedError = errors.New("the libheif worker crashed during the request")
+var QuarantinedError = errors.New("the input has been quarantined because it crashed the libheif worker repeatedly")
+
+// do runs a request on the worker and retries it by the retry policy of the
+// config when the worker crashed. Errors of the worker itself, like invalid
+// input, are returned without retrying. data is the input of the request of
+// which the crashes are counted for the quarantine, nil when the request has
+// no input.
+//
+// A crash fails all the requests in flight, so a crash is only counted for the
+// input when its request was the only one in flight. Otherwise the request is
+// retried alone, to find out whether its input or another one crashed the
+// worker.
+func (s *supervisor) do(data *[]byte, request func(worker shared.Libheif) error) error {
+	retry := s.retryPolicy()
+	quarantine := data != nil && retry.QuarantineAfter > 0
+
+	var key [sha256.Size]byte
+	if quarantine {
+		key = sha256.Sum256(*data)
+		if s.quarantined(key) {
+			return QuarantinedError
+		}
+	}
+
+	backoff := retry.Backoff
+	alone := false
+	for attempt := 1; ; attempt++ {
+		ranAlone, exited, err := s.attempt(request, alone)
+
+		// Without retries or quarantine it doesn't matter whether the worker
+		// crashed, so there is no need to wait for it to exit.
+		if err == nil || (retry.MaxAttempts <= 1 && !quarantine) || !isCrash(err, exited) {
+			return err
+		}
+
+		if quarantine && ranAlone && s.recordCrash(key) {
+			log.Printf("quarantined input %x after it crashed the libheif worker %d times", key[:8], retry.QuarantineAfter)
+			return fmt.Errorf("%w: %s", QuarantinedError, err.Error())
+		}
+
+		if attempt >= retry.MaxAttempts {
+			return fmt.Errorf("%w: %s", WorkerCrashedError, err.Error())
+		}
+
+		// The input can only be blamed for a crash when it runs alone.
+		alone = quarantine
+
+		log.Printf("retrying request after the libheif worker crashed, attempt %d of %d: %s", attempt+1, retry.MaxAttempts, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+		if retry.MaxBackoff > 0 && backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// attempt runs the request once, waiting for the other requests to finish
+// first when alone is set. It returns whether no other request was in flight
+// at the same time, and the channel that is closed when the worker that ran
+// the request has exited.
+func (s *supervisor) attempt(request func(worker shared.Libheif) error, alone bool) (bool, <-chan struct{}, error) {
+	if alone {
+		s.isolation.Lock()
+		defer s.isolation.Unlock()
+	} else {
+		s.isolation.RLock()
+		defer s.isolation.RUnlock()
+	}
+
+	worker, err := s.acquire()
+	if err != nil {
+		return false, nil, err
+	}
+	exited := s.exited
+
+	// The request ran alone when nothing else was in flight when it started,
+	// and nothing else started before it finished.
+	sequence := s.sequence.Add(1)
+	ranAlone := s.inFlight.Add(1) == 1
+
+	err = request(worker)
+
+	ranAlone = ranAlone && s.sequence.Load() == sequence
+	s.inFlight.Add(-1)
+	s.release(worker)
+
+	return ranAlone, exited, err
+}
+
+// crashExitTimeout is how long isCrash waits for the worker process to exit
+// after an error of the connection to the worker.
+const crashExitTimeout = 2 * time.Second
+
+// isCrash returns whether the error is caused by the worker process exiting
+// during the request: an error of the connection to the worker, rather than
+// an error that the worker returned or an error of the library itself, after
+// which the worker process exited. exited is nil when no worker ran the
+// request.
+func isCrash(err error, exited <-chan struct{}) bool {
+	var serverError rpc.ServerError
+	if exited == nil || errors.As(err, &serverError) || !isConnectionError(err) {
+		return false
+	}
+
+	// The connection can break just before the process has exited.
+	timer := time.NewTimer(crashExitTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// isConnectionError returns whether the error is an error of the connection to
+// the worker.
+func isConnectionError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, rpc.ErrShutdown) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
+func (s *supervisor) retryPolicy() Retry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.config.Retry
+}
+
+// quarantined returns whether the input crashed the worker too often.
+func (s *supervisor) quarantined(key [sha256.Size]byte) bool {
+	s.crashLock.Lock()
+	defer s.crashLock.Unlock()
+
+	quarantineAfter := s.retryPolicy().QuarantineAfter
+	return quarantineAfter > 0 && s.crashes[key] >= quarantineAfter
+}
+
+// recordCrash counts a crash of the worker on the input and returns whether
+// the input is quarantined now.
+func (s *supervisor) recordCrash(key [sha256.Size]byte) bool {
+	s.crashLock.Lock()
+	defer s.crashLock.Unlock()
+
+	quarantineAfter := s.retryPolicy().QuarantineAfter
+	if quarantineAfter <= 0 {
+		return false
+	}
+
+	if s.crashes == nil {
+		s.crashes = map[[sha256.Size]byte]int{}
+	}
+
+	if _, ok := s.crashes[key]; !ok {
+		if len(s.crashOrder) >= quarantineSize {
+			delete(s.crashes, s.crashOrder[0])
+			s.crashOrder = s.crashOrder[1:]
+		}
+		s.crashOrder = append(s.crashOrder, key)
+	}
+
+	s.crashes[key]++
+	return s.crashes[key] >= quarantineAfter
+}
@@ -0,0 +1,226 @@
+package library
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/shared"
+)
+
+// crashWorker kills the worker process during the request, like a crash of
+// libheif on the input would.
+func crashWorker(s *supervisor) func(worker shared.Libheif) error {
+	return func(worker shared.Libheif) error {
+		process, err := os.FindProcess(s.info.PID)
+		if err != nil {
+			return err
+		}
+		process.Kill()
+		process.Wait()
+
+		_, err = worker.Stats(&requests.Stats{})
+		return err
+	}
+}
+
+func TestRetry(t *testing.T) {
+	config := testConfig()
+	config.Retry = Retry{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	s := &supervisor{}
+	err := s.start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	data := []byte("input")
+	attempts := 0
+	err = s.do(&data, func(worker shared.Libheif) error {
+		attempts++
+		if attempts == 1 {
+			return crashWorker(s)(worker)
+		}
+		_, err := worker.Stats(&requests.Stats{})
+		return err
+	})
+	if err != nil {
+		t.Errorf("expected the retry to succeed, got %s", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	err = s.do(&data, func(worker shared.Libheif) error {
+		attempts++
+		return crashWorker(s)(worker)
+	})
+	if !errors.Is(err, WorkerCrashedError) {
+		t.Errorf("expected WorkerCrashedError after the last attempt, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	// Errors of the worker are not retried.
+	attempts = 0
+	err = s.do(&data, func(worker shared.Libheif) error {
+		attempts++
+		return rpc.ServerError("invalid input")
+	})
+	if err == nil || errors.Is(err, WorkerCrashedError) {
+		t.Errorf("expected the error of the worker, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt for an error of the worker, got %d", attempts)
+	}
+
+	// Errors of the library itself, like a response it can't decode, and
+	// connection errors while the worker is still running are not crashes.
+	for _, requestErr := range []error{errors.New("gob: type not registered for interface"), io.ErrUnexpectedEOF} {
+		attempts = 0
+		err = s.do(&data, func(worker shared.Libheif) error {
+			attempts++
+			return requestErr
+		})
+		if err != requestErr {
+			t.Errorf("expected the error %v, got %v", requestErr, err)
+		}
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt for %v, got %d", requestErr, attempts)
+		}
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	s := &supervisor{}
+	err := s.start(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	// Without retries there is no need to wait for the worker to exit.
+	data := []byte("input")
+	start := time.Now()
+	err = s.do(&data, func(worker shared.Libheif) error {
+		return io.ErrUnexpectedEOF
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected the error of the request, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= crashExitTimeout {
+		t.Errorf("expected the error without waiting for the worker to exit, took %s", elapsed)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	config := testConfig()
+	config.Retry = Retry{MaxAttempts: 5, QuarantineAfter: 2}
+
+	s := &supervisor{}
+	err := s.start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	poison := []byte("poison")
+	attempts := 0
+	err = s.do(&poison, func(worker shared.Libheif) error {
+		attempts++
+		return crashWorker(s)(worker)
+	})
+	if !errors.Is(err, QuarantinedError) {
+		t.Errorf("expected QuarantinedError, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected the input to be quarantined after 2 crashes, got %d attempts", attempts)
+	}
+
+	// The quarantined input is not sent to the worker anymore.
+	attempts = 0
+	err = s.do(&poison, func(worker shared.Libheif) error {
+		attempts++
+		return nil
+	})
+	if !errors.Is(err, QuarantinedError) || attempts != 0 {
+		t.Errorf("expected QuarantinedError without attempts, got %v after %d attempts", err, attempts)
+	}
+
+	other := []byte("other")
+	err = s.do(&other, func(worker shared.Libheif) error {
+		_, err := worker.Stats(&requests.Stats{})
+		return err
+	})
+	if err != nil {
+		t.Errorf("expected other inputs to work, got %s", err)
+	}
+}
+
+func TestQuarantineConcurrent(t *testing.T) {
+	config := testConfig()
+	config.Retry = Retry{MaxAttempts: 5, QuarantineAfter: 2}
+
+	s := &supervisor{}
+	err := s.start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	// The other inputs are in flight when the poison input crashes the worker.
+	inFlight := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	others := make([][]byte, 4)
+	errs := make([]error, len(others))
+	for i := range others {
+		others[i] = []byte(fmt.Sprintf("other %d", i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			first := true
+			errs[i] = s.do(&others[i], func(worker shared.Libheif) error {
+				if first {
+					first = false
+					inFlight <- struct{}{}
+					time.Sleep(500 * time.Millisecond)
+				}
+				_, err := worker.Stats(&requests.Stats{})
+				return err
+			})
+		}(i)
+	}
+
+	for range others {
+		<-inFlight
+	}
+
+	poison := []byte("poison")
+	err = s.do(&poison, func(worker shared.Libheif) error {
+		return crashWorker(s)(worker)
+	})
+	if !errors.Is(err, QuarantinedError) {
+		t.Errorf("expected QuarantinedError, got %v", err)
+	}
+
+	wg.Wait()
+	for i, other := range others {
+		if errs[i] != nil {
+			t.Errorf("expected the retry of %s to succeed, got %s", other, errs[i])
+		}
+		if s.crashes[sha256.Sum256(other)] != 0 {
+			t.Errorf("expected no crashes to be counted for %s, got %d", other, s.crashes[sha256.Sum256(other)])
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin/runner"
+)
+
+// workerRunner runs the worker process for go-plugin like its own runner of
+// commands does, but closes exited when the process has exited. That tells a
+// crash of the worker apart from other errors of the connection.
+type workerRunner struct {
+	logger hclog.Logger
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	pid    int
+	exited chan struct{}
+}
+
+var _ runner.Runner = (*workerRunner)(nil)
+
+// newWorkerRunner returns a runner for the command, with the environment that
+// go-plugin prepared in spec.
+func newWorkerRunner(logger hclog.Logger, command Command, spec *exec.Cmd, exited chan struct{}) (*workerRunner, error) {
+	cmd := exec.Command(command.BinPath, command.Args...)
+	cmd.Env = spec.Env
+	cmd.Stdin = spec.Stdin
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workerRunner{
+		logger: logger,
+		cmd:    cmd,
+		stdout: stdout,
+		stderr: stderr,
+		exited: exited,
+	}, nil
+}
+
+func (r *workerRunner) Start(_ context.Context) error {
+	r.logger.Debug("starting plugin", "path", r.cmd.Path, "args", r.cmd.Args)
+	err := r.cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	r.pid = r.cmd.Process.Pid
+	r.logger.Debug("plugin started", "path", r.cmd.Path, "pid", r.pid)
+	return nil
+}
+
+func (r *workerRunner) Wait(_ context.Context) error {
+	defer close(r.exited)
+	return r.cmd.Wait()
+}
+
+func (r *workerRunner) Kill(_ context.Context) error {
+	if r.cmd.Process == nil {
+		return nil
+	}
+
+	// Kill can be called after the process exited.
+	err := r.cmd.Process.Kill()
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return err
+}
+
+func (r *workerRunner) Stdout() io.ReadCloser {
+	return r.stdout
+}
+
+func (r *workerRunner) Stderr() io.ReadCloser {
+	return r.stderr
+}
+
+func (r *workerRunner) Name() string {
+	return r.cmd.Path
+}
+
+func (r *workerRunner) ID() string {
+	return strconv.Itoa(r.pid)
+}
+
+func (r *workerRunner) Diagnose(_ context.Context) string {
+	return fmt.Sprintf("check that %s starts a go-libheif worker that is built for this platform", r.cmd.Path)
+}
+
+// The worker runs on the same host, so the addresses are the same.
+
+func (r *workerRunner) PluginToHost(pluginNet, pluginAddr string) (string, string, error) {
+	return pluginNet, pluginAddr, nil
+}
+
+func (r *workerRunner) HostToPlugin(hostNet, hostAddr string) (string, string, error) {
+	return hostNet, hostAddr, nil
+}
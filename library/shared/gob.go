@@ -0,0 +1,18 @@
+package shared
+
+import (
+	"encoding/gob"
+	"image"
+)
+
+func init() {
+	// Needed to serialize the image interface, both the library and the
+	// worker import this package so they always register the same types.
+	gob.Register(&image.YCbCr{})
+	gob.Register(&image.RGBA64{})
+	gob.Register(&image.RGBA{})
+	gob.Register(&image.Gray{})
+	gob.Register(&image.Gray16{})
+	gob.Register(&image.NRGBA{})
+	gob.Register(&image.NRGBA64{})
+}
@@ -15,6 +15,11 @@ type Libheif interface {
 	DecodeImage(*requests.DecodeImage) (*responses.DecodeImage, error)
 	DecodeConfig(*requests.DecodeConfig) (*responses.DecodeConfig, error)
 	RenderFile(*requests.RenderFile) (*responses.RenderFile, error)
+	Probe(*requests.Probe) (*responses.Probe, error)
+	TransformJPEG(*requests.TransformJPEG) (*responses.TransformJPEG, error)
+	Capabilities(*requests.Capabilities) (*responses.Capabilities, error)
+	Handshake(*requests.Handshake) (*responses.Handshake, error)
+	Stats(*requests.Stats) (*responses.Stats, error)
 }
 
 type LibheifRPC struct{ client *rpc.Client }
@@ -59,6 +64,56 @@ func (g *LibheifRPC) RenderFile(request *requests.RenderFile) (*responses.Render
 	return resp, nil
 }
 
+func (g *LibheifRPC) Probe(request *requests.Probe) (*responses.Probe, error) {
+	resp := &responses.Probe{}
+	err := g.client.Call("Plugin.Probe", request, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (g *LibheifRPC) TransformJPEG(request *requests.TransformJPEG) (*responses.TransformJPEG, error) {
+	resp := &responses.TransformJPEG{}
+	err := g.client.Call("Plugin.TransformJPEG", request, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (g *LibheifRPC) Capabilities(request *requests.Capabilities) (*responses.Capabilities, error) {
+	resp := &responses.Capabilities{}
+	err := g.client.Call("Plugin.Capabilities", request, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (g *LibheifRPC) Handshake(request *requests.Handshake) (*responses.Handshake, error) {
+	resp := &responses.Handshake{}
+	err := g.client.Call("Plugin.Handshake", request, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (g *LibheifRPC) Stats(request *requests.Stats) (*responses.Stats, error) {
+	resp := &responses.Stats{}
+	err := g.client.Call("Plugin.Stats", request, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
 type LibheifRPCServer struct {
 	Impl Libheif
 }
@@ -126,6 +181,96 @@ func (s *LibheifRPCServer) RenderFile(request *requests.RenderFile, resp *respon
 	return nil
 }
 
+func (s *LibheifRPCServer) Probe(request *requests.Probe, resp *responses.Probe) (err error) {
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			err = fmt.Errorf("panic occurred in %s: %v", "Probe", panicError)
+		}
+	}()
+
+	implResp, err := s.Impl.Probe(request)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the target address of resp to the target address of implResp.
+	*resp = *implResp
+
+	return nil
+}
+
+func (s *LibheifRPCServer) TransformJPEG(request *requests.TransformJPEG, resp *responses.TransformJPEG) (err error) {
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			err = fmt.Errorf("panic occurred in %s: %v", "TransformJPEG", panicError)
+		}
+	}()
+
+	implResp, err := s.Impl.TransformJPEG(request)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the target address of resp to the target address of implResp.
+	*resp = *implResp
+
+	return nil
+}
+
+func (s *LibheifRPCServer) Capabilities(request *requests.Capabilities, resp *responses.Capabilities) (err error) {
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			err = fmt.Errorf("panic occurred in %s: %v", "Capabilities", panicError)
+		}
+	}()
+
+	implResp, err := s.Impl.Capabilities(request)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the target address of resp to the target address of implResp.
+	*resp = *implResp
+
+	return nil
+}
+
+func (s *LibheifRPCServer) Handshake(request *requests.Handshake, resp *responses.Handshake) (err error) {
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			err = fmt.Errorf("panic occurred in %s: %v", "Handshake", panicError)
+		}
+	}()
+
+	implResp, err := s.Impl.Handshake(request)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the target address of resp to the target address of implResp.
+	*resp = *implResp
+
+	return nil
+}
+
+func (s *LibheifRPCServer) Stats(request *requests.Stats, resp *responses.Stats) (err error) {
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			err = fmt.Errorf("panic occurred in %s: %v", "Stats", panicError)
+		}
+	}()
+
+	implResp, err := s.Impl.Stats(request)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the target address of resp to the target address of implResp.
+	*resp = *implResp
+
+	return nil
+}
+
 type LibheifPlugin struct {
 	Impl Libheif
 }
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"runtime/debug"
+
+	"github.com/hashicorp/go-plugin"
+)
+
+// ProtocolVersion is the version of the protocol between the library and the
+// worker. It's increased on incompatible changes of the methods, requests and
+// responses, the library only starts workers with the same version.
+const ProtocolVersion = 3
+
+// HandshakeConfig is the handshake of go-plugin for the worker.
+var HandshakeConfig = plugin.HandshakeConfig{
+	ProtocolVersion:  ProtocolVersion,
+	MagicCookieKey:   "BASIC_PLUGIN",
+	MagicCookieValue: "libheif",
+}
+
+const modulePath = "github.com/klippa-app/go-libheif"
+
+// Version returns the version of go-libheif that the binary has been built
+// with, like v1.2.0, from its build info. It's (devel) when go-libheif is the
+// main module and empty when the build info is not available.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+
+	for _, dependency := range info.Deps {
+		if dependency.Path != modulePath {
+			continue
+		}
+
+		if dependency.Replace != nil {
+			return dependency.Replace.Version
+		}
+		return dependency.Version
+	}
+
+	return ""
+}
@@ -0,0 +1,329 @@
+package library
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klippa-app/go-libheif/library/requests"
+	"github.com/klippa-app/go-libheif/library/responses"
+	"github.com/klippa-app/go-libheif/library/shared"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/go-plugin/runner"
+)
+
+// supervisor runs the worker process. It restarts the worker when it died or
+// when it's due to be recycled, one restart at a time: the requests that find
+// the worker dead at the same time all wait for the same restart.
+type supervisor struct {
+	// lock is held for reading during requests to the worker and for writing
+	// while the worker is started, restarted or stopped, so that the requests
+	// in flight finish first.
+	lock sync.RWMutex
+
+	running    bool                  // Whether Init has been called, the worker itself could be dead.
+	config     Config                // The config of Init.
+	client     *plugin.Client        // The client of the worker process, nil when it's not running.
+	exited     <-chan struct{}       // Closed when the worker process has exited.
+	rpcClient  plugin.ClientProtocol // The RPC connection to the worker process.
+	worker     shared.Libheif        // The worker, nil when it's not running.
+	info       *responses.Handshake  // The handshake of the worker.
+	started    time.Time             // When the worker has been started.
+	generation uint64                // Increased on every start of the worker.
+	startErr   error                 // The error of the last start of the worker.
+
+	requests atomic.Int64  // The number of requests that the worker handled.
+	rss      atomic.Uint64 // The resident memory of the worker after the last request.
+
+	// isolation is held for reading during the requests of do, and for
+	// writing by a retry that must run alone to find out whether its input
+	// crashed the worker.
+	isolation sync.RWMutex
+	inFlight  atomic.Int64  // The number of requests of do in flight.
+	sequence  atomic.Uint64 // Increased on the start of every request of do.
+
+	crashLock  sync.Mutex                // Held while counting crashes.
+	crashes    map[[sha256.Size]byte]int // The number of crashes of the worker per input, by the SHA-256 of the input.
+	crashOrder [][sha256.Size]byte       // The inputs in crashes, oldest first.
+}
+
+// start starts the worker, it does nothing when it's running already.
+func (s *supervisor) start(config Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.running {
+		return nil
+	}
+
+	s.config = config
+	err := s.startWorker()
+	if err != nil {
+		return err
+	}
+	s.running = true
+
+	return nil
+}
+
+// stop waits for the requests in flight and kills the worker.
+func (s *supervisor) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopWorker()
+	s.running = false
+}
+
+// startWorker starts a worker process and checks its handshake, the lock must
+// be held for writing.
+func (s *supervisor) startWorker() error {
+	s.generation++
+
+	// pluginMap is the map of plugins we can dispense.
+	var pluginMap = map[string]plugin.Plugin{
+		"libheif": &shared.LibheifPlugin{},
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "plugin",
+		Output: os.Stdout,
+		Level:  hclog.Debug,
+	})
+
+	exited := make(chan struct{})
+	command := s.config.Command
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig: shared.HandshakeConfig,
+		Plugins:         pluginMap,
+		RunnerFunc: func(logger hclog.Logger, cmd *exec.Cmd, _ string) (runner.Runner, error) {
+			return newWorkerRunner(logger, command, cmd, exited)
+		},
+		Logger:       logger,
+		StartTimeout: s.config.Command.StartTimeout,
+	})
+
+	rpcClient, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return err
+	}
+
+	raw, err := rpcClient.Dispense("libheif")
+	if err != nil {
+		client.Kill()
+		return err
+	}
+
+	worker := raw.(shared.Libheif)
+	handshake, err := worker.Handshake(&requests.Handshake{
+		Version:         shared.Version(),
+		ProtocolVersion: shared.ProtocolVersion,
+	})
+	if err == nil {
+		err = checkWorker(s.config, handshake)
+	}
+	if err != nil {
+		client.Kill()
+		return err
+	}
+
+	log.Printf("started libheif worker, go-libheif version %s, libheif version %s, features %v", handshake.Version, handshake.LibheifVersion, handshake.Features)
+
+	s.client = client
+	s.exited = exited
+	s.rpcClient = rpcClient
+	s.worker = worker
+	s.info = handshake
+	s.started = time.Now()
+	s.requests.Store(0)
+	s.rss.Store(0)
+
+	return nil
+}
+
+// stopWorker kills the worker process when it's running, the lock must be
+// held for writing.
+func (s *supervisor) stopWorker() {
+	if s.client != nil {
+		s.client.Kill()
+	}
+	if s.rpcClient != nil {
+		s.rpcClient.Close()
+	}
+
+	s.client = nil
+	s.exited = nil
+	s.rpcClient = nil
+	s.worker = nil
+	s.info = nil
+}
+
+// acquire returns the worker after checking that it's alive, restarting it
+// when it's dead or due to be recycled. The lock is held for reading when it
+// returns without an error, release must be called after the request.
+func (s *supervisor) acquire() (shared.Libheif, error) {
+	for attempt := 0; ; attempt++ {
+		s.lock.RLock()
+		if !s.running {
+			s.lock.RUnlock()
+			return nil, NotInitializedError
+		}
+
+		generation := s.generation
+		reason := ""
+		if attempt == 0 {
+			reason = s.recycleReason()
+		}
+
+		if reason == "" {
+			err := s.ping()
+			if err == nil {
+				return s.worker, nil
+			}
+			if attempt > 0 {
+				s.lock.RUnlock()
+				return nil, fmt.Errorf("could not check or start plugin: %w", err)
+			}
+			reason = err.Error()
+		}
+		s.lock.RUnlock()
+
+		err := s.restart(generation, reason)
+		if errors.Is(err, NotInitializedError) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not check or start plugin: %w", err)
+		}
+	}
+}
+
+// release counts the request of acquire and releases the lock.
+func (s *supervisor) release(worker shared.Libheif) {
+	defer s.lock.RUnlock()
+
+	s.requests.Add(1)
+	if s.config.Recycle.MaxRSS > 0 {
+		stats, err := worker.Stats(&requests.Stats{})
+		if err == nil {
+			s.rss.Store(stats.RSS)
+		}
+	}
+}
+
+// workerInfo returns the handshake of the running worker, without restarting
+// or recycling it.
+func (s *supervisor) workerInfo() (*responses.Handshake, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.running {
+		return nil, NotInitializedError
+	}
+
+	if s.info == nil {
+		return nil, errors.New("could not check or start plugin: the worker is not running")
+	}
+
+	return s.info, nil
+}
+
+// ping returns an error when the worker is not alive, the lock must be held.
+func (s *supervisor) ping() error {
+	if s.worker == nil {
+		return errors.New("the worker is not running")
+	}
+
+	pong, err := s.worker.Ping()
+	if err != nil {
+		return fmt.Errorf("wrong pong result: %w", err)
+	}
+
+	if pong != "Pong" {
+		return fmt.Errorf("wrong pong result: %s", pong)
+	}
+
+	return nil
+}
+
+// restart kills the worker and starts a new one, unless the worker has been
+// restarted already since generation, then it returns the error of that
+// restart.
+func (s *supervisor) restart(generation uint64, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.running {
+		return NotInitializedError
+	}
+
+	if s.generation != generation {
+		return s.startErr
+	}
+
+	log.Printf("restarting libheif plugin: %s", reason)
+	s.stopWorker()
+	s.startErr = s.startWorker()
+	if s.startErr != nil {
+		log.Printf("could not restart libheif plugin: %s", s.startErr.Error())
+	}
+
+	return s.startErr
+}
+
+// recycleReason returns why the worker should be recycled, or an empty string
+// when it shouldn't. The lock must be held.
+func (s *supervisor) recycleReason() string {
+	recycle := s.config.Recycle
+	if recycle.MaxRequests > 0 && s.requests.Load() >= recycle.MaxRequests {
+		return fmt.Sprintf("recycling after %d requests", s.requests.Load())
+	}
+
+	if recycle.MaxRSS > 0 && s.rss.Load() > recycle.MaxRSS {
+		return fmt.Sprintf("recycling at a resident memory of %d bytes", s.rss.Load())
+	}
+
+	if recycle.MaxAge > 0 && s.worker != nil && time.Since(s.started) >= recycle.MaxAge {
+		return fmt.Sprintf("recycling after running since %s", s.started.Format(time.RFC3339))
+	}
+
+	return ""
+}
+
+// checkWorker returns an IncompatibleWorkerError when the worker speaks
+// another protocol version or misses a required feature. A different
+// go-libheif version is only logged, as long as the protocol is the same.
+func checkWorker(config Config, handshake *responses.Handshake) error {
+	if handshake.ProtocolVersion != shared.ProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d of the worker differs from protocol version %d of the library", IncompatibleWorkerError, handshake.ProtocolVersion, shared.ProtocolVersion)
+	}
+
+	for _, required := range config.RequiredFeatures {
+		found := false
+		for _, feature := range handshake.Features {
+			if feature == required {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: the worker doesn't have required feature %s", IncompatibleWorkerError, required)
+		}
+	}
+
+	if handshake.Version != "" && shared.Version() != "" && handshake.Version != shared.Version() {
+		log.Printf("go-libheif version %s of the worker differs from version %s of the library", handshake.Version, shared.Version())
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klippa-app/go-libheif/library/requests"
+)
+
+func testConfig() Config {
+	return Config{
+		Command: Command{
+			BinPath: "go",
+			Args:    []string{"run", "worker_example/main.go"},
+		},
+	}
+}
+
+// requestConcurrently does a request from every goroutine at the same time
+// and returns the errors.
+func requestConcurrently(s *supervisor, goroutines int) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			worker, err := s.acquire()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer s.release(worker)
+
+			_, errs[i] = worker.Stats(&requests.Stats{})
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	s := &supervisor{}
+	err := s.start(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	pid := s.info.PID
+	generation := s.generation
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = process.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.Wait()
+
+	for _, err := range requestConcurrently(s, 16) {
+		if err != nil {
+			t.Errorf("unexpected error after the worker died: %s", err)
+		}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.generation != generation+1 {
+		t.Errorf("expected a single restart for all requests, got %d", s.generation-generation)
+	}
+
+	if s.info.PID == pid {
+		t.Errorf("expected a new worker process")
+	}
+}
+
+func TestSupervisorRecycle(t *testing.T) {
+	config := testConfig()
+	config.Recycle.MaxRequests = 4
+
+	s := &supervisor{}
+	err := s.start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop()
+
+	// The requests of the second batch find the worker due to be recycled.
+	for batch := 0; batch < 2; batch++ {
+		for _, err := range requestConcurrently(s, 16) {
+			if err != nil {
+				t.Errorf("unexpected error while recycling: %s", err)
+			}
+		}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.generation < 2 {
+		t.Errorf("expected the worker to be recycled")
+	}
+}
+
+func TestSupervisorStopped(t *testing.T) {
+	s := &supervisor{}
+	if _, err := s.acquire(); !errors.Is(err, NotInitializedError) {
+		t.Errorf("expected NotInitializedError before start, got %v", err)
+	}
+
+	// Stopping a supervisor that never started does nothing.
+	s.stop()
+
+	for cycle := 0; cycle < 2; cycle++ {
+		err := s.start(testConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, err := range requestConcurrently(s, 4) {
+			if err != nil {
+				t.Errorf("unexpected error in cycle %d: %s", cycle, err)
+			}
+		}
+
+		s.stop()
+		s.stop()
+
+		if _, err := s.acquire(); !errors.Is(err, NotInitializedError) {
+			t.Errorf("expected NotInitializedError after stop, got %v", err)
+		}
+	}
+}
+
+func TestSupervisorStopDrains(t *testing.T) {
+	s := &supervisor{}
+	err := s.start(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("expected stop to wait for the request in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The request in flight still has a working worker.
+	if _, err := worker.Stats(&requests.Stats{}); err != nil {
+		t.Errorf("unexpected error of the request in flight: %s", err)
+	}
+	s.release(worker)
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected stop to finish after the request in flight")
+	}
+}
@@ -0,0 +1,54 @@
+package libheif
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/klippa-app/go-libheif/library/isobmff"
+)
+
+var UnsupportedFileTypeError = errors.New("file is not a HEIF file that libheif can handle")
+
+// Sniff parses the ftyp box at the start of data, including the compatible
+// brands, and returns the brands, MIME type and whether libheif can handle the
+// file. Only the start of the file is needed.
+func Sniff(data []byte) isobmff.SniffResult {
+	return isobmff.Sniff(data)
+}
+
+func readSniffed(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files without any HEIF brand, like MP4 videos, are never sent to the
+	// worker. Files with a HEIF brand are, even when libheif would say it
+	// doesn't support the brand, since libheif often can still read them.
+	result := Sniff(data)
+	if result.FileType == isobmff.FileTypeNo || result.MIMEType == "" {
+		return nil, UnsupportedFileTypeError
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func decodeSniffedImage(r io.Reader) (image.Image, error) {
+	sniffedReader, err := readSniffed(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeImage(sniffedReader)
+}
+
+func decodeSniffedConfig(r io.Reader) (image.Config, error) {
+	sniffedReader, err := readSniffed(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return DecodeConfig(sniffedReader)
+}